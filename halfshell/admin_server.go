@@ -0,0 +1,153 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// AdminServer serves health, readiness, metrics and profiling endpoints on a
+// separate port, so that they are never exposed on the public image port.
+type AdminServer struct {
+	*http.Server
+	Mux    *http.ServeMux
+	Logger *Logger
+	server *Server
+}
+
+// Creates a new AdminServer for the given image server.
+func NewAdminServerWithConfig(config *ServerConfig, server *Server) *AdminServer {
+	mux := http.NewServeMux()
+	admin := &AdminServer{
+		Server: &http.Server{
+			Addr:           fmt.Sprintf(":%d", config.AdminPort),
+			Handler:        mux,
+			ReadTimeout:    time.Duration(config.ReadTimeout) * time.Second,
+			MaxHeaderBytes: 1 << 20,
+		},
+		Mux:    mux,
+		Logger: NewLogger("admin"),
+		server: server,
+	}
+
+	mux.HandleFunc("/healthcheck", admin.HealthHandler)
+	mux.HandleFunc("/health", admin.HealthHandler)
+	mux.HandleFunc("/ready", admin.ReadinessHandler)
+	mux.HandleFunc("/metrics", admin.MetricsHandler)
+	if server.FaultInjector != nil {
+		mux.HandleFunc("/faults", admin.FaultsHandler)
+	}
+	if server.UsageTracker != nil {
+		mux.HandleFunc("/usage", admin.UsageHandler)
+	}
+	if server.Cache != nil {
+		mux.HandleFunc("/cache", admin.CacheHandler)
+	}
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return admin
+}
+
+func (a *AdminServer) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+func (a *AdminServer) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.server.Ready() {
+		http.Error(w, "Saturated", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// Writes the server's worker pool, memory and cache statistics as JSON.
+func (a *AdminServer) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics := map[string]map[string]interface{}{
+		"worker_pool": {
+			"queue_depth": a.server.WorkerPool.QueueDepth(),
+			"in_flight":   a.server.WorkerPool.InFlight(),
+			"rejected":    a.server.WorkerPool.Rejected(),
+			"saturated":   a.server.WorkerPool.Saturated(),
+		},
+		"memory": {
+			"usage": a.server.MemoryWatchdog.Usage(),
+			"limit": a.server.MemoryWatchdog.Limit,
+		},
+	}
+	if a.server.Cache != nil {
+		stats := a.server.Cache.Stats()
+		metrics["cache"] = map[string]interface{}{
+			"entries":    stats.Entries,
+			"size":       stats.Size,
+			"max_size":   stats.MaxSize,
+			"hits":       stats.Hits,
+			"misses":     stats.Misses,
+			"evictions":  stats.Evictions,
+			"rejections": stats.Rejections,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
+
+// Responds with the faults being injected as JSON, after setting them from the
+// JSON body of PUT requests.
+func (a *AdminServer) FaultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var settings FaultSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.server.FaultInjector.SetSettings(settings)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.server.FaultInjector.Settings())
+}
+
+// Writes the usage of every account in the current period as JSON.
+func (a *AdminServer) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.server.UsageTracker.Accounts())
+}
+
+// Purges the response cache on DELETE requests, of the responses for the
+// source image path given by the path parameter or else of every response, and
+// writes the number of responses purged as JSON.
+func (a *AdminServer) CacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	purged := a.server.Cache.Purge(r.URL.Query().Get("path"))
+	a.Logger.Info("Purged %d cached responses", purged)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
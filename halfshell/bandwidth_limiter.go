@@ -0,0 +1,61 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"sync"
+	"time"
+)
+
+// The largest amount of data written at once by a rate limited writer.
+const BANDWIDTH_CHUNK_SIZE = 32 * 1024
+
+// BandwidthLimiter limits the rate at which data is written across all of the
+// writers sharing it. Each write reserves the time it takes to send its data
+// at the configured rate, so concurrent writers are served in turn.
+type BandwidthLimiter struct {
+	BytesPerSecond uint64
+	mutex          sync.Mutex
+	next           time.Time
+}
+
+// Creates a new BandwidthLimiter. Returns nil if bytesPerSecond is 0, meaning
+// that the bandwidth is not limited.
+func NewBandwidthLimiter(bytesPerSecond uint64) *BandwidthLimiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	return &BandwidthLimiter{BytesPerSecond: bytesPerSecond}
+}
+
+// Blocks until n bytes may be written.
+func (l *BandwidthLimiter) Wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.BytesPerSecond) * float64(time.Second)))
+	l.mutex.Unlock()
+
+	time.Sleep(delay)
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rafikk/imagick/imagick"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BenchmarkConfig holds the settings of a benchmark run by the bench
+// subcommand.
+type BenchmarkConfig struct {
+	Shapes      []string
+	Concurrency int
+	Requests    int
+	Duration    time.Duration
+	ConfigFile  string
+}
+
+// The results of a benchmark.
+type benchmarkResult struct {
+	Latencies []time.Duration
+	Errors    int64
+	Bytes     int64
+	Elapsed   time.Duration
+}
+
+// Runs the bench subcommand with its command line arguments, and returns the
+// exit status. The request shapes are URLs given as arguments or as the lines
+// of a file, and are requested in turn, so that repeating a shape weights the
+// mix towards it. Shapes are requested from a running instance, or, with a
+// configuration file, their images are fetched from the routes' sources once
+// and processed directly by the routes' processors.
+func RunBenchmark(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	config := &BenchmarkConfig{}
+	flags.IntVar(&config.Concurrency, "c", 8, "number of concurrent requests")
+	flags.IntVar(&config.Requests, "n", 1000, "number of requests, unless a duration is given")
+	flags.DurationVar(&config.Duration, "d", 0, "duration of the benchmark, e.g. 30s")
+	flags.StringVar(&config.ConfigFile, "config", "", "configuration file to process images with directly")
+	shapesFile := flags.String("shapes", "", "file of request shapes, one URL per line")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s bench [flags] [url ...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	config.Shapes = flags.Args()
+	if *shapesFile != "" {
+		shapes, err := readBenchmarkShapes(*shapesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read request shapes: %v\n", err)
+			return 1
+		}
+		config.Shapes = append(config.Shapes, shapes...)
+	}
+	if len(config.Shapes) == 0 || config.Concurrency < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var request func(shape string) (int64, error)
+	if config.ConfigFile != "" {
+		halfshellConfig := NewConfigFromFile(config.ConfigFile)
+		if policy := halfshellConfig.ServerConfig.ImageMagickPolicy; policy != nil {
+			if err := policy.Apply(); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to apply ImageMagick policy: %v\n", err)
+				return 1
+			}
+		}
+		imagick.Initialize()
+		defer imagick.Terminate()
+		processor, err := newBenchmarkProcessor(config, halfshellConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		request = processor.process
+	} else {
+		request = fetchBenchmarkShape
+	}
+
+	result := runBenchmark(config, request)
+	result.Report(os.Stdout)
+	return 0
+}
+
+// Returns the non-empty lines of a file that aren't comments.
+func readBenchmarkShapes(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var shapes []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			shapes = append(shapes, line)
+		}
+	}
+	return shapes, scanner.Err()
+}
+
+// Requests the shapes from concurrent workers until the requests are made or
+// the duration has passed.
+func runBenchmark(config *BenchmarkConfig, request func(shape string) (int64, error)) *benchmarkResult {
+	result := &benchmarkResult{}
+	var next int64 = -1
+	var deadline time.Time
+	if config.Duration > 0 {
+		deadline = time.Now().Add(config.Duration)
+	}
+
+	var mutex sync.Mutex
+	var workers sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < config.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				n := atomic.AddInt64(&next, 1)
+				if deadline.IsZero() && n >= int64(config.Requests) || !deadline.IsZero() && time.Now().After(deadline) {
+					return
+				}
+				requestStart := time.Now()
+				size, err := request(config.Shapes[n%int64(len(config.Shapes))])
+				latency := time.Since(requestStart)
+				if err != nil {
+					atomic.AddInt64(&result.Errors, 1)
+					continue
+				}
+				atomic.AddInt64(&result.Bytes, size)
+				mutex.Lock()
+				result.Latencies = append(result.Latencies, latency)
+				mutex.Unlock()
+			}
+		}()
+	}
+	workers.Wait()
+	result.Elapsed = time.Since(start)
+	return result
+}
+
+// Requests a shape from a running instance and returns the size of the
+// response body.
+func fetchBenchmarkShape(shape string) (int64, error) {
+	response, err := http.Get(shape)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	size, err := io.Copy(ioutil.Discard, response.Body)
+	if err == nil && response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s responded with %s", shape, response.Status)
+	}
+	return size, err
+}
+
+// benchmarkProcessor processes the shapes' images with the processors of the
+// routes configured for them, as the server would: on the routes' workers and
+// the server's worker pool, under the configuration's ImageMagick policy.
+type benchmarkProcessor struct {
+	routes     []*Route
+	workerPool *WorkerPool
+	images     map[string]*Image
+}
+
+// Creates a benchmarkProcessor for the routes and worker pool of the
+// benchmark's configuration, and fetches the images of the shapes from their
+// routes' sources.
+func newBenchmarkProcessor(config *BenchmarkConfig, halfshellConfig *Config) (*benchmarkProcessor, error) {
+	processor := &benchmarkProcessor{
+		workerPool: NewWorkerPoolWithConfig(halfshellConfig.ServerConfig),
+		images:     make(map[string]*Image),
+	}
+	for _, routeConfig := range halfshellConfig.RouteConfigs {
+		processor.routes = append(processor.routes, NewRouteWithConfig(routeConfig))
+	}
+	for _, shape := range config.Shapes {
+		r, route, err := processor.route(shape)
+		if err != nil {
+			return nil, err
+		}
+		sourceOptions, processorOptions, err := route.SourceAndProcessorOptionsForRequest(r)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid request shape %s: %v", shape, err)
+		}
+		if len(processorOptions.Overlays) > 0 || processorOptions.SpriteSheet != nil {
+			return nil, fmt.Errorf("Request shape %s needs further images, which aren't supported", shape)
+		}
+		if _, ok := processor.images[sourceOptions.Path]; ok {
+			continue
+		}
+		image := route.Source.GetImage(sourceOptions)
+		if image == nil {
+			return nil, fmt.Errorf("Unable to fetch image %s for request shape %s", sourceOptions.Path, shape)
+		}
+		processor.images[sourceOptions.Path] = image
+	}
+	return processor, nil
+}
+
+// Returns the request for a shape and the route that handles it.
+func (b *benchmarkProcessor) route(shape string) (*http.Request, *Route, error) {
+	r, err := http.NewRequest("GET", shape, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid request shape %s: %v", shape, err)
+	}
+	if route := RouteForRequest(b.routes, r); route != nil {
+		return r, route, nil
+	}
+	return nil, nil, fmt.Errorf("No route handles request shape %s", shape)
+}
+
+// Processes the image of a shape and returns the size of the processed image.
+func (b *benchmarkProcessor) process(shape string) (int64, error) {
+	r, route, err := b.route(shape)
+	if err != nil {
+		return 0, err
+	}
+	sourceOptions, processorOptions, err := route.SourceAndProcessorOptionsForRequest(r)
+	if err != nil {
+		return 0, err
+	}
+	var processed *Image
+	if !doWorkForRoute(b.workerPool, route, func() {
+		processed, err = route.Processor.ProcessImage(b.images[sourceOptions.Path], processorOptions)
+	}) {
+		return 0, errors.New("Worker pool saturated")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if processed == nil {
+		return 0, errors.New("No image was processed")
+	}
+	return int64(len(processed.Bytes)), nil
+}
+
+// Writes the throughput, latency percentiles and memory statistics of a
+// benchmark.
+func (r *benchmarkResult) Report(w io.Writer) {
+	sort.Slice(r.Latencies, func(i, j int) bool { return r.Latencies[i] < r.Latencies[j] })
+	succeeded := len(r.Latencies)
+	fmt.Fprintf(w, "Requests:    %d (%d failed)\n", succeeded+int(r.Errors), r.Errors)
+	fmt.Fprintf(w, "Elapsed:     %v\n", r.Elapsed)
+	fmt.Fprintf(w, "Throughput:  %.1f requests/s, %.1f KiB/s\n",
+		float64(succeeded)/r.Elapsed.Seconds(), float64(r.Bytes)/1024/r.Elapsed.Seconds())
+	if succeeded > 0 {
+		fmt.Fprintf(w, "Latency:     p50 %v, p90 %v, p99 %v, max %v\n",
+			r.percentile(0.5), r.percentile(0.9), r.percentile(0.99), r.Latencies[succeeded-1])
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	watchdog := &MemoryWatchdog{}
+	fmt.Fprintf(w, "Memory:      %d MiB resident, %d MiB Go heap, %d GC cycles\n",
+		watchdog.sample()>>20, stats.HeapAlloc>>20, stats.NumGC)
+}
+
+// Returns the latency that the fraction of requests completed within.
+func (r *benchmarkResult) percentile(fraction float64) time.Duration {
+	index := int(float64(len(r.Latencies))*fraction+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	return r.Latencies[index]
+}
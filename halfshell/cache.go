@@ -0,0 +1,365 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a response to an image request held by the response
+// cache: its header and body, and the pixels of the images in it.
+type CachedResponse struct {
+	Header http.Header
+	Body   []byte
+	Pixels uint64
+
+	// Set for responses whose body is compressed for each client it's
+	// served to.
+	compressible bool
+
+	key     string
+	path    string
+	expires time.Time
+}
+
+func (c *CachedResponse) size() uint64 {
+	return uint64(len(c.key) + len(c.Body))
+}
+
+func (c *CachedResponse) expired(now time.Time) bool {
+	return !c.expires.IsZero() && now.After(c.expires)
+}
+
+// How the response cache decides whether to cache a response when it's full.
+const (
+	// Always cache the response, evicting the least recently used.
+	CACHE_ADMISSION_LRU = "lru"
+	// Cache the response only if it's requested more often than the least
+	// recently used responses it would evict.
+	CACHE_ADMISSION_TINYLFU = "tinylfu"
+)
+
+// The cache's frequency sketch has a counter per this many bytes of the
+// cache, and at least the minimum number of counters.
+const (
+	CACHE_BYTES_PER_COUNTER = 4096
+	CACHE_MIN_COUNTERS      = 1024
+)
+
+// The caches a route's responses may be held by.
+const (
+	// The server's response cache.
+	CACHE_BACKEND_MEMORY = "memory"
+	// Shared caches such as CDNs and proxies.
+	CACHE_BACKEND_CDN = "cdn"
+	// Clients' private caches.
+	CACHE_BACKEND_BROWSER = "browser"
+)
+
+// How long in seconds browsers and shared caches keep responses by default,
+// and the Cache-Control header of image responses under the default policy.
+const (
+	DEFAULT_CACHE_MAX_AGE  = 86400
+	DEFAULT_CACHE_S_MAXAGE = 2592000
+	DEFAULT_CACHE_CONTROL  = "no-transform,public,max-age=86400,s-maxage=2592000"
+)
+
+// CachePolicy is a route's policy for caching its responses: which caches may
+// hold them, and for how long. Routes cache their responses everywhere by
+// default.
+type CachePolicy struct {
+	Memory  bool
+	CDN     bool
+	Browser bool
+
+	// How long responses stay in the server's cache, or 0 for the server's
+	// cache TTL.
+	TTL time.Duration
+	// How long in seconds browsers and shared caches keep responses.
+	MaxAge  uint64
+	SMaxAge uint64
+}
+
+// Returns the policy of caching responses everywhere for the default times.
+func NewCachePolicy() *CachePolicy {
+	return &CachePolicy{
+		Memory:  true,
+		CDN:     true,
+		Browser: true,
+		MaxAge:  DEFAULT_CACHE_MAX_AGE,
+		SMaxAge: DEFAULT_CACHE_S_MAXAGE,
+	}
+}
+
+// Returns the Cache-Control header of image responses under the policy.
+func (p *CachePolicy) CacheControl() string {
+	switch {
+	case p.CDN && p.Browser:
+		return fmt.Sprintf("no-transform,public,max-age=%d,s-maxage=%d", p.MaxAge, p.SMaxAge)
+	case p.CDN:
+		return fmt.Sprintf("no-transform,public,max-age=0,s-maxage=%d", p.SMaxAge)
+	case p.Browser:
+		return fmt.Sprintf("no-transform,private,max-age=%d", p.MaxAge)
+	}
+	return "no-store"
+}
+
+// Returns the Cache-Control header of image responses under the policy for a
+// URL that stops working at the expiry time, which browsers and shared caches
+// keep the responses until at most.
+func (p *CachePolicy) CacheControlUntil(expires time.Time) string {
+	var remaining uint64
+	if validity := time.Until(expires); validity > 0 {
+		remaining = uint64(validity / time.Second)
+	}
+	policy := *p
+	policy.MaxAge = minUint64(policy.MaxAge, remaining)
+	policy.SMaxAge = minUint64(policy.SMaxAge, remaining)
+	return policy.CacheControl()
+}
+
+// CacheStats are the statistics of the response cache.
+type CacheStats struct {
+	Entries    int
+	Size       uint64
+	MaxSize    uint64
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	Rejections uint64
+}
+
+// ResponseCache holds successful responses to image requests, by the
+// requests' cache keys, up to a total size in bytes, evicting the least
+// recently used. With TinyLFU admission, how often each key is requested is
+// tracked whether or not it's cached, and a response is only cached if its key
+// is requested more often than those of the responses it would evict, so that
+// the long tail of rarely requested images doesn't push out the popular ones.
+// A nil ResponseCache holds nothing.
+type ResponseCache struct {
+	MaxSize uint64
+	TTL     time.Duration
+	size    uint64
+	entries map[string]*list.Element
+	order   *list.List
+	sketch  *frequencySketch
+	stats   CacheStats
+	mutex   sync.Mutex
+}
+
+// Creates a new ResponseCache if the server's configuration has a cache size,
+// or returns nil.
+func NewResponseCacheWithConfig(config *ServerConfig) *ResponseCache {
+	if config.CacheSize == 0 {
+		return nil
+	}
+	cache := &ResponseCache{
+		MaxSize: config.CacheSize,
+		TTL:     config.CacheTTL,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+	if config.CacheAdmission == CACHE_ADMISSION_TINYLFU {
+		counters := config.CacheSize / CACHE_BYTES_PER_COUNTER
+		if counters < CACHE_MIN_COUNTERS {
+			counters = CACHE_MIN_COUNTERS
+		}
+		cache.sketch = newFrequencySketch(counters)
+	}
+	return cache
+}
+
+// Returns the cached response for a cache key, if it hasn't expired.
+func (c *ResponseCache) Get(key string) (*CachedResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.sketch != nil {
+		c.sketch.Increment(key)
+	}
+	element, ok := c.entries[key]
+	if ok && element.Value.(*CachedResponse).expired(time.Now()) {
+		c.remove(element)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*CachedResponse), true
+}
+
+// Caches a response for a cache key, unless it isn't admitted. The response
+// expires after the given TTL, or the cache's TTL if it's 0. Responses larger
+// than the whole cache aren't cached.
+func (c *ResponseCache) Add(key string, response *CachedResponse, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	response.key = key
+	if ttl == 0 {
+		ttl = c.TTL
+	}
+	if ttl > 0 {
+		response.expires = time.Now().Add(ttl)
+	}
+	if response.size() > c.MaxSize {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	now := time.Now()
+	victims := []*list.Element{}
+	size := c.size + response.size()
+	for element := c.order.Back(); size > c.MaxSize; element = element.Prev() {
+		victim := element.Value.(*CachedResponse)
+		if c.sketch != nil && !victim.expired(now) &&
+			c.sketch.Estimate(victim.key) >= c.sketch.Estimate(key) {
+			c.stats.Rejections++
+			return
+		}
+		victims = append(victims, element)
+		size -= victim.size()
+	}
+	for _, victim := range victims {
+		c.remove(victim)
+		c.stats.Evictions++
+	}
+
+	c.entries[key] = c.order.PushFront(response)
+	c.size += response.size()
+}
+
+// Removes the cached responses to requests for a source image path, or every
+// cached response if the path is empty, and returns how many were removed.
+func (c *ResponseCache) Purge(path string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	purged := 0
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if path == "" || element.Value.(*CachedResponse).path == path {
+			c.remove(element)
+			purged++
+		}
+		element = next
+	}
+	return purged
+}
+
+// Returns the cache's statistics.
+func (c *ResponseCache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	stats.Size = c.size
+	stats.MaxSize = c.MaxSize
+	return stats
+}
+
+func (c *ResponseCache) remove(element *list.Element) {
+	response := element.Value.(*CachedResponse)
+	c.order.Remove(element)
+	delete(c.entries, response.key)
+	c.size -= response.size()
+}
+
+// Caches the response written to a request under its cache key, if it can be
+// cached.
+func (s *Server) cacheResponse(w *HalfshellResponseWriter, r *HalfshellRequest, key string) {
+	if response, ok := w.cacheableResponse(); ok {
+		response.path = r.SourceOptions.Path
+		s.Cache.Add(key, response, r.Route.CachePolicy.TTL)
+	}
+}
+
+// Starts capturing the response being written, to cache it once it's
+// complete. Capturing stops once the body is known to be larger than the limit,
+// such as the cache's size, since the response couldn't be cached anyway.
+func (hw *HalfshellResponseWriter) captureResponse(limit uint64) {
+	hw.captured = &CachedResponse{}
+	hw.captureLimit = limit
+}
+
+// Returns the captured response if it can be cached: successful responses
+// that aren't debug responses. Responses compressed for the client are cached
+// uncompressed. Whether the route's responses are held in memory is up to its
+// cache policy, not the Cache-Control header sent to clients, so that the
+// responses of routes that only cache in memory are too. Debug headers aren't
+// cached.
+func (hw *HalfshellResponseWriter) cacheableResponse() (*CachedResponse, bool) {
+	response := hw.captured
+	if response == nil || hw.Status != http.StatusOK || response.Header == nil || hw.uncacheable {
+		return nil, false
+	}
+	if response.compressible {
+		response.Body = hw.uncompressed
+		response.Header.Del("Content-Encoding")
+		response.Header.Set("Content-Length", fmt.Sprintf("%d", len(response.Body)))
+	} else if response.Header.Get("Content-Encoding") != "" {
+		return nil, false
+	}
+	for header := range response.Header {
+		if strings.HasPrefix(header, DEBUG_HEADER) {
+			delete(response.Header, header)
+		}
+	}
+	response.Pixels = hw.Pixels
+	return response, true
+}
+
+// Writes a cached response, compressing its body for the client if it's
+// compressible.
+func (hw *HalfshellResponseWriter) WriteCachedResponse(response *CachedResponse) {
+	for header, values := range response.Header {
+		hw.w.Header()[header] = values
+	}
+	body := response.Body
+	if response.compressible {
+		body = hw.encode(body)
+		hw.SetHeader("Content-Length", fmt.Sprintf("%d", len(body)))
+		if hw.Digester != nil {
+			hw.Digester.SetHeaders(hw, body)
+		}
+	}
+	// The Cache-Control header depends on the request, such as when its
+	// signature expires, rather than only on the image.
+	hw.w.Header().Set("Cache-Control", hw.cacheControl())
+	hw.Pixels += response.Pixels
+	hw.setDebugDimensions(response.Body)
+	hw.WriteHeader(http.StatusOK)
+	hw.Write(body)
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"hash/fnv"
+)
+
+// The number of counters each key is counted in, and the most a counter
+// counts to.
+const (
+	FREQUENCY_SKETCH_DEPTH     = 4
+	FREQUENCY_SKETCH_MAX_COUNT = 15
+)
+
+// frequencySketch estimates how often each cache key has been requested
+// recently with a count-min sketch, which counts keys in a fixed amount of
+// memory whether or not they're cached. Every counter is halved once there
+// have been ten times as many requests as counters in a row, so that keys
+// that were popular long ago age out.
+type frequencySketch struct {
+	counters []uint8
+	mask     uint64
+	requests uint64
+}
+
+// Creates a frequency sketch with at least the given number of counters per
+// row.
+func newFrequencySketch(width uint64) *frequencySketch {
+	size := uint64(1)
+	for size < width {
+		size <<= 1
+	}
+	return &frequencySketch{
+		counters: make([]uint8, size*FREQUENCY_SKETCH_DEPTH),
+		mask:     size - 1,
+	}
+}
+
+// Returns the index of a key's counter in each row.
+func (s *frequencySketch) indexes(key string) [FREQUENCY_SKETCH_DEPTH]uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+	low, high := sum&0xffffffff, sum>>32|1
+	var indexes [FREQUENCY_SKETCH_DEPTH]uint64
+	for row := range indexes {
+		indexes[row] = uint64(row)*(s.mask+1) + (low+uint64(row)*high)&s.mask
+	}
+	return indexes
+}
+
+// Counts a request for a key.
+func (s *frequencySketch) Increment(key string) {
+	for _, index := range s.indexes(key) {
+		if s.counters[index] < FREQUENCY_SKETCH_MAX_COUNT {
+			s.counters[index]++
+		}
+	}
+	s.requests++
+	if s.requests >= 10*(s.mask+1) {
+		for i := range s.counters {
+			s.counters[i] /= 2
+		}
+		s.requests /= 2
+	}
+}
+
+// Returns the estimated number of recent requests for a key.
+func (s *frequencySketch) Estimate(key string) uint8 {
+	estimate := uint8(FREQUENCY_SKETCH_MAX_COUNT)
+	for _, index := range s.indexes(key) {
+		if s.counters[index] < estimate {
+			estimate = s.counters[index]
+		}
+	}
+	return estimate
+}
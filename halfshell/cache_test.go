@@ -0,0 +1,227 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Checks that the responses of a route that only caches them in memory are
+// cached, though clients are told not to store them, and that debug
+// responses and error images aren't.
+func TestCacheableResponses(t *testing.T) {
+	policy := &CachePolicy{Memory: true}
+	image := &Image{Bytes: []byte("image"), MimeType: "image/png"}
+
+	w := &HalfshellResponseWriter{w: httptest.NewRecorder(), CacheControl: policy.CacheControl()}
+	w.captureResponse(1024)
+	w.WriteImage(image)
+	if response, ok := w.cacheableResponse(); !ok {
+		t.Error("response of a memory-only route isn't cacheable")
+	} else if got := response.Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("response of a memory-only route has Cache-Control %q", got)
+	}
+
+	w = &HalfshellResponseWriter{w: httptest.NewRecorder(), debugStart: time.Now()}
+	w.captureResponse(1024)
+	w.WriteImage(image)
+	if _, ok := w.cacheableResponse(); ok {
+		t.Error("debug response is cacheable")
+	}
+
+	// Error images aren't cached even with a status that otherwise is.
+	w = &HalfshellResponseWriter{w: httptest.NewRecorder()}
+	w.captureResponse(1024)
+	w.WriteErrorImage(image, http.StatusOK)
+	if _, ok := w.cacheableResponse(); ok {
+		t.Error("error image is cacheable")
+	}
+
+	// Compressed responses are cached uncompressed, and compressed for the
+	// clients that accept it when they're served.
+	svg := &Image{Bytes: []byte("<svg>" + strings.Repeat(" ", COMPRESSION_MIN_SIZE) + "</svg>"), MimeType: "image/svg+xml"}
+	w = &HalfshellResponseWriter{w: httptest.NewRecorder(), acceptEncoding: "gzip"}
+	w.captureResponse(1024)
+	w.WriteImage(svg)
+	response, ok := w.cacheableResponse()
+	if !ok {
+		t.Fatal("compressed response isn't cacheable")
+	}
+	if !bytes.Equal(response.Body, svg.Bytes) || response.Header.Get("Content-Encoding") != "" {
+		t.Errorf("compressed response is cached with Content-Encoding %q", response.Header.Get("Content-Encoding"))
+	}
+	for _, encoding := range []string{"gzip", ""} {
+		recorder := httptest.NewRecorder()
+		w = &HalfshellResponseWriter{w: recorder, acceptEncoding: encoding}
+		w.WriteCachedResponse(response)
+		if got := recorder.Header().Get("Content-Encoding"); got != encoding {
+			t.Errorf("cached response for Accept-Encoding %q served with Content-Encoding %q", encoding, got)
+		}
+		if got := recorder.Header().Get("Content-Length"); got != fmt.Sprint(recorder.Body.Len()) {
+			t.Errorf("cached response of %d bytes for Accept-Encoding %q served with Content-Length %s", recorder.Body.Len(), encoding, got)
+		}
+	}
+
+	// Responses larger than the limit aren't captured.
+	w = &HalfshellResponseWriter{w: httptest.NewRecorder()}
+	w.captureResponse(4)
+	w.WriteImage(image)
+	if _, ok := w.cacheableResponse(); ok {
+		t.Error("response larger than the capture limit is cacheable")
+	}
+}
+
+// Checks that the sketch never estimates fewer requests than were counted,
+// saturates at its maximum count and ages out old requests.
+func TestFrequencySketch(t *testing.T) {
+	sketch := newFrequencySketch(64)
+	for i := 0; i < 5; i++ {
+		sketch.Increment("popular")
+	}
+	sketch.Increment("rare")
+	if estimate := sketch.Estimate("popular"); estimate < 5 {
+		t.Errorf("estimated %d requests for a key requested 5 times", estimate)
+	}
+	if estimate := sketch.Estimate("rare"); estimate < 1 {
+		t.Errorf("estimated %d requests for a key requested once", estimate)
+	}
+	if popular, rare := sketch.Estimate("popular"), sketch.Estimate("rare"); popular <= rare {
+		t.Errorf("estimated %d requests for the popular key and %d for the rare one", popular, rare)
+	}
+
+	for i := 0; i < 2*FREQUENCY_SKETCH_MAX_COUNT; i++ {
+		sketch.Increment("saturated")
+	}
+	if estimate := sketch.Estimate("saturated"); estimate != FREQUENCY_SKETCH_MAX_COUNT {
+		t.Errorf("estimated %d requests for a saturated key", estimate)
+	}
+
+	// The counters are halved after ten times as many requests as counters
+	// in a row.
+	sketch = newFrequencySketch(16)
+	for i := 0; i < FREQUENCY_SKETCH_MAX_COUNT; i++ {
+		sketch.Increment("old")
+	}
+	for i := FREQUENCY_SKETCH_MAX_COUNT; i < 10*16; i++ {
+		sketch.Increment(fmt.Sprintf("new%d", i))
+	}
+	if estimate := sketch.Estimate("old"); estimate > FREQUENCY_SKETCH_MAX_COUNT/2 {
+		t.Errorf("estimated %d requests for an old key after aging", estimate)
+	}
+}
+
+// Returns a response that takes up the given size in a cache under a one-byte
+// key.
+func testCachedResponse(size int) *CachedResponse {
+	return &CachedResponse{Header: http.Header{}, Body: make([]byte, size-1)}
+}
+
+// Checks that a full cache evicts its least recently used responses, and
+// doesn't cache responses larger than itself or keep expired ones.
+func TestResponseCacheEviction(t *testing.T) {
+	cache := NewResponseCacheWithConfig(&ServerConfig{CacheSize: 30})
+	for _, key := range []string{"a", "b", "c"} {
+		cache.Add(key, testCachedResponse(10), 0)
+	}
+	cache.Get("a")
+	cache.Add("d", testCachedResponse(10), 0)
+	for key, cached := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := cache.Get(key); ok != cached {
+			t.Errorf("response for %s cached: %v, expected %v", key, ok, cached)
+		}
+	}
+	if stats := cache.Stats(); stats.Entries != 3 || stats.Size != 30 || stats.Evictions != 1 {
+		t.Errorf("cache has %d entries of %d bytes after %d evictions, expected 3 of 30 after 1",
+			stats.Entries, stats.Size, stats.Evictions)
+	}
+
+	cache.Add("e", testCachedResponse(31), 0)
+	if _, ok := cache.Get("e"); ok {
+		t.Error("response larger than the cache is cached")
+	}
+
+	cache.Add("f", testCachedResponse(10), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if _, ok := cache.Get("f"); ok {
+		t.Error("expired response is cached")
+	}
+}
+
+// Checks that with TinyLFU admission a response is only cached in place of
+// others if its key is requested more often.
+func TestResponseCacheAdmission(t *testing.T) {
+	cache := NewResponseCacheWithConfig(&ServerConfig{CacheSize: 20, CacheAdmission: CACHE_ADMISSION_TINYLFU})
+	request := func(key string, times int) {
+		for i := 0; i < times; i++ {
+			cache.Get(key)
+		}
+	}
+	request("a", 3)
+	cache.Add("a", testCachedResponse(10), 0)
+	request("b", 3)
+	cache.Add("b", testCachedResponse(10), 0)
+
+	request("c", 1)
+	cache.Add("c", testCachedResponse(10), 0)
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Rejections != 1 || stats.Evictions != 0 {
+		t.Errorf("cache has %d entries after %d rejections and %d evictions, expected 2 after 1 and 0",
+			stats.Entries, stats.Rejections, stats.Evictions)
+	}
+
+	request("d", 5)
+	cache.Add("d", testCachedResponse(10), 0)
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Rejections != 1 || stats.Evictions != 1 {
+		t.Errorf("cache has %d entries after %d rejections and %d evictions, expected 2 after 1 and 1",
+			stats.Entries, stats.Rejections, stats.Evictions)
+	}
+	for key, cached := range map[string]bool{"a": false, "b": true, "c": false, "d": true} {
+		if _, ok := cache.Get(key); ok != cached {
+			t.Errorf("response for %s cached: %v, expected %v", key, ok, cached)
+		}
+	}
+}
+
+func TestCacheControlUntil(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *CachePolicy
+		validity time.Duration
+		expected string
+	}{
+		{"long-lived", NewCachePolicy(), 365 * 24 * time.Hour, DEFAULT_CACHE_CONTROL},
+		{"short-lived", NewCachePolicy(), time.Hour + time.Second/2, "no-transform,public,max-age=3600,s-maxage=3600"},
+		{"expired", NewCachePolicy(), -time.Hour, "no-transform,public,max-age=0,s-maxage=0"},
+		{"cdn", &CachePolicy{CDN: true, SMaxAge: 86400}, time.Hour + time.Second/2, "no-transform,public,max-age=0,s-maxage=3600"},
+		{"browser", &CachePolicy{Browser: true, MaxAge: 60}, time.Hour, "no-transform,private,max-age=60"},
+		{"none", &CachePolicy{}, time.Hour, "no-store"},
+	}
+	for _, test := range tests {
+		if got := test.policy.CacheControlUntil(time.Now().Add(test.validity)); got != test.expected {
+			t.Errorf("%s: Cache-Control %q, expected %q", test.name, got, test.expected)
+		}
+	}
+}
@@ -21,12 +21,20 @@
 package halfshell
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Config is the primary configuration of Halfshell. It contains the server
@@ -38,19 +46,134 @@ type Config struct {
 
 // ServerConfig holds the configuration settings relevant for the HTTP server.
 type ServerConfig struct {
-	Port           uint64
-	ReadTimeout    uint64
-	WriteTimeout   uint64
-	StatsdDisabled bool
+	Port                uint64
+	ReadTimeout         uint64
+	WriteTimeout        uint64
+	StatsdDisabled      bool
+	ProcessingWorkers   uint64
+	ProcessingQueueSize uint64
+	MaxMemory           uint64
+	AdminPort           uint64
+	AdminToken          string
+	UnixSocket          string
+	UnixSocketMode      os.FileMode
+	TLSCertFile         string
+	TLSKeyFile          string
+	H2CEnabled          bool
+	HTTP3Enabled        bool
+	HTTP3Port           uint64
+	FaultInjection      bool
+	TrustedProxies      []*net.IPNet
+	ImageMagickPolicy   *ImageMagickPolicyConfig
+	StatsConfigs        []*StatsConfig
+	EventLog            string
+	UsageConfig         *UsageConfig
+	CacheSize           uint64
+	CacheTTL            time.Duration
+	CacheAdmission      string
+	WarmupConfig        *WarmupConfig
+
+	SecurityHeaders          map[string]string
+	SVGContentSecurityPolicy string
+}
+
+// StatsConfig holds the settings of a metrics backend that stats are sent to.
+type StatsConfig struct {
+	Backend   string
+	Address   string
+	Namespace string
+}
+
+// UsageConfig holds the settings of usage accounting: the store usage is
+// flushed to, how often, and the quota of each account.
+type UsageConfig struct {
+	StoreType     UsageStoreType
+	Path          string
+	URL           string
+	Timeout       uint64
+	FlushInterval time.Duration
+	Quotas        map[string]*UsageQuota
+	KeyAccounts   map[string]string
+}
+
+// WarmupConfig holds the settings of warming up the response cache on
+// startup: where to read the requests to make from, and how many to make at
+// once.
+type WarmupConfig struct {
+	File        string
+	URL         string
+	Concurrency uint64
+	Timeout     time.Duration
+}
+
+// TenantConfig identifies the requests belonging to a tenant. Requests are
+// matched by hostname, path prefix, or both.
+type TenantConfig struct {
+	Name       string
+	Hostnames  []string
+	PathPrefix string
 }
 
 // RouteConfig holds the configuration settings for a particular route.
 type RouteConfig struct {
 	Name            string
+	TenantConfig    *TenantConfig
 	Pattern         *regexp.Regexp
 	ImagePathIndex  int
 	SourceConfig    *SourceConfig
 	ProcessorConfig *ProcessorConfig
+	Priority        int64
+	DefaultOptions  map[string]string
+	ParameterNames  map[string]string
+
+	AllowedDimensions       []ImageDimensions
+	SnapToAllowedDimensions bool
+	ProcessingWorkers       uint64
+	ProcessingQueueSize     uint64
+	MaxBandwidth            uint64
+	ClientHints             bool
+	SaveDataProfile         bool
+	SocialCard              *SocialCardConfig
+	SpriteSheet             bool
+	ModeratorConfig         *ModeratorConfig
+	OutputFormats           []string
+	MinDimensions           ImageDimensions
+	MinAspectRatio          float64
+	MaxAspectRatio          float64
+	Raw                     bool
+	MissingDimensions       string
+	SignatureSecret         string
+	SignatureSecrets        map[string]string
+	SignatureClockSkew      time.Duration
+	UnsignedWatermark       *ImageOverlay
+	PreserveProvenance      bool
+	ContentDigest           bool
+	ContentDigestSecret     string
+	BlurMode                string
+	StripMetadata           bool
+	ErrorImages             bool
+	ErrorImageFont          string
+	LUTs                    map[string]*ColorLookupTable
+	ExifRules               []*ExifRule
+	StatsConfigs            []*StatsConfig
+	ScrubLocation           bool
+	Headers                 map[string]string
+	CachePolicy             *CachePolicy
+}
+
+// SocialCardConfig holds the layout of the social cards rendered by a route.
+// Cards are the requested image cropped to the card's dimensions, with the
+// title text and an optional logo from the route's source over it.
+type SocialCardConfig struct {
+	Width           uint64
+	Height          uint64
+	Logo            string
+	LogoGravity     string
+	Font            string
+	TitleSize       uint64
+	TitleColor      string
+	TitleBackground string
+	TitleGravity    string
 }
 
 // SourceConfig holds the type information and configuration settings for a
@@ -60,23 +183,100 @@ type SourceConfig struct {
 	Type               ImageSourceType
 	S3AccessKey        string
 	S3Bucket           string
+	S3Endpoint         *url.URL
+	S3PathStyle        bool
+	S3SignatureVersion uint64
+	S3Region           string
 	S3SecretKey        string
+	WebDAVURL          string
+	WebDAVUsername     string
+	WebDAVPassword     string
+	WebDAVToken        string
+	WebDAVTokenFile    string
+	DatabaseDriver     string
+	DatabaseDSN        string
+	DatabaseTable      string
+	DatabaseKeyColumn  string
+	DatabaseDataColumn string
 	Directory          string
 	DescendDirectories bool
+	MaxSourceSize      uint64
+	ScannerAddress     string
+	ScannerTimeout     uint64
+	AllowedFormats     []string
+	FetchTimeout       time.Duration
+	HedgeDelay         time.Duration
+	MetadataCacheTTL   time.Duration
+	MetadataCacheSize  uint64
+
+	MaxIdleConnsPerHost uint64
+	IdleConnTimeout     time.Duration
+	TLSSessionCacheSize uint64
+	DNSCacheTTL         time.Duration
+	TLSRootCAs          *x509.CertPool
+
+	DatabaseMaxOpenConns uint64
+	DatabaseMaxIdleConns uint64
+
+	MaxRedirects            uint64
+	AllowCrossHostRedirects bool
+	RedirectHosts           []string
 }
 
 // ProcessorConfig holds the configuration settings for the image processor.
 type ProcessorConfig struct {
 	Name                    string
 	ImageCompressionQuality uint64
+	PNGCompressionLevel     uint64
+	WebPQuality             uint64
+	WebPLossless            bool
+	AVIFQuality             uint64
+	AVIFSpeed               uint64
 	MaintainAspectRatio     bool
+	Enlarge                 bool
+	MaxLiquidRescalePixels  uint64
+	ResizeFilter            string
+	LinearResize            bool
+	MaxAnimationFrames      uint64
+	MaxAnimationPixels      uint64
+	MaxAnimationLoops       uint64
+	AnimationLimitAction    string
+	MaxLiquidRescaleRatio   float64
 	DefaultImageHeight      uint64
 	DefaultImageWidth       uint64
 	MaxImageHeight          uint64
 	MaxImageWidth           uint64
 	MaxBlurRadiusPercentage float64
+	FastBlurSigma           float64
 	GrayscaleByDefault      bool
 	GrayscaleDisabled       bool
+	GrayscaleExemptPaths    []*regexp.Regexp
+	SaveDataQuality         uint64
+	SaveDataFormat          string
+	SaveDataMaxImageWidth   uint64
+	GrayscaleColorspace     string
+	GrayscaleDither         string
+	RotationBackground      string
+	RasterizeSVG            bool
+	LegacyOutputFormat      string
+	Fonts                   map[string]string
+	DecodeTimeout           time.Duration
+	TransformTimeout        time.Duration
+}
+
+// ModeratorConfig holds the type information and configuration settings for
+// a particular moderator.
+type ModeratorConfig struct {
+	Name        string
+	Type        ModeratorType
+	URL         string
+	Timeout     uint64
+	HashesFile  string
+	MaxDistance uint64
+	Action      ModerationVerdict
+	BlurSigma   float64
+	CacheSize   uint64
+	FailOpen    bool
 }
 
 // Parses a JSON configuration file and returns a pointer to a new Config object.
@@ -108,100 +308,999 @@ func newConfigParser(filepath string) *configParser {
 
 func (c *configParser) parse() *Config {
 	config := Config{ServerConfig: c.parseServerConfig()}
+	config.RouteConfigs = c.parseRouteConfigs(nil)
+
+	for tenantName := range c.section("tenants") {
+		tenantParser, tenantConfig := c.parseTenantConfig(tenantName)
+		config.RouteConfigs = append(config.RouteConfigs, tenantParser.parseRouteConfigs(tenantConfig)...)
+	}
+
+	// Requests are handled by the first matching route in order of descending
+	// priority. JSON objects are unordered, so routes of equal priority are
+	// ordered by pattern to keep the order stable between restarts.
+	sort.Sort(routeConfigsByPriority(config.RouteConfigs))
+	warnOfOverlappingRoutes(config.RouteConfigs)
+	for _, routeConfig := range config.RouteConfigs {
+		routeConfig.StatsConfigs = config.ServerConfig.StatsConfigs
+	}
+
+	return &config
+}
+
+// Parses the routes along with the sources, processors and moderators they
+// use.
+func (c *configParser) parseRouteConfigs(tenantConfig *TenantConfig) []*RouteConfig {
 	sourceConfigsByName := make(map[string]*SourceConfig)
 	processorConfigsByName := make(map[string]*ProcessorConfig)
+	moderatorConfigsByName := make(map[string]*ModeratorConfig)
+	routeConfigs := []*RouteConfig{}
 
-	for sourceName := range c.data["sources"].(map[string]interface{}) {
+	for sourceName := range c.section("sources") {
 		sourceConfigsByName[sourceName] = c.parseSourceConfig(sourceName)
 	}
 
-	for processorName := range c.data["processors"].(map[string]interface{}) {
+	for processorName := range c.section("processors") {
 		processorConfigsByName[processorName] = c.parseProcessorConfig(processorName)
 	}
 
-	routesData := c.data["routes"].(map[string]interface{})
-	for routePatternString := range routesData {
-		routeConfig := &RouteConfig{ImagePathIndex: -1}
-		routeData := routesData[routePatternString].(map[string]interface{})
-		pattern, err := regexp.Compile(routePatternString)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid route pattern %s: %v\n", routePatternString, err)
-			os.Exit(1)
+	for moderatorName := range c.section("moderators") {
+		moderatorConfigsByName[moderatorName] = c.parseModeratorConfig(moderatorName)
+	}
+
+	for routePatternString := range c.section("routes") {
+		routeConfig := c.parseRouteConfig(routePatternString, sourceConfigsByName, processorConfigsByName, moderatorConfigsByName)
+		if tenantConfig != nil {
+			routeConfig.Name = fmt.Sprintf("%s.%s", tenantConfig.Name, routeConfig.Name)
+			routeConfig.TenantConfig = tenantConfig
+		}
+		routeConfigs = append(routeConfigs, routeConfig)
+	}
+
+	return routeConfigs
+}
+
+// Parses a tenant's hostnames and path prefix. Returns a parser for the
+// tenant's sources, processors, moderators and routes, where the tenant's
+// sources, processors and moderators extend the top-level ones of the same
+// name.
+func (c *configParser) parseTenantConfig(tenantName string) (*configParser, *TenantConfig) {
+	tenantData := c.section("tenants")[tenantName].(map[string]interface{})
+	tenantConfig := &TenantConfig{Name: tenantName}
+	tenantConfig.PathPrefix, _ = tenantData["path_prefix"].(string)
+	tenantConfig.PathPrefix = strings.TrimSuffix(tenantConfig.PathPrefix, "/")
+	if hostnames, ok := tenantData["hostnames"].([]interface{}); ok {
+		for _, hostname := range hostnames {
+			tenantConfig.Hostnames = append(tenantConfig.Hostnames, strings.ToLower(fmt.Sprint(hostname)))
+		}
+	}
+
+	if tenantConfig.PathPrefix == "" && len(tenantConfig.Hostnames) == 0 {
+		fmt.Fprintf(os.Stderr, "Tenant %s has neither hostnames nor a path prefix\n", tenantName)
+		os.Exit(1)
+	}
+
+	tenantParser := &configParser{filepath: c.filepath, data: map[string]interface{}{
+		"server":     c.data["server"],
+		"sources":    mergeConfigSections(c.section("sources"), tenantData["sources"]),
+		"processors": mergeConfigSections(c.section("processors"), tenantData["processors"]),
+		"moderators": mergeConfigSections(c.section("moderators"), tenantData["moderators"]),
+		"routes":     tenantData["routes"],
+	}}
+
+	return tenantParser, tenantConfig
+}
+
+// Returns the named top-level section of the configuration, or an empty
+// section if it is missing.
+func (c *configParser) section(name string) map[string]interface{} {
+	if section, ok := c.data[name].(map[string]interface{}); ok {
+		return section
+	}
+	return map[string]interface{}{}
+}
+
+// Returns a copy of a configuration section in which the settings of each
+// entry in overrides replace those of the entry of the same name.
+func mergeConfigSections(section map[string]interface{}, overrides interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(section))
+	for name, entry := range section {
+		merged[name] = entry
+	}
+
+	overridesByName, _ := overrides.(map[string]interface{})
+	for name, override := range overridesByName {
+		entry := make(map[string]interface{})
+		if base, ok := merged[name].(map[string]interface{}); ok {
+			for key, value := range base {
+				entry[key] = value
+			}
+		}
+		if overrideData, ok := override.(map[string]interface{}); ok {
+			for key, value := range overrideData {
+				entry[key] = value
+			}
+		}
+		merged[name] = entry
+	}
+
+	return merged
+}
+
+func (c *configParser) parseRouteConfig(routePatternString string,
+	sourceConfigsByName map[string]*SourceConfig,
+	processorConfigsByName map[string]*ProcessorConfig,
+	moderatorConfigsByName map[string]*ModeratorConfig) *RouteConfig {
+	routeConfig := &RouteConfig{ImagePathIndex: -1}
+	routeData := c.section("routes")[routePatternString].(map[string]interface{})
+	pattern, err := regexp.Compile(routePatternString)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid route pattern %s: %v\n", routePatternString, err)
+		os.Exit(1)
+	}
+
+	for i, expName := range pattern.SubexpNames() {
+		if expName == "image_path" {
+			routeConfig.ImagePathIndex = i
+		}
+	}
+
+	if routeConfig.ImagePathIndex == -1 {
+		fmt.Fprintf(os.Stderr, "No 'image_path' named group in regex: %s\n", routePatternString)
+		os.Exit(1)
+	}
+
+	processorKey := routeData["processor"].(string)
+	sourceKey := routeData["source"].(string)
+
+	routeConfig.Name = routeData["name"].(string)
+	routeConfig.Pattern = pattern
+	routeConfig.ProcessorConfig = processorConfigsByName[processorKey]
+	routeConfig.SourceConfig = sourceConfigsByName[sourceKey]
+	if priority, ok := routeData["priority"].(float64); ok {
+		routeConfig.Priority = int64(priority)
+	}
+
+	routeConfig.DefaultOptions = make(map[string]string)
+	if defaults, ok := routeData["defaults"].(map[string]interface{}); ok {
+		for key, value := range defaults {
+			routeConfig.DefaultOptions[key] = fmt.Sprint(value)
+		}
+	}
+
+	routeConfig.ParameterNames = make(map[string]string)
+	if parameterNames, ok := routeData["parameter_names"].(map[string]interface{}); ok {
+		for option, name := range parameterNames {
+			routeConfig.ParameterNames[option] = fmt.Sprint(name)
+		}
+	}
+
+	if headers, ok := routeData["headers"].(map[string]interface{}); ok {
+		routeConfig.Headers = make(map[string]string, len(headers))
+		for header, value := range headers {
+			header = http.CanonicalHeaderKey(header)
+			if header == "Cache-Control" {
+				fmt.Fprintf(os.Stderr, "Route %s cannot set the Cache-Control header, which is set by its cache policy\n", routeConfig.Name)
+				os.Exit(1)
+			}
+			if header == "Content-Length" || header == "Content-Encoding" || header == "Transfer-Encoding" {
+				fmt.Fprintf(os.Stderr, "Route %s cannot set the %s header\n", routeConfig.Name, header)
+				os.Exit(1)
+			}
+			routeConfig.Headers[header] = fmt.Sprint(value)
 		}
+	}
+
+	routeConfig.CachePolicy = parseCachePolicy(routeConfig.Name, routeData["cache"])
 
-		for i, expName := range pattern.SubexpNames() {
-			if expName == "image_path" {
-				routeConfig.ImagePathIndex = i
+	if luts, ok := routeData["luts"].(map[string]interface{}); ok {
+		routeConfig.LUTs = make(map[string]*ColorLookupTable, len(luts))
+		for name, path := range luts {
+			lut, err := NewColorLookupTableFromFile(name, fmt.Sprint(path))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid color lookup table %s for route %s: %v\n", name, routePatternString, err)
+				os.Exit(1)
 			}
+			routeConfig.LUTs[name] = lut
 		}
+	}
 
-		if routeConfig.ImagePathIndex == -1 {
-			fmt.Fprintf(os.Stderr, "No 'image_path' named group in regex: %s\n", routePatternString)
+	if allowedDimensions, ok := routeData["allowed_dimensions"].([]interface{}); ok {
+		for _, value := range allowedDimensions {
+			var dimensions ImageDimensions
+			if _, err := fmt.Sscanf(fmt.Sprint(value), "%dx%d", &dimensions.Width, &dimensions.Height); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid allowed dimensions %v for route %s\n", value, routePatternString)
+				os.Exit(1)
+			}
+			routeConfig.AllowedDimensions = append(routeConfig.AllowedDimensions, dimensions)
+		}
+	}
+	routeConfig.SnapToAllowedDimensions, _ = routeData["snap_to_allowed_dimensions"].(bool)
+	if workers, ok := routeData["processing_workers"].(float64); ok {
+		routeConfig.ProcessingWorkers = uint64(workers)
+	}
+	if queueSize, ok := routeData["processing_queue_size"].(float64); ok {
+		routeConfig.ProcessingQueueSize = uint64(queueSize)
+	}
+	processorConfig := routeConfig.ProcessorConfig
+	routeConfig.SaveDataProfile = processorConfig.SaveDataQuality > 0 ||
+		processorConfig.SaveDataFormat != "" || processorConfig.SaveDataMaxImageWidth > 0
+	if bandwidth, ok := routeData["max_bandwidth"].(float64); ok {
+		routeConfig.MaxBandwidth = uint64(bandwidth)
+	}
+	routeConfig.ClientHints, _ = routeData["client_hints"].(bool)
+	if minWidth, ok := routeData["min_width"].(float64); ok {
+		routeConfig.MinDimensions.Width = uint64(minWidth)
+	}
+	if minHeight, ok := routeData["min_height"].(float64); ok {
+		routeConfig.MinDimensions.Height = uint64(minHeight)
+	}
+	routeConfig.Raw, _ = routeData["raw"].(bool)
+	routeConfig.PreserveProvenance, _ = routeData["preserve_provenance"].(bool)
+	routeConfig.ScrubLocation, _ = routeData["scrub_location"].(bool)
+	routeConfig.StripMetadata = true
+	if strip, ok := routeData["strip_metadata"].(bool); ok {
+		routeConfig.StripMetadata = strip
+	}
+	routeConfig.ErrorImages, _ = routeData["error_images"].(bool)
+	if font, ok := routeData["error_image_font"].(string); ok {
+		if routeConfig.ErrorImageFont, ok = processorConfig.Fonts[font]; !ok {
+			fmt.Fprintf(os.Stderr, "Unknown error image font %s for route %s\n", font, routeConfig.Name)
+			os.Exit(1)
+		}
+	}
+	routeConfig.ContentDigest, _ = routeData["content_digest"].(bool)
+	routeConfig.ContentDigestSecret, _ = routeData["content_digest_secret"].(string)
+	routeConfig.BlurMode = BLUR_MODE_RELATIVE
+	if blurMode, ok := routeData["blur_mode"].(string); ok {
+		routeConfig.BlurMode = blurMode
+	}
+	if routeConfig.BlurMode != BLUR_MODE_RELATIVE && routeConfig.BlurMode != BLUR_MODE_SIGMA {
+		fmt.Fprintf(os.Stderr, "Unknown blur mode %s for route %s\n", routeConfig.BlurMode, routeConfig.Name)
+		os.Exit(1)
+	}
+	routeConfig.MissingDimensions = MISSING_DIMENSIONS_DEFAULT
+	if missingDimensions, ok := routeData["missing_dimensions"].(string); ok {
+		routeConfig.MissingDimensions = missingDimensions
+	}
+	switch routeConfig.MissingDimensions {
+	case MISSING_DIMENSIONS_DEFAULT, MISSING_DIMENSIONS_ORIGINAL, MISSING_DIMENSIONS_REJECT:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown missing dimensions behavior %s for route %s\n", routeConfig.MissingDimensions, routeConfig.Name)
+		os.Exit(1)
+	}
+	routeConfig.MinAspectRatio, _ = routeData["min_aspect_ratio"].(float64)
+	routeConfig.MaxAspectRatio, _ = routeData["max_aspect_ratio"].(float64)
+	if routeConfig.MaxAspectRatio > 0 && routeConfig.MaxAspectRatio < routeConfig.MinAspectRatio {
+		fmt.Fprintf(os.Stderr, "Maximum aspect ratio is below the minimum for route %s\n", routeConfig.Name)
+		os.Exit(1)
+	}
+	if outputFormats, ok := routeData["output_formats"].([]interface{}); ok {
+		for _, value := range outputFormats {
+			format, ok := imageFormatsByName[strings.ToLower(fmt.Sprint(value))]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Unknown output format %v for route %s\n", value, routeConfig.Name)
+				os.Exit(1)
+			}
+			routeConfig.OutputFormats = append(routeConfig.OutputFormats, format)
+		}
+	}
+	if rules, ok := routeData["exif_rules"].([]interface{}); ok {
+		for _, rule := range rules {
+			ruleData, _ := rule.(map[string]interface{})
+			routeConfig.ExifRules = append(routeConfig.ExifRules, parseExifRuleConfig(ruleData, routeConfig.Name))
+		}
+	}
+	routeConfig.SignatureSecret, _ = routeData["signature_secret"].(string)
+	routeConfig.SignatureClockSkew = DEFAULT_SIGNATURE_CLOCK_SKEW
+	if skew, ok := routeData["signature_clock_skew"].(float64); ok {
+		routeConfig.SignatureClockSkew = time.Duration(skew * float64(time.Second))
+	}
+	if secrets, ok := routeData["signature_secrets"].(map[string]interface{}); ok {
+		routeConfig.SignatureSecrets = make(map[string]string, len(secrets))
+		for keyID, value := range secrets {
+			secret, _ := value.(string)
+			if secret == "" {
+				fmt.Fprintf(os.Stderr, "Invalid signature secret %s for route %s\n", keyID, routeConfig.Name)
+				os.Exit(1)
+			}
+			routeConfig.SignatureSecrets[keyID] = secret
+		}
+	}
+	if watermark, ok := routeData["unsigned_watermark"].(map[string]interface{}); ok {
+		routeConfig.UnsignedWatermark = parseWatermarkConfig(watermark, routeConfig.Name)
+		if (routeConfig.SignatureSecret == "" && len(routeConfig.SignatureSecrets) == 0) || routeConfig.Raw {
+			fmt.Fprintf(os.Stderr, "Route %s can only watermark unsigned requests with a signature secret and without raw\n", routeConfig.Name)
 			os.Exit(1)
 		}
+	}
+	if moderatorKey, ok := routeData["moderator"].(string); ok {
+		routeConfig.ModeratorConfig = moderatorConfigsByName[moderatorKey]
+		if routeConfig.ModeratorConfig == nil {
+			fmt.Fprintf(os.Stderr, "Unknown moderator %s for route %s\n", moderatorKey, routeConfig.Name)
+			os.Exit(1)
+		}
+	}
+	routeConfig.SpriteSheet, _ = routeData["sprite_sheet"].(bool)
+	if socialCard, ok := routeData["social_card"].(map[string]interface{}); ok {
+		routeConfig.SocialCard = parseSocialCardConfig(socialCard, processorConfig, routeConfig.Name)
+	}
 
-		processorKey := routeData["processor"].(string)
-		sourceKey := routeData["source"].(string)
+	return routeConfig
+}
+
+// Parses the watermark that a route composites over the images of unsigned
+// requests, an image from the route's source placed like a layer.
+func parseWatermarkConfig(data map[string]interface{}, routeName string) *ImageOverlay {
+	watermark := &ImageOverlay{Gravity: "center", Blend: "over", Opacity: 1}
+	watermark.Path, _ = data["path"].(string)
+	if gravity, ok := data["gravity"].(string); ok {
+		watermark.Gravity = strings.ToLower(gravity)
+	}
+	if x, ok := data["x"].(float64); ok {
+		watermark.X = int(x)
+	}
+	if y, ok := data["y"].(float64); ok {
+		watermark.Y = int(y)
+	}
+	if blend, ok := data["blend"].(string); ok {
+		watermark.Blend = strings.ToLower(blend)
+	}
+	if opacity, ok := data["opacity"].(float64); ok {
+		watermark.Opacity = opacity
+	}
 
-		routeConfig.Name = routeData["name"].(string)
-		routeConfig.Pattern = pattern
-		routeConfig.ProcessorConfig = processorConfigsByName[processorKey]
-		routeConfig.SourceConfig = sourceConfigsByName[sourceKey]
+	_, validGravity := textGravities[watermark.Gravity]
+	_, validBlend := blendModes[watermark.Blend]
+	if watermark.Path == "" || !validGravity || !validBlend || watermark.Opacity < 0 || watermark.Opacity > 1 {
+		fmt.Fprintf(os.Stderr, "Invalid unsigned watermark for route %s\n", routeName)
+		os.Exit(1)
+	}
+	return watermark
+}
 
-		config.RouteConfigs = append(config.RouteConfigs, routeConfig)
+// Parses an EXIF rule of a route. Rules match either an EXIF tag or an
+// embedded color profile.
+func parseExifRuleConfig(data map[string]interface{}, routeName string) *ExifRule {
+	rule := &ExifRule{}
+	rule.Tag, _ = data["tag"].(string)
+	rule.Profile, _ = data["profile"].(string)
+	rule.Equals, _ = data["equals"].(string)
+	rule.Action, _ = data["action"].(string)
+	for key, date := range map[string]*time.Time{"before": &rule.Before, "after": &rule.After} {
+		value, ok := data[key].(string)
+		if !ok {
+			continue
+		}
+		var err error
+		if *date, err = time.Parse(EXIF_RULE_DATE_LAYOUT, value); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid EXIF rule date %s for route %s\n", value, routeName)
+			os.Exit(1)
+		}
 	}
 
-	return &config
+	valid := (rule.Tag == "") != (rule.Profile == "")
+	switch rule.Action {
+	case EXIF_RULE_ACTION_AUTO_ORIENT, EXIF_RULE_ACTION_REJECT:
+	case EXIF_RULE_ACTION_SRGB:
+		path, _ := data["srgb_profile"].(string)
+		var err error
+		if rule.SRGBProfile, err = ioutil.ReadFile(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read the sRGB profile of an EXIF rule for route %s: %v\n", routeName, err)
+			os.Exit(1)
+		}
+	default:
+		valid = false
+	}
+	if !valid {
+		fmt.Fprintf(os.Stderr, "Invalid EXIF rule for route %s\n", routeName)
+		os.Exit(1)
+	}
+	return rule
+}
+
+func parseSocialCardConfig(data map[string]interface{}, processorConfig *ProcessorConfig, routeName string) *SocialCardConfig {
+	config := &SocialCardConfig{
+		Width:        DEFAULT_SOCIAL_CARD_WIDTH,
+		Height:       DEFAULT_SOCIAL_CARD_HEIGHT,
+		LogoGravity:  "northeast",
+		TitleSize:    DEFAULT_SOCIAL_CARD_TITLE_SIZE,
+		TitleColor:   DEFAULT_TEXT_COLOR,
+		TitleGravity: "southwest",
+	}
+	if width, ok := data["width"].(float64); ok {
+		config.Width = uint64(width)
+	}
+	if height, ok := data["height"].(float64); ok {
+		config.Height = uint64(height)
+	}
+	if size, ok := data["title_size"].(float64); ok {
+		config.TitleSize = uint64(size)
+	}
+	config.Logo, _ = data["logo"].(string)
+	config.Font, _ = data["font"].(string)
+
+	if _, ok := processorConfig.Fonts[config.Font]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown social card font %s for route %s\n", config.Font, routeName)
+		os.Exit(1)
+	}
+	for key, gravity := range map[string]*string{"logo_gravity": &config.LogoGravity, "title_gravity": &config.TitleGravity} {
+		if value, ok := data[key].(string); ok {
+			*gravity = strings.ToLower(value)
+		}
+		if _, ok := textGravities[*gravity]; !ok {
+			fmt.Fprintf(os.Stderr, "Invalid social card %s %s for route %s\n", key, *gravity, routeName)
+			os.Exit(1)
+		}
+	}
+	for key, color := range map[string]*string{"title_color": &config.TitleColor, "title_background": &config.TitleBackground} {
+		if value, ok := data[key].(string); ok {
+			if *color, ok = parseHexColor(value); !ok {
+				fmt.Fprintf(os.Stderr, "Invalid social card %s %s for route %s\n", key, value, routeName)
+				os.Exit(1)
+			}
+		}
+	}
+
+	return config
+}
+
+type routeConfigsByPriority []*RouteConfig
+
+func (r routeConfigsByPriority) Len() int      { return len(r) }
+func (r routeConfigsByPriority) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r routeConfigsByPriority) Less(i, j int) bool {
+	if r[i].Priority != r[j].Priority {
+		return r[i].Priority > r[j].Priority
+	}
+	// Tenant routes take precedence over top-level routes.
+	if (r[i].TenantConfig == nil) != (r[j].TenantConfig == nil) {
+		return r[i].TenantConfig != nil
+	}
+	return r[i].Pattern.String() < r[j].Pattern.String()
+}
+
+// Warns about routes of equal priority that may match the same requests, in
+// which case the route handling a request depends on the pattern order. Two
+// patterns are assumed to overlap when one's literal prefix begins with the
+// other's.
+func warnOfOverlappingRoutes(routeConfigs []*RouteConfig) {
+	logger := NewLogger("config")
+	for i, first := range routeConfigs {
+		for _, second := range routeConfigs[i+1:] {
+			if first.Priority != second.Priority || first.TenantConfig != second.TenantConfig {
+				continue
+			}
+			firstPrefix, _ := first.Pattern.LiteralPrefix()
+			secondPrefix, _ := second.Pattern.LiteralPrefix()
+			if strings.HasPrefix(firstPrefix, secondPrefix) || strings.HasPrefix(secondPrefix, firstPrefix) {
+				logger.Warn("Routes %s and %s may overlap and have equal priority; %s takes precedence",
+					first.Name, second.Name, first.Name)
+			}
+		}
+	}
 }
 
 func (c *configParser) parseServerConfig() *ServerConfig {
-	return &ServerConfig{
-		Port:           c.uintForKeypath("server.port"),
-		ReadTimeout:    c.uintForKeypath("server.read_timeout"),
-		WriteTimeout:   c.uintForKeypath("server.write_timeout"),
-		StatsdDisabled: c.boolForKeypath("server.disable_statsd"),
+	config := &ServerConfig{
+		Port:                c.uintForKeypath("server.port"),
+		ReadTimeout:         c.uintForKeypath("server.read_timeout"),
+		WriteTimeout:        c.uintForKeypath("server.write_timeout"),
+		StatsdDisabled:      c.boolForKeypath("server.disable_statsd"),
+		ProcessingWorkers:   c.uintForKeypath("server.processing_workers"),
+		ProcessingQueueSize: c.uintForKeypath("server.processing_queue_size"),
+		MaxMemory:           c.uintForKeypath("server.max_memory"),
+		AdminPort:           c.uintForKeypath("server.admin_port"),
+		AdminToken:          c.stringForKeypath("server.admin_token"),
+		UnixSocket:          c.stringForKeypath("server.unix_socket"),
+		TLSCertFile:         c.stringForKeypath("server.tls_cert_file"),
+		TLSKeyFile:          c.stringForKeypath("server.tls_key_file"),
+		H2CEnabled:          c.boolForKeypath("server.enable_h2c"),
+		HTTP3Enabled:        c.boolForKeypath("server.enable_http3"),
+		HTTP3Port:           c.uintForKeypath("server.http3_port"),
+		FaultInjection:      c.boolForKeypath("server.fault_injection"),
+		EventLog:            c.stringForKeypath("server.event_log"),
+		CacheSize:           c.uintForKeypath("server.cache_size"),
+		CacheTTL:            c.durationForKeypath("server.cache_ttl"),
+		CacheAdmission:      c.stringForKeypath("server.cache_admission"),
+
+		SVGContentSecurityPolicy: DEFAULT_SVG_CONTENT_SECURITY_POLICY,
 	}
+
+	config.SecurityHeaders = map[string]string{"X-Content-Type-Options": "nosniff"}
+	for header, value := range c.stringMapForKeypath("server.security_headers") {
+		header = http.CanonicalHeaderKey(header)
+		if value == "" {
+			delete(config.SecurityHeaders, header)
+		} else {
+			config.SecurityHeaders[header] = value
+		}
+	}
+	if policy, ok := c.lookupKeypath("server.svg_content_security_policy").(string); ok {
+		config.SVGContentSecurityPolicy = policy
+	}
+
+	if trustedProxies, ok := c.data["server"].(map[string]interface{})["trusted_proxies"].([]interface{}); ok {
+		for _, value := range trustedProxies {
+			network := fmt.Sprint(value)
+			if !strings.Contains(network, "/") {
+				if strings.Contains(network, ":") {
+					network += "/128"
+				} else {
+					network += "/32"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid trusted proxy %v: %v\n", value, err)
+				os.Exit(1)
+			}
+			config.TrustedProxies = append(config.TrustedProxies, ipNet)
+		}
+	}
+
+	if policy, ok := c.lookupKeypath("server.imagemagick_policy").(map[string]interface{}); ok {
+		config.ImageMagickPolicy = parseImageMagickPolicyConfig(policy)
+	}
+
+	if backends, ok := c.lookupKeypath("server.stats").([]interface{}); ok {
+		for _, value := range backends {
+			data, _ := value.(map[string]interface{})
+			statsConfig := &StatsConfig{}
+			statsConfig.Backend, _ = data["backend"].(string)
+			statsConfig.Address, _ = data["address"].(string)
+			statsConfig.Namespace, _ = data["namespace"].(string)
+			if _, ok := statsFormats[statsConfig.Backend]; !ok {
+				fmt.Fprintf(os.Stderr, "Unknown stats backend %v\n", data["backend"])
+				os.Exit(1)
+			}
+			config.StatsConfigs = append(config.StatsConfigs, statsConfig)
+		}
+	}
+
+	if _, ok := c.lookupKeypath("server.usage").(map[string]interface{}); ok {
+		config.UsageConfig = c.parseUsageConfig()
+	}
+
+	switch config.CacheAdmission {
+	case "":
+		config.CacheAdmission = CACHE_ADMISSION_LRU
+	case CACHE_ADMISSION_LRU, CACHE_ADMISSION_TINYLFU:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown cache admission %s\n", config.CacheAdmission)
+		os.Exit(1)
+	}
+
+	if _, ok := c.lookupKeypath("server.warmup").(map[string]interface{}); ok {
+		config.WarmupConfig = &WarmupConfig{
+			File:        c.stringForKeypath("server.warmup.file"),
+			URL:         c.stringForKeypath("server.warmup.url"),
+			Concurrency: c.uintForKeypath("server.warmup.concurrency"),
+			Timeout:     c.durationForKeypath("server.warmup.timeout"),
+		}
+		if config.WarmupConfig.File == "" && config.WarmupConfig.URL == "" {
+			fmt.Fprintf(os.Stderr, "Warm-up has neither a file nor a URL of requests\n")
+			os.Exit(1)
+		}
+		if config.CacheSize == 0 {
+			fmt.Fprintf(os.Stderr, "Warm-up requires a cache size\n")
+			os.Exit(1)
+		}
+	}
+
+	if config.HTTP3Enabled {
+		if !HTTP3_SUPPORTED {
+			fmt.Fprintf(os.Stderr, "HTTP/3 requires halfshell to be built with the http3 tag\n")
+			os.Exit(1)
+		}
+		if config.TLSCertFile == "" {
+			fmt.Fprintf(os.Stderr, "HTTP/3 requires a TLS certificate\n")
+			os.Exit(1)
+		}
+		if config.HTTP3Port == 0 && config.Port == 0 {
+			fmt.Fprintf(os.Stderr, "HTTP/3 requires an http3_port when the server has no port\n")
+			os.Exit(1)
+		}
+		if config.HTTP3Port == 0 {
+			config.HTTP3Port = config.Port
+		}
+	}
+
+	if config.FaultInjection && config.AdminPort == 0 {
+		fmt.Fprintf(os.Stderr, "Fault injection requires an admin port\n")
+		os.Exit(1)
+	}
+
+	if modeString := c.stringForKeypath("server.unix_socket_mode"); modeString != "" {
+		mode, err := strconv.ParseUint(modeString, 8, 32)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid unix socket mode %s: %v\n", modeString, err)
+			os.Exit(1)
+		}
+		config.UnixSocketMode = os.FileMode(mode)
+	}
+
+	return config
+}
+
+// Parses a route's cache policy: false to cache nothing, or an object with the
+// policy's backends and times, which default to caching everywhere.
+func parseCachePolicy(routeName string, value interface{}) *CachePolicy {
+	policy := NewCachePolicy()
+	switch data := value.(type) {
+	case nil:
+	case bool:
+		policy.Memory, policy.CDN, policy.Browser = data, data, data
+	case map[string]interface{}:
+		if backends, ok := data["backends"].([]interface{}); ok {
+			policy.Memory, policy.CDN, policy.Browser = false, false, false
+			for _, backend := range backends {
+				switch backend {
+				case CACHE_BACKEND_MEMORY:
+					policy.Memory = true
+				case CACHE_BACKEND_CDN:
+					policy.CDN = true
+				case CACHE_BACKEND_BROWSER:
+					policy.Browser = true
+				default:
+					fmt.Fprintf(os.Stderr, "Unknown cache backend %v for route %s\n", backend, routeName)
+					os.Exit(1)
+				}
+			}
+		}
+		if ttl, ok := data["ttl"].(float64); ok {
+			policy.TTL = time.Duration(ttl * float64(time.Second))
+		}
+		if maxAge, ok := data["max_age"].(float64); ok {
+			policy.MaxAge = uint64(maxAge)
+		}
+		if sMaxAge, ok := data["s_maxage"].(float64); ok {
+			policy.SMaxAge = uint64(sMaxAge)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid cache policy %v for route %s\n", value, routeName)
+		os.Exit(1)
+	}
+	return policy
+}
+
+func (c *configParser) parseUsageConfig() *UsageConfig {
+	config := &UsageConfig{
+		StoreType:     UsageStoreType(c.stringForKeypath("server.usage.store")),
+		Path:          c.stringForKeypath("server.usage.path"),
+		URL:           c.stringForKeypath("server.usage.url"),
+		Timeout:       c.uintForKeypath("server.usage.timeout"),
+		FlushInterval: c.durationForKeypath("server.usage.flush_interval"),
+		Quotas:        make(map[string]*UsageQuota),
+		KeyAccounts:   c.stringMapForKeypath("server.usage.key_accounts"),
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DEFAULT_USAGE_STORE_TIMEOUT
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = DEFAULT_USAGE_FLUSH_INTERVAL * time.Second
+	}
+
+	quotas, _ := c.lookupKeypath("server.usage.quotas").(map[string]interface{})
+	for account, value := range quotas {
+		data, _ := value.(map[string]interface{})
+		quota := &UsageQuota{Status: http.StatusTooManyRequests}
+		for key, limit := range map[string]*uint64{"requests": &quota.Requests, "pixels": &quota.Pixels, "bytes": &quota.Bytes} {
+			if value, ok := data[key].(float64); ok && value >= 0 {
+				*limit = uint64(value)
+			} else if data[key] != nil {
+				fmt.Fprintf(os.Stderr, "Invalid %s quota of %s: %v\n", key, account, data[key])
+				os.Exit(1)
+			}
+		}
+		if status, ok := data["status"].(float64); ok {
+			quota.Status = int(status)
+		}
+		if quota.Status != http.StatusPaymentRequired && quota.Status != http.StatusTooManyRequests {
+			fmt.Fprintf(os.Stderr, "Quota status of %s must be 402 or 429, not %v\n", account, data["status"])
+			os.Exit(1)
+		}
+		config.Quotas[account] = quota
+	}
+
+	return config
 }
 
 func (c *configParser) parseSourceConfig(sourceName string) *SourceConfig {
-	return &SourceConfig{
+	config := &SourceConfig{
 		Name:               sourceName,
 		Type:               ImageSourceType(c.stringForKeypath("sources.%s.type", sourceName)),
 		S3AccessKey:        c.stringForKeypath("sources.%s.s3_access_key", sourceName),
 		S3SecretKey:        c.stringForKeypath("sources.%s.s3_secret_key", sourceName),
 		S3Bucket:           c.stringForKeypath("sources.%s.s3_bucket", sourceName),
+		S3PathStyle:        c.boolForKeypath("sources.%s.s3_path_style", sourceName),
+		S3SignatureVersion: c.uintForKeypath("sources.%s.s3_signature_version", sourceName),
+		S3Region:           c.stringForKeypath("sources.%s.s3_region", sourceName),
+		WebDAVURL:          c.stringForKeypath("sources.%s.webdav_url", sourceName),
+		WebDAVUsername:     c.stringForKeypath("sources.%s.webdav_username", sourceName),
+		WebDAVPassword:     c.stringForKeypath("sources.%s.webdav_password", sourceName),
+		WebDAVToken:        c.stringForKeypath("sources.%s.webdav_token", sourceName),
+		WebDAVTokenFile:    c.stringForKeypath("sources.%s.webdav_token_file", sourceName),
+		DatabaseDriver:     c.stringForKeypath("sources.%s.database_driver", sourceName),
+		DatabaseDSN:        c.stringForKeypath("sources.%s.database_dsn", sourceName),
+		DatabaseTable:      c.stringForKeypath("sources.%s.database_table", sourceName),
+		DatabaseKeyColumn:  c.stringForKeypath("sources.%s.database_key_column", sourceName),
+		DatabaseDataColumn: c.stringForKeypath("sources.%s.database_data_column", sourceName),
 		Directory:          c.stringForKeypath("sources.%s.directory", sourceName),
 		DescendDirectories: c.boolForKeypath("sources.%s.descend_directories", sourceName),
+		MaxSourceSize:      c.uintForKeypath("sources.%s.max_source_size", sourceName),
+		ScannerAddress:     c.stringForKeypath("sources.%s.scanner_address", sourceName),
+		ScannerTimeout:     c.uintForKeypath("sources.%s.scanner_timeout", sourceName),
+		FetchTimeout:       c.durationForKeypath("sources.%s.fetch_timeout", sourceName),
+		HedgeDelay:         c.durationForKeypath("sources.%s.hedge_delay", sourceName),
+		MetadataCacheTTL:   c.durationForKeypath("sources.%s.metadata_cache_ttl", sourceName),
+		MetadataCacheSize:  c.uintForKeypath("sources.%s.metadata_cache_size", sourceName),
+
+		MaxIdleConnsPerHost: c.uintForKeypath("sources.%s.max_idle_conns_per_host", sourceName),
+		IdleConnTimeout:     c.durationForKeypath("sources.%s.idle_conn_timeout", sourceName),
+		TLSSessionCacheSize: c.uintForKeypath("sources.%s.tls_session_cache_size", sourceName),
+		DNSCacheTTL:         c.durationForKeypath("sources.%s.dns_cache_ttl", sourceName),
+
+		DatabaseMaxOpenConns: c.uintForKeypath("sources.%s.database_max_open_conns", sourceName),
+		DatabaseMaxIdleConns: c.uintForKeypath("sources.%s.database_max_idle_conns", sourceName),
+
+		AllowCrossHostRedirects: c.boolForKeypath("sources.%s.allow_cross_host_redirects", sourceName),
+	}
+
+	config.MaxRedirects = DEFAULT_MAX_REDIRECTS
+	if c.rawValueForKeypath("sources.%s.max_redirects", sourceName) != nil {
+		config.MaxRedirects = c.uintForKeypath("sources.%s.max_redirects", sourceName)
+	}
+	for _, host := range c.stringsForKeypath("sources.%s.redirect_hosts", sourceName) {
+		config.RedirectHosts = append(config.RedirectHosts, strings.ToLower(host))
+	}
+
+	if config.ScannerTimeout == 0 {
+		config.ScannerTimeout = DEFAULT_SCANNER_TIMEOUT
+	}
+	switch config.S3SignatureVersion {
+	case 0:
+		config.S3SignatureVersion = 2
+	case 2, 4:
+	default:
+		fmt.Fprintf(os.Stderr, "Unsupported S3 signature version %d for source %s\n", config.S3SignatureVersion, sourceName)
+		os.Exit(1)
+	}
+	if config.S3Region == "" {
+		config.S3Region = DEFAULT_S3_REGION
+	}
+	if endpoint := c.stringForKeypath("sources.%s.s3_endpoint", sourceName); endpoint != "" {
+		endpointURL, err := url.Parse(endpoint)
+		if err != nil || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") || endpointURL.Host == "" {
+			fmt.Fprintf(os.Stderr, "Invalid S3 endpoint %s for source %s\n", endpoint, sourceName)
+			os.Exit(1)
+		}
+		config.S3Endpoint = endpointURL
+	}
+	if caFile := c.stringForKeypath("sources.%s.tls_ca_file", sourceName); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read CA file for source %s: %v\n", sourceName, err)
+			os.Exit(1)
+		}
+		if config.TLSRootCAs, err = x509.SystemCertPool(); err != nil {
+			config.TLSRootCAs = x509.NewCertPool()
+		}
+		if !config.TLSRootCAs.AppendCertsFromPEM(pem) {
+			fmt.Fprintf(os.Stderr, "No certificates in CA file %s for source %s\n", caFile, sourceName)
+			os.Exit(1)
+		}
+	}
+	if config.DatabaseMaxOpenConns == 0 {
+		config.DatabaseMaxOpenConns = DEFAULT_DATABASE_MAX_OPEN_CONNS
+	}
+	if config.DatabaseMaxIdleConns == 0 {
+		config.DatabaseMaxIdleConns = DEFAULT_DATABASE_MAX_IDLE_CONNS
 	}
+
+	config.AllowedFormats = DEFAULT_ALLOWED_SOURCE_FORMATS
+	if formats := c.stringsForKeypath("sources.%s.allowed_formats", sourceName); len(formats) > 0 {
+		config.AllowedFormats = nil
+		for _, format := range formats {
+			format = strings.ToUpper(format)
+			if !isSniffableFormat(format) {
+				fmt.Fprintf(os.Stderr, "Unknown allowed format %s for source %s\n", format, sourceName)
+				os.Exit(1)
+			}
+			config.AllowedFormats = append(config.AllowedFormats, format)
+		}
+	}
+
+	return config
+}
+
+func parseImageMagickPolicyConfig(data map[string]interface{}) *ImageMagickPolicyConfig {
+	config := &ImageMagickPolicyConfig{ResourceLimits: make(map[string]string)}
+	for key, names := range map[string]*[]string{"disabled_coders": &config.DisabledCoders, "disabled_delegates": &config.DisabledDelegates} {
+		values, _ := data[key].([]interface{})
+		for _, value := range values {
+			name := strings.ToUpper(fmt.Sprint(value))
+			if name == "" || strings.ContainsAny(name, "{},") {
+				fmt.Fprintf(os.Stderr, "Invalid ImageMagick policy %s entry %v\n", key, value)
+				os.Exit(1)
+			}
+			*names = append(*names, name)
+		}
+	}
+
+	limits, _ := data["resource_limits"].(map[string]interface{})
+	for resource, limit := range limits {
+		known := false
+		for _, name := range imageMagickResources {
+			known = known || resource == name
+		}
+		if resource == "time" {
+			fmt.Fprintf(os.Stderr, "The ImageMagick time resource can't be limited, since it counts from startup\n")
+			os.Exit(1)
+		}
+		if !known {
+			fmt.Fprintf(os.Stderr, "Unknown ImageMagick resource %s\n", resource)
+			os.Exit(1)
+		}
+		config.ResourceLimits[resource] = fmt.Sprint(limit)
+	}
+
+	config.DisableIndirectReads, _ = data["disable_indirect_reads"].(bool)
+	return config
+}
+
+func (c *configParser) parseModeratorConfig(moderatorName string) *ModeratorConfig {
+	config := &ModeratorConfig{
+		Name:        moderatorName,
+		Type:        ModeratorType(c.stringForKeypath("moderators.%s.type", moderatorName)),
+		URL:         c.stringForKeypath("moderators.%s.url", moderatorName),
+		Timeout:     c.uintForKeypath("moderators.%s.timeout", moderatorName),
+		HashesFile:  c.stringForKeypath("moderators.%s.hashes_file", moderatorName),
+		MaxDistance: c.uintForKeypath("moderators.%s.max_distance", moderatorName),
+		Action:      ModerationVerdict(c.stringForKeypath("moderators.%s.action", moderatorName)),
+		BlurSigma:   c.floatForKeypath("moderators.%s.blur_sigma", moderatorName),
+		CacheSize:   c.uintForKeypath("moderators.%s.cache_size", moderatorName),
+		FailOpen:    c.boolForKeypath("moderators.%s.fail_open", moderatorName),
+	}
+
+	switch config.Action {
+	case "":
+		config.Action = MODERATION_VERDICT_BLOCK
+	case MODERATION_VERDICT_BLOCK, MODERATION_VERDICT_BLUR:
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid action %s for moderator %s\n", config.Action, moderatorName)
+		os.Exit(1)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DEFAULT_MODERATOR_TIMEOUT
+	}
+	if config.BlurSigma < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid blur sigma %v for moderator %s\n", config.BlurSigma, moderatorName)
+		os.Exit(1)
+	} else if config.BlurSigma == 0 {
+		config.BlurSigma = DEFAULT_MODERATION_BLUR_SIGMA
+	}
+
+	return config
 }
 
 func (c *configParser) parseProcessorConfig(processorName string) *ProcessorConfig {
 	config := &ProcessorConfig{
-		Name: processorName,
+		Name:                    processorName,
 		ImageCompressionQuality: c.uintForKeypath("processors.%s.image_compression_quality", processorName),
+		PNGCompressionLevel:     c.uintForKeypath("processors.%s.png_compression_level", processorName),
+		WebPQuality:             c.uintForKeypath("processors.%s.webp_quality", processorName),
+		WebPLossless:            c.boolForKeypath("processors.%s.webp_lossless", processorName),
+		AVIFQuality:             c.uintForKeypath("processors.%s.avif_quality", processorName),
+		AVIFSpeed:               c.uintForKeypath("processors.%s.avif_speed", processorName),
 		MaintainAspectRatio:     c.boolForKeypath("processors.%s.maintain_aspect_ratio", processorName),
+		Enlarge:                 c.boolForKeypath("processors.%s.enlarge", processorName),
+		MaxLiquidRescalePixels:  c.uintForKeypath("processors.%s.max_liquid_rescale_pixels", processorName),
+		ResizeFilter:            strings.ToLower(c.stringForKeypath("processors.%s.resize_filter", processorName)),
+		LinearResize:            c.boolForKeypath("processors.%s.linear_resize", processorName),
+		MaxAnimationFrames:      c.uintForKeypath("processors.%s.max_animation_frames", processorName),
+		MaxAnimationPixels:      c.uintForKeypath("processors.%s.max_animation_pixels", processorName),
+		MaxAnimationLoops:       c.uintForKeypath("processors.%s.max_animation_loops", processorName),
+		AnimationLimitAction:    c.stringForKeypath("processors.%s.animation_limit_action", processorName),
+		MaxLiquidRescaleRatio:   c.floatForKeypath("processors.%s.max_liquid_rescale_ratio", processorName),
 		DefaultImageHeight:      c.uintForKeypath("processors.%s.default_image_height", processorName),
 		DefaultImageWidth:       c.uintForKeypath("processors.%s.default_image_width", processorName),
 		MaxImageHeight:          c.uintForKeypath("processors.%s.max_image_height", processorName),
 		MaxImageWidth:           c.uintForKeypath("processors.%s.max_image_width", processorName),
 		MaxBlurRadiusPercentage: c.floatForKeypath("processors.%s.max_blur_radius_percentage", processorName),
+		FastBlurSigma:           c.floatForKeypath("processors.%s.fast_blur_sigma", processorName),
+		SaveDataQuality:         c.uintForKeypath("processors.%s.save_data_quality", processorName),
+		SaveDataMaxImageWidth:   c.uintForKeypath("processors.%s.save_data_max_image_width", processorName),
+		GrayscaleColorspace:     strings.ToLower(c.stringForKeypath("processors.%s.grayscale_colorspace", processorName)),
+		GrayscaleDither:         strings.ToLower(c.stringForKeypath("processors.%s.grayscale_dither", processorName)),
+		RotationBackground:      c.stringForKeypath("processors.%s.rotation_background", processorName),
+		RasterizeSVG:            c.boolForKeypath("processors.%s.rasterize_svg", processorName),
+		LegacyOutputFormat:      c.stringForKeypath("processors.%s.legacy_output_format", processorName),
+		Fonts:                   c.stringMapForKeypath("processors.%s.fonts", processorName),
+		DecodeTimeout:           c.durationForKeypath("processors.%s.decode_timeout", processorName),
+		TransformTimeout:        c.durationForKeypath("processors.%s.transform_timeout", processorName),
+	}
+
+	if config.PNGCompressionLevel > 9 || config.AVIFSpeed > 9 || config.WebPQuality > 100 || config.AVIFQuality > 100 {
+		fmt.Fprintf(os.Stderr, "Invalid compression settings for processor %s\n", processorName)
+		os.Exit(1)
+	}
+	if config.LegacyOutputFormat == "" {
+		config.LegacyOutputFormat = DEFAULT_LEGACY_OUTPUT_FORMAT
+	} else if format, ok := imageFormatsByName[strings.ToLower(config.LegacyOutputFormat)]; ok {
+		config.LegacyOutputFormat = format
+	} else {
+		fmt.Fprintf(os.Stderr, "Unknown legacy output format %s for processor %s\n", config.LegacyOutputFormat, processorName)
+		os.Exit(1)
+	}
+	switch config.AnimationLimitAction {
+	case "":
+		config.AnimationLimitAction = ANIMATION_LIMIT_ACTION_REJECT
+	case ANIMATION_LIMIT_ACTION_REJECT, ANIMATION_LIMIT_ACTION_TRUNCATE:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown animation limit action %s for processor %s\n", config.AnimationLimitAction, processorName)
+		os.Exit(1)
+	}
+	if config.ResizeFilter == "" {
+		config.ResizeFilter = DEFAULT_RESIZE_FILTER
+	}
+	if _, ok := resizeFilters[config.ResizeFilter]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown resize filter %s for processor %s\n", config.ResizeFilter, processorName)
+		os.Exit(1)
+	}
+	if config.MaxLiquidRescalePixels == 0 {
+		config.MaxLiquidRescalePixels = DEFAULT_MAX_LIQUID_RESCALE_PIXELS
+	}
+	if config.MaxLiquidRescaleRatio == 0 {
+		config.MaxLiquidRescaleRatio = DEFAULT_MAX_LIQUID_RESCALE_RATIO
+	}
+	if config.RotationBackground == "" {
+		config.RotationBackground = "white"
+	}
+	if config.FastBlurSigma != 0 && !(config.FastBlurSigma >= FAST_BLUR_REDUCED_SIGMA) {
+		fmt.Fprintf(os.Stderr, "Fast blur sigma for processor %s must be at least %d\n", processorName, FAST_BLUR_REDUCED_SIGMA)
+		os.Exit(1)
+	}
+
+	if _, ok := grayscaleColorspaces[config.GrayscaleColorspace]; !ok {
+		fmt.Fprintf(os.Stderr, "Invalid grayscale colorspace %s for processor %s\n", config.GrayscaleColorspace, processorName)
+		os.Exit(1)
+	}
+	if config.GrayscaleDither != "" {
+		known := false
+		for _, thresholdMap := range ditherThresholdMaps {
+			known = known || config.GrayscaleDither == thresholdMap
+		}
+		if !known {
+			fmt.Fprintf(os.Stderr, "Unknown grayscale dither %s for processor %s\n", config.GrayscaleDither, processorName)
+			os.Exit(1)
+		}
+	}
+
+	if format := c.stringForKeypath("processors.%s.save_data_format", processorName); format != "" {
+		config.SaveDataFormat = imageFormatsByName[strings.ToLower(format)]
+		if config.SaveDataFormat == "" {
+			fmt.Fprintf(os.Stderr, "Invalid save data format %s for processor %s\n", format, processorName)
+			os.Exit(1)
+		}
 	}
 
 	config.GrayscaleByDefault, config.GrayscaleDisabled = c.onOrDisabledForKeypath("processors.%s.grayscale", processorName)
+	for _, exemption := range c.stringsForKeypath("processors.%s.grayscale_exempt_paths", processorName) {
+		pattern, err := regexp.Compile(exemption)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid grayscale exempt path %s for processor %s: %v\n", exemption, processorName, err)
+			os.Exit(1)
+		}
+		config.GrayscaleExemptPaths = append(config.GrayscaleExemptPaths, pattern)
+	}
 
 	return config
 }
 
 func (c *configParser) valueForKeypath(valueType reflect.Kind, keypathFormat string, v ...interface{}) interface{} {
-	keypath := fmt.Sprintf(keypathFormat, v...)
-	components := strings.Split(keypath, ".")
-	var currentData = c.data
-	for _, component := range components[:len(components)-1] {
-		currentData = currentData[component].(map[string]interface{})
-	}
-	value := currentData[components[len(components)-1]]
+	value := c.lookupKeypath(fmt.Sprintf(keypathFormat, v...))
 	if value == nil && len(v) > 0 {
-		return c.valueForKeypath(valueType, fmt.Sprintf(keypathFormat, "default"))
+		value = c.lookupKeypath(fmt.Sprintf(keypathFormat, "default"))
 	}
 
 	switch value.(type) {
@@ -224,6 +1323,46 @@ func (c *configParser) valueForKeypath(valueType reflect.Kind, keypathFormat str
 	return value
 }
 
+func (c *configParser) stringMapForKeypath(keypathFormat string, v ...interface{}) map[string]string {
+	value := c.rawValueForKeypath(keypathFormat, v...)
+	values := make(map[string]string)
+	if data, ok := value.(map[string]interface{}); ok {
+		for key, value := range data {
+			values[key] = fmt.Sprint(value)
+		}
+	}
+	return values
+}
+
+func (c *configParser) stringsForKeypath(keypathFormat string, v ...interface{}) []string {
+	value, _ := c.rawValueForKeypath(keypathFormat, v...).([]interface{})
+	values := make([]string, 0, len(value))
+	for _, element := range value {
+		values = append(values, fmt.Sprint(element))
+	}
+	return values
+}
+
+// Returns the raw value at a keypath, falling back to the "default" entry like
+// valueForKeypath, or nil if there is none.
+func (c *configParser) rawValueForKeypath(keypathFormat string, v ...interface{}) interface{} {
+	value := c.lookupKeypath(fmt.Sprintf(keypathFormat, v...))
+	if value == nil && len(v) > 0 {
+		value = c.lookupKeypath(fmt.Sprintf(keypathFormat, "default"))
+	}
+	return value
+}
+
+// Returns the raw value at a keypath, or nil if there is none.
+func (c *configParser) lookupKeypath(keypath string) interface{} {
+	components := strings.Split(keypath, ".")
+	var currentData = c.data
+	for _, component := range components[:len(components)-1] {
+		currentData, _ = currentData[component].(map[string]interface{})
+	}
+	return currentData[components[len(components)-1]]
+}
+
 func (c *configParser) stringForKeypath(keypathFormat string, v ...interface{}) string {
 	return c.valueForKeypath(reflect.String, keypathFormat, v...).(string)
 }
@@ -236,6 +1375,11 @@ func (c *configParser) uintForKeypath(keypathFormat string, v ...interface{}) ui
 	return uint64(c.floatForKeypath(keypathFormat, v...))
 }
 
+// Returns a duration given in seconds, which may be fractional.
+func (c *configParser) durationForKeypath(keypathFormat string, v ...interface{}) time.Duration {
+	return time.Duration(c.floatForKeypath(keypathFormat, v...) * float64(time.Second))
+}
+
 func (c *configParser) boolForKeypath(keypathFormat string, v ...interface{}) bool {
 	return c.valueForKeypath(reflect.Bool, keypathFormat, v...).(bool)
 }
@@ -0,0 +1,59 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCachePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected *CachePolicy
+	}{
+		{"default", nil, NewCachePolicy()},
+		{"enabled", true, NewCachePolicy()},
+		{"disabled", false, &CachePolicy{MaxAge: DEFAULT_CACHE_MAX_AGE, SMaxAge: DEFAULT_CACHE_S_MAXAGE}},
+		{
+			"backends",
+			map[string]interface{}{"backends": []interface{}{CACHE_BACKEND_MEMORY, CACHE_BACKEND_CDN}},
+			&CachePolicy{Memory: true, CDN: true, MaxAge: DEFAULT_CACHE_MAX_AGE, SMaxAge: DEFAULT_CACHE_S_MAXAGE},
+		},
+		{
+			"no backends",
+			map[string]interface{}{"backends": []interface{}{}},
+			&CachePolicy{MaxAge: DEFAULT_CACHE_MAX_AGE, SMaxAge: DEFAULT_CACHE_S_MAXAGE},
+		},
+		{
+			"times",
+			map[string]interface{}{"ttl": 1.5, "max_age": float64(60), "s_maxage": float64(3600)},
+			&CachePolicy{Memory: true, CDN: true, Browser: true, TTL: 1500 * time.Millisecond, MaxAge: 60, SMaxAge: 3600},
+		},
+	}
+	for _, test := range tests {
+		if policy := parseCachePolicy("test", test.value); !reflect.DeepEqual(policy, test.expected) {
+			t.Errorf("%s: parsed %+v, expected %+v", test.name, policy, test.expected)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"github.com/rafikk/imagick/imagick"
+	"net/http"
+	"time"
+)
+
+// The request header that asks for debug headers, and the debug headers of
+// the response: whether it was served from a cache and its cache key, the
+// route and source that served it, the dimensions of the image served, and the
+// time taken until the response was written.
+const (
+	DEBUG_HEADER            = "X-Halfshell-Debug"
+	DEBUG_CACHE_HEADER      = "X-Halfshell-Debug-Cache"
+	DEBUG_CACHE_KEY_HEADER  = "X-Halfshell-Debug-Cache-Key"
+	DEBUG_ROUTE_HEADER      = "X-Halfshell-Debug-Route"
+	DEBUG_SOURCE_HEADER     = "X-Halfshell-Debug-Source"
+	DEBUG_DIMENSIONS_HEADER = "X-Halfshell-Debug-Dimensions"
+	DEBUG_TIME_HEADER       = "X-Halfshell-Debug-Time"
+)
+
+// Returns true if a request asks for debug headers with X-Halfshell-Debug: 1
+// and carries the server's admin token.
+func (s *Server) wantsDebugHeaders(r *http.Request) bool {
+	return r.Header.Get(DEBUG_HEADER) == "1" && s.hasAdminToken(r)
+}
+
+// Sets the debug headers of a response to a request for an image. Debug
+// responses aren't cached, and the time taken is set when the response's
+// header is written.
+func (s *Server) setDebugHeaders(w *HalfshellResponseWriter, r *HalfshellRequest) {
+	w.debugStart = r.Timestamp
+	w.SetHeader(DEBUG_CACHE_HEADER, r.CacheStatus)
+	w.SetHeader(DEBUG_CACHE_KEY_HEADER, r.CacheKey())
+	w.SetHeader(DEBUG_ROUTE_HEADER, r.Route.Name)
+	w.SetHeader(DEBUG_SOURCE_HEADER, fmt.Sprintf("%s %s", r.Route.SourceName, r.SourceOptions.Path))
+}
+
+// Sets the dimensions of the image in a debug response, as it was processed,
+// before the response's header is written. Responses that aren't an image,
+// such as multipart renditions, have none.
+func (hw *HalfshellResponseWriter) setDebugDimensions(data []byte) {
+	if hw.debugStart.IsZero() {
+		return
+	}
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	wand.SetFilename("[0]")
+	if err := pingImageBlob(wand, data); err == nil {
+		dimensions := ImageDimensions{uint64(wand.GetImageWidth()), uint64(wand.GetImageHeight())}
+		hw.SetHeader(DEBUG_DIMENSIONS_HEADER, dimensions.String())
+	}
+}
+
+// Sets the time taken by a debug response, just before its header is written.
+func (hw *HalfshellResponseWriter) setDebugTime() {
+	if hw.debugStart.IsZero() {
+		return
+	}
+	hw.w.Header().Set(DEBUG_TIME_HEADER, time.Since(hw.debugStart).String())
+	hw.w.Header().Set("Cache-Control", "no-store")
+	hw.uncacheable = true
+}
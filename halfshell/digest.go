@@ -0,0 +1,73 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+)
+
+// Headers with the digests of responses: the SHA-256 digest of the body, as in
+// RFC 9530, its HMAC-SHA256 when the route has a digest secret, and the
+// SHA-256 digest of the original image from the source.
+const (
+	CONTENT_DIGEST_HEADER    = "Content-Digest"
+	CONTENT_SIGNATURE_HEADER = "X-Halfshell-Content-Signature"
+	SOURCE_DIGEST_HEADER     = "X-Halfshell-Source-Digest"
+)
+
+// A ResponseDigester sets headers with digests of the images that a route
+// responds with, so that downstream systems can verify the images weren't
+// altered or truncated, e.g. by a CDN.
+type ResponseDigester struct {
+	Secret string
+}
+
+// Returns a ResponseDigester for a route that digests its responses, or nil.
+func NewResponseDigesterWithConfig(config *RouteConfig) *ResponseDigester {
+	if !config.ContentDigest {
+		return nil
+	}
+	return &ResponseDigester{Secret: config.ContentDigestSecret}
+}
+
+// Sets the digest headers for a response body.
+func (d *ResponseDigester) SetHeaders(hw *HalfshellResponseWriter, body []byte) {
+	hw.SetHeader(CONTENT_DIGEST_HEADER, structuredDigest("sha-256", sha256.New(), body))
+	if d.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(d.Secret))
+		hw.SetHeader(CONTENT_SIGNATURE_HEADER, structuredDigest("hmac-sha256", mac, body))
+	}
+}
+
+// Sets the digest header for the original image of a response.
+func (d *ResponseDigester) SetSourceHeader(hw *HalfshellResponseWriter, source []byte) {
+	hw.SetHeader(SOURCE_DIGEST_HEADER, structuredDigest("sha-256", sha256.New(), source))
+}
+
+// Returns a digest formatted as a structured field dictionary member, e.g.
+// sha-256=:base64:.
+func structuredDigest(algorithm string, h hash.Hash, data []byte) string {
+	h.Write(data)
+	return algorithm + "=:" + base64.StdEncoding.EncodeToString(h.Sum(nil)) + ":"
+}
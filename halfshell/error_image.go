@@ -0,0 +1,91 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"github.com/rafikk/imagick/imagick"
+	"net/http"
+)
+
+const (
+	ERROR_IMAGE_DEFAULT_SIZE = 256
+	ERROR_IMAGE_MAX_SIZE     = 2048
+	ERROR_IMAGE_BACKGROUND   = "#e5e5e5"
+	ERROR_IMAGE_TEXT_COLOR   = "#737373"
+	ERROR_IMAGE_MIN_TEXT     = 8
+)
+
+// Renders a placeholder image with the given dimensions for an error response,
+// showing the response's status, so that layouts keep their shape when an
+// image fails. A missing width or height makes the image square, and both
+// missing make it ERROR_IMAGE_DEFAULT_SIZE pixels square. The image is drawn
+// with the given font file, or ImageMagick's default font if it's empty.
+func NewErrorImage(dimensions ImageDimensions, status int, font string) (*Image, error) {
+	width, height := dimensions.Width, dimensions.Height
+	switch {
+	case width == 0 && height == 0:
+		width, height = ERROR_IMAGE_DEFAULT_SIZE, ERROR_IMAGE_DEFAULT_SIZE
+	case width == 0:
+		width = height
+	case height == 0:
+		height = width
+	}
+	width, height = minUint64(width, ERROR_IMAGE_MAX_SIZE), minUint64(height, ERROR_IMAGE_MAX_SIZE)
+
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	background.SetColor(ERROR_IMAGE_BACKGROUND)
+	if err := wand.NewImage(uint(width), uint(height), background); err != nil {
+		return nil, err
+	}
+
+	draw := imagick.NewDrawingWand()
+	defer draw.Destroy()
+	if font != "" {
+		if err := draw.SetFont(font); err != nil {
+			return nil, err
+		}
+	}
+	fill := imagick.NewPixelWand()
+	defer fill.Destroy()
+	fill.SetColor(ERROR_IMAGE_TEXT_COLOR)
+	draw.SetFillColor(fill)
+	draw.SetGravity(imagick.GRAVITY_CENTER)
+
+	// Glyphs are about two thirds as wide as the font size, so the text fits
+	// the width of the image. Images too small to read the text are left blank.
+	text := fmt.Sprintf("%d %s", status, http.StatusText(status))
+	size := minUint64(width*3/uint64(2*len(text)), height/3)
+	if size >= ERROR_IMAGE_MIN_TEXT {
+		draw.SetFontSize(float64(size))
+		if err := wand.AnnotateImage(draw, 0, 0, 0, text); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := wand.SetImageFormat("PNG"); err != nil {
+		return nil, err
+	}
+	return &Image{Bytes: wand.GetImageBlob(), MimeType: "image/png"}, nil
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Cache statuses of a request's response.
+const (
+	CACHE_STATUS_HIT  = "HIT"
+	CACHE_STATUS_MISS = "MISS"
+)
+
+// Events waiting to be written beyond this are dropped, so that a slow event
+// log never holds up requests.
+const EVENT_LOG_QUEUE_SIZE = 4096
+
+// A RequestEvent describes a completed image request, for analytics of which
+// options and renditions are requested.
+type RequestEvent struct {
+	Time             time.Time                `json:"time"`
+	Route            string                   `json:"route"`
+	Tenant           string                   `json:"tenant,omitempty"`
+	Method           string                   `json:"method"`
+	Path             string                   `json:"path"`
+	Status           int                      `json:"status"`
+	CacheKey         string                   `json:"cache_key,omitempty"`
+	CacheStatus      string                   `json:"cache_status"`
+	SourcePath       string                   `json:"source_path,omitempty"`
+	ProcessorOptions *ImageProcessorOptions   `json:"processor_options,omitempty"`
+	Renditions       []*ImageProcessorOptions `json:"renditions,omitempty"`
+	BytesIn          int                      `json:"bytes_in"`
+	BytesOut         int                      `json:"bytes_out"`
+	FetchMs          float64                  `json:"fetch_ms"`
+	DurationMs       float64                  `json:"duration_ms"`
+}
+
+// EventLogger writes an event for each completed image request as a line
+// of JSON to a file or socket. Events are written in the background, and if
+// the destination is a socket, it's reconnected after errors. A nil
+// EventLogger logs no events.
+type EventLogger struct {
+	Logger      *Logger
+	Destination string
+	events      chan *RequestEvent
+	dropped     uint64
+}
+
+// Creates a new EventLogger if the server's configuration has an event log,
+// or returns nil. The event log is a file path, or a unix://, tcp:// or
+// udp:// socket address.
+func NewEventLoggerWithConfig(config *ServerConfig) *EventLogger {
+	if config.EventLog == "" {
+		return nil
+	}
+	logger := &EventLogger{
+		Logger:      NewLogger("event_log"),
+		Destination: config.EventLog,
+		events:      make(chan *RequestEvent, EVENT_LOG_QUEUE_SIZE),
+	}
+	go logger.run()
+	return logger
+}
+
+// Queues the event of a completed request to a route.
+func (l *EventLogger) LogRequest(w *HalfshellResponseWriter, r *HalfshellRequest) {
+	if l == nil || r.Route == nil {
+		return
+	}
+
+	event := &RequestEvent{
+		Time:        r.Timestamp,
+		Route:       r.Route.Name,
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Status:      w.Status,
+		CacheStatus: r.CacheStatus,
+		BytesIn:     r.SourceSize,
+		BytesOut:    w.Size,
+		FetchMs:     float64(r.FetchDuration) / float64(time.Millisecond),
+		DurationMs:  float64(time.Since(r.Timestamp)) / float64(time.Millisecond),
+	}
+	if r.Route.Tenant != nil {
+		event.Tenant = r.Route.Tenant.Name
+	}
+	if r.OptionsError == nil {
+		event.CacheKey = r.CacheKey()
+		event.SourcePath = r.SourceOptions.Path
+		event.ProcessorOptions = r.ProcessorOptions
+		event.Renditions = r.Renditions
+	}
+
+	select {
+	case l.events <- event:
+	default:
+		if dropped := atomic.AddUint64(&l.dropped, 1); dropped&(dropped-1) == 0 {
+			l.Logger.Warn("Event log queue is full, %d events dropped", dropped)
+		}
+	}
+}
+
+// Writes the queued events to the destination, opening it as needed.
+func (l *EventLogger) run() {
+	var writer io.WriteCloser
+	for event := range l.events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			l.Logger.Error("Error encoding event: %v", err)
+			continue
+		}
+		if writer == nil {
+			if writer, err = l.open(); err != nil {
+				l.Logger.Error("Unable to open event log %s: %v", l.Destination, err)
+				writer = nil
+				continue
+			}
+		}
+		if _, err = writer.Write(append(line, '\n')); err != nil {
+			l.Logger.Error("Error writing to event log %s: %v", l.Destination, err)
+			writer.Close()
+			writer = nil
+		}
+	}
+}
+
+func (l *EventLogger) open() (io.WriteCloser, error) {
+	for _, network := range []string{"unix", "tcp", "udp"} {
+		if address := strings.TrimPrefix(l.Destination, network+"://"); address != l.Destination {
+			return net.DialTimeout(network, address, 5*time.Second)
+		}
+	}
+	return os.OpenFile(l.Destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
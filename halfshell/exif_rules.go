@@ -0,0 +1,157 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"errors"
+	"github.com/rafikk/imagick/imagick"
+	"strings"
+	"time"
+)
+
+// The actions of EXIF rules.
+const (
+	EXIF_RULE_ACTION_AUTO_ORIENT = "auto_orient"
+	EXIF_RULE_ACTION_SRGB        = "srgb"
+	EXIF_RULE_ACTION_REJECT      = "reject"
+)
+
+// The layouts of dates in EXIF tags and in the configuration of EXIF rules.
+const (
+	EXIF_DATE_LAYOUT      = "2006:01:02 15:04:05"
+	EXIF_RULE_DATE_LAYOUT = "2006-01-02"
+)
+
+var ErrImageRejected = errors.New("image rejected by the route's EXIF rules")
+
+// An ExifRule normalizes the decoded images of a route that match its
+// condition, before they are processed. A rule matches images that have an
+// EXIF tag, optionally with a value equal to Equals or a date before Before or
+// after After, or images that have an embedded color profile.
+type ExifRule struct {
+	Tag     string
+	Profile string
+	Equals  string
+	Before  time.Time
+	After   time.Time
+
+	Action string
+	// The sRGB color profile that images are converted to by the srgb action.
+	SRGBProfile []byte `json:"-"`
+}
+
+// Returns true if the decoded image matches the rule's condition.
+func (rule *ExifRule) matches(wand *imagick.MagickWand) bool {
+	if rule.Profile != "" {
+		return len(wand.GetImageProfile(rule.Profile)) > 0
+	}
+
+	value := strings.TrimSpace(wand.GetImageProperty("exif:" + rule.Tag))
+	if value == "" {
+		return false
+	}
+	if rule.Equals != "" && value != rule.Equals {
+		return false
+	}
+	if !rule.Before.IsZero() || !rule.After.IsZero() {
+		date, err := time.Parse(EXIF_DATE_LAYOUT, value)
+		if err != nil {
+			return false
+		}
+		if !rule.Before.IsZero() && !date.Before(rule.Before) {
+			return false
+		}
+		if !rule.After.IsZero() && !date.After(rule.After) {
+			return false
+		}
+	}
+	return true
+}
+
+// Applies the rule's action to a matching image.
+func (rule *ExifRule) apply(wand *imagick.MagickWand) error {
+	switch rule.Action {
+	case EXIF_RULE_ACTION_AUTO_ORIENT:
+		return autoOrient(wand)
+	case EXIF_RULE_ACTION_SRGB:
+		return wand.ProfileImage("icc", rule.SRGBProfile)
+	case EXIF_RULE_ACTION_REJECT:
+		return ErrImageRejected
+	}
+	return nil
+}
+
+// Returns ErrImageRejected if the first frame of an image matches one of the
+// rules that reject images. Only the image's attributes are read, so fetched
+// images can be checked before they're served in any way, including raw.
+func checkRejectRules(rules []*ExifRule, image *Image) error {
+	rejects := false
+	for _, rule := range rules {
+		rejects = rejects || rule.Action == EXIF_RULE_ACTION_REJECT
+	}
+	if !rejects {
+		return nil
+	}
+
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	wand.SetFilename("[0]")
+	if err := pingImageBlob(wand, image.Bytes); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Action == EXIF_RULE_ACTION_REJECT && rule.matches(wand) {
+			return ErrImageRejected
+		}
+	}
+	return nil
+}
+
+// Rotates and mirrors the image as its EXIF orientation tag says it's to be
+// displayed, and resets its orientation to normal, which ImageMagick writes to
+// the EXIF data of the encoded image.
+func autoOrient(wand *imagick.MagickWand) (err error) {
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+
+	switch wand.GetImageProperty("exif:Orientation") {
+	case "2":
+		err = wand.FlopImage()
+	case "3":
+		err = wand.RotateImage(background, 180)
+	case "4":
+		err = wand.FlipImage()
+	case "5":
+		err = wand.TransposeImage()
+	case "6":
+		err = wand.RotateImage(background, 90)
+	case "7":
+		err = wand.TransverseImage()
+	case "8":
+		err = wand.RotateImage(background, 270)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return wand.SetImageOrientation(imagick.ORIENTATION_TOP_LEFT)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// The header carrying the server's admin token, which requests must send to
+// be explained.
+const ADMIN_TOKEN_HEADER = "X-Halfshell-Admin-Token"
+
+// requestExplanation describes how a request is handled, for debugging
+// routes and options without processing the image.
+type requestExplanation struct {
+	Route            string                   `json:"route"`
+	Tenant           string                   `json:"tenant,omitempty"`
+	Source           string                   `json:"source"`
+	Processor        string                   `json:"processor"`
+	SourceOptions    *ImageSourceOptions      `json:"source_options,omitempty"`
+	ProcessorOptions *ImageProcessorOptions   `json:"processor_options,omitempty"`
+	Renditions       []*ImageProcessorOptions `json:"renditions,omitempty"`
+	Scaling          *ScalingExplanation      `json:"scaling,omitempty"`
+	CacheKey         string                   `json:"cache_key,omitempty"`
+	Error            string                   `json:"error,omitempty"`
+}
+
+// Returns true if a request carries the server's admin token. Servers without
+// an admin token accept no requests as admin requests.
+func (s *Server) hasAdminToken(r *http.Request) bool {
+	token := r.Header.Get(ADMIN_TOKEN_HEADER)
+	return s.Config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.AdminToken)) == 1
+}
+
+// Returns true if the request asks to be explained rather than served.
+func (r *HalfshellRequest) WantsExplanation() bool {
+	return r.URL.Query().Get("explain") == "true"
+}
+
+// Responds with JSON describing how the request was routed, the options parsed
+// from it, how the image would be scaled and cropped, and its cache key. The
+// image is fetched to read its dimensions, but not decoded or processed.
+// Requests must carry the server's admin token.
+func (s *Server) ExplainHandler(w *HalfshellResponseWriter, r *HalfshellRequest) {
+	if !s.hasAdminToken(r.Request) {
+		w.WriteError("Forbidden", http.StatusForbidden)
+		return
+	}
+
+	explanation := &requestExplanation{
+		Route:     r.Route.Name,
+		Source:    r.Route.SourceName,
+		Processor: r.Route.ProcessorName,
+	}
+	if r.Route.Tenant != nil {
+		explanation.Tenant = r.Route.Tenant.Name
+	}
+	if r.OptionsError != nil {
+		explanation.Error = r.OptionsError.Error()
+		w.WriteJSON(explanation)
+		return
+	}
+
+	explanation.SourceOptions = r.SourceOptions
+	explanation.ProcessorOptions = r.ProcessorOptions
+	explanation.Renditions = r.Renditions
+	explanation.CacheKey = r.CacheKey()
+
+	image, err := s.getImage(r, r.SourceOptions)
+	if err != nil {
+		explanation.Error = err.Error()
+		w.WriteJSON(explanation)
+		return
+	}
+	defer image.Release()
+
+	if explanation.Scaling, err = r.Route.Processor.ExplainImage(image, r.ProcessorOptions); err != nil {
+		explanation.Error = err.Error()
+	}
+	w.WriteJSON(explanation)
+}
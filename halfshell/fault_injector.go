@@ -0,0 +1,111 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// FaultSettings are the faults injected into requests, for testing how
+// clients and CDNs cope with a misbehaving server. Each fault is injected into
+// a request with its rate's probability, from 0 to 1.
+type FaultSettings struct {
+	SourceLatencyRate     float64 `json:"source_latency_rate"`
+	SourceLatencyMs       uint64  `json:"source_latency_ms"`
+	ProcessingFailureRate float64 `json:"processing_failure_rate"`
+	SlowResponseRate      float64 `json:"slow_response_rate"`
+	SlowResponseMs        uint64  `json:"slow_response_ms"`
+}
+
+// FaultInjector injects faults into requests as set through the admin server.
+// No faults are injected until they are set. A nil FaultInjector never injects
+// faults.
+type FaultInjector struct {
+	Logger   *Logger
+	mutex    sync.Mutex
+	settings FaultSettings
+	random   *rand.Rand
+}
+
+// Creates a new FaultInjector if the server's configuration enables fault
+// injection, or returns nil.
+func NewFaultInjectorWithConfig(config *ServerConfig) *FaultInjector {
+	if !config.FaultInjection {
+		return nil
+	}
+	return &FaultInjector{
+		Logger: NewLogger("fault_injector"),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Returns the faults being injected.
+func (f *FaultInjector) Settings() FaultSettings {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.settings
+}
+
+// Sets the faults to inject.
+func (f *FaultInjector) SetSettings(settings FaultSettings) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.settings = settings
+	f.Logger.Warn("Injecting faults: %+v", settings)
+}
+
+// Delays fetching an image from a source, if the fault is injected.
+func (f *FaultInjector) DelaySource() {
+	if f == nil {
+		return
+	}
+	settings := f.Settings()
+	if f.inject(settings.SourceLatencyRate) {
+		time.Sleep(time.Duration(settings.SourceLatencyMs) * time.Millisecond)
+	}
+}
+
+// Returns true if processing an image is to fail.
+func (f *FaultInjector) FailProcessing() bool {
+	return f != nil && f.inject(f.Settings().ProcessingFailureRate)
+}
+
+// Delays a response, if the fault is injected.
+func (f *FaultInjector) DelayResponse() {
+	if f == nil {
+		return
+	}
+	settings := f.Settings()
+	if f.inject(settings.SlowResponseRate) {
+		time.Sleep(time.Duration(settings.SlowResponseMs) * time.Millisecond)
+	}
+}
+
+func (f *FaultInjector) inject(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.random.Float64() < rate
+}
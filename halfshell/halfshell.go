@@ -36,8 +36,18 @@ type Halfshell struct {
 	Logger *Logger
 }
 
-// Create a new Halfshell instance from an instance of Config.
+// Create a new Halfshell instance from an instance of Config. Performs the
+// global initialization of ImageMagick, which the routes need to decode their
+// color lookup tables.
 func NewWithConfig(config *Config) *Halfshell {
+	logger := NewLogger("main")
+	if policy := config.ServerConfig.ImageMagickPolicy; policy != nil {
+		if err := policy.Apply(); err != nil {
+			logger.Fatalf("Unable to apply ImageMagick policy: %v", err)
+		}
+	}
+	imagick.Initialize()
+
 	routes := make([]*Route, 0, len(config.RouteConfigs))
 	for _, routeConfig := range config.RouteConfigs {
 		routes = append(routes, NewRouteWithConfig(routeConfig))
@@ -48,18 +58,16 @@ func NewWithConfig(config *Config) *Halfshell {
 		Config: config,
 		Routes: routes,
 		Server: NewServerWithConfigAndRoutes(config.ServerConfig, routes),
-		Logger: NewLogger("main"),
+		Logger: logger,
 	}
 }
 
-// Start the Halfshell program. Performs global (de)initialization, and
-// starts the HTTP server.
+// Start the Halfshell program. Starts the HTTP server, and performs the global
+// deinitialization of ImageMagick once it stops.
 func (h *Halfshell) Run() {
 	var tmpl, _ = template.New("start").Parse(STARTUP_TEMPLATE_STRING)
 	_ = tmpl.Execute(os.Stdout, h)
 
-	imagick.Initialize()
 	defer imagick.Terminate()
-
 	h.Server.ListenAndServe()
 }
@@ -0,0 +1,168 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for the transport of sources fetching over HTTP.
+const (
+	DEFAULT_MAX_IDLE_CONNS_PER_HOST = 32
+	DEFAULT_IDLE_CONN_TIMEOUT       = 90 * time.Second
+	DEFAULT_TLS_SESSION_CACHE_SIZE  = 64
+	DEFAULT_MAX_REDIRECTS           = 10
+)
+
+// Returns an HTTP client for a source that fetches over HTTP, tuned with the
+// source's transport settings. Connections to the origin are kept alive and
+// reused, TLS sessions are resumed, and DNS lookups are optionally cached.
+func newSourceHTTPClient(config *SourceConfig) *http.Client {
+	maxIdleConnsPerHost := int(config.MaxIdleConnsPerHost)
+	if maxIdleConnsPerHost == 0 {
+		maxIdleConnsPerHost = DEFAULT_MAX_IDLE_CONNS_PER_HOST
+	}
+	idleConnTimeout := config.IdleConnTimeout
+	if idleConnTimeout == 0 {
+		idleConnTimeout = DEFAULT_IDLE_CONN_TIMEOUT
+	}
+	tlsSessionCacheSize := int(config.TLSSessionCacheSize)
+	if tlsSessionCacheSize == 0 {
+		tlsSessionCacheSize = DEFAULT_TLS_SESSION_CACHE_SIZE
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        maxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     idleConnTimeout,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig: &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(tlsSessionCacheSize),
+			RootCAs:            config.TLSRootCAs,
+		},
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if config.DNSCacheTTL > 0 {
+		transport.DialContext = (&dnsCache{ttl: config.DNSCacheTTL, dialer: dialer}).DialContext
+	}
+
+	return &http.Client{Transport: transport, CheckRedirect: redirectPolicy(config)}
+}
+
+// Returns a redirect policy for a source. Redirects are followed up to the
+// source's maximum number of hops. A redirect to another host is only followed
+// when cross-host redirects are allowed and, if the source has a redirect host
+// allowlist, the destination host is on it.
+func redirectPolicy(config *SourceConfig) func(*http.Request, []*http.Request) error {
+	return func(request *http.Request, via []*http.Request) error {
+		if uint64(len(via)) > config.MaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", config.MaxRedirects)
+		}
+		if request.URL.Scheme != "http" && request.URL.Scheme != "https" {
+			return fmt.Errorf("refusing redirect to %s URL", request.URL.Scheme)
+		}
+
+		host := strings.ToLower(request.URL.Hostname())
+		if host == strings.ToLower(via[0].URL.Hostname()) {
+			return nil
+		}
+		if !config.AllowCrossHostRedirects {
+			return fmt.Errorf("refusing cross-host redirect to %s", host)
+		}
+		if len(config.RedirectHosts) == 0 {
+			return nil
+		}
+		for _, allowedHost := range config.RedirectHosts {
+			if host == allowedHost || strings.HasPrefix(allowedHost, ".") && strings.HasSuffix(host, allowedHost) {
+				return nil
+			}
+		}
+		return fmt.Errorf("refusing redirect to host %s not in the allowlist", host)
+	}
+}
+
+// dnsCache dials connections to the addresses of hosts looked up at most once
+// per TTL.
+type dnsCache struct {
+	ttl     time.Duration
+	dialer  *net.Dialer
+	entries map[string]dnsCacheEntry
+	mutex   sync.Mutex
+}
+
+type dnsCacheEntry struct {
+	addresses []string
+	expires   time.Time
+}
+
+func (c *dnsCache) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range addresses {
+		var conn net.Conn
+		if conn, err = c.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	c.mutex.Lock()
+	entry, ok := c.entries[host]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addresses, nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]dnsCacheEntry)
+	}
+	c.entries[host] = dnsCacheEntry{addresses, time.Now().Add(c.ttl)}
+	c.mutex.Unlock()
+	return addresses, nil
+}
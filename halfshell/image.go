@@ -21,49 +21,227 @@
 package halfshell
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// The number of bytes inspected before the rest of an image is read.
+const IMAGE_HEADER_SIZE = 512
+
+var (
+	ErrNotAnImage    = errors.New("content is not an image")
+	ErrImageTooLarge = errors.New("image exceeds the maximum source size")
+	ErrImageNotFound = errors.New("image not found")
+)
+
+// The formats that sources accept unless configured otherwise.
+var DEFAULT_ALLOWED_SOURCE_FORMATS = []string{"JPEG", "PNG", "GIF", "WEBP"}
+
+// ISO base media file brands of the formats that SniffImageFormat recognizes.
+var imageFormatsByBrand = map[string]string{
+	"avif": "AVIF",
+	"avis": "AVIF",
+	"heic": "HEIC",
+	"heix": "HEIC",
+	"hevc": "HEIC",
+	"mif1": "HEIC",
+	"msf1": "HEIC",
+}
+
+// Canonical MIME types of images by ImageMagick format name.
+var imageMimeTypesByFormat = map[string]string{
+	"JPEG":   "image/jpeg",
+	"JPG":    "image/jpeg",
+	"PJPEG":  "image/jpeg",
+	"PNG":    "image/png",
+	"PNG8":   "image/png",
+	"PNG24":  "image/png",
+	"PNG32":  "image/png",
+	"APNG":   "image/apng",
+	"GIF":    "image/gif",
+	"GIF87":  "image/gif",
+	"WEBP":   "image/webp",
+	"TIFF":   "image/tiff",
+	"TIF":    "image/tiff",
+	"TIFF64": "image/tiff",
+	"BMP":    "image/bmp",
+	"BMP2":   "image/bmp",
+	"BMP3":   "image/bmp",
+	"ICO":    "image/x-icon",
+	"CUR":    "image/x-icon",
+	"SVG":    "image/svg+xml",
+	"SVGZ":   "image/svg+xml",
+	"AVIF":   "image/avif",
+	"HEIC":   "image/heic",
+	"JXL":    "image/jxl",
+	"JP2":    "image/jp2",
+	"PSD":    "image/vnd.adobe.photoshop",
+}
+
+// Returns the canonical MIME type of images of an ImageMagick format, or
+// application/octet-stream for formats without a registered type.
+func MimeTypeForImageFormat(format string) string {
+	if mimeType, ok := imageMimeTypesByFormat[strings.ToUpper(format)]; ok {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
 // Image contains a byte array of the image data and its MIME type.
 // TODO: See if we can use the std library's Image type without incurring
 // the hit of extra copying.
 type Image struct {
 	Bytes    []byte
 	MimeType string
+	buffer   *bytes.Buffer
 }
 
-// Returns a pointer to a new Image created from an HTTP response object.
-func NewImageFromHTTPResponse(httpResponse *http.Response) (*Image, error) {
-	imageBytes, err := ioutil.ReadAll(httpResponse.Body)
+// Returns a pointer to a new Image created from an HTTP response object. A
+// maxSize of 0 reads the response without a size limit.
+func NewImageFromHTTPResponse(httpResponse *http.Response, maxSize uint64) (*Image, error) {
 	defer httpResponse.Body.Close()
-	if err != nil {
-		return nil, err
+	if maxSize > 0 && httpResponse.ContentLength > int64(maxSize) {
+		return nil, ErrImageTooLarge
 	}
 
-	return &Image{
-		Bytes:    imageBytes,
-		MimeType: httpResponse.Header.Get("Content-Type"),
-	}, nil
+	return newImageFromReader(httpResponse.Body, httpResponse.Header.Get("Content-Type"), httpResponse.ContentLength, maxSize)
+}
+
+// Returns a pointer to a new Image created from a file. A maxSize of 0 reads
+// the file without a size limit.
+func NewImageFromFile(file *os.File, maxSize uint64) (*Image, error) {
+	var size int64 = -1
+	if fileInfo, err := file.Stat(); err == nil {
+		size = fileInfo.Size()
+	}
+	if maxSize > 0 && size > int64(maxSize) {
+		return nil, ErrImageTooLarge
+	}
+
+	return newImageFromReader(file, mime.TypeByExtension(filepath.Ext(file.Name())), size, maxSize)
 }
 
-// Returns a pointer to a new Image created from a file.
-func NewImageFromFile(file *os.File) (*Image, error) {
-	imageBytes, err := ioutil.ReadAll(file)
-	if err != nil {
+// Reads an image from r, checking that the first bytes look like an image
+// before reading the rest, and giving up as soon as maxSize is exceeded. The
+// data is read into a pooled buffer sized using the expected size, if known.
+func newImageFromReader(r io.Reader, mimeType string, size int64, maxSize uint64) (*Image, error) {
+	header := make([]byte, IMAGE_HEADER_SIZE)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
 		return nil, err
 	}
 
+	header = header[:n]
+	if !isImageContent(header, mimeType) {
+		return nil, ErrNotAnImage
+	}
+
+	body := io.MultiReader(bytes.NewReader(header), r)
+	if maxSize > 0 {
+		body = io.LimitReader(body, int64(maxSize)+1)
+	}
+
+	buffer := getImageBuffer()
+	if size > 0 {
+		buffer.Grow(int(size) + bytes.MinRead)
+	}
+	if _, err := buffer.ReadFrom(body); err != nil {
+		putImageBuffer(buffer)
+		return nil, err
+	}
+	if maxSize > 0 && uint64(buffer.Len()) > maxSize {
+		putImageBuffer(buffer)
+		return nil, ErrImageTooLarge
+	}
+
 	return &Image{
-		Bytes:    imageBytes,
-		MimeType: mime.TypeByExtension(filepath.Ext(file.Name())),
+		Bytes:    buffer.Bytes(),
+		MimeType: mimeType,
+		buffer:   buffer,
 	}, nil
 }
 
+// Returns the memory holding the image data to the buffer pool. The image must
+// not be used afterwards. Images that weren't read from a source are left to
+// the garbage collector.
+func (i *Image) Release() {
+	if i.buffer != nil {
+		putImageBuffer(i.buffer)
+		i.buffer = nil
+		i.Bytes = nil
+	}
+}
+
+// Returns true if content beginning with header could be an image of the
+// declared MIME type. This doesn't identify the image format, it only rejects
+// error pages and other content that is clearly not an image.
+func isImageContent(header []byte, mimeType string) bool {
+	if len(header) == 0 {
+		return false
+	}
+
+	if mimeType != "" && !strings.HasPrefix(mimeType, "image/") && !strings.HasSuffix(mimeType, "octet-stream") {
+		return false
+	}
+
+	if strings.HasPrefix(http.DetectContentType(header), "text/") {
+		return strings.HasPrefix(mimeType, "image/svg+xml")
+	}
+
+	return true
+}
+
+// Returns the ImageMagick name of the format of an image from its magic bytes,
+// or an empty string if the format isn't one that halfshell recognizes. Content
+// for ImageMagick's more dangerous coders, such as PostScript, MVG and MSL, is
+// never recognized.
+func SniffImageFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("\xff\xd8\xff")):
+		return "JPEG"
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return "PNG"
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return "GIF"
+	case len(header) >= 12 && bytes.Equal(header[:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WEBP")):
+		return "WEBP"
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return "TIFF"
+	case bytes.HasPrefix(header, []byte("BM")):
+		return "BMP"
+	case len(header) >= 3 && header[0] == 0x0a && header[1] <= 5 && header[2] == 1:
+		return "PCX"
+	case len(header) >= 3 && header[0] == 'P' && '1' <= header[1] && header[1] <= '6' && isPNMWhitespace(header[2]):
+		return "PNM"
+	case bytes.HasPrefix(header, []byte("\x00\x00\x01\x00")):
+		return "ICO"
+	case len(header) >= 12 && bytes.Equal(header[4:8], []byte("ftyp")):
+		return imageFormatsByBrand[string(header[8:12])]
+	case strings.HasPrefix(http.DetectContentType(header), "text/") && bytes.Contains(header, []byte("<svg")):
+		return "SVG"
+	}
+	return ""
+}
+
+func isPNMWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isSniffableFormat(format string) bool {
+	switch format {
+	case "JPEG", "PNG", "GIF", "WEBP", "TIFF", "BMP", "PCX", "PNM", "ICO", "AVIF", "HEIC", "SVG":
+		return true
+	}
+	return false
+}
+
 // Width and height of an image.
 type ImageDimensions struct {
 	Width  uint64
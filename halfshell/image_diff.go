@@ -0,0 +1,88 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"github.com/rafikk/imagick/imagick"
+)
+
+// The header carrying the percentage of pixels that differ between the images
+// of a visual diff.
+const DIFF_CHANGED_PIXELS_HEADER = "X-Diff-Changed-Pixels"
+
+// Renders a visual diff of two images: the first image faded, with the pixels
+// that differ from the second image highlighted in red. Pixels differ when
+// their colors are further apart than fuzz, a percentage of the color range.
+// Images of different dimensions are compared on a canvas the size of both,
+// where the area only one of them covers differs. Returns the diff as a PNG
+// image and the percentage of pixels that differ. Only the first frames of
+// animated images are decoded and compared.
+func DiffImages(image, other *Image, fuzz float64) (*Image, float64, error) {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	otherWand := imagick.NewMagickWand()
+	defer otherWand.Destroy()
+	for _, w := range []struct {
+		wand  *imagick.MagickWand
+		image *Image
+	}{{wand, image}, {otherWand, other}} {
+		if err := readFirstFrame(w.wand, w.image.Bytes); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	width := maxUint64(uint64(wand.GetImageWidth()), uint64(otherWand.GetImageWidth()))
+	height := maxUint64(uint64(wand.GetImageHeight()), uint64(otherWand.GetImageHeight()))
+	if width == 0 || height == 0 {
+		return nil, 0, fmt.Errorf("Cannot diff empty images")
+	}
+	transparent := imagick.NewPixelWand()
+	defer transparent.Destroy()
+	transparent.SetColor("none")
+	for _, w := range []*imagick.MagickWand{wand, otherWand} {
+		if uint64(w.GetImageWidth()) == width && uint64(w.GetImageHeight()) == height {
+			continue
+		}
+		if err := w.SetImageBackgroundColor(transparent); err != nil {
+			return nil, 0, err
+		}
+		if err := w.ExtentImage(uint(width), uint(height), 0, 0); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	_, quantumRange := imagick.GetQuantumRange()
+	if err := wand.SetImageFuzz(fuzz / 100 * float64(quantumRange)); err != nil {
+		return nil, 0, err
+	}
+	diffWand, changedPixels := wand.CompareImages(otherWand, imagick.METRIC_ABSOLUTE_ERROR)
+	if diffWand == nil {
+		return nil, 0, fmt.Errorf("Error comparing images")
+	}
+	defer diffWand.Destroy()
+	if err := diffWand.SetImageFormat("PNG"); err != nil {
+		return nil, 0, err
+	}
+
+	diff := &Image{Bytes: diffWand.GetImageBlob(), MimeType: "image/png"}
+	return diff, changedPixels / float64(width*height) * 100, nil
+}
@@ -21,16 +21,60 @@
 package halfshell
 
 import (
+	"errors"
 	"fmt"
 	"github.com/rafikk/imagick/imagick"
 	"math"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // ImageProcessor is the public interface for the image processor. It exposes a
 // single method to process an image with options.
 type ImageProcessor interface {
-	ProcessImage(*Image, *ImageProcessorOptions) *Image
+	ProcessImage(*Image, *ImageProcessorOptions) (*Image, error)
+	ProcessImageRenditions(*Image, []*ImageProcessorOptions) ([]*Image, error)
+	ExplainImage(*Image, *ImageProcessorOptions) (*ScalingExplanation, error)
+	CanonicalOptions(*ImageProcessorOptions) *ImageProcessorOptions
+	StripMetadata(*Image) (*Image, error)
+}
+
+// ScalingExplanation describes how the processor scales and crops an image,
+// as worked out from the image's dimensions without decoding it.
+type ScalingExplanation struct {
+	SourceDimensions ImageDimensions
+	ScaledDimensions ImageDimensions
+	CropDimensions   ImageDimensions
+	CropX            int
+	CropY            int
+	Fit              ImageFit
+	Format           string
+	Quality          uint64
+}
+
+// ErrAnimationTooLarge is returned for animated images with more frames or
+// pixels than the processor allows, when it doesn't truncate them.
+var ErrAnimationTooLarge = errors.New("animated image exceeds the frame or pixel limit")
+
+// What processors do with animated images beyond their limits: reject them, or
+// keep the frames within the limits.
+const (
+	ANIMATION_LIMIT_ACTION_REJECT   = "reject"
+	ANIMATION_LIMIT_ACTION_TRUNCATE = "truncate"
+)
+
+// A StageTimeoutError reports that a stage of handling a request, such as
+// fetching, decoding or transforming the image, exceeded its timeout.
+type StageTimeoutError struct {
+	Stage   string
+	Timeout time.Duration
+}
+
+func (e *StageTimeoutError) Error() string {
+	return fmt.Sprintf("%s exceeded its timeout of %v", e.Stage, e.Timeout)
 }
 
 // ImageProcessorOptions specify the request parameters for the processing
@@ -38,140 +82,1810 @@ type ImageProcessor interface {
 type ImageProcessorOptions struct {
 	Dimensions ImageDimensions
 	BlurRadius float64
-	GrayScale  bool
+	BlurMode   string
+	GrayScale  *bool
+	Fit        ImageFit
+	Format     string
+	Quality    uint64
+	SaveData   bool
+	Enlarge    *bool
+	Filter     string
+	Zoom       float64
+
+	GaussianRadius float64
+	GaussianSigma  float64
+
+	GrayscaleColorspace string
+	Dither              string
+	Gamma               float64
+	BlackPoint          float64
+	WhitePoint          float64
+	Enhance             bool
+	Denoise             uint64
+	VignetteRadius      float64
+	VignetteOpacity     float64
+	Posterize           uint64
+	Flip                string
+	Rotate              float64
+	LUT                 *ColorLookupTable
+
+	Text           string
+	Font           string
+	TextSize       uint64
+	TextColor      string
+	TextBackground string
+	TextGravity    string
+
+	Overlays    []*ImageOverlay
+	SpriteSheet *SpriteSheet
+	Slice       *ImageInsets
+	Crop        *ImageRect
+	CropOrder   string
+	Extract     *ImageRect
+
+	PerceptualHash   string
+	PerceptualHashOf string
+	Statistics       bool
+	Info             bool
+	CompareTo        string
+	DiffTo           string
+	DiffFuzz         float64
+
+	Raw                bool
+	Strip              bool
+	PreserveProvenance bool
+	ExifRules          []*ExifRule
+
+	// Set for requests without dimensions that are served at the image's
+	// original dimensions rather than the processor's default dimensions.
+	OriginalDimensions bool
+
+	IconSizes []uint64
+}
+
+// When the crop region of a request is cropped: before scaling, with the
+// region in the original image's pixels, or after scaling, with the region in
+// the scaled image's pixels.
+const (
+	CROP_ORDER_BEFORE = "before"
+	CROP_ORDER_AFTER  = "after"
+)
+
+// ImageInsets are distances in pixels from the edges of an image.
+type ImageInsets struct {
+	Top    uint64
+	Right  uint64
+	Bottom uint64
+	Left   uint64
+}
+
+// A SpriteSheet tiles the requested image and further images from the route's
+// source into a grid of equally sized cells, left to right and top to bottom.
+// The server fetches the tiles' images from their paths before the sheet is
+// processed.
+type SpriteSheet struct {
+	Paths      []string
+	Images     []*Image `json:"-"`
+	Columns    uint64
+	Cell       ImageDimensions
+	Spacing    uint64
+	Background string
+}
+
+// An ImageOverlay is an image from the route's source that is composited over
+// the processed image. The server fetches the overlay's image from its path
+// before the image is processed.
+type ImageOverlay struct {
+	Path    string
+	Gravity string
+	X       int
+	Y       int
+	Blend   string
+	Opacity float64
+	Image   *Image `json:"-"`
+}
+
+// The saturation, as a percentage of the original, of enhanced images.
+const ENHANCE_SATURATION = 110
+
+// The largest factor that images can be zoomed by relative to their original
+// dimensions.
+const MAX_ZOOM = 8
+
+// How the blur amount of a request is interpreted: relative to the image's
+// width, scaled by the processor's maximum blur radius percentage, or as the
+// sigma of the Gaussian blur in pixels.
+const (
+	BLUR_MODE_RELATIVE = "relative"
+	BLUR_MODE_SIGMA    = "sigma"
+)
+
+// The largest blur sigma and radius in pixels that can be requested.
+const (
+	MAX_BLUR_SIGMA  = 100
+	MAX_BLUR_RADIUS = 300
+)
+
+// The sigma in pixels that fast blurs blur their reduced image with.
+const FAST_BLUR_REDUCED_SIGMA = 4
+
+// The maximum number of despeckle passes that can be requested to denoise an
+// image.
+const MAX_DENOISE_PASSES = 5
+
+// Limits of text overlays: the number of characters, the font size in points,
+// and the margin in pixels between the text and the edges of the image.
+const (
+	MAX_TEXT_LENGTH = 256
+	MAX_TEXT_SIZE   = 512
+	TEXT_MARGIN     = 10
+)
+
+// Text overlay defaults.
+const (
+	DEFAULT_TEXT_SIZE    = 24
+	DEFAULT_TEXT_COLOR   = "#ffffff"
+	DEFAULT_TEXT_GRAVITY = "southeast"
+)
+
+// The maximum number of layers that can be composited in one request.
+const MAX_LAYERS = 8
+
+// Blend modes for compositing layers.
+var blendModes = map[string]imagick.CompositeOperator{
+	"over":     imagick.COMPOSITE_OP_OVER,
+	"multiply": imagick.COMPOSITE_OP_MULTIPLY,
+	"screen":   imagick.COMPOSITE_OP_SCREEN,
+	"overlay":  imagick.COMPOSITE_OP_OVERLAY,
+	"darken":   imagick.COMPOSITE_OP_DARKEN,
+	"lighten":  imagick.COMPOSITE_OP_LIGHTEN,
+}
+
+// Limits of sprite sheets: the number of tiles, including the requested image,
+// the spacing in pixels between cells, and the number of pixels in the sheet.
+const (
+	MAX_SPRITE_TILES        = 100
+	MAX_SPRITE_SPACING      = 100
+	MAX_SPRITE_SHEET_PIXELS = 50000000
+)
+
+// The default layout of social cards, sized for Open Graph images.
+const (
+	DEFAULT_SOCIAL_CARD_WIDTH      = 1200
+	DEFAULT_SOCIAL_CARD_HEIGHT     = 630
+	DEFAULT_SOCIAL_CARD_TITLE_SIZE = 64
+)
+
+// Positions that text and image overlays can be placed at.
+var textGravities = map[string]imagick.GravityType{
+	"northwest": imagick.GRAVITY_NORTH_WEST,
+	"north":     imagick.GRAVITY_NORTH,
+	"northeast": imagick.GRAVITY_NORTH_EAST,
+	"west":      imagick.GRAVITY_WEST,
+	"center":    imagick.GRAVITY_CENTER,
+	"east":      imagick.GRAVITY_EAST,
+	"southwest": imagick.GRAVITY_SOUTH_WEST,
+	"south":     imagick.GRAVITY_SOUTH,
+	"southeast": imagick.GRAVITY_SOUTH_EAST,
+}
+
+// ImageFit determines how an image is fit into the requested dimensions when
+// both a width and a height are requested.
+type ImageFit string
+
+const (
+	// Scale the image to fit within the dimensions, maintaining its aspect ratio.
+	IMAGE_FIT_CONTAIN ImageFit = "contain"
+	// Scale the image to cover the dimensions, maintaining its aspect ratio, and
+	// crop the center to the dimensions.
+	IMAGE_FIT_COVER ImageFit = "cover"
+	// Stretch the image to the dimensions.
+	IMAGE_FIT_FILL ImageFit = "fill"
+	// Scale the image to cover the dimensions, maintaining its aspect ratio, and
+	// remove the least noticeable seams of pixels until it fits them. Images
+	// that would lose too much or are too large are cropped as with cover.
+	IMAGE_FIT_LIQUID ImageFit = "liquid"
+)
+
+// Filters that images can be resized with, by the name used in requests and
+// configuration. Lanczos is sharpest for photos; point keeps pixel art crisp.
+var resizeFilters = map[string]imagick.FilterType{
+	"lanczos":  imagick.FILTER_LANCZOS,
+	"mitchell": imagick.FILTER_MITCHELL,
+	"catrom":   imagick.FILTER_CATROM,
+	"triangle": imagick.FILTER_TRIANGLE,
+	"point":    imagick.FILTER_POINT,
+}
+
+// The resize filter used unless configured otherwise.
+const DEFAULT_RESIZE_FILTER = "lanczos"
+
+// Limits of liquid rescaling unless configured otherwise: the largest number
+// of pixels of the requested dimensions, and the most the image may be
+// scaled to cover them relative to them in either direction, so that at most
+// a third of the image is removed as seams.
+const (
+	DEFAULT_MAX_LIQUID_RESCALE_PIXELS = 1000000
+	DEFAULT_MAX_LIQUID_RESCALE_RATIO  = 1.5
+)
+
+// Output formats that can be requested, by the name used in requests.
+var imageFormatsByName = map[string]string{
+	"jpeg": "JPEG",
+	"jpg":  "JPEG",
+	"png":  "PNG",
+	"gif":  "GIF",
+	"webp": "WEBP",
+	"avif": "AVIF",
+	"ico":  "ICO",
+}
+
+// Source formats that are always converted to the processor's legacy output
+// format unless another format is requested.
+var legacyImageFormats = map[string]bool{
+	"BMP":  true,
+	"BMP2": true,
+	"BMP3": true,
+	"PCX":  true,
+	"PBM":  true,
+	"PGM":  true,
+	"PPM":  true,
+	"PNM":  true,
+	"TIFF": true,
+}
+
+// The format legacy source formats are converted to unless configured
+// otherwise.
+const DEFAULT_LEGACY_OUTPUT_FORMAT = "PNG"
+
+// Limits of icons: the sizes in pixels of their square images, and the number
+// of sizes. Icons have the default sizes unless others are requested.
+const (
+	MAX_ICON_SIZE  = 256
+	MAX_ICON_SIZES = 8
+)
+
+var DEFAULT_ICON_SIZES = []uint64{16, 32, 48}
+
+// Colorspaces that images can be grayscaled to: linear gray, or the luma of
+// Rec. 601 or Rec. 709.
+var grayscaleColorspaces = map[string]imagick.ColorspaceType{
+	"":           imagick.COLORSPACE_GRAY,
+	"gray":       imagick.COLORSPACE_GRAY,
+	"rec601luma": imagick.COLORSPACE_REC601LUMA,
+	"rec709luma": imagick.COLORSPACE_REC709LUMA,
+}
+
+// ImageMagick's built-in threshold maps for ordered dithering. Dithering a
+// grayscale image produces 1-bit output.
+var ditherThresholdMaps = []string{
+	"threshold", "checks", "o2x2", "o3x3", "o4x4", "o8x8",
+	"h4x4a", "h6x6a", "h8x8a", "h4x4o", "h6x6o", "h8x8o", "h16x16o",
+}
+
+func resizeFilterNames() []string {
+	names := make([]string, 0, len(resizeFilters))
+	for name := range resizeFilters {
+		names = append(names, name)
+	}
+	return names
+}
+
+func imageFormatNames() []string {
+	names := make([]string, 0, len(imageFormatsByName))
+	for name := range imageFormatsByName {
+		names = append(names, name)
+	}
+	return names
+}
+
+func textGravityNames() []string {
+	names := make([]string, 0, len(textGravities))
+	for name := range textGravities {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Reports whether text is safe to render as an overlay. ImageMagick may treat
+// '%' and '\' as escapes and a leading '@' as a file to read the text from, so
+// these are rejected along with control characters and overly long text.
+func isSafeText(text string) bool {
+	if !utf8.ValidString(text) || utf8.RuneCountInString(text) > MAX_TEXT_LENGTH ||
+		strings.HasPrefix(text, "@") || strings.ContainsAny(text, "%\\") {
+		return false
+	}
+	for _, r := range text {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses a color given as 6 or 8 hexadecimal digits, RGB or RGBA, optionally
+// with a leading '#'. The color is returned with a leading '#'.
+func parseHexColor(value string) (string, bool) {
+	value = strings.ToLower(strings.TrimPrefix(value, "#"))
+	if len(value) != 6 && len(value) != 8 {
+		return "", false
+	}
+	for _, c := range value {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return "", false
+		}
+	}
+	return "#" + value, true
+}
+
+// Returns the offset of an overlay placed at a gravity within an image. Like
+// ImageMagick's geometry offsets, the x and y offsets move the overlay away
+// from the edges it is placed against.
+func gravityOffset(gravity string, width, height, overlayWidth, overlayHeight, x, y int) (int, int) {
+	offsetX, offsetY := (width-overlayWidth)/2+x, (height-overlayHeight)/2+y
+	if strings.HasSuffix(gravity, "west") {
+		offsetX = x
+	} else if strings.HasSuffix(gravity, "east") {
+		offsetX = width - overlayWidth - x
+	}
+	if strings.HasPrefix(gravity, "north") {
+		offsetY = y
+	} else if strings.HasPrefix(gravity, "south") {
+		offsetY = height - overlayHeight - y
+	}
+	return offsetX, offsetY
+}
+
+type imageProcessor struct {
+	Config *ProcessorConfig
+	Logger *Logger
+}
+
+// Creates a new ImageProcessor instance using configuration settings.
+func NewImageProcessorWithConfig(config *ProcessorConfig) ImageProcessor {
+	return &imageProcessor{
+		Config: config,
+		Logger: NewLogger("image_processor.%s", config.Name),
+	}
+}
+
+// The public method for processing an image. The method receives an original
+// image and options and returns the processed image.
+//
+// ImageMagick operations can't be interrupted, so the decode and transform
+// timeouts are checked after decoding and after each processing step, and
+// processing stops at the first step that finishes past its stage's timeout.
+func (ip *imageProcessor) ProcessImage(image *Image, request *ImageProcessorOptions) (*Image, error) {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	if hint := ip.decodeSizeHint(request); hint.Width > 0 {
+		wand.SetOption("jpeg:size", hint.String())
+	}
+
+	decodeStart := time.Now()
+	modified := false
+	if request.SpriteSheet != nil {
+		if err := ip.readSpriteSheet(wand, image, request); err != nil {
+			ip.Logger.Warn("Error tiling sprite sheet: %s", err)
+			return nil, err
+		}
+		modified = true
+	} else if err := ip.readImage(wand, image); err != nil {
+		ip.Logger.Warn("Error decoding image: %s", err)
+		return nil, err
+	}
+	if timeout := ip.Config.DecodeTimeout; timeout > 0 && time.Since(decodeStart) > timeout {
+		return nil, &StageTimeoutError{"decode", timeout}
+	}
+
+	return ip.transform(wand, image, request, modified)
+}
+
+// Processes several renditions of an image, decoding it once and transforming
+// a copy of the decoded image for each rendition in parallel.
+func (ip *imageProcessor) ProcessImageRenditions(image *Image, requests []*ImageProcessorOptions) ([]*Image, error) {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	// The image is decoded large enough for every rendition, in each
+	// dimension, which rules out a size hint if any rendition is full size.
+	var hint ImageDimensions
+	for _, request := range requests {
+		renditionHint := ip.decodeSizeHint(request)
+		if renditionHint.Width == 0 {
+			hint = ImageDimensions{}
+			break
+		}
+		hint.Width = maxUint64(hint.Width, renditionHint.Width)
+		hint.Height = maxUint64(hint.Height, renditionHint.Height)
+	}
+	if hint.Width > 0 {
+		wand.SetOption("jpeg:size", hint.String())
+	}
+
+	decodeStart := time.Now()
+	if err := ip.readImage(wand, image); err != nil {
+		ip.Logger.Warn("Error decoding image: %s", err)
+		return nil, err
+	}
+	if timeout := ip.Config.DecodeTimeout; timeout > 0 && time.Since(decodeStart) > timeout {
+		return nil, &StageTimeoutError{"decode", timeout}
+	}
+
+	renditions := make([]*Image, len(requests))
+	errs := make([]error, len(requests))
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		renditionWand := wand.Clone()
+		wg.Add(1)
+		go func(i int, request *ImageProcessorOptions) {
+			defer wg.Done()
+			defer renditionWand.Destroy()
+			renditions[i], errs[i] = ip.transform(renditionWand, image, request, false)
+		}(i, request)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return renditions, nil
+}
+
+// Decodes an image into the wand. Animated images are first pinged to check
+// them against the processor's frame and pixel limits, and only the frames
+// within the limits are decoded. Their loop count is capped at the processor's
+// maximum.
+func (ip *imageProcessor) readImage(wand *imagick.MagickWand, image *Image) error {
+	frames, err := ip.allowedFrames(image)
+	if err != nil {
+		return err
+	}
+	if frames > 0 {
+		wand.SetFilename(fmt.Sprintf("[0-%d]", frames-1))
+	}
+	if err = readImageBlob(wand, image.Bytes); err != nil {
+		return err
+	}
+
+	iteratorMoved := false
+	for frames > 0 && wand.GetNumberImages() > frames {
+		wand.SetIteratorIndex(int(wand.GetNumberImages()) - 1)
+		if err = wand.RemoveImage(); err != nil {
+			return err
+		}
+		iteratorMoved = true
+	}
+	if maxLoops := ip.Config.MaxAnimationLoops; maxLoops > 0 && wand.GetNumberImages() > 1 {
+		wand.SetIteratorIndex(0)
+		if loops := wand.GetImageIterations(); loops == 0 || uint64(loops) > maxLoops {
+			if err = wand.SetImageIterations(uint(maxLoops)); err != nil {
+				return err
+			}
+		}
+		iteratorMoved = true
+	}
+	if iteratorMoved {
+		wand.ResetIterator()
+	}
+	return nil
+}
+
+// Reads an image into a wand. SVG images are sanitized before ImageMagick's
+// SVG delegates decode them, since the delegates would otherwise follow
+// references to local files and to other coders, and are decoded with the SVG
+// coder whatever else their content looks like.
+func readImageBlob(wand *imagick.MagickWand, blob []byte) error {
+	blob, err := sanitizeSVGForDecoding(wand, blob)
+	if err != nil {
+		return err
+	}
+	return wand.ReadImageBlob(blob)
+}
+
+// Reads only the first frame of an image into a wand, like readImageBlob, for
+// operations on still images, so that the other frames of an animated image
+// are never decoded.
+func readFirstFrame(wand *imagick.MagickWand, blob []byte) error {
+	wand.SetFilename("[0]")
+	return readImageBlob(wand, blob)
+}
+
+// Reads the attributes of an image into a wand without decoding its pixels,
+// sanitizing SVG images like readImageBlob.
+func pingImageBlob(wand *imagick.MagickWand, blob []byte) error {
+	blob, err := sanitizeSVGForDecoding(wand, blob)
+	if err != nil {
+		return err
+	}
+	return wand.PingImageBlob(blob)
+}
+
+// Returns an SVG image sanitized, with the wand's filename prefixed so that
+// ImageMagick reads it with the SVG coder. Other images are returned as they
+// are.
+func sanitizeSVGForDecoding(wand *imagick.MagickWand, blob []byte) ([]byte, error) {
+	if SniffImageFormat(blob) != "SVG" {
+		return blob, nil
+	}
+	sanitized, err := SanitizeSVG(blob)
+	if err != nil {
+		return nil, err
+	}
+	wand.SetFilename("svg:" + wand.GetFilename())
+	return sanitized, nil
+}
+
+// Returns the number of frames of an animated image to decode, or 0 to decode
+// them all. Frames are counted up to the processor's maximum number of frames
+// and its budget of pixels over all frames. Animations beyond the limits are
+// rejected unless the processor truncates them.
+func (ip *imageProcessor) allowedFrames(image *Image) (uint, error) {
+	if ip.Config.MaxAnimationFrames == 0 && ip.Config.MaxAnimationPixels == 0 {
+		return 0, nil
+	}
+
+	pingWand := imagick.NewMagickWand()
+	defer pingWand.Destroy()
+	if err := pingImageBlob(pingWand, image.Bytes); err != nil {
+		return 0, err
+	}
+	count := pingWand.GetNumberImages()
+	if count <= 1 {
+		return 0, nil
+	}
+
+	frames := count
+	if maxFrames := uint(ip.Config.MaxAnimationFrames); maxFrames > 0 && frames > maxFrames {
+		frames = maxFrames
+	}
+	if ip.Config.MaxAnimationPixels > 0 {
+		var pixels uint64
+		for i := uint(0); i < frames; i++ {
+			pingWand.SetIteratorIndex(int(i))
+			pixels += uint64(pingWand.GetImageWidth()) * uint64(pingWand.GetImageHeight())
+			if pixels > ip.Config.MaxAnimationPixels {
+				frames = i
+				break
+			}
+		}
+	}
+
+	if frames == count {
+		return 0, nil
+	}
+	if frames == 0 || ip.Config.AnimationLimitAction != ANIMATION_LIMIT_ACTION_TRUNCATE {
+		return 0, ErrAnimationTooLarge
+	}
+	ip.Logger.Info("Truncating animated image from %d to %d frames", count, frames)
+	return frames, nil
+}
+
+// Runs the processing steps on a decoded image and encodes the result. The
+// original image is returned as is if none of the steps modify it and it
+// needn't be re-encoded with the requested quality or to strip its metadata.
+func (ip *imageProcessor) transform(wand *imagick.MagickWand, image *Image, request *ImageProcessorOptions, modified bool) (*Image, error) {
+	processedImage := Image{}
+	transformStart := time.Now()
+	for _, step := range ip.steps() {
+		err, stepModified := step.process(wand, request)
+		if err != nil {
+			ip.Logger.Warn("Error %s image: %s", step.description, err)
+			return nil, err
+		}
+		modified = modified || stepModified
+
+		if timeout := ip.Config.TransformTimeout; timeout > 0 && time.Since(transformStart) > timeout {
+			return nil, &StageTimeoutError{"transform", timeout}
+		}
+	}
+
+	if !modified && !ip.requestsQuality(wand, request) && !(request.Strip && len(wand.GetImageProfiles("*")) > 0) {
+		processedImage.Bytes = image.Bytes
+	} else {
+		if err := ip.pinEncoding(wand, request); err != nil {
+			ip.Logger.Warn("Error pinning image encoding: %s", err)
+			return nil, err
+		}
+		if err := ip.setCompression(wand, request); err != nil {
+			ip.Logger.Warn("Error setting image compression: %s", err)
+			return nil, err
+		}
+		if len(request.IconSizes) > 0 && wand.GetImageFormat() == "ICO" {
+			icon, err := ip.encodeIcon(wand, request)
+			if err != nil {
+				ip.Logger.Warn("Error encoding icon: %s", err)
+				return nil, err
+			}
+			processedImage.Bytes = icon
+		} else {
+			processedImage.Bytes = wand.GetImageBlob()
+		}
+		if request.PreserveProvenance && request.Strip {
+			processedImage.Bytes = copyProvenance(image.Bytes, processedImage.Bytes)
+		}
+	}
+
+	processedImage.MimeType = MimeTypeForImageFormat(wand.GetImageFormat())
+	if processedImage.MimeType == "image/svg+xml" {
+		sanitized, err := SanitizeSVG(processedImage.Bytes)
+		if err != nil {
+			ip.Logger.Warn("Error sanitizing SVG image: %s", err)
+			return nil, err
+		}
+		processedImage.Bytes = sanitized
+	}
+
+	return &processedImage, nil
+}
+
+// Re-encodes an image in its format without any metadata. The image is decoded
+// within the processor's frame and pixel limits, as it is for processing.
+func (ip *imageProcessor) StripMetadata(image *Image) (*Image, error) {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := ip.readImage(wand, image); err != nil {
+		ip.Logger.Warn("Error decoding image: %s", err)
+		return nil, err
+	}
+
+	for i := 0; i < int(wand.GetNumberImages()); i++ {
+		wand.SetIteratorIndex(i)
+		if err := wand.StripImage(); err != nil {
+			return nil, err
+		}
+		// StripImage keeps the EXIF values that coders such as TIFF's decode
+		// into properties and write back.
+		for _, property := range wand.GetImageProperties("exif:*") {
+			if err := wand.DeleteImageProperty(property); err != nil {
+				return nil, err
+			}
+		}
+	}
+	wand.ResetIterator()
+	return &Image{Bytes: wand.GetImagesBlob(), MimeType: image.MimeType}, nil
+}
+
+// Returns a copy of the options in a canonical form for cache keys, so that
+// requests for the same image share a key. Options the request leaves to the
+// processor are set to the processor's defaults, and options that have no
+// effect on their own are cleared.
+func (ip *imageProcessor) CanonicalOptions(request *ImageProcessorOptions) *ImageProcessorOptions {
+	options := *request
+
+	options.Dimensions = ip.requestedDimensions(request)
+	options.OriginalDimensions = options.Dimensions.Width == 0 && options.Dimensions.Height == 0 && options.Zoom == 0
+	// The fit only matters when the image is scaled to both dimensions.
+	if options.Dimensions.Width == 0 || options.Dimensions.Height == 0 {
+		options.Fit = ""
+	} else {
+		options.Fit = ip.fit(request)
+	}
+	enlarge := ip.enlarge(request)
+	options.Enlarge = &enlarge
+	if _, ok := resizeFilters[options.Filter]; !ok {
+		options.Filter = ip.Config.ResizeFilter
+	}
+
+	grayscale := !ip.Config.GrayscaleDisabled && ip.grayscale(request)
+	options.GrayScale = &grayscale
+	if !grayscale {
+		options.GrayscaleColorspace, options.Dither = "", ""
+	} else {
+		if options.GrayscaleColorspace == "" {
+			options.GrayscaleColorspace = ip.Config.GrayscaleColorspace
+		}
+		if options.Dither == "" {
+			options.Dither = ip.Config.GrayscaleDither
+		}
+	}
+
+	// Rotations by whole turns leave the image as it is, like no rotation.
+	switch options.Rotate = math.Mod(options.Rotate, 360); {
+	case options.Rotate == 0:
+		options.Rotate = 0 // Not -0.
+	case options.Rotate < 0:
+		options.Rotate += 360
+	}
+	if options.VignetteRadius == 0 {
+		options.VignetteOpacity = 0
+	} else if options.VignetteOpacity == 0 {
+		options.VignetteOpacity = 1
+	}
+	if options.Text == "" {
+		options.Font, options.TextSize, options.TextColor, options.TextBackground, options.TextGravity = "", 0, "", "", ""
+	}
+	if options.Crop == nil {
+		options.CropOrder = ""
+	} else if options.CropOrder != CROP_ORDER_AFTER {
+		options.CropOrder = CROP_ORDER_BEFORE
+	}
+	if options.PerceptualHash == "" {
+		options.PerceptualHashOf = ""
+	} else if options.PerceptualHashOf == "" {
+		options.PerceptualHashOf = "processed"
+	}
+	if options.DiffTo == "" {
+		options.DiffFuzz = 0
+	}
+
+	// The Save-Data format is the requested format of Save-Data requests
+	// that don't ask for one.
+	options.Format = ip.format(request)
+	// A quality equal to the one the processor would choose is the same as
+	// none, except for requests that may be answered with an unchanged JPEG,
+	// WebP or AVIF image, which a requested quality re-encodes. Save-Data
+	// qualities re-encode those images either way.
+	saveDataQuality := options.SaveData && ip.Config.SaveDataQuality > 0
+	if options.Quality > 0 && (saveDataQuality || (options.Format != "" && !lossyImageFormats[options.Format])) {
+		defaults := options
+		defaults.Quality = 0
+		if ip.quality(&defaults, options.Format) == options.Quality {
+			options.Quality = 0
+		}
+	}
+
+	// Gaussian blurs replace the blur amount, and a radius only applies to
+	// them.
+	if options.GaussianSigma > 0 {
+		options.BlurRadius = 0
+	} else {
+		options.GaussianRadius = 0
+	}
+	if options.BlurRadius == 0 {
+		options.BlurMode = ""
+	} else if options.BlurMode == "" {
+		options.BlurMode = BLUR_MODE_RELATIVE
+	}
+	return &options
+}
+
+// The formats whose compression quality is lossy, in which requests for a
+// quality re-encode images that are otherwise unchanged.
+var lossyImageFormats = map[string]bool{"JPEG": true, "WEBP": true, "AVIF": true}
+
+// Works out how the image would be scaled and cropped from its dimensions,
+// which are read without decoding it.
+func (ip *imageProcessor) ExplainImage(image *Image, request *ImageProcessorOptions) (*ScalingExplanation, error) {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	if err := pingImageBlob(wand, image.Bytes); err != nil {
+		return nil, err
+	}
+
+	explanation := &ScalingExplanation{
+		SourceDimensions: ImageDimensions{uint64(wand.GetImageWidth()), uint64(wand.GetImageHeight())},
+		Fit:              ip.fit(request),
+		Format:           ip.outputFormat(request, wand.GetImageFormat()),
+		Quality:          ip.quality(request, ip.outputFormat(request, wand.GetImageFormat())),
+	}
+
+	sourceDimensions := explanation.SourceDimensions
+	if request.Crop != nil && request.CropOrder != CROP_ORDER_AFTER {
+		region, _ := clipRect(*request.Crop, sourceDimensions)
+		sourceDimensions = ImageDimensions{region.Width, region.Height}
+	}
+	explanation.ScaledDimensions = ip.getScaledDimensions(sourceDimensions, request)
+	explanation.CropDimensions = ip.getCropDimensions(request)
+	if explanation.CropDimensions.Width == 0 {
+		explanation.CropDimensions = explanation.ScaledDimensions
+	}
+	explanation.CropDimensions = ip.fitCropDimensions(explanation.CropDimensions, explanation.ScaledDimensions)
+	explanation.CropX = maxInt(int(explanation.ScaledDimensions.Width)-int(explanation.CropDimensions.Width), 0) / 2
+	explanation.CropY = maxInt(int(explanation.ScaledDimensions.Height)-int(explanation.CropDimensions.Height), 0) / 2
+	return explanation, nil
+}
+
+// Encodes an ICO icon of the image with a square image of each requested size.
+// The image is scaled to fit each square and centered on a transparent
+// background.
+func (ip *imageProcessor) encodeIcon(wand *imagick.MagickWand, request *ImageProcessorOptions) ([]byte, error) {
+	iconWand := imagick.NewMagickWand()
+	defer iconWand.Destroy()
+
+	transparent := imagick.NewPixelWand()
+	defer transparent.Destroy()
+	transparent.SetColor("none")
+
+	current := ImageDimensions{uint64(wand.GetImageWidth()), uint64(wand.GetImageHeight())}
+	for _, size := range request.IconSizes {
+		sizeWand := wand.Clone()
+		defer sizeWand.Destroy()
+
+		scaled := ip.scaleToRequestedDimensions(current, ImageDimensions{size, size}, &ImageProcessorOptions{Fit: IMAGE_FIT_CONTAIN})
+		if err := sizeWand.ResizeImage(uint(scaled.Width), uint(scaled.Height), ip.filter(request), 1); err != nil {
+			return nil, err
+		}
+		if err := sizeWand.SetImageBackgroundColor(transparent); err != nil {
+			return nil, err
+		}
+		x := -int(size-scaled.Width) / 2
+		y := -int(size-scaled.Height) / 2
+		if err := sizeWand.ExtentImage(uint(size), uint(size), x, y); err != nil {
+			return nil, err
+		}
+		if err := iconWand.AddImage(sizeWand); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := iconWand.SetImageFormat("ICO"); err != nil {
+		return nil, err
+	}
+	return iconWand.GetImagesBlob(), nil
+}
+
+// Image properties that ImageMagick sets when reading and writing images and
+// that vary between requests and hosts.
+var volatileImageProperties = []string{"date:create", "date:modify", "date:timestamp"}
+
+// Removes everything from the image that would make encoding it vary between
+// requests and hosts, so that identical inputs are encoded to identical bytes:
+// timestamps, the encoders' time chunks, and metadata unless it's kept.
+func (ip *imageProcessor) pinEncoding(wand *imagick.MagickWand, request *ImageProcessorOptions) error {
+	if request.Strip {
+		if err := wand.StripImage(); err != nil {
+			return err
+		}
+	}
+	for _, property := range volatileImageProperties {
+		wand.DeleteImageProperty(property)
+	}
+	return wand.SetOption("png:exclude-chunk", "date,time")
+}
+
+// Reads a sprite sheet of the image and the sheet's other tiles into the wand.
+// The sheet has as many columns as tiles unless fewer are requested.
+func (ip *imageProcessor) readSpriteSheet(wand *imagick.MagickWand, image *Image, request *ImageProcessorOptions) error {
+	sheet := request.SpriteSheet
+	tiles := append([]*Image{image}, sheet.Images...)
+	columns := uint64(len(tiles))
+	if sheet.Columns > 0 {
+		columns = minUint64(sheet.Columns, columns)
+	}
+	rows := (uint64(len(tiles)) + columns - 1) / columns
+
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	background.SetColor(sheet.Background)
+	cell := ip.spriteCellDimensions(sheet, columns, rows)
+	width := columns*cell.Width + (columns-1)*sheet.Spacing
+	height := rows*cell.Height + (rows-1)*sheet.Spacing
+	if err := wand.NewImage(uint(width), uint(height), background); err != nil {
+		ip.Logger.Warn("ImageMagick error creating sprite sheet: %s", err)
+		return err
+	}
+
+	for i, tile := range tiles {
+		column, row := uint64(i)%columns, uint64(i)/columns
+		x := column * (cell.Width + sheet.Spacing)
+		y := row * (cell.Height + sheet.Spacing)
+		if err := ip.compositeSpriteTile(wand, tile, i, cell, int(x), int(y)); err != nil {
+			return err
+		}
+	}
+
+	return wand.SetImageCompressionQuality(uint(ip.quality(request, wand.GetImageFormat())))
+}
+
+// Returns the cell size of a sprite sheet, reduced keeping its aspect ratio so
+// that the sheet fits within the processor's maximum dimensions and has at
+// most MAX_SPRITE_SHEET_PIXELS pixels.
+func (ip *imageProcessor) spriteCellDimensions(sheet *SpriteSheet, columns, rows uint64) ImageDimensions {
+	cell := sheet.Cell
+	scale := 1.0
+	limit := func(max, count, size uint64) {
+		if max == 0 {
+			return
+		}
+		if spacing := (count - 1) * sheet.Spacing; max > spacing {
+			scale = math.Min(scale, float64(max-spacing)/float64(count*size))
+		} else {
+			scale = 0
+		}
+	}
+	limit(ip.Config.MaxImageWidth, columns, cell.Width)
+	limit(ip.Config.MaxImageHeight, rows, cell.Height)
+	if pixels := float64(columns*cell.Width) * float64(rows*cell.Height); pixels > MAX_SPRITE_SHEET_PIXELS {
+		scale = math.Min(scale, math.Sqrt(MAX_SPRITE_SHEET_PIXELS/pixels))
+	}
+
+	if scale >= 1 {
+		return cell
+	}
+	return ImageDimensions{
+		uint64(math.Max(math.Floor(float64(cell.Width)*scale), 1)),
+		uint64(math.Max(math.Floor(float64(cell.Height)*scale), 1)),
+	}
+}
+
+// Scales a tile to cover its cell and composites it into the sprite sheet at
+// the cell's offset. The sheet takes the format of its first tile.
+func (ip *imageProcessor) compositeSpriteTile(wand *imagick.MagickWand, tile *Image, index int, cell ImageDimensions, x, y int) error {
+	tileWand := imagick.NewMagickWand()
+	defer tileWand.Destroy()
+	if err := ip.readImage(tileWand, tile); err != nil {
+		ip.Logger.Warn("ImageMagick error reading sprite tile %d: %s", index, err)
+		return err
+	}
+	if index == 0 {
+		if err := wand.SetImageFormat(tileWand.GetImageFormat()); err != nil {
+			ip.Logger.Warn("ImageMagick error setting sprite sheet format: %s", err)
+			return err
+		}
+	}
+	enlarge := true
+	if err, _ := ip.scaleWand(tileWand, &ImageProcessorOptions{Dimensions: cell, Fit: IMAGE_FIT_COVER, Enlarge: &enlarge}); err != nil {
+		return err
+	}
+
+	err := wand.CompositeImage(tileWand, imagick.COMPOSITE_OP_OVER, x, y)
+	if err != nil {
+		ip.Logger.Warn("ImageMagick error compositing sprite tile %d: %s", index, err)
+	}
+	return err
+}
+
+// An imageProcessorStep performs one operation on the image in a wand if the
+// request calls for it, and reports whether the image was modified.
+type imageProcessorStep struct {
+	description string
+	process     func(*imagick.MagickWand, *ImageProcessorOptions) (error, bool)
+}
+
+// Returns the steps of processing an image, in the order they are performed.
+func (ip *imageProcessor) steps() []imageProcessorStep {
+	return []imageProcessorStep{
+		{"normalizing", ip.exifRulesWand},
+		{"converting", ip.formatWand},
+		{"denoising", ip.denoiseWand},
+		{"cropping", ip.precropWand},
+		{"scaling", ip.scaleWand},
+		{"cropping", ip.postcropWand},
+		{"rotating", ip.rotateWand},
+		{"mirroring", ip.flipWand},
+		{"extracting", ip.extractWand},
+		{"enhancing", ip.enhanceWand},
+		{"leveling", ip.levelWand},
+		{"grading", ip.lutWand},
+		{"blurring", ip.blurWand},
+		{"grayscaling", ip.grayscaleWand},
+		{"posterizing", ip.posterizeWand},
+		{"vignetting", ip.vignetteWand},
+		{"compositing", ip.overlayWand},
+		{"annotating", ip.textWand},
+	}
+}
+
+// Applies the route's EXIF rules that match the decoded image, in order,
+// before it is otherwise processed.
+func (ip *imageProcessor) exifRulesWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	for _, rule := range request.ExifRules {
+		if !rule.matches(wand) {
+			continue
+		}
+		if err = rule.apply(wand); err != nil {
+			return err, true
+		}
+		modified = true
+	}
+	return nil, modified
+}
+
+func (ip *imageProcessor) formatWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	format := ip.outputFormat(request, wand.GetImageFormat())
+	if format == wand.GetImageFormat() {
+		return nil, false
+	}
+	if err = wand.SetImageFormat(format); err != nil {
+		ip.Logger.Warn("ImageMagick error setting image format: %s", err)
+	}
+	return err, true
+}
+
+// Despeckles the image the requested number of times. Denoising is done
+// before scaling since scaling blends the noise into the image.
+func (ip *imageProcessor) denoiseWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if request.Denoise == 0 {
+		return nil, false
+	}
+	for i := uint64(0); i < request.Denoise; i++ {
+		if err = wand.DespeckleImage(); err != nil {
+			ip.Logger.Warn("ImageMagick error despeckling image: %s", err)
+			break
+		}
+	}
+	return err, true
+}
+
+// Crops the requested region out of the original image, before it is scaled.
+func (ip *imageProcessor) precropWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if request.Crop == nil || request.CropOrder == CROP_ORDER_AFTER {
+		return nil, false
+	}
+	return ip.cropWand(wand, *request.Crop), true
+}
+
+// Crops the requested region out of the scaled image.
+func (ip *imageProcessor) postcropWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if request.Crop == nil || request.CropOrder != CROP_ORDER_AFTER {
+		return nil, false
+	}
+	return ip.cropWand(wand, *request.Crop), true
+}
+
+// Crops the image to the part of a region that lies within it.
+func (ip *imageProcessor) cropWand(wand *imagick.MagickWand, region ImageRect) error {
+	region, ok := clipRect(region, ImageDimensions{uint64(wand.GetImageWidth()), uint64(wand.GetImageHeight())})
+	if !ok {
+		return fmt.Errorf("Crop region %v is outside the image", region)
+	}
+	if err := wand.CropImage(uint(region.Width), uint(region.Height), int(region.X), int(region.Y)); err != nil {
+		ip.Logger.Warn("ImageMagick error cropping image: %s", err)
+		return err
+	}
+	if err := wand.SetImagePage(uint(region.Width), uint(region.Height), 0, 0); err != nil {
+		ip.Logger.Warn("ImageMagick error resetting image page: %s", err)
+		return err
+	}
+	return nil
+}
+
+func (ip *imageProcessor) scaleWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	currentDimensions := ImageDimensions{uint64(wand.GetImageWidth()), uint64(wand.GetImageHeight())}
+	newDimensions := ip.getScaledDimensions(currentDimensions, request)
+	cropDimensions := ip.getCropDimensions(request)
+	if cropDimensions.Width == 0 {
+		cropDimensions = newDimensions
+	}
+	cropDimensions = ip.fitCropDimensions(cropDimensions, newDimensions)
+
+	if request.Slice != nil {
+		if err = ip.sliceWand(wand, request); err != nil {
+			return err, true
+		}
+		return ip.finishScaling(wand, request)
+	}
+
+	if ip.fit(request) == IMAGE_FIT_LIQUID && ip.canLiquidRescale(newDimensions, cropDimensions) {
+		if newDimensions != currentDimensions {
+			if err = ip.resizeWand(wand, newDimensions, request); err != nil {
+				ip.Logger.Warn("ImageMagick error resizing image: %s", err)
+				return err, true
+			}
+		}
+		if err = wand.LiquidRescaleImage(uint(cropDimensions.Width), uint(cropDimensions.Height), 1, 0); err != nil {
+			ip.Logger.Warn("ImageMagick error liquid rescaling image: %s", err)
+			return err, true
+		}
+		return ip.finishScaling(wand, request)
+	}
+
+	if newDimensions == currentDimensions && cropDimensions == newDimensions {
+		return nil, false
+	}
+
+	if newDimensions != currentDimensions {
+		if err = ip.resizeWand(wand, newDimensions, request); err != nil {
+			ip.Logger.Warn("ImageMagick error resizing image: %s", err)
+			return err, true
+		}
+	}
+
+	if cropDimensions != newDimensions {
+		x := maxInt(int(newDimensions.Width)-int(cropDimensions.Width), 0) / 2
+		y := maxInt(int(newDimensions.Height)-int(cropDimensions.Height), 0) / 2
+		if err = wand.CropImage(uint(cropDimensions.Width), uint(cropDimensions.Height), x, y); err != nil {
+			ip.Logger.Warn("ImageMagick error cropping image: %s", err)
+			return err, true
+		}
+
+		if err = wand.SetImagePage(uint(cropDimensions.Width), uint(cropDimensions.Height), 0, 0); err != nil {
+			ip.Logger.Warn("ImageMagick error resetting image page: %s", err)
+			return err, true
+		}
+	}
+
+	return ip.finishScaling(wand, request)
 }
 
-type imageProcessor struct {
-	Config *ProcessorConfig
-	Logger *Logger
+// Resizes the image with the requested filter. If the processor resizes in
+// linear light, sRGB images are converted to linear RGB for the resize and
+// back afterwards, so that light and dark pixels blend correctly instead of
+// fine bright details darkening.
+func (ip *imageProcessor) resizeWand(wand *imagick.MagickWand, dimensions ImageDimensions, request *ImageProcessorOptions) error {
+	linear := ip.Config.LinearResize && wand.GetImageColorspace() == imagick.COLORSPACE_SRGB
+	if linear {
+		if err := wand.TransformImageColorspace(imagick.COLORSPACE_RGB); err != nil {
+			return err
+		}
+	}
+	if err := wand.ResizeImage(uint(dimensions.Width), uint(dimensions.Height), ip.filter(request), 1); err != nil {
+		return err
+	}
+	if linear {
+		return wand.TransformImageColorspace(imagick.COLORSPACE_SRGB)
+	}
+	return nil
 }
 
-// Creates a new ImageProcessor instance using configuration settings.
-func NewImageProcessorWithConfig(config *ProcessorConfig) ImageProcessor {
-	return &imageProcessor{
-		Config: config,
-		Logger: NewLogger("image_processor.%s", config.Name),
+// Sets how the image is compressed for its output format: JPEGs are
+// progressive with the requested quality, PNGs have the processor's zlib
+// compression level, WebPs are lossless or have the requested quality, and
+// AVIFs have the requested quality and the processor's encoder speed.
+func (ip *imageProcessor) setCompression(wand *imagick.MagickWand, request *ImageProcessorOptions) error {
+	format := wand.GetImageFormat()
+	switch format {
+	case "JPEG":
+		if err := wand.SetImageInterlaceScheme(imagick.INTERLACE_PLANE); err != nil {
+			return err
+		}
+		if err := wand.SetImageCompression(imagick.COMPRESSION_JPEG); err != nil {
+			return err
+		}
+	case "PNG":
+		if ip.Config.PNGCompressionLevel > 0 {
+			return wand.SetOption("png:compression-level", fmt.Sprint(ip.Config.PNGCompressionLevel))
+		}
+		return nil
+	case "WEBP":
+		if ip.Config.WebPLossless {
+			return wand.SetOption("webp:lossless", "true")
+		}
+	case "AVIF":
+		if ip.Config.AVIFSpeed > 0 {
+			if err := wand.SetOption("heic:speed", fmt.Sprint(ip.Config.AVIFSpeed)); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
 	}
+	return wand.SetImageCompressionQuality(uint(ip.quality(request, format)))
 }
 
-// The public method for processing an image. The method receives an original
-// image and options and returns the processed image.
-func (ip *imageProcessor) ProcessImage(image *Image, request *ImageProcessorOptions) *Image {
-	processedImage := Image{}
-	wand := imagick.NewMagickWand()
-	defer wand.Destroy()
+// Prepares a scaled image for encoding.
+func (ip *imageProcessor) finishScaling(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if err = wand.SetImageInterpolateMethod(imagick.INTERPOLATE_PIXEL_BICUBIC); err != nil {
+		ip.Logger.Warn("ImageMagick error setting interpoliation method: %s", err)
+		return err, true
+	}
 
-	wand.ReadImageBlob(image.Bytes)
-	err, scaleModified := ip.scaleWand(wand, request)
-	if err != nil {
-		ip.Logger.Warn("Error scaling image: %s", err)
-		return nil
+	if request.Strip {
+		if err = wand.StripImage(); err != nil {
+			ip.Logger.Warn("ImageMagick error stripping image routes and metadata")
+			return err, true
+		}
 	}
 
-	err, blurModified := ip.blurWand(wand, request)
-	if err != nil {
-		ip.Logger.Warn("Error blurring image: %s", err)
-		return nil
+	return nil, true
+}
+
+// Rotates the image clockwise by the requested degrees. The corners of the
+// canvas exposed by rotations that aren't multiples of 90 degrees are filled
+// with the processor's rotation background.
+func (ip *imageProcessor) rotateWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if math.Mod(request.Rotate, 360) == 0 {
+		return nil, false
 	}
 
-	err, grayscaleModified := ip.grayscaleWand(wand, request)
-	if err != nil {
-		ip.Logger.Warn("Error grayscaling image: %s", err)
-		return nil
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	background.SetColor(ip.Config.RotationBackground)
+	if err = wand.RotateImage(background, request.Rotate); err != nil {
+		ip.Logger.Warn("ImageMagick error rotating image: %s", err)
+		return err, true
+	}
+	// Rotating leaves a virtual canvas offset that is kept by some formats.
+	if err = wand.SetImagePage(wand.GetImageWidth(), wand.GetImageHeight(), 0, 0); err != nil {
+		ip.Logger.Warn("ImageMagick error resetting image page: %s", err)
 	}
+	return err, true
+}
 
-	if !scaleModified && !blurModified && !grayscaleModified {
-		processedImage.Bytes = image.Bytes
-	} else {
-		processedImage.Bytes = wand.GetImageBlob()
+// Mirrors the image horizontally (ImageMagick's flop), vertically
+// (ImageMagick's flip), or both.
+func (ip *imageProcessor) flipWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if request.Flip == "" {
+		return nil, false
 	}
+	if strings.Contains(request.Flip, "h") {
+		if err = wand.FlopImage(); err != nil {
+			ip.Logger.Warn("ImageMagick error mirroring image horizontally: %s", err)
+			return err, true
+		}
+	}
+	if strings.Contains(request.Flip, "v") {
+		if err = wand.FlipImage(); err != nil {
+			ip.Logger.Warn("ImageMagick error mirroring image vertically: %s", err)
+		}
+	}
+	return err, true
+}
 
-	processedImage.MimeType = fmt.Sprintf("image/%s", strings.ToLower(wand.GetImageFormat()))
+// Extracts the requested region of the image as it is displayed, after it has
+// been scaled, rotated and mirrored, so that the region can be given in the
+// coordinates of the rendered image, e.g. a tile of a map.
+func (ip *imageProcessor) extractWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if request.Extract == nil {
+		return nil, false
+	}
+	return ip.cropWand(wand, *request.Extract), true
+}
 
-	return &processedImage
+// Stretches the image's levels to the full range and corrects its gamma
+// automatically, then mildly boosts its saturation to make up for the washed
+// out colors of poorly exposed photos.
+func (ip *imageProcessor) enhanceWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if !request.Enhance {
+		return nil, false
+	}
+	if err = wand.AutoLevelImage(); err != nil {
+		ip.Logger.Warn("ImageMagick error auto-leveling image: %s", err)
+		return err, true
+	}
+	if err = wand.AutoGammaImage(); err != nil {
+		ip.Logger.Warn("ImageMagick error auto-correcting image gamma: %s", err)
+		return err, true
+	}
+	if err = wand.ModulateImage(100, ENHANCE_SATURATION, 100); err != nil {
+		ip.Logger.Warn("ImageMagick error saturating image: %s", err)
+	}
+	return err, true
 }
 
-func (ip *imageProcessor) scaleWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
-	currentDimensions := ImageDimensions{uint64(wand.GetImageWidth()), uint64(wand.GetImageHeight())}
-	newDimensions := ip.getScaledDimensions(currentDimensions, request)
+func (ip *imageProcessor) levelWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if request.Gamma == 0 && request.BlackPoint == 0 && request.WhitePoint == 0 {
+		return nil, false
+	}
+
+	gamma, whitePoint := request.Gamma, request.WhitePoint
+	if gamma == 0 {
+		gamma = 1
+	}
+	if whitePoint == 0 {
+		whitePoint = 100
+	}
 
-	if newDimensions == currentDimensions {
+	// The black and white points are requested as percentages of the quantum
+	// range.
+	_, quantumRange := imagick.GetQuantumRange()
+	if err = wand.LevelImage(request.BlackPoint/100*float64(quantumRange), gamma, whitePoint/100*float64(quantumRange)); err != nil {
+		ip.Logger.Warn("ImageMagick error leveling image: %s", err)
+	}
+	return err, true
+}
+
+// Maps the image's colors through the requested color lookup table.
+func (ip *imageProcessor) lutWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if request.LUT == nil {
 		return nil, false
 	}
 
-	if err = wand.ResizeImage(uint(newDimensions.Width), uint(newDimensions.Height), imagick.FILTER_LANCZOS, 1); err != nil {
-		ip.Logger.Warn("ImageMagick error resizing image: %s", err)
-		return err, true
+	if request.LUT.wand == nil {
+		return fmt.Errorf("Color lookup table %s is not decoded", request.LUT.Name), true
+	}
+	if err = wand.HaldClutImage(request.LUT.wand); err != nil {
+		ip.Logger.Warn("ImageMagick error applying color lookup table %s: %s", request.LUT.Name, err)
 	}
+	return err, true
+}
 
-	if err = wand.SetImageInterpolateMethod(imagick.INTERPOLATE_PIXEL_BICUBIC); err != nil {
-		ip.Logger.Warn("ImageMagick error setting interpoliation method: %s", err)
-		return err, true
+// Blurs the image by the requested amount, or with the requested Gaussian
+// radius and sigma. Sigma blurs let ImageMagick choose the radius unless one
+// is requested. Blurs with a sigma of at least the processor's fast blur sigma
+// are approximated.
+func (ip *imageProcessor) blurWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	var blurRadius, blurSigma float64
+	if request.GaussianSigma > 0 {
+		blurRadius, blurSigma = request.GaussianRadius, request.GaussianSigma
+	} else if request.BlurRadius != 0 {
+		blurRadius = float64(wand.GetImageWidth()) * request.BlurRadius * ip.Config.MaxBlurRadiusPercentage
+		blurSigma = blurRadius
+		if request.BlurMode == BLUR_MODE_SIGMA {
+			blurRadius, blurSigma = 0, request.BlurRadius
+		}
+	} else {
+		return nil, false
 	}
 
-	if err = wand.StripImage(); err != nil {
-		ip.Logger.Warn("ImageMagick error stripping image routes and metadata")
-		return err, true
+	if ip.Config.FastBlurSigma > 0 && blurSigma >= ip.Config.FastBlurSigma {
+		err = ip.fastBlur(wand, blurSigma)
+	} else {
+		err = wand.GaussianBlurImage(blurRadius, blurSigma)
 	}
+	if err != nil {
+		ip.Logger.Warn("ImageMagick error setting blur radius: %s", err)
+	}
+	return err, true
+}
+
+// Approximates a large Gaussian blur quickly: the image is reduced with a box
+// filter, which averages blocks of pixels, by the factor that takes the sigma
+// down to a small one, blurred with the small sigma, and enlarged back to its
+// dimensions. The cost of the blur no longer grows with the sigma.
+func (ip *imageProcessor) fastBlur(wand *imagick.MagickWand, sigma float64) error {
+	width, height := wand.GetImageWidth(), wand.GetImageHeight()
+	factor := sigma / FAST_BLUR_REDUCED_SIGMA
+	reducedWidth := uint(math.Max(math.Floor(float64(width)/factor+0.5), 1))
+	reducedHeight := uint(math.Max(math.Floor(float64(height)/factor+0.5), 1))
+
+	if err := wand.ResizeImage(reducedWidth, reducedHeight, imagick.FILTER_BOX, 1); err != nil {
+		return err
+	}
+	if err := wand.GaussianBlurImage(0, FAST_BLUR_REDUCED_SIGMA); err != nil {
+		return err
+	}
+	return wand.ResizeImage(width, height, imagick.FILTER_TRIANGLE, 1)
+}
 
-	if "JPEG" == wand.GetImageFormat() {
-		if err = wand.SetImageInterlaceScheme(imagick.INTERLACE_PLANE); err != nil {
-			ip.Logger.Warn("ImageMagick error setting the image interlace scheme")
+func (ip *imageProcessor) grayscaleWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if !ip.Config.GrayscaleDisabled && ip.grayscale(request) {
+		colorspace := request.GrayscaleColorspace
+		if colorspace == "" {
+			colorspace = ip.Config.GrayscaleColorspace
+		}
+		if err = wand.TransformImageColorspace(grayscaleColorspaces[colorspace]); err != nil {
+			ip.Logger.Warn("ImageMagick error grayscaling image: %s", err)
 			return err, true
 		}
 
-		if err = wand.SetImageCompression(imagick.COMPRESSION_JPEG); err != nil {
-			ip.Logger.Warn("ImageMagick error setting the image compression type")
-			return err, true
+		dither := request.Dither
+		if dither == "" {
+			dither = ip.Config.GrayscaleDither
 		}
+		if dither != "" {
+			if err = wand.OrderedPosterizeImage(dither); err != nil {
+				ip.Logger.Warn("ImageMagick error dithering image: %s", err)
+			}
+		}
+		return err, true
+	}
+	return nil, false
+}
+
+// Reduces the image to the requested number of color levels per channel.
+func (ip *imageProcessor) posterizeWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if request.Posterize == 0 {
+		return nil, false
+	}
+	if err = wand.PosterizeImage(uint(request.Posterize), false); err != nil {
+		ip.Logger.Warn("ImageMagick error posterizing image: %s", err)
+	}
+	return err, true
+}
+
+// Darkens the edges of the image with a vignette. The radius is a fraction of
+// the image's shorter side and the opacity is that of the black fading in at
+// the edges.
+func (ip *imageProcessor) vignetteWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if request.VignetteRadius == 0 {
+		return nil, false
+	}
+
+	opacity := request.VignetteOpacity
+	if opacity == 0 {
+		opacity = 1
+	}
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	background.SetColor(fmt.Sprintf("rgba(0,0,0,%g)", opacity))
+	if err = wand.SetImageBackgroundColor(background); err != nil {
+		ip.Logger.Warn("ImageMagick error setting vignette color: %s", err)
+		return err, true
+	}
+
+	shorterSide := math.Min(float64(wand.GetImageWidth()), float64(wand.GetImageHeight()))
+	if err = wand.VignetteImage(0, request.VignetteRadius*shorterSide/2, 0, 0); err != nil {
+		ip.Logger.Warn("ImageMagick error vignetting image: %s", err)
+	}
+	return err, true
+}
 
-		if err = wand.SetImageCompressionQuality(uint(ip.Config.ImageCompressionQuality)); err != nil {
-			ip.Logger.Warn("sImageMagick error setting compression quality: %s", err)
+// Composites the request's overlays over the image at their own size, in
+// order.
+func (ip *imageProcessor) overlayWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	for _, overlay := range request.Overlays {
+		if overlay.Image == nil {
+			return fmt.Errorf("Overlay %s was not fetched", overlay.Path), true
+		}
+		if err = ip.compositeOverlay(wand, overlay); err != nil {
 			return err, true
 		}
+		modified = true
 	}
-
-	return nil, true
+	return nil, modified
 }
 
-func (ip *imageProcessor) blurWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
-	if request.BlurRadius != 0 {
-		blurRadius := float64(wand.GetImageWidth()) * request.BlurRadius * ip.Config.MaxBlurRadiusPercentage
-		if err = wand.GaussianBlurImage(blurRadius, blurRadius); err != nil {
-			ip.Logger.Warn("ImageMagick error setting blur radius: %s", err)
+func (ip *imageProcessor) compositeOverlay(wand *imagick.MagickWand, overlay *ImageOverlay) error {
+	overlayWand := imagick.NewMagickWand()
+	defer overlayWand.Destroy()
+	if err := ip.readImage(overlayWand, overlay.Image); err != nil {
+		ip.Logger.Warn("ImageMagick error reading overlay %s: %s", overlay.Path, err)
+		return err
+	}
+
+	if overlay.Opacity < 1 {
+		if err := overlayWand.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_SET); err != nil {
+			ip.Logger.Warn("ImageMagick error adding alpha channel to overlay %s: %s", overlay.Path, err)
+			return err
 		}
+		if err := overlayWand.EvaluateImageChannel(imagick.CHANNEL_ALPHA, imagick.EVAL_OP_MULTIPLY, overlay.Opacity); err != nil {
+			ip.Logger.Warn("ImageMagick error setting opacity of overlay %s: %s", overlay.Path, err)
+			return err
+		}
+	}
+
+	x, y := gravityOffset(overlay.Gravity,
+		int(wand.GetImageWidth()), int(wand.GetImageHeight()),
+		int(overlayWand.GetImageWidth()), int(overlayWand.GetImageHeight()), overlay.X, overlay.Y)
+	err := wand.CompositeImage(overlayWand, blendModes[overlay.Blend], x, y)
+	if err != nil {
+		ip.Logger.Warn("ImageMagick error compositing overlay %s: %s", overlay.Path, err)
+	}
+	return err
+}
+
+// Renders the requested text over the image with one of the processor's
+// fonts, optionally on a background box.
+func (ip *imageProcessor) textWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
+	if request.Text == "" {
+		return nil, false
+	}
+	font, ok := ip.Config.Fonts[request.Font]
+	if !ok {
+		return fmt.Errorf("Font %s is not configured", request.Font), true
+	}
+
+	draw := imagick.NewDrawingWand()
+	defer draw.Destroy()
+	if err = draw.SetFont(font); err != nil {
+		ip.Logger.Warn("ImageMagick error setting font %s: %s", font, err)
 		return err, true
 	}
-	return nil, false
+
+	size, color, gravity := request.TextSize, request.TextColor, request.TextGravity
+	if size == 0 {
+		size = DEFAULT_TEXT_SIZE
+	}
+	if color == "" {
+		color = DEFAULT_TEXT_COLOR
+	}
+	if gravity == "" {
+		gravity = DEFAULT_TEXT_GRAVITY
+	}
+	draw.SetFontSize(float64(size))
+	draw.SetGravity(textGravities[gravity])
+
+	fill := imagick.NewPixelWand()
+	defer fill.Destroy()
+	fill.SetColor(color)
+	draw.SetFillColor(fill)
+
+	if request.TextBackground != "" {
+		background := imagick.NewPixelWand()
+		defer background.Destroy()
+		background.SetColor(request.TextBackground)
+		draw.SetTextUnderColor(background)
+	}
+
+	if err = wand.AnnotateImage(draw, TEXT_MARGIN, TEXT_MARGIN, 0, request.Text); err != nil {
+		ip.Logger.Warn("ImageMagick error rendering text: %s", err)
+	}
+	return err, true
 }
 
-func (ip *imageProcessor) grayscaleWand(wand *imagick.MagickWand, request *ImageProcessorOptions) (err error, modified bool) {
-	if !ip.Config.GrayscaleDisabled && (ip.Config.GrayscaleByDefault || request.GrayScale) {
-		if err = wand.TransformImageColorspace(imagick.COLORSPACE_GRAY); err != nil {
-			ip.Logger.Warn("ImageMagick error grayscaling image: %s", err)
+// Scales the image to the requested dimensions as a nine-patch: the corners
+// within the slice insets keep their size, the edges between them are
+// stretched along the edge, and the center is stretched in both directions.
+func (ip *imageProcessor) sliceWand(wand *imagick.MagickWand, request *ImageProcessorOptions) error {
+	insets := request.Slice
+	source := ImageDimensions{uint64(wand.GetImageWidth()), uint64(wand.GetImageHeight())}
+	target := ip.clampDimensionsToMaxima(ip.requestedDimensions(request), request)
+	if insets.Left+insets.Right >= minUint64(source.Width, target.Width) ||
+		insets.Top+insets.Bottom >= minUint64(source.Height, target.Height) {
+		return fmt.Errorf("Slice insets %v do not fit within %v scaled to %v", *insets, source, target)
+	}
+
+	// The columns and rows of the patches in the source and the target.
+	sourceColumns := []uint64{insets.Left, source.Width - insets.Left - insets.Right, insets.Right}
+	sourceRows := []uint64{insets.Top, source.Height - insets.Top - insets.Bottom, insets.Bottom}
+	targetColumns := []uint64{insets.Left, target.Width - insets.Left - insets.Right, insets.Right}
+	targetRows := []uint64{insets.Top, target.Height - insets.Top - insets.Bottom, insets.Bottom}
+
+	original := wand.Clone()
+	defer original.Destroy()
+	if err := ip.resizeWand(wand, target, request); err != nil {
+		ip.Logger.Warn("ImageMagick error resizing image: %s", err)
+		return err
+	}
+
+	var sourceY, targetY uint64
+	for row := range sourceRows {
+		var sourceX, targetX uint64
+		for column := range sourceColumns {
+			patch := ImageRect{sourceX, sourceY, sourceColumns[column], sourceRows[row]}
+			scaled := ImageDimensions{targetColumns[column], targetRows[row]}
+			if err := ip.compositePatch(wand, original, patch, scaled, targetX, targetY, request); err != nil {
+				return err
+			}
+			sourceX += sourceColumns[column]
+			targetX += targetColumns[column]
 		}
-		return err, true
+		sourceY += sourceRows[row]
+		targetY += targetRows[row]
 	}
-	return nil, false
+	return wand.SetImagePage(uint(target.Width), uint(target.Height), 0, 0)
+}
+
+// An ImageRect is a rectangle within an image, in pixels.
+type ImageRect struct {
+	X, Y, Width, Height uint64
+}
+
+// Returns the part of a rectangle that lies within an image of the given
+// dimensions, and false if none of it does.
+func clipRect(rect ImageRect, dimensions ImageDimensions) (ImageRect, bool) {
+	if rect.X >= dimensions.Width || rect.Y >= dimensions.Height {
+		return rect, false
+	}
+	rect.Width = minUint64(rect.Width, dimensions.Width-rect.X)
+	rect.Height = minUint64(rect.Height, dimensions.Height-rect.Y)
+	return rect, rect.Width > 0 && rect.Height > 0
+}
+
+// Crops a patch out of the original image, scales it as the whole image is
+// scaled, and copies it into the wand at the given offset.
+func (ip *imageProcessor) compositePatch(wand, original *imagick.MagickWand, patch ImageRect, scaled ImageDimensions, x, y uint64, request *ImageProcessorOptions) error {
+	if patch.Width == 0 || patch.Height == 0 {
+		return nil
+	}
+
+	patchWand := original.Clone()
+	defer patchWand.Destroy()
+	if err := patchWand.CropImage(uint(patch.Width), uint(patch.Height), int(patch.X), int(patch.Y)); err != nil {
+		ip.Logger.Warn("ImageMagick error cropping patch: %s", err)
+		return err
+	}
+	if err := patchWand.SetImagePage(uint(patch.Width), uint(patch.Height), 0, 0); err != nil {
+		ip.Logger.Warn("ImageMagick error resetting patch page: %s", err)
+		return err
+	}
+	if scaled.Width != patch.Width || scaled.Height != patch.Height {
+		if err := ip.resizeWand(patchWand, scaled, request); err != nil {
+			ip.Logger.Warn("ImageMagick error resizing patch: %s", err)
+			return err
+		}
+	}
+
+	err := wand.CompositeImage(patchWand, imagick.COMPOSITE_OP_COPY, int(x), int(y))
+	if err != nil {
+		ip.Logger.Warn("ImageMagick error compositing patch: %s", err)
+	}
+	return err
+}
+
+// Returns true if the request sets the quality of an image in a lossy format,
+// which must then be re-encoded even if it's otherwise unchanged.
+func (ip *imageProcessor) requestsQuality(wand *imagick.MagickWand, request *ImageProcessorOptions) bool {
+	if lossyImageFormats[wand.GetImageFormat()] {
+		return request.Quality > 0 || (request.SaveData && ip.Config.SaveDataQuality > 0)
+	}
+	return false
+}
+
+// Returns the requested compression quality for an output format, or the
+// configured one if the request doesn't specify it.
+func (ip *imageProcessor) quality(request *ImageProcessorOptions, format string) uint64 {
+	if request.Quality > 0 {
+		return request.Quality
+	}
+	if request.SaveData && ip.Config.SaveDataQuality > 0 {
+		return ip.Config.SaveDataQuality
+	}
+	if format == "WEBP" && ip.Config.WebPQuality > 0 {
+		return ip.Config.WebPQuality
+	}
+	if format == "AVIF" && ip.Config.AVIFQuality > 0 {
+		return ip.Config.AVIFQuality
+	}
+	return ip.Config.ImageCompressionQuality
+}
+
+// Returns the requested output format, or the Save-Data format for Save-Data
+// requests that don't specify one.
+func (ip *imageProcessor) format(request *ImageProcessorOptions) string {
+	if request.Format == "" && request.SaveData {
+		return ip.Config.SaveDataFormat
+	}
+	return request.Format
+}
+
+// Returns the format an image of the source format is encoded to: the
+// requested format, or else the source format unless it's a legacy format
+// that browsers can't display, or an SVG that the processor rasterizes.
+func (ip *imageProcessor) outputFormat(request *ImageProcessorOptions, sourceFormat string) string {
+	if format := ip.format(request); format != "" {
+		return format
+	}
+	if legacyImageFormats[sourceFormat] {
+		return ip.Config.LegacyOutputFormat
+	}
+	if ip.Config.RasterizeSVG && sourceFormat == "SVG" {
+		return "PNG"
+	}
+	return sourceFormat
+}
+
+// Returns the maximum image width, which is reduced for Save-Data requests.
+func (ip *imageProcessor) maxImageWidth(request *ImageProcessorOptions) uint64 {
+	maxWidth := ip.Config.MaxImageWidth
+	if request.SaveData && ip.Config.SaveDataMaxImageWidth > 0 &&
+		(maxWidth == 0 || ip.Config.SaveDataMaxImageWidth < maxWidth) {
+		maxWidth = ip.Config.SaveDataMaxImageWidth
+	}
+	return maxWidth
+}
+
+// Returns the requested resize filter, or the processor's.
+func (ip *imageProcessor) filter(request *ImageProcessorOptions) imagick.FilterType {
+	if filter, ok := resizeFilters[request.Filter]; ok {
+		return filter
+	}
+	return resizeFilters[ip.Config.ResizeFilter]
+}
+
+// Returns the requested fit, or the fit corresponding to the
+// maintain_aspect_ratio setting if the request doesn't specify it.
+func (ip *imageProcessor) fit(request *ImageProcessorOptions) ImageFit {
+	if request.Fit != "" {
+		return request.Fit
+	}
+	if ip.Config.MaintainAspectRatio {
+		return IMAGE_FIT_CONTAIN
+	}
+	return IMAGE_FIT_FILL
+}
+
+// Returns the requested dimensions, or the default dimensions if the request
+// doesn't specify any and isn't served at the original or zoomed dimensions.
+func (ip *imageProcessor) requestedDimensions(request *ImageProcessorOptions) ImageDimensions {
+	if request.Dimensions.Width == 0 && request.Dimensions.Height == 0 && !request.OriginalDimensions && request.Zoom == 0 {
+		return ImageDimensions{Width: ip.Config.DefaultImageWidth, Height: ip.Config.DefaultImageHeight}
+	}
+	return request.Dimensions
+}
+
+// Returns true if the image is to be grayscaled, as set by the request or else
+// the processor's grayscale_by_default setting.
+func (ip *imageProcessor) grayscale(request *ImageProcessorOptions) bool {
+	if request.GrayScale != nil {
+		return *request.GrayScale
+	}
+	return ip.Config.GrayscaleByDefault
+}
+
+// Returns true if images smaller than the requested dimensions may be scaled
+// up to them, as set by the request or else the processor.
+func (ip *imageProcessor) enlarge(request *ImageProcessorOptions) bool {
+	if request.Enlarge != nil {
+		return *request.Enlarge
+	}
+	return ip.Config.Enlarge
 }
 
 func (ip *imageProcessor) getScaledDimensions(currentDimensions ImageDimensions, request *ImageProcessorOptions) ImageDimensions {
-	requestDimensions := request.Dimensions
-	if requestDimensions.Width == 0 && requestDimensions.Height == 0 {
-		requestDimensions = ImageDimensions{Width: ip.Config.DefaultImageWidth, Height: ip.Config.DefaultImageHeight}
+	if request.Zoom > 0 {
+		return ip.zoomedDimensions(currentDimensions, request)
+	}
+
+	var dimensions ImageDimensions
+	if cropDimensions := ip.getCropDimensions(request); cropDimensions.Width > 0 {
+		dimensions = ip.scaleToCoverDimensions(currentDimensions, cropDimensions)
+	} else {
+		dimensions = ip.scaleToRequestedDimensions(currentDimensions, ip.requestedDimensions(request), request)
+		dimensions = ip.clampDimensionsToMaxima(dimensions, request)
+	}
+
+	if !ip.enlarge(request) && (dimensions.Width > currentDimensions.Width || dimensions.Height > currentDimensions.Height) {
+		return currentDimensions
 	}
+	return dimensions
+}
 
-	dimensions := ip.scaleToRequestedDimensions(currentDimensions, requestDimensions, request)
+// Returns the image's dimensions multiplied by the requested zoom factor and
+// clamped to the maxima. Zoomed images are enlarged regardless of the enlarge
+// setting, since the factor is relative to the image rather than a size that
+// it may be smaller than.
+func (ip *imageProcessor) zoomedDimensions(currentDimensions ImageDimensions, request *ImageProcessorOptions) ImageDimensions {
+	dimensions := ImageDimensions{
+		uint64(math.Max(math.Floor(float64(currentDimensions.Width)*request.Zoom+0.5), 1)),
+		uint64(math.Max(math.Floor(float64(currentDimensions.Height)*request.Zoom+0.5), 1)),
+	}
 	return ip.clampDimensionsToMaxima(dimensions, request)
 }
 
+// Returns true if an image scaled to cover the crop dimensions can be liquid
+// rescaled to them within the processor's limits. Otherwise it is cropped.
+func (ip *imageProcessor) canLiquidRescale(scaledDimensions, cropDimensions ImageDimensions) bool {
+	if cropDimensions == scaledDimensions || cropDimensions.Width == 0 || cropDimensions.Height == 0 {
+		return false
+	}
+	if cropDimensions.Width*cropDimensions.Height > ip.Config.MaxLiquidRescalePixels {
+		return false
+	}
+	ratio := math.Max(float64(scaledDimensions.Width)/float64(cropDimensions.Width),
+		float64(scaledDimensions.Height)/float64(cropDimensions.Height))
+	return ratio <= ip.Config.MaxLiquidRescaleRatio
+}
+
+// Returns the crop dimensions reduced, keeping their aspect ratio, to fit within
+// the scaled dimensions, which are smaller than them when the image isn't
+// enlarged to cover the requested dimensions.
+func (ip *imageProcessor) fitCropDimensions(cropDimensions, scaledDimensions ImageDimensions) ImageDimensions {
+	if cropDimensions.Width <= scaledDimensions.Width && cropDimensions.Height <= scaledDimensions.Height {
+		return cropDimensions
+	}
+	aspectRatio := cropDimensions.AspectRatio()
+	if scaledDimensions.AspectRatio() > aspectRatio {
+		return ImageDimensions{ip.getAspectScaledWidth(aspectRatio, scaledDimensions.Height), scaledDimensions.Height}
+	}
+	return ImageDimensions{scaledDimensions.Width, ip.getAspectScaledHeight(aspectRatio, scaledDimensions.Width)}
+}
+
+// Returns the dimensions the scaled image is cropped to when it covers the
+// requested dimensions, or zero dimensions if the image isn't cropped.
+func (ip *imageProcessor) getCropDimensions(request *ImageProcessorOptions) ImageDimensions {
+	requestedDimensions := ip.requestedDimensions(request)
+	if fit := ip.fit(request); (fit != IMAGE_FIT_COVER && fit != IMAGE_FIT_LIQUID) ||
+		requestedDimensions.Width == 0 || requestedDimensions.Height == 0 {
+		return ImageDimensions{}
+	}
+	return ip.clampDimensionsToMaxima(requestedDimensions, request)
+}
+
+// Returns the smallest dimensions with the image's aspect ratio that cover the
+// requested dimensions.
+func (ip *imageProcessor) scaleToCoverDimensions(currentDimensions, requestedDimensions ImageDimensions) ImageDimensions {
+	imageAspectRatio := currentDimensions.AspectRatio()
+	if requestedDimensions.AspectRatio() > imageAspectRatio {
+		return ImageDimensions{requestedDimensions.Width, ip.getAspectScaledHeight(imageAspectRatio, requestedDimensions.Width)}
+	}
+	return ImageDimensions{ip.getAspectScaledWidth(imageAspectRatio, requestedDimensions.Height), requestedDimensions.Height}
+}
+
+// Returns the size hint for the JPEG decoder, which lets it decode a large
+// image at a fraction of its full resolution. The decoder keeps both dimensions
+// at or above the hint, so the hint is twice the requested dimensions to leave
+// the resize enough data to work with, and a missing dimension is hinted with
+// the one that was requested. Images cropped before scaling, and sliced images,
+// are decoded at full resolution, since the crop region and the slice insets
+// are in their original pixels.
+func (ip *imageProcessor) decodeSizeHint(request *ImageProcessorOptions) ImageDimensions {
+	if (request.Crop != nil && request.CropOrder != CROP_ORDER_AFTER) || request.Slice != nil {
+		return ImageDimensions{}
+	}
+	dimensions := ip.requestedDimensions(request)
+	if dimensions.Width == 0 {
+		dimensions.Width = dimensions.Height
+	}
+	if dimensions.Height == 0 {
+		dimensions.Height = dimensions.Width
+	}
+	return ImageDimensions{dimensions.Width * 2, dimensions.Height * 2}
+}
+
 func (ip *imageProcessor) scaleToRequestedDimensions(currentDimensions, requestedDimensions ImageDimensions, request *ImageProcessorOptions) ImageDimensions {
 	imageAspectRatio := currentDimensions.AspectRatio()
 	if requestedDimensions.Width > 0 && requestedDimensions.Height > 0 {
 		requestedAspectRatio := requestedDimensions.AspectRatio()
-		ip.Logger.Info("Requested image ratio %f, image ratio %f, %v", requestedAspectRatio, imageAspectRatio, ip.Config.MaintainAspectRatio)
+		ip.Logger.Info("Requested image ratio %f, image ratio %f, %v", requestedAspectRatio, imageAspectRatio, ip.fit(request))
 
-		if !ip.Config.MaintainAspectRatio {
+		if ip.fit(request) == IMAGE_FIT_FILL {
 			// If we're not asked to maintain the aspect ratio, give them what they want
 			return requestedDimensions
 		}
@@ -200,9 +1914,9 @@ func (ip *imageProcessor) scaleToRequestedDimensions(currentDimensions, requeste
 }
 
 func (ip *imageProcessor) clampDimensionsToMaxima(dimensions ImageDimensions, request *ImageProcessorOptions) ImageDimensions {
-	if ip.Config.MaxImageWidth > 0 && dimensions.Width > ip.Config.MaxImageWidth {
-		scaledHeight := ip.getAspectScaledHeight(dimensions.AspectRatio(), ip.Config.MaxImageWidth)
-		return ip.clampDimensionsToMaxima(ImageDimensions{ip.Config.MaxImageWidth, scaledHeight}, request)
+	if maxWidth := ip.maxImageWidth(request); maxWidth > 0 && dimensions.Width > maxWidth {
+		scaledHeight := ip.getAspectScaledHeight(dimensions.AspectRatio(), maxWidth)
+		return ip.clampDimensionsToMaxima(ImageDimensions{maxWidth, scaledHeight}, request)
 	}
 
 	if ip.Config.MaxImageHeight > 0 && dimensions.Height > ip.Config.MaxImageHeight {
@@ -220,3 +1934,24 @@ func (ip *imageProcessor) getAspectScaledHeight(aspectRatio float64, width uint6
 func (ip *imageProcessor) getAspectScaledWidth(aspectRatio float64, height uint64) uint64 {
 	return uint64(math.Floor((float64(height) * aspectRatio) + 0.5))
 }
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
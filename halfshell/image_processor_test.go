@@ -0,0 +1,459 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"flag"
+	"github.com/rafikk/imagick/imagick"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "write the processor's renders as the golden references")
+
+// The largest perceptual difference between a render and its golden reference
+// that is put down to differences between ImageMagick releases. Renders whose
+// crop is off by a single pixel differ by three times as much or more.
+const GOLDEN_MAX_DIFFERENCE = 0.005
+
+// The directory holding the golden references, one PNG image per case.
+const GOLDEN_DIRECTORY = "testdata/golden"
+
+// The size in pixels of the cells of the test card.
+const TEST_CARD_CELL_SIZE = 40
+
+func TestMain(m *testing.M) {
+	imagick.Initialize()
+	code := m.Run()
+	imagick.Terminate()
+	os.Exit(code)
+}
+
+// A render of the test card checked against its golden reference. Renders
+// that only move and scale the test card's cells also have the cells they show
+// checked against the part of the card they are expected to show, so that a
+// change in crop math fails even when the references are regenerated.
+type goldenCase struct {
+	name       string
+	options    ImageProcessorOptions
+	config     func(*ProcessorConfig)
+	dimensions ImageDimensions
+	region     *ImageRect
+}
+
+func goldenCases() []goldenCase {
+	grayscale := true
+	return []goldenCase{
+		{
+			name:       "contain",
+			options:    ImageProcessorOptions{Dimensions: ImageDimensions{240, 240}, Fit: IMAGE_FIT_CONTAIN},
+			dimensions: ImageDimensions{240, 160},
+			region:     &ImageRect{0, 0, 480, 320},
+		},
+		{
+			name:       "fill",
+			options:    ImageProcessorOptions{Dimensions: ImageDimensions{240, 240}, Fit: IMAGE_FIT_FILL},
+			dimensions: ImageDimensions{240, 240},
+			region:     &ImageRect{0, 0, 480, 320},
+		},
+		{
+			name:       "width-only",
+			options:    ImageProcessorOptions{Dimensions: ImageDimensions{120, 0}},
+			dimensions: ImageDimensions{120, 80},
+			region:     &ImageRect{0, 0, 480, 320},
+		},
+		{
+			name:       "cover-square",
+			options:    ImageProcessorOptions{Dimensions: ImageDimensions{160, 160}, Fit: IMAGE_FIT_COVER},
+			dimensions: ImageDimensions{160, 160},
+			region:     &ImageRect{80, 0, 320, 320},
+		},
+		{
+			name:       "cover-wide",
+			options:    ImageProcessorOptions{Dimensions: ImageDimensions{240, 60}, Fit: IMAGE_FIT_COVER},
+			dimensions: ImageDimensions{240, 60},
+			region:     &ImageRect{0, 100, 480, 120},
+		},
+		{
+			name:       "cover-tall",
+			options:    ImageProcessorOptions{Dimensions: ImageDimensions{100, 200}, Fit: IMAGE_FIT_COVER},
+			dimensions: ImageDimensions{100, 200},
+			region:     &ImageRect{160, 0, 160, 320},
+		},
+		{
+			name: "crop-before",
+			options: ImageProcessorOptions{
+				Dimensions: ImageDimensions{120, 0},
+				Crop:       &ImageRect{40, 80, 240, 160},
+				CropOrder:  CROP_ORDER_BEFORE,
+			},
+			dimensions: ImageDimensions{120, 80},
+			region:     &ImageRect{40, 80, 240, 160},
+		},
+		{
+			name: "crop-after",
+			options: ImageProcessorOptions{
+				Dimensions: ImageDimensions{240, 160},
+				Crop:       &ImageRect{60, 40, 120, 80},
+				CropOrder:  CROP_ORDER_AFTER,
+			},
+			dimensions: ImageDimensions{120, 80},
+			region:     &ImageRect{120, 80, 240, 160},
+		},
+		{
+			name: "crop-clipped",
+			options: ImageProcessorOptions{
+				OriginalDimensions: true,
+				Crop:               &ImageRect{400, 240, 200, 200},
+			},
+			dimensions: ImageDimensions{80, 80},
+			region:     &ImageRect{400, 240, 80, 80},
+		},
+		{
+			name:       "grayscale",
+			options:    ImageProcessorOptions{Dimensions: ImageDimensions{240, 160}, GrayScale: &grayscale},
+			config:     func(config *ProcessorConfig) { config.GrayscaleColorspace = "rec601luma" },
+			dimensions: ImageDimensions{240, 160},
+		},
+		{
+			name:       "blur",
+			options:    ImageProcessorOptions{Dimensions: ImageDimensions{256, 160}, Fit: IMAGE_FIT_FILL, BlurRadius: 0.5},
+			config:     func(config *ProcessorConfig) { config.MaxBlurRadiusPercentage = 0.03125 },
+			dimensions: ImageDimensions{256, 160},
+		},
+		{
+			name:       "fast-blur",
+			options:    ImageProcessorOptions{Dimensions: ImageDimensions{240, 160}, GaussianSigma: 16},
+			config:     func(config *ProcessorConfig) { config.FastBlurSigma = 8 },
+			dimensions: ImageDimensions{240, 160},
+		},
+	}
+}
+
+// Renders the test card for each case and compares the render with the
+// case's golden reference. Run with -update-golden to write the current
+// renders as the references after a deliberate change in behavior.
+func TestProcessorGolden(t *testing.T) {
+	card, err := testCardImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range goldenCases() {
+		config := &ProcessorConfig{
+			Name:                "golden",
+			MaxImageWidth:       4000,
+			MaxImageHeight:      4000,
+			MaintainAspectRatio: true,
+			ResizeFilter:        "lanczos",
+			GrayscaleColorspace: "gray",
+		}
+		if c.config != nil {
+			c.config(config)
+		}
+		processor := NewImageProcessorWithConfig(config)
+
+		options := c.options
+		processed, err := processor.ProcessImage(card, &options)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		render, err := png.Decode(bytes.NewReader(processed.Bytes))
+		if err != nil {
+			t.Errorf("%s: decoding render: %v", c.name, err)
+			continue
+		}
+
+		size := render.Bounds().Size()
+		if uint64(size.X) != c.dimensions.Width || uint64(size.Y) != c.dimensions.Height {
+			t.Errorf("%s: render is %dx%d, want %v", c.name, size.X, size.Y, c.dimensions)
+			continue
+		}
+		if c.region != nil {
+			checkTestCardRegion(t, c.name, render, *c.region)
+		}
+		if c.options.GrayScale != nil && !isGrayImage(render) {
+			t.Errorf("%s: render has colored pixels", c.name)
+		}
+
+		path := filepath.Join(GOLDEN_DIRECTORY, c.name+".png")
+		if *updateGolden {
+			if err := os.MkdirAll(GOLDEN_DIRECTORY, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, processed.Bytes, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		golden, err := readGoldenImage(path)
+		if err != nil {
+			t.Errorf("%s: %v, run with -update-golden to write the reference", c.name, err)
+			continue
+		}
+		if golden.Bounds().Size() != size {
+			t.Errorf("%s: render is %v, golden reference is %v", c.name, size, golden.Bounds().Size())
+		} else if difference := perceptualDifference(render, golden); difference > GOLDEN_MAX_DIFFERENCE {
+			t.Errorf("%s: render differs from golden reference by %.4f, more than %.4f", c.name, difference, GOLDEN_MAX_DIFFERENCE)
+		}
+	}
+}
+
+// Checks that processing the same image with the same options encodes the
+// same bytes, even a second apart, when ImageMagick's timestamps change.
+func TestPinEncoding(t *testing.T) {
+	card, err := testCardImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	processor := NewImageProcessorWithConfig(&ProcessorConfig{
+		Name:                    "pinned",
+		ImageCompressionQuality: 85,
+		MaintainAspectRatio:     true,
+		ResizeFilter:            "lanczos",
+	})
+
+	var options []ImageProcessorOptions
+	for _, format := range []string{"png", "jpeg", "webp", "gif"} {
+		for _, strip := range []bool{false, true} {
+			options = append(options, ImageProcessorOptions{Dimensions: ImageDimensions{240, 0}, Format: format, Strip: strip})
+		}
+	}
+
+	encode := func() [][]byte {
+		var encoded [][]byte
+		for i := range options {
+			request := options[i]
+			processed, err := processor.ProcessImage(card, &request)
+			if err != nil {
+				t.Fatalf("%s: %v", request.Format, err)
+			}
+			encoded = append(encoded, processed.Bytes)
+		}
+		return encoded
+	}
+	first := encode()
+	time.Sleep(1100 * time.Millisecond)
+	second := encode()
+
+	for i, request := range options {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Errorf("%s with strip %t: encodings of the same image differ", request.Format, request.Strip)
+		}
+	}
+}
+
+// Returns the color of a cell of the test card. Every cell has its own color,
+// so a render of part of the card shows which part it is, and the cells are
+// alternately light and dark, so a render that is off by a pixel shows too.
+func testCardColor(column, row int) color.RGBA {
+	return color.RGBA{uint8(20 + column*20), uint8(30 + row*6 + 160*((column+row)%2)), uint8(20 + row*28), 255}
+}
+
+// Returns a PNG image of the test card: a 480x320 grid of 12 by 8 cells.
+func testCardImage() (*Image, error) {
+	card := image.NewRGBA(image.Rect(0, 0, 480, 320))
+	for y := 0; y < 320; y++ {
+		for x := 0; x < 480; x++ {
+			card.SetRGBA(x, y, testCardColor(x/TEST_CARD_CELL_SIZE, y/TEST_CARD_CELL_SIZE))
+		}
+	}
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, card); err != nil {
+		return nil, err
+	}
+	return &Image{Bytes: buffer.Bytes(), MimeType: "image/png"}, nil
+}
+
+// Checks that the cells of a render showing a region of the test card have the
+// colors of the region's cells. Cells are compared at their centers, and only
+// where they're large enough in the render for the resize filter to leave
+// their centers untouched by their neighbors.
+func checkTestCardRegion(t *testing.T, name string, render image.Image, region ImageRect) {
+	size := render.Bounds().Size()
+	scaleX := float64(size.X) / float64(region.Width)
+	scaleY := float64(size.Y) / float64(region.Height)
+	if float64(TEST_CARD_CELL_SIZE)*math.Min(scaleX, scaleY) < 10 {
+		t.Fatalf("%s: cells of the region are too small to check", name)
+	}
+
+	for row := 0; row < 8; row++ {
+		for column := 0; column < 12; column++ {
+			left := math.Max(float64(column*TEST_CARD_CELL_SIZE), float64(region.X))
+			right := math.Min(float64((column+1)*TEST_CARD_CELL_SIZE), float64(region.X+region.Width))
+			top := math.Max(float64(row*TEST_CARD_CELL_SIZE), float64(region.Y))
+			bottom := math.Min(float64((row+1)*TEST_CARD_CELL_SIZE), float64(region.Y+region.Height))
+			if (right-left)*scaleX < 10 || (bottom-top)*scaleY < 10 {
+				continue
+			}
+
+			x := int(((left+right)/2 - float64(region.X)) * scaleX)
+			y := int(((top+bottom)/2 - float64(region.Y)) * scaleY)
+			want := testCardColor(column, row)
+			if got := color.RGBAModel.Convert(render.At(x, y)).(color.RGBA); colorDistance(got, want) > 8 {
+				t.Errorf("%s: pixel %d,%d is %v, want %v of cell %d,%d", name, x, y, got, want, column, row)
+			}
+		}
+	}
+}
+
+// Returns the largest difference between the channels of two colors.
+func colorDistance(a, b color.RGBA) int {
+	distance := 0
+	for _, d := range []int{int(a.R) - int(b.R), int(a.G) - int(b.G), int(a.B) - int(b.B)} {
+		if d < 0 {
+			d = -d
+		}
+		if d > distance {
+			distance = d
+		}
+	}
+	return distance
+}
+
+func isGrayImage(img image.Image) bool {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			if c.R != c.G || c.G != c.B {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func readGoldenImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return png.Decode(file)
+}
+
+// Returns the perceptual difference between two images of the same size, from
+// 0 for images that look the same to 1 for black and white. The images are
+// compared in blocks of 4x4 pixels, so that resize filters that differ in
+// detail between ImageMagick releases hardly count, and the difference of the
+// blocks' average colors is weighted by the eye's sensitivity to each channel.
+func perceptualDifference(a, b image.Image) float64 {
+	const block = 4
+	weights := [3]float64{0.299, 0.587, 0.114}
+	size := a.Bounds().Size()
+
+	var total float64
+	blocks := 0
+	for by := 0; by < size.Y; by += block {
+		for bx := 0; bx < size.X; bx += block {
+			var sumA, sumB [3]float64
+			for y := by; y < by+block && y < size.Y; y++ {
+				for x := bx; x < bx+block && x < size.X; x++ {
+					ca := color.RGBAModel.Convert(a.At(a.Bounds().Min.X+x, a.Bounds().Min.Y+y)).(color.RGBA)
+					cb := color.RGBAModel.Convert(b.At(b.Bounds().Min.X+x, b.Bounds().Min.Y+y)).(color.RGBA)
+					sumA[0], sumA[1], sumA[2] = sumA[0]+float64(ca.R), sumA[1]+float64(ca.G), sumA[2]+float64(ca.B)
+					sumB[0], sumB[1], sumB[2] = sumB[0]+float64(cb.R), sumB[1]+float64(cb.G), sumB[2]+float64(cb.B)
+				}
+			}
+
+			var distance float64
+			for i, weight := range weights {
+				d := (sumA[i] - sumB[i]) / (block * block * 255)
+				distance += weight * d * d
+			}
+			total += math.Sqrt(distance)
+			blocks++
+		}
+	}
+	return total / float64(blocks)
+}
+
+// Checks that requests for the same image have the same canonical options,
+// and requests for different images don't.
+func TestCanonicalOptions(t *testing.T) {
+	processor := NewImageProcessorWithConfig(&ProcessorConfig{
+		Name:                    "test",
+		DefaultImageWidth:       800,
+		DefaultImageHeight:      600,
+		MaintainAspectRatio:     true,
+		ResizeFilter:            "lanczos",
+		GrayscaleColorspace:     "gray",
+		GrayscaleDither:         "o8x8",
+		ImageCompressionQuality: 85,
+		SaveDataFormat:          "WEBP",
+		SaveDataQuality:         40,
+	})
+	yes, no := true, false
+	tests := []struct {
+		name  string
+		a, b  ImageProcessorOptions
+		equal bool
+	}{
+		{
+			"defaults",
+			ImageProcessorOptions{},
+			ImageProcessorOptions{Dimensions: ImageDimensions{800, 600}, Fit: IMAGE_FIT_CONTAIN, Enlarge: &no, Filter: "lanczos", GrayScale: &no},
+			true,
+		},
+		{"one dimension", ImageProcessorOptions{Dimensions: ImageDimensions{100, 0}, Fit: IMAGE_FIT_COVER}, ImageProcessorOptions{Dimensions: ImageDimensions{100, 0}}, true},
+		{"dimensions", ImageProcessorOptions{Dimensions: ImageDimensions{100, 100}}, ImageProcessorOptions{Dimensions: ImageDimensions{100, 200}}, false},
+		{"unknown filter", ImageProcessorOptions{Filter: "unknown"}, ImageProcessorOptions{}, true},
+		{"dither without grayscale", ImageProcessorOptions{Dither: "h4x4a"}, ImageProcessorOptions{}, true},
+		{"grayscale defaults", ImageProcessorOptions{GrayScale: &yes}, ImageProcessorOptions{GrayScale: &yes, GrayscaleColorspace: "gray", Dither: "o8x8"}, true},
+		{"full turn", ImageProcessorOptions{Rotate: 360}, ImageProcessorOptions{}, true},
+		{"negative rotation", ImageProcessorOptions{Rotate: -90}, ImageProcessorOptions{Rotate: 270}, true},
+		{"rotation", ImageProcessorOptions{Rotate: 90}, ImageProcessorOptions{Rotate: 180}, false},
+		{"vignette opacity", ImageProcessorOptions{VignetteRadius: 10}, ImageProcessorOptions{VignetteRadius: 10, VignetteOpacity: 1}, true},
+		{"text options without text", ImageProcessorOptions{Font: "sans", TextSize: 12}, ImageProcessorOptions{}, true},
+		{"crop order without crop", ImageProcessorOptions{CropOrder: CROP_ORDER_AFTER}, ImageProcessorOptions{}, true},
+		{"default PNG quality", ImageProcessorOptions{Format: "PNG", Quality: 85}, ImageProcessorOptions{Format: "PNG"}, true},
+		{"default JPEG quality", ImageProcessorOptions{Format: "JPEG", Quality: 85}, ImageProcessorOptions{Format: "JPEG"}, false},
+		{"default quality without format", ImageProcessorOptions{Quality: 85}, ImageProcessorOptions{}, false},
+		{"Save-Data format", ImageProcessorOptions{SaveData: true}, ImageProcessorOptions{SaveData: true, Format: "WEBP"}, true},
+		{"Save-Data quality", ImageProcessorOptions{SaveData: true, Quality: 40}, ImageProcessorOptions{SaveData: true}, true},
+		{"Gaussian blur", ImageProcessorOptions{GaussianSigma: 2, BlurRadius: 5}, ImageProcessorOptions{GaussianSigma: 2}, true},
+		{"Gaussian radius without sigma", ImageProcessorOptions{GaussianRadius: 3}, ImageProcessorOptions{}, true},
+		{"blur mode without blur", ImageProcessorOptions{BlurMode: BLUR_MODE_SIGMA}, ImageProcessorOptions{}, true},
+		{"default blur mode", ImageProcessorOptions{BlurRadius: 0.5}, ImageProcessorOptions{BlurRadius: 0.5, BlurMode: BLUR_MODE_RELATIVE}, true},
+		{"blur mode", ImageProcessorOptions{BlurRadius: 0.5}, ImageProcessorOptions{BlurRadius: 0.5, BlurMode: BLUR_MODE_SIGMA}, false},
+	}
+	for _, test := range tests {
+		a, b := processor.CanonicalOptions(&test.a), processor.CanonicalOptions(&test.b)
+		if equal := reflect.DeepEqual(a, b); equal != test.equal {
+			t.Errorf("%s: canonical options equal: %v, expected %v (%+v and %+v)", test.name, equal, test.equal, a, b)
+		}
+		if again := processor.CanonicalOptions(a); !reflect.DeepEqual(again, a) {
+			t.Errorf("%s: canonical options change when canonicalized again: %+v", test.name, again)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The ImageMagick resources that policies can limit. The time resource isn't
+// among them: it limits the time since ImageMagick was initialized, so the
+// server would fail every request once it passed.
+var imageMagickResources = []string{
+	"area", "disk", "file", "height", "list-length", "map", "memory",
+	"thread", "throttle", "width",
+}
+
+// ImageMagickPolicyConfig holds the security policy that halfshell applies to
+// ImageMagick, the equivalent of a policy.xml.
+type ImageMagickPolicyConfig struct {
+	DisabledCoders       []string
+	DisabledDelegates    []string
+	ResourceLimits       map[string]string
+	DisableIndirectReads bool
+}
+
+// Returns the policy as the contents of an ImageMagick policy.xml.
+func (p *ImageMagickPolicyConfig) XML() []byte {
+	var policy bytes.Buffer
+	var writePolicy = func(attributes ...string) {
+		policy.WriteString("  <policy")
+		for i := 0; i < len(attributes); i += 2 {
+			policy.WriteString(" " + attributes[i] + "=\"")
+			xml.EscapeText(&policy, []byte(attributes[i+1]))
+			policy.WriteString("\"")
+		}
+		policy.WriteString("/>\n")
+	}
+
+	policy.WriteString("<policymap>\n")
+	if len(p.DisabledCoders) > 0 {
+		writePolicy("domain", "coder", "rights", "none", "pattern", "{"+strings.Join(p.DisabledCoders, ",")+"}")
+	}
+	if len(p.DisabledDelegates) > 0 {
+		writePolicy("domain", "delegate", "rights", "none", "pattern", "{"+strings.Join(p.DisabledDelegates, ",")+"}")
+	}
+	if p.DisableIndirectReads {
+		writePolicy("domain", "path", "rights", "none", "pattern", "@*")
+	}
+	for _, resource := range imageMagickResources {
+		if limit, ok := p.ResourceLimits[resource]; ok {
+			writePolicy("domain", "resource", "name", resource, "value", limit)
+		}
+	}
+	policy.WriteString("</policymap>\n")
+	return policy.Bytes()
+}
+
+// Writes the policy to a policy.xml in a new temporary directory and adds the
+// directory to the front of MAGICK_CONFIGURE_PATH, so that ImageMagick loads
+// the policy along with any system-wide policy.xml. Must be called before
+// ImageMagick is initialized.
+func (p *ImageMagickPolicyConfig) Apply() error {
+	directory, err := ioutil.TempDir("", "halfshell-imagemagick")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(directory, "policy.xml"), p.XML(), 0644); err != nil {
+		return err
+	}
+
+	configurePath := directory
+	if existing := os.Getenv("MAGICK_CONFIGURE_PATH"); existing != "" {
+		configurePath = fmt.Sprintf("%s%c%s", directory, os.PathListSeparator, existing)
+	}
+	return os.Setenv("MAGICK_CONFIGURE_PATH", configurePath)
+}
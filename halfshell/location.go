@@ -0,0 +1,494 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/rafikk/imagick/imagick"
+	"hash/crc32"
+)
+
+// The header asserting that an image's location and serial number metadata
+// was scrubbed and the scrubbed image was verified to be free of it.
+const LOCATION_SCRUBBED_HEADER = "X-Halfshell-Location-Scrubbed"
+
+// The tags of EXIF IFD pointers, and of EXIF values that identify the camera
+// that took an image: its body, lens and camera serial numbers, and the maker
+// note, in which cameras record their serial numbers among other data.
+const (
+	EXIF_TAG_EXIF_IFD           = 0x8769
+	EXIF_TAG_GPS_IFD            = 0x8825
+	EXIF_TAG_MAKER_NOTE         = 0x927c
+	EXIF_TAG_BODY_SERIAL_NUMBER = 0xa431
+	EXIF_TAG_LENS_SERIAL_NUMBER = 0xa435
+	EXIF_TAG_CAMERA_SERIAL      = 0xc62f
+)
+
+var ErrLocationNotScrubbed = errors.New("image location metadata could not be scrubbed")
+
+var exifSerialNumberTags = map[uint16]bool{
+	EXIF_TAG_MAKER_NOTE:         true,
+	EXIF_TAG_BODY_SERIAL_NUMBER: true,
+	EXIF_TAG_LENS_SERIAL_NUMBER: true,
+	EXIF_TAG_CAMERA_SERIAL:      true,
+}
+
+// The sizes in bytes of the values of the TIFF field types.
+var tiffTypeSizes = map[uint16]uint64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+var (
+	jpegExifHeader  = []byte("Exif\x00\x00")
+	jpegXMPHeaders  = [][]byte{[]byte("http://ns.adobe.com/xap/1.0/\x00"), []byte("http://ns.adobe.com/xmp/extension/\x00")}
+	pngTextKeywords = [][]byte{[]byte("XML:com.adobe.xmp\x00"), []byte("Raw profile type exif\x00"),
+		[]byte("Raw profile type APP1\x00"), []byte("Raw profile type xmp\x00")}
+)
+
+// Returns a copy of an image without its GPS location and camera serial
+// numbers, verified to be free of them. The EXIF data of JPEG, PNG and WebP
+// images is scrubbed in place, keeping its other values such as the image's
+// orientation, and their XMP packets and C2PA manifests, which can also hold
+// a location, are removed, as are the XMP packets of GIF images. BMP, ICO and
+// SVG images don't carry EXIF data. Images in other formats are re-encoded by
+// the processor without any metadata.
+func ScrubLocationMetadata(image *Image, processor ImageProcessor) (*Image, error) {
+	data := append([]byte(nil), image.Bytes...)
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		data = scrubJPEGLocation(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		data = scrubPNGLocation(data)
+	case isWebP(data):
+		data = scrubWebPLocation(data)
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		data = scrubGIFLocation(data)
+	case !reencodedToScrubLocation(image):
+		return &Image{Bytes: data, MimeType: image.MimeType}, nil
+	default:
+		stripped, err := processor.StripMetadata(image)
+		if err != nil {
+			return nil, err
+		}
+		if hasDecodedMetadata(stripped.Bytes) {
+			return nil, ErrLocationNotScrubbed
+		}
+		return stripped, nil
+	}
+
+	if hasLocationMetadata(data) {
+		return nil, ErrLocationNotScrubbed
+	}
+	return &Image{Bytes: data, MimeType: image.MimeType}, nil
+}
+
+// Returns true if the location of an image is scrubbed by re-encoding it, as
+// it isn't in a format whose metadata is scrubbed in place or in one that
+// doesn't carry any.
+func reencodedToScrubLocation(image *Image) bool {
+	data := image.Bytes
+	return !bytes.HasPrefix(data, []byte("\xff\xd8\xff")) && !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) &&
+		!isWebP(data) && !bytes.HasPrefix(data, []byte("GIF8")) && !bytes.HasPrefix(data, []byte("BM")) &&
+		!bytes.HasPrefix(data, []byte("\x00\x00\x01\x00")) && image.MimeType != "image/svg+xml"
+}
+
+// Returns true if any frame of an image has a profile or EXIF values as
+// ImageMagick decodes it. Only the image's attributes are read.
+func hasDecodedMetadata(data []byte) bool {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := pingImageBlob(wand, data); err != nil {
+		return true
+	}
+	for i := 0; i < int(wand.GetNumberImages()); i++ {
+		wand.SetIteratorIndex(i)
+		if len(wand.GetImageProfiles("*")) > 0 || len(wand.GetImageProperties("exif:*")) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP"))
+}
+
+// Returns true if a JPEG, PNG or WebP image holds a GPS location, a serial
+// number, an XMP packet, a C2PA manifest or EXIF data that can't be parsed, or
+// if a GIF image holds an XMP packet or can't be parsed.
+func hasLocationMetadata(data []byte) bool {
+	found := false
+	check := func(exif []byte) {
+		if !walkExifEntries(exif, func(gps bool, tag uint16, ifd, entry, value []byte) {
+			found = found || gps || (exifSerialNumberTags[tag] && !isZero(value))
+		}) {
+			found = true
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8")):
+		walkJPEGSegments(data, func(marker byte, offset, length int) bool {
+			if length < 4 {
+				return true
+			}
+			segment := data[offset+4 : offset+length]
+			if marker == 0xe1 && bytes.HasPrefix(segment, jpegExifHeader) {
+				check(segment[len(jpegExifHeader):])
+			}
+			found = found || (marker == 0xe1 && hasAnyPrefix(segment, jpegXMPHeaders)) ||
+				isJPEGProvenanceSegment(marker, segment)
+			return !found
+		})
+	case bytes.HasPrefix(data, []byte("\x89PNG")):
+		walkPNGChunks(data, func(chunkType string, offset, length int) bool {
+			chunk := data[offset+8 : offset+length-4]
+			if chunkType == "eXIf" {
+				check(chunk)
+			}
+			found = found || (isPNGTextChunk(chunkType) && hasAnyPrefix(chunk, pngTextKeywords)) ||
+				chunkType == "caBX"
+			return !found
+		})
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		parsed := walkGIFExtensions(data, func(offset, length int) bool {
+			found = isGIFXMPExtension(data[offset : offset+length])
+			return !found
+		})
+		found = found || !parsed
+	default:
+		walkWebPChunks(data, func(chunkType string, offset, length int) bool {
+			if chunkType == "EXIF" {
+				check(webPExif(data[offset+8 : offset+8+length]))
+			}
+			found = found || chunkType == "XMP " || chunkType == "C2PA"
+			return !found
+		})
+	}
+	return found
+}
+
+// Scrubs the EXIF data of a JPEG image, and removes its XMP segments, C2PA
+// manifest segments, whose EXIF assertions can hold a location, and EXIF
+// segments that can't be parsed.
+func scrubJPEGLocation(data []byte) []byte {
+	var buffer bytes.Buffer
+	position := 0
+	walkJPEGSegments(data, func(marker byte, offset, length int) bool {
+		if length < 4 {
+			return true
+		}
+		segment := data[offset+4 : offset+length]
+		remove := (marker == 0xe1 && hasAnyPrefix(segment, jpegXMPHeaders)) || isJPEGProvenanceSegment(marker, segment)
+		if marker == 0xe1 && bytes.HasPrefix(segment, jpegExifHeader) {
+			remove = !scrubExif(segment[len(jpegExifHeader):])
+		}
+		if remove {
+			buffer.Write(data[position:offset])
+			position = offset + length
+		}
+		return true
+	})
+	buffer.Write(data[position:])
+	return buffer.Bytes()
+}
+
+// Scrubs the eXIf chunk of a PNG image, and removes its caBX chunks of C2PA
+// manifests, its XMP chunks and text chunks in which ImageMagick keeps EXIF
+// and XMP data.
+func scrubPNGLocation(data []byte) []byte {
+	var buffer bytes.Buffer
+	position := 0
+	walkPNGChunks(data, func(chunkType string, offset, length int) bool {
+		chunk := data[offset+8 : offset+length-4]
+		remove := (isPNGTextChunk(chunkType) && hasAnyPrefix(chunk, pngTextKeywords)) || chunkType == "caBX"
+		if chunkType == "eXIf" {
+			if remove = !scrubExif(chunk); !remove {
+				binary.BigEndian.PutUint32(data[offset+length-4:], crc32.ChecksumIEEE(data[offset+4:offset+length-4]))
+			}
+		}
+		if remove {
+			buffer.Write(data[position:offset])
+			position = offset + length
+		}
+		return true
+	})
+	buffer.Write(data[position:])
+	return buffer.Bytes()
+}
+
+// Scrubs the EXIF chunk of a WebP image, and removes its XMP and C2PA chunks
+// and its EXIF chunk if it can't be parsed, updating the RIFF size and the
+// extended header's flags.
+func scrubWebPLocation(data []byte) []byte {
+	var buffer bytes.Buffer
+	position := 0
+	removed := map[string]bool{}
+	walkWebPChunks(data, func(chunkType string, offset, length int) bool {
+		remove := chunkType == "XMP " || chunkType == "C2PA"
+		if chunkType == "EXIF" {
+			remove = !scrubExif(webPExif(data[offset+8 : offset+8+length]))
+		}
+		if remove {
+			removed[chunkType] = true
+			buffer.Write(data[position:offset])
+			position = offset + 8 + length + length%2
+		}
+		return true
+	})
+	buffer.Write(data[position:])
+
+	scrubbed := buffer.Bytes()
+	binary.LittleEndian.PutUint32(scrubbed[4:], uint32(len(scrubbed)-8))
+	if len(scrubbed) >= 21 && bytes.Equal(scrubbed[12:16], []byte("VP8X")) {
+		if removed["EXIF"] {
+			scrubbed[20] &^= 0x08
+		}
+		if removed["XMP "] {
+			scrubbed[20] &^= 0x04
+		}
+	}
+	return scrubbed
+}
+
+// Removes the XMP application extensions of a GIF image, which ImageMagick
+// otherwise keeps as a profile and writes back.
+func scrubGIFLocation(data []byte) []byte {
+	var buffer bytes.Buffer
+	position := 0
+	walkGIFExtensions(data, func(offset, length int) bool {
+		if isGIFXMPExtension(data[offset : offset+length]) {
+			buffer.Write(data[position:offset])
+			position = offset + length
+		}
+		return true
+	})
+	buffer.Write(data[position:])
+	return buffer.Bytes()
+}
+
+// Calls fn with the offset and length of each extension block of a GIF image,
+// including its introducer, label and sub-blocks, until fn returns false.
+// Image data is skipped. Returns false if the image is malformed.
+func walkGIFExtensions(data []byte, fn func(offset, length int) bool) bool {
+	// The sub-blocks of an extension or image data each start with their size
+	// and end with an empty one. Returns the offset after the terminator, or
+	// -1 if the sub-blocks run past the data.
+	skipSubBlocks := func(offset int) int {
+		for offset < len(data) {
+			size := int(data[offset])
+			offset++
+			if size == 0 {
+				return offset
+			}
+			offset += size
+		}
+		return -1
+	}
+	colorTableSize := func(flags byte) int {
+		if flags&0x80 == 0 {
+			return 0
+		}
+		return 3 << (flags&0x07 + 1)
+	}
+
+	if len(data) < 13 {
+		return false
+	}
+	offset := 13 + colorTableSize(data[10])
+	for offset < len(data) {
+		switch data[offset] {
+		case 0x3b:
+			return true
+		case 0x21:
+			end := skipSubBlocks(offset + 2)
+			if end < 0 {
+				return false
+			}
+			if !fn(offset, end-offset) {
+				return true
+			}
+			offset = end
+		case 0x2c:
+			if offset+11 > len(data) {
+				return false
+			}
+			end := skipSubBlocks(offset + 11 + colorTableSize(data[offset+9]))
+			if end < 0 {
+				return false
+			}
+			offset = end
+		default:
+			return false
+		}
+	}
+	return offset == len(data)
+}
+
+// Returns true for the application extension of a GIF image holding an XMP
+// packet.
+func isGIFXMPExtension(extension []byte) bool {
+	return bytes.HasPrefix(extension, []byte("\x21\xff\x0bXMP DataXMP"))
+}
+
+// Calls fn with the type, offset and payload length of each chunk of a WebP
+// image, until fn returns false. Chunks are padded to an even length.
+func walkWebPChunks(data []byte, fn func(chunkType string, offset, length int) bool) {
+	offset := 12
+	for offset+8 <= len(data) {
+		length := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		if length < 0 || offset+8+length > len(data) || !fn(string(data[offset:offset+4]), offset, length) {
+			return
+		}
+		offset += 8 + length + length%2
+	}
+}
+
+// Returns the TIFF structure of a WebP EXIF chunk, which some encoders prefix
+// with the JPEG EXIF header.
+func webPExif(chunk []byte) []byte {
+	return bytes.TrimPrefix(chunk, jpegExifHeader)
+}
+
+// Scrubs EXIF data in place: empties the GPS IFD and zeroes the values of
+// serial number tags. Returns false if the data can't be parsed.
+func scrubExif(exif []byte) bool {
+	return walkExifEntries(exif, func(gps bool, tag uint16, ifd, entry, value []byte) {
+		if gps {
+			zero(value)
+			zero(entry)
+			ifd[0], ifd[1] = 0, 0
+		} else if exifSerialNumberTags[tag] {
+			zero(value)
+		}
+	})
+}
+
+// Calls fn with each entry of the IFDs of an EXIF TIFF structure, with the
+// entry's tag, the IFD, starting with its entry count, the entry, and the
+// entry's value: the chain of IFDs from IFD0, and the Exif and GPS IFDs they
+// point to. The entries of an IFD are passed after they're all read, so fn may
+// zero them, even where values overlap the TIFF header. Returns false if the
+// structure is malformed.
+func walkExifEntries(exif []byte, fn func(gps bool, tag uint16, ifd, entry, value []byte)) bool {
+	order := tiffByteOrder(exif)
+	if order == nil {
+		return false
+	}
+
+	visited := make(map[uint32]bool)
+	var walk func(offset uint32, gps, chain bool) bool
+	walk = func(offset uint32, gps, chain bool) bool {
+		for offset != 0 {
+			if visited[offset] || uint64(offset)+2 > uint64(len(exif)) {
+				return false
+			}
+			visited[offset] = true
+			ifd := exif[offset:]
+			count := int(order.Uint16(ifd))
+			if 2+count*12+4 > len(ifd) {
+				return false
+			}
+
+			type field struct {
+				tag          uint16
+				entry, value []byte
+			}
+			fields := make([]field, 0, count)
+			for i := 0; i < count; i++ {
+				entry := ifd[2+i*12 : 14+i*12]
+				tag, size := order.Uint16(entry), tiffTypeSizes[order.Uint16(entry[2:])]*uint64(order.Uint32(entry[4:]))
+				value := entry[8 : 8+minUint64(size, 4)]
+				if size > 4 {
+					valueOffset := uint64(order.Uint32(entry[8:]))
+					if valueOffset+size > uint64(len(exif)) {
+						return false
+					}
+					value = exif[valueOffset : valueOffset+size]
+				}
+				if !gps && (tag == EXIF_TAG_EXIF_IFD || tag == EXIF_TAG_GPS_IFD) && size == 4 {
+					if !walk(order.Uint32(value), tag == EXIF_TAG_GPS_IFD, false) {
+						return false
+					}
+				}
+				fields = append(fields, field{tag, entry, value})
+			}
+			for _, f := range fields {
+				fn(gps, f.tag, ifd, f.entry, f.value)
+			}
+
+			if !chain {
+				return true
+			}
+			offset = order.Uint32(ifd[2+count*12:])
+		}
+		return true
+	}
+	return walk(order.Uint32(exif[4:]), false, true)
+}
+
+// Returns the byte order of a TIFF structure, or nil if it isn't one.
+func tiffByteOrder(data []byte) binary.ByteOrder {
+	if len(data) < 8 {
+		return nil
+	}
+	switch string(data[:4]) {
+	case "II*\x00":
+		return binary.LittleEndian
+	case "MM\x00*":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// Returns true for the APP11 segments of a JPEG image holding JUMBF boxes, in
+// which C2PA manifests are embedded.
+func isJPEGProvenanceSegment(marker byte, segment []byte) bool {
+	return marker == 0xeb && bytes.HasPrefix(segment, []byte("JP"))
+}
+
+func isPNGTextChunk(chunkType string) bool {
+	return chunkType == "iTXt" || chunkType == "tEXt" || chunkType == "zTXt"
+}
+
+func hasAnyPrefix(data []byte, prefixes [][]byte) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func zero(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+const testExifTagOrientation = 0x0112
+
+// Returns a little-endian EXIF TIFF structure with an orientation in IFD0 and,
+// if requested, a GPS IFD holding a latitude reference and a body serial
+// number in an Exif IFD.
+func testExif(gps bool, serial string) []byte {
+	type entry struct {
+		tag, fieldType uint16
+		count, value   uint32
+	}
+	ifd := func(entries []entry) []byte {
+		data := make([]byte, 2+len(entries)*12+4)
+		binary.LittleEndian.PutUint16(data, uint16(len(entries)))
+		for i, e := range entries {
+			field := data[2+i*12:]
+			binary.LittleEndian.PutUint16(field, e.tag)
+			binary.LittleEndian.PutUint16(field[2:], e.fieldType)
+			binary.LittleEndian.PutUint32(field[4:], e.count)
+			binary.LittleEndian.PutUint32(field[8:], e.value)
+		}
+		return data
+	}
+
+	ifd0 := []entry{{testExifTagOrientation, 3, 1, 6}}
+	if gps {
+		ifd0 = append(ifd0, entry{EXIF_TAG_GPS_IFD, 4, 1, 0})
+	}
+	if serial != "" {
+		ifd0 = append(ifd0, entry{EXIF_TAG_EXIF_IFD, 4, 1, 0})
+	}
+
+	exif := []byte("II*\x00\x08\x00\x00\x00")
+	offset := uint32(8 + 2 + len(ifd0)*12 + 4)
+	var extra []byte
+	for i := range ifd0 {
+		switch ifd0[i].tag {
+		case EXIF_TAG_GPS_IFD:
+			ifd0[i].value = offset + uint32(len(extra))
+			extra = append(extra, ifd([]entry{{0x0001, 2, 2, uint32('N')}})...)
+		case EXIF_TAG_EXIF_IFD:
+			ifd0[i].value = offset + uint32(len(extra))
+			var value [4]byte
+			copy(value[:], serial)
+			extra = append(extra, ifd([]entry{{EXIF_TAG_BODY_SERIAL_NUMBER, 2, 4, binary.LittleEndian.Uint32(value[:])}})...)
+		}
+	}
+	exif = append(exif, ifd(ifd0)...)
+	return append(exif, extra...)
+}
+
+// Returns the orientation in IFD0 of EXIF data, or 0 if it has none.
+func testExifOrientation(exif []byte) uint16 {
+	var orientation uint16
+	walkExifEntries(exif, func(gps bool, tag uint16, ifd, entry, value []byte) {
+		if !gps && tag == testExifTagOrientation {
+			orientation = binary.LittleEndian.Uint16(value)
+		}
+	})
+	return orientation
+}
+
+func testJPEG(segments ...[]byte) []byte {
+	data := []byte("\xff\xd8")
+	for _, segment := range segments {
+		data = append(data, segment...)
+	}
+	return append(data, "\xff\xda\x00\x02scan\xff\xd9"...)
+}
+
+func testJPEGSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func testPNG(chunks ...[]byte) []byte {
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = append(data, testPNGChunk("IHDR", make([]byte, 13))...)
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	data = append(data, testPNGChunk("IDAT", []byte("pixels"))...)
+	return append(data, testPNGChunk("IEND", nil)...)
+}
+
+func testPNGChunk(chunkType string, payload []byte) []byte {
+	chunk := make([]byte, 4, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, payload...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// Returns an extended WebP image with the chunks, flagged as having EXIF and
+// XMP metadata.
+func testWebP(chunks ...[]byte) []byte {
+	data := []byte("RIFF\x00\x00\x00\x00WEBP")
+	data = append(data, testWebPChunk("VP8X", []byte{0x0c, 0, 0, 0, 0, 0, 0, 0, 0, 0})...)
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	data = append(data, testWebPChunk("VP8 ", []byte("pixels"))...)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	return data
+}
+
+func testWebPChunk(chunkType string, payload []byte) []byte {
+	chunk := append([]byte(chunkType), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// Returns a 1x1 GIF image with the extension blocks before its image data.
+func testGIF(extensions ...[]byte) []byte {
+	data := []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\xff\xff\xff")
+	for _, extension := range extensions {
+		data = append(data, extension...)
+	}
+	data = append(data, "\x2c\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02\x44\x01\x00"...)
+	return append(data, 0x3b)
+}
+
+func testJPEGExif(gps bool, serial string) []byte {
+	return testJPEGSegment(0xe1, append([]byte("Exif\x00\x00"), testExif(gps, serial)...))
+}
+
+var (
+	testJPEGXMP    = testJPEGSegment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+	testJPEGC2PA   = testJPEGSegment(0xeb, []byte("JP\x00\x00manifest"))
+	testJPEGApp0   = testJPEGSegment(0xe0, []byte("JFIF\x00\x01\x02"))
+	testPNGXMP     = testPNGChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))
+	testPNGC2PA    = testPNGChunk("caBX", []byte("manifest"))
+	testPNGComment = testPNGChunk("tEXt", []byte("Comment\x00hello"))
+	testWebPXMP    = testWebPChunk("XMP ", []byte("<x:xmpmeta/>"))
+	testWebPC2PA   = testWebPChunk("C2PA", []byte("manifest"))
+	testGIFXMP     = []byte("\x21\xff\x0bXMP DataXMP\x0c<x:xmpmeta/>\x00")
+	testGIFComment = []byte("\x21\xfe\x05hello\x00")
+)
+
+func TestHasLocationMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"jpeg without metadata", testJPEG(testJPEGApp0), false},
+		{"jpeg exif without gps", testJPEG(testJPEGExif(false, "")), false},
+		{"jpeg exif with gps", testJPEG(testJPEGExif(true, "")), true},
+		{"jpeg exif with serial number", testJPEG(testJPEGExif(false, "A12")), true},
+		{"jpeg exif with zeroed serial number", testJPEG(testJPEGExif(false, "\x00")), false},
+		{"jpeg malformed exif", testJPEG(testJPEGSegment(0xe1, []byte("Exif\x00\x00II*\x00\xff\xff\x00\x00"))), true},
+		{"jpeg xmp", testJPEG(testJPEGXMP), true},
+		{"jpeg c2pa", testJPEG(testJPEGC2PA), true},
+		{"png without metadata", testPNG(testPNGComment), false},
+		{"png exif without gps", testPNG(testPNGChunk("eXIf", testExif(false, ""))), false},
+		{"png exif with gps", testPNG(testPNGChunk("eXIf", testExif(true, ""))), true},
+		{"png xmp", testPNG(testPNGXMP), true},
+		{"png c2pa", testPNG(testPNGC2PA), true},
+		{"webp without metadata", testWebP(), false},
+		{"webp exif without gps", testWebP(testWebPChunk("EXIF", testExif(false, ""))), false},
+		{"webp exif with gps", testWebP(testWebPChunk("EXIF", testExif(true, ""))), true},
+		{"webp exif with jpeg header", testWebP(testWebPChunk("EXIF", append([]byte("Exif\x00\x00"), testExif(true, "")...))), true},
+		{"webp xmp", testWebP(testWebPXMP), true},
+		{"webp c2pa", testWebP(testWebPC2PA), true},
+		{"gif without metadata", testGIF(testGIFComment), false},
+		{"gif xmp", testGIF(testGIFComment, testGIFXMP), true},
+		{"gif truncated", testGIF(testGIFComment)[:30], true},
+	}
+	for _, test := range tests {
+		if got := hasLocationMetadata(test.data); got != test.want {
+			t.Errorf("%s: hasLocationMetadata() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestScrubLocationMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    *Image
+		exif     func([]byte) []byte
+		removed  [][]byte
+		retained [][]byte
+	}{
+		{
+			name:     "jpeg",
+			image:    &Image{Bytes: testJPEG(testJPEGApp0, testJPEGExif(true, "A12"), testJPEGXMP, testJPEGC2PA), MimeType: "image/jpeg"},
+			exif:     testJPEGExifData,
+			removed:  [][]byte{testJPEGXMP, testJPEGC2PA},
+			retained: [][]byte{testJPEGApp0},
+		},
+		{
+			name:     "png",
+			image:    &Image{Bytes: testPNG(testPNGChunk("eXIf", testExif(true, "A12")), testPNGXMP, testPNGC2PA, testPNGComment), MimeType: "image/png"},
+			exif:     testPNGExifData,
+			removed:  [][]byte{testPNGXMP, testPNGC2PA},
+			retained: [][]byte{testPNGComment},
+		},
+		{
+			name:    "webp",
+			image:   &Image{Bytes: testWebP(testWebPChunk("EXIF", testExif(true, "A12")), testWebPXMP, testWebPC2PA), MimeType: "image/webp"},
+			exif:    testWebPExifData,
+			removed: [][]byte{testWebPXMP, testWebPC2PA},
+		},
+		{
+			name:     "gif",
+			image:    &Image{Bytes: testGIF(testGIFXMP, testGIFComment), MimeType: "image/gif"},
+			removed:  [][]byte{testGIFXMP},
+			retained: [][]byte{testGIFComment},
+		},
+	}
+	for _, test := range tests {
+		original := append([]byte(nil), test.image.Bytes...)
+		scrubbed, err := ScrubLocationMetadata(test.image, nil)
+		if err != nil {
+			t.Errorf("%s: ScrubLocationMetadata() error: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(test.image.Bytes, original) {
+			t.Errorf("%s: ScrubLocationMetadata() modified the original image", test.name)
+		}
+		if hasLocationMetadata(scrubbed.Bytes) {
+			t.Errorf("%s: scrubbed image still has location metadata", test.name)
+		}
+		if test.exif != nil {
+			if orientation := testExifOrientation(test.exif(scrubbed.Bytes)); orientation != 6 {
+				t.Errorf("%s: scrubbed image has orientation %d, want 6", test.name, orientation)
+			}
+		}
+		for _, data := range test.removed {
+			if bytes.Contains(scrubbed.Bytes, data) {
+				t.Errorf("%s: scrubbed image still contains %q", test.name, data)
+			}
+		}
+		for _, data := range test.retained {
+			if !bytes.Contains(scrubbed.Bytes, data) {
+				t.Errorf("%s: scrubbed image lost %q", test.name, data)
+			}
+		}
+		if scrubbed.MimeType != test.image.MimeType {
+			t.Errorf("%s: scrubbed image has MIME type %s, want %s", test.name, scrubbed.MimeType, test.image.MimeType)
+		}
+	}
+}
+
+func TestScrubWebPLocationUpdatesHeader(t *testing.T) {
+	scrubbed := scrubWebPLocation(testWebP(testWebPChunk("EXIF", []byte("garbage")), testWebPXMP))
+	if size := binary.LittleEndian.Uint32(scrubbed[4:]); int(size) != len(scrubbed)-8 {
+		t.Errorf("RIFF size = %d, want %d", size, len(scrubbed)-8)
+	}
+	if flags := scrubbed[20]; flags&0x0c != 0 {
+		t.Errorf("VP8X flags = %#x, want EXIF and XMP flags cleared", flags)
+	}
+}
+
+func TestScrubPNGLocationUpdatesCRC(t *testing.T) {
+	scrubbed := scrubPNGLocation(testPNG(testPNGChunk("eXIf", testExif(true, ""))))
+	walkPNGChunks(scrubbed, func(chunkType string, offset, length int) bool {
+		if crc := binary.BigEndian.Uint32(scrubbed[offset+length-4:]); crc != crc32.ChecksumIEEE(scrubbed[offset+4:offset+length-4]) {
+			t.Errorf("%s chunk has CRC %#x, want %#x", chunkType, crc, crc32.ChecksumIEEE(scrubbed[offset+4:offset+length-4]))
+		}
+		return true
+	})
+}
+
+// Returns the EXIF data of a JPEG, PNG or WebP test image.
+func testJPEGExifData(data []byte) []byte {
+	var exif []byte
+	walkJPEGSegments(data, func(marker byte, offset, length int) bool {
+		if segment := data[offset+4 : offset+length]; marker == 0xe1 && bytes.HasPrefix(segment, jpegExifHeader) {
+			exif = segment[len(jpegExifHeader):]
+		}
+		return exif == nil
+	})
+	return exif
+}
+
+func testPNGExifData(data []byte) []byte {
+	var exif []byte
+	walkPNGChunks(data, func(chunkType string, offset, length int) bool {
+		if chunkType == "eXIf" {
+			exif = data[offset+8 : offset+length-4]
+		}
+		return exif == nil
+	})
+	return exif
+}
+
+func testWebPExifData(data []byte) []byte {
+	var exif []byte
+	walkWebPChunks(data, func(chunkType string, offset, length int) bool {
+		if chunkType == "EXIF" {
+			exif = webPExif(data[offset+8 : offset+8+length])
+		}
+		return exif == nil
+	})
+	return exif
+}
+
+func FuzzScrubExif(f *testing.F) {
+	f.Add(testExif(false, ""))
+	f.Add(testExif(true, ""))
+	f.Add(testExif(true, "A12"))
+	f.Add([]byte("MM\x00*\x00\x00\x00\x08\x00\x01\x88\x25\x00\x04\x00\x00\x00\x01\x00\x00\x00\x08\x00\x00\x00\x00"))
+	f.Add([]byte("II*\x00\xff\xff\x00\x00"))
+
+	f.Fuzz(func(t *testing.T, exif []byte) {
+		for _, image := range [][]byte{
+			testJPEG(testJPEGSegment(0xe1, append([]byte("Exif\x00\x00"), exif...))),
+			testPNG(testPNGChunk("eXIf", exif)),
+			testWebP(testWebPChunk("EXIF", exif)),
+		} {
+			hasLocationMetadata(image)
+			if scrubbed, err := ScrubLocationMetadata(&Image{Bytes: image}, nil); err == nil && hasLocationMetadata(scrubbed.Bytes) {
+				t.Errorf("scrubbed image %q has location metadata", scrubbed.Bytes)
+			}
+		}
+
+		scrubbed := append([]byte(nil), exif...)
+		if !scrubExif(scrubbed) {
+			return
+		}
+		walkExifEntries(scrubbed, func(gps bool, tag uint16, ifd, entry, value []byte) {
+			if gps {
+				t.Errorf("scrubbed EXIF data %q has GPS entries", scrubbed)
+			} else if exifSerialNumberTags[tag] && !isZero(value) {
+				t.Errorf("scrubbed EXIF data %q has a serial number", scrubbed)
+			}
+		})
+	})
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/rafikk/imagick/imagick"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The largest .cube LUT accepted. Its HALD image is 729 pixels square.
+const MAX_CUBE_LUT_SIZE = 81
+
+// A ColorLookupTable maps the colors of an image to graded colors, such as a
+// photo filter. The table is kept as an encoded HALD CLUT image, which
+// ImageMagick decodes once and applies to the images with the table.
+type ColorLookupTable struct {
+	Name string
+	Hald []byte `json:"-"`
+
+	// The decoded HALD CLUT image. ImageMagick only reads it when applying
+	// the table, so the route's workers share it.
+	wand *imagick.MagickWand
+}
+
+// Decodes the table's HALD CLUT image, unless it's already decoded.
+// ImageMagick must be initialized.
+func (lut *ColorLookupTable) Decode() error {
+	if lut.wand != nil {
+		return nil
+	}
+	wand := imagick.NewMagickWand()
+	if err := wand.ReadImageBlob(lut.Hald); err != nil {
+		wand.Destroy()
+		return err
+	}
+	lut.wand = wand
+	return nil
+}
+
+// Loads a color lookup table from a file: either a HALD CLUT image in PNG
+// format, or an Adobe/Resolve .cube file with a 3D LUT, which is converted to
+// a HALD CLUT image.
+func NewColorLookupTableFromFile(name, path string) (*ColorLookupTable, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		config, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if level := haldLevel(config.Width); config.Width != config.Height || level == 0 {
+			return nil, fmt.Errorf("%dx%d is not the size of a HALD CLUT image", config.Width, config.Height)
+		}
+		return &ColorLookupTable{Name: name, Hald: data}, nil
+	case ".cube":
+		lut, err := parseCubeLUT(data)
+		if err != nil {
+			return nil, err
+		}
+		return &ColorLookupTable{Name: name, Hald: lut.hald()}, nil
+	}
+	return nil, fmt.Errorf("Unsupported color lookup table file %s", path)
+}
+
+// Returns the level of a HALD CLUT image with the given width, which is the
+// cube of its level, or 0 if there's no such level.
+func haldLevel(width int) int {
+	for level := 2; level*level*level <= width; level++ {
+		if level*level*level == width {
+			return level
+		}
+	}
+	return 0
+}
+
+// A cubeLUT is the 3D LUT of a .cube file: the colors of Size entries along
+// each axis, in the file's order with red changing fastest, for the input
+// colors from the domain's minimum to its maximum.
+type cubeLUT struct {
+	Size      int
+	DomainMin [3]float64
+	DomainMax [3]float64
+	Table     [][3]float64
+}
+
+// Parses a .cube file's 3D LUT.
+func parseCubeLUT(data []byte) (*cubeLUT, error) {
+	lut := &cubeLUT{DomainMax: [3]float64{1, 1, 1}}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var err error
+		switch fields[0] {
+		case "TITLE":
+		case "LUT_1D_SIZE":
+			return nil, fmt.Errorf("1D LUTs are not supported")
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("Invalid LUT_3D_SIZE")
+			}
+			if lut.Size, err = strconv.Atoi(fields[1]); err != nil || lut.Size < 2 || lut.Size > MAX_CUBE_LUT_SIZE {
+				return nil, fmt.Errorf("Invalid LUT_3D_SIZE %s", fields[1])
+			}
+		case "DOMAIN_MIN":
+			lut.DomainMin, err = parseCubeTriple(fields[1:])
+		case "DOMAIN_MAX":
+			lut.DomainMax, err = parseCubeTriple(fields[1:])
+		default:
+			var color [3]float64
+			color, err = parseCubeTriple(fields)
+			lut.Table = append(lut.Table, color)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if lut.Size == 0 {
+		return nil, fmt.Errorf("Missing LUT_3D_SIZE")
+	}
+	if entries := lut.Size * lut.Size * lut.Size; len(lut.Table) != entries {
+		return nil, fmt.Errorf("Expected %d LUT entries, found %d", entries, len(lut.Table))
+	}
+	for channel := range lut.DomainMin {
+		if lut.DomainMax[channel] <= lut.DomainMin[channel] {
+			return nil, fmt.Errorf("Invalid LUT domain")
+		}
+	}
+	return lut, nil
+}
+
+func parseCubeTriple(fields []string) (triple [3]float64, err error) {
+	if len(fields) != 3 {
+		return triple, fmt.Errorf("Invalid LUT line %s", strings.Join(fields, " "))
+	}
+	for i, field := range fields {
+		if triple[i], err = strconv.ParseFloat(field, 64); err != nil || math.IsNaN(triple[i]) || math.IsInf(triple[i], 0) {
+			return triple, fmt.Errorf("Invalid LUT value %s", field)
+		}
+	}
+	return triple, nil
+}
+
+// Resamples the LUT to the smallest HALD CLUT image with at least as many
+// entries, and encodes it as a 16-bit binary PPM image. The HALD image's
+// colors are interpolated trilinearly between the LUT's entries.
+func (lut *cubeLUT) hald() []byte {
+	size := lut.Size
+	level := 2
+	for level*level < size {
+		level++
+	}
+	cube := level * level
+	width := cube * level
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "P6\n%d %d\n65535\n", width, width)
+	entry := func(r, g, b int) [3]float64 {
+		return lut.Table[r+g*size+b*size*size]
+	}
+	for b := 0; b < cube; b++ {
+		for g := 0; g < cube; g++ {
+			for r := 0; r < cube; r++ {
+				var position, fraction [3]float64
+				var lower, upper [3]int
+				for channel, value := range [3]int{r, g, b} {
+					input := float64(value) / float64(cube-1)
+					input = (input - lut.DomainMin[channel]) / (lut.DomainMax[channel] - lut.DomainMin[channel])
+					position[channel] = math.Max(0, math.Min(1, input)) * float64(size-1)
+					lower[channel] = int(math.Floor(position[channel]))
+					upper[channel] = lower[channel]
+					if upper[channel] < size-1 {
+						upper[channel]++
+					}
+					fraction[channel] = position[channel] - float64(lower[channel])
+				}
+
+				for channel := 0; channel < 3; channel++ {
+					value := 0.0
+					for corner := 0; corner < 8; corner++ {
+						index, weight := [3]int{}, 1.0
+						for axis := 0; axis < 3; axis++ {
+							if corner&(1<<uint(axis)) != 0 {
+								index[axis] = upper[axis]
+								weight *= fraction[axis]
+							} else {
+								index[axis] = lower[axis]
+								weight *= 1 - fraction[axis]
+							}
+						}
+						value += weight * entry(index[0], index[1], index[2])[channel]
+					}
+					value = math.Max(0, math.Min(1, value))
+					binary.Write(&buffer, binary.BigEndian, uint16(math.Floor(value*65535+0.5)))
+				}
+			}
+		}
+	}
+	return buffer.Bytes()
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Returns a .cube file with an identity LUT of the given size.
+func testCubeLUT(size int) []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "TITLE \"identity\"\n# comment\nLUT_3D_SIZE %d\n", size)
+	for b := 0; b < size; b++ {
+		for g := 0; g < size; g++ {
+			for r := 0; r < size; r++ {
+				fmt.Fprintf(&buffer, "%g %g %g\n", float64(r)/float64(size-1), float64(g)/float64(size-1), float64(b)/float64(size-1))
+			}
+		}
+	}
+	return buffer.Bytes()
+}
+
+func FuzzParseCubeLUT(f *testing.F) {
+	f.Add(testCubeLUT(2))
+	f.Add(testCubeLUT(3))
+	f.Add(append([]byte("DOMAIN_MIN 0 0 0\nDOMAIN_MAX 2 2 2\n"), testCubeLUT(2)...))
+	f.Add(append([]byte("DOMAIN_MIN 0 0 NaN\n"), testCubeLUT(2)...))
+	f.Add([]byte("LUT_1D_SIZE 4\n"))
+	f.Add([]byte("LUT_3D_SIZE 2\n0 0 0\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		lut, err := parseCubeLUT(data)
+		if err != nil {
+			return
+		}
+		if lut.Size < 2 || lut.Size > MAX_CUBE_LUT_SIZE || len(lut.Table) != lut.Size*lut.Size*lut.Size {
+			t.Fatalf("accepted LUT of size %d with %d entries", lut.Size, len(lut.Table))
+		}
+
+		hald := lut.hald()
+		var width int
+		if _, err := fmt.Fscanf(bytes.NewReader(hald), "P6\n%d", &width); err != nil {
+			t.Fatalf("HALD image has no PPM header: %s", err)
+		}
+		if haldLevel(width) == 0 {
+			t.Errorf("HALD image is %d pixels wide, which isn't the cube of a level", width)
+		}
+		header := fmt.Sprintf("P6\n%d %d\n65535\n", width, width)
+		if !strings.HasPrefix(string(hald[:len(header)]), header) || len(hald) != len(header)+width*width*6 {
+			t.Errorf("HALD image of %d bytes isn't %dx%d", len(hald), width, width)
+		}
+	})
+}
+
+func TestParseCubeLUT(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		size      int
+		domainMin [3]float64
+		domainMax [3]float64
+		err       bool
+	}{
+		{"identity", testCubeLUT(2), 2, [3]float64{0, 0, 0}, [3]float64{1, 1, 1}, false},
+		{"domain", append([]byte("DOMAIN_MIN -1 0 0\nDOMAIN_MAX 2 2 2\n"), testCubeLUT(3)...), 3, [3]float64{-1, 0, 0}, [3]float64{2, 2, 2}, false},
+		{"1D", []byte("LUT_1D_SIZE 4\n"), 0, [3]float64{}, [3]float64{}, true},
+		{"missing size", []byte("0 0 0\n"), 0, [3]float64{}, [3]float64{}, true},
+		{"too large", []byte(fmt.Sprintf("LUT_3D_SIZE %d\n", MAX_CUBE_LUT_SIZE+1)), 0, [3]float64{}, [3]float64{}, true},
+		{"missing entries", []byte("LUT_3D_SIZE 2\n0 0 0\n"), 0, [3]float64{}, [3]float64{}, true},
+		{"short entry", append(testCubeLUT(2), "0 0\n"...), 0, [3]float64{}, [3]float64{}, true},
+		{"infinite entry", append(testCubeLUT(2), "0 0 Inf\n"...), 0, [3]float64{}, [3]float64{}, true},
+		{"empty domain", append([]byte("DOMAIN_MIN 1 0 0\n"), testCubeLUT(2)...), 0, [3]float64{}, [3]float64{}, true},
+	}
+	for _, test := range tests {
+		lut, err := parseCubeLUT(test.data)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: parsed invalid LUT", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if lut.Size != test.size || lut.DomainMin != test.domainMin || lut.DomainMax != test.domainMax {
+			t.Errorf("%s: parsed LUT of size %d with domain %v-%v, expected %d with %v-%v",
+				test.name, lut.Size, lut.DomainMin, lut.DomainMax, test.size, test.domainMin, test.domainMax)
+		}
+		// Red changes fastest, so the second entry is the first red step.
+		if step := 1 / float64(test.size-1); lut.Table[1] != [3]float64{step, 0, 0} {
+			t.Errorf("%s: second LUT entry is %v", test.name, lut.Table[1])
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The fraction of the memory ceiling above which new requests are shed.
+	MEMORY_SHED_THRESHOLD = 0.9
+	// How often the process memory usage is sampled.
+	MEMORY_SAMPLE_INTERVAL = time.Second
+)
+
+// MemoryWatchdog periodically samples the memory usage of the process and
+// reports when it is approaching the configured ceiling, so that new requests
+// can be shed rather than having the process killed mid-request.
+type MemoryWatchdog struct {
+	Limit  uint64
+	Logger *Logger
+	usage  uint64
+}
+
+// Creates a new MemoryWatchdog using the server's configuration settings. The
+// watchdog never sheds requests when no memory limit is configured.
+func NewMemoryWatchdogWithConfig(config *ServerConfig) *MemoryWatchdog {
+	return &MemoryWatchdog{
+		Limit:  config.MaxMemory * 1024 * 1024,
+		Logger: NewLogger("memory_watchdog"),
+	}
+}
+
+// Starts sampling memory usage in the background.
+func (m *MemoryWatchdog) Start() {
+	if m.Limit == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(MEMORY_SAMPLE_INTERVAL) {
+			atomic.StoreUint64(&m.usage, m.sample())
+		}
+	}()
+}
+
+// The most recently sampled memory usage in bytes.
+func (m *MemoryWatchdog) Usage() uint64 {
+	return atomic.LoadUint64(&m.usage)
+}
+
+// Returns true if memory usage is close enough to the limit that new
+// processing requests should be rejected.
+func (m *MemoryWatchdog) ShouldShed() bool {
+	return m.Limit > 0 && float64(m.Usage()) >= float64(m.Limit)*MEMORY_SHED_THRESHOLD
+}
+
+// Returns the resident set size of the process. ImageMagick allocates outside
+// of the Go heap, so the Go runtime's statistics are only used where the RSS
+// is unavailable.
+func (m *MemoryWatchdog) sample() uint64 {
+	if data, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) > 1 {
+			if pages, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.Sys
+}
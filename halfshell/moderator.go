@@ -0,0 +1,168 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ModerationVerdict is a moderator's decision about serving an image.
+type ModerationVerdict string
+
+const (
+	// Serve the image.
+	MODERATION_VERDICT_ALLOW ModerationVerdict = "allow"
+	// Refuse to serve the image.
+	MODERATION_VERDICT_BLOCK ModerationVerdict = "block"
+	// Serve the image blurred with the moderator's blur sigma.
+	MODERATION_VERDICT_BLUR ModerationVerdict = "blur"
+)
+
+// The default timeout in seconds for moderating an image.
+const DEFAULT_MODERATOR_TIMEOUT = 5
+
+// The default sigma in pixels of the Gaussian blur of images to be blurred.
+const DEFAULT_MODERATION_BLUR_SIGMA = 20
+
+type ModeratorType string
+type ModeratorFactoryFunction func(*ModeratorConfig) Moderator
+
+var (
+	moderatorTypeToFactoryFunctionMap = make(map[ModeratorType]ModeratorFactoryFunction)
+)
+
+// Moderator is the interface for hooks that decide whether source images may
+// be served, before they are processed.
+type Moderator interface {
+	Moderate(*Image) (ModerationVerdict, error)
+}
+
+// Sets the options to blur an image that a moderator requires to be blurred
+// with the sigma, in place of any blur requested, and to process the image
+// rather than serve it raw.
+func blurForModeration(options *ImageProcessorOptions, sigma float64) {
+	options.GaussianSigma = sigma
+	options.GaussianRadius = 0
+	options.BlurRadius = 0
+	options.Raw = false
+}
+
+func RegisterModerator(moderatorType ModeratorType, factory ModeratorFactoryFunction) {
+	moderatorTypeToFactoryFunctionMap[moderatorType] = factory
+}
+
+// Creates a new Moderator using configuration settings. The moderator caches
+// its verdicts if the configuration has a cache size, and allows images it
+// fails to moderate if the configuration fails open.
+func NewModeratorWithConfig(config *ModeratorConfig) Moderator {
+	factory := moderatorTypeToFactoryFunctionMap[config.Type]
+	if factory == nil {
+		fmt.Fprintf(os.Stderr, "Unknown moderator type: %s\n", config.Type)
+		os.Exit(1)
+	}
+	return &configuredModerator{
+		Moderator: factory(config),
+		Config:    config,
+		Logger:    NewLogger("moderator.%s", config.Name),
+		cache:     newVerdictCache(config.CacheSize),
+	}
+}
+
+type configuredModerator struct {
+	Moderator
+	Config *ModeratorConfig
+	Logger *Logger
+	cache  *verdictCache
+}
+
+func (m *configuredModerator) Moderate(image *Image) (ModerationVerdict, error) {
+	key := sha256.Sum256(image.Bytes)
+	if verdict, ok := m.cache.Get(key); ok {
+		return verdict, nil
+	}
+
+	verdict, err := m.Moderator.Moderate(image)
+	if err != nil {
+		if !m.Config.FailOpen {
+			return verdict, err
+		}
+		m.Logger.Warn("Error moderating image, allowing it: %s", err)
+		return MODERATION_VERDICT_ALLOW, nil
+	}
+	m.cache.Add(key, verdict)
+	return verdict, nil
+}
+
+// verdictCache holds the most recent verdicts, by the SHA-256 of the moderated
+// image, evicting the least recently used.
+type verdictCache struct {
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List
+	mutex   sync.Mutex
+}
+
+type verdictCacheEntry struct {
+	key     [sha256.Size]byte
+	verdict ModerationVerdict
+}
+
+func newVerdictCache(size uint64) *verdictCache {
+	return &verdictCache{
+		size:    int(size),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *verdictCache) Get(key [sha256.Size]byte) (ModerationVerdict, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*verdictCacheEntry).verdict, true
+}
+
+func (c *verdictCache) Add(key [sha256.Size]byte, verdict ModerationVerdict) {
+	if c.size == 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*verdictCacheEntry).verdict = verdict
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&verdictCacheEntry{key, verdict})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*verdictCacheEntry).key)
+	}
+}
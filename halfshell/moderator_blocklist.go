@@ -0,0 +1,95 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bufio"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	MODERATOR_TYPE_HASH_BLOCKLIST ModeratorType = "hash_blocklist"
+)
+
+// HashBlocklistModerator applies its action to images whose perceptual hash
+// is within a Hamming distance of a hash in its blocklist, so that known-bad
+// images are caught after being re-encoded or resized.
+type HashBlocklistModerator struct {
+	Config *ModeratorConfig
+	Logger *Logger
+	hashes []uint64
+}
+
+func NewHashBlocklistModeratorWithConfig(config *ModeratorConfig) Moderator {
+	moderator := &HashBlocklistModerator{
+		Config: config,
+		Logger: NewLogger("moderator.blocklist.%s", config.Name),
+	}
+
+	file, err := os.Open(config.HashesFile)
+	if err != nil {
+		moderator.Logger.Fatal(err)
+	}
+	defer file.Close()
+
+	// The file has one hexadecimal hash per line. Blank lines and lines
+	// starting with '#' are ignored.
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, err := strconv.ParseUint(line, 16, 64)
+		if err != nil {
+			moderator.Logger.Fatalf("Invalid hash %q in %s", line, config.HashesFile)
+		}
+		moderator.hashes = append(moderator.hashes, hash)
+	}
+	if err := scanner.Err(); err != nil {
+		moderator.Logger.Fatal(err)
+	}
+
+	moderator.Logger.Info("Loaded %d blocked hashes from %s", len(moderator.hashes), config.HashesFile)
+	return moderator
+}
+
+func (m *HashBlocklistModerator) Moderate(image *Image) (ModerationVerdict, error) {
+	hexHash, err := PerceptualHash(image)
+	if err != nil {
+		return "", err
+	}
+	hash, _ := strconv.ParseUint(hexHash, 16, 64)
+	for _, blocked := range m.hashes {
+		if uint64(bits.OnesCount64(hash^blocked)) <= m.Config.MaxDistance {
+			m.Logger.Info("Image with hash %s matches blocked hash %016x", hexHash, blocked)
+			return m.Config.Action, nil
+		}
+	}
+	return MODERATION_VERDICT_ALLOW, nil
+}
+
+func init() {
+	RegisterModerator(MODERATOR_TYPE_HASH_BLOCKLIST, NewHashBlocklistModeratorWithConfig)
+}
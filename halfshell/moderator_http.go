@@ -0,0 +1,87 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	MODERATOR_TYPE_HTTP ModeratorType = "http"
+)
+
+// HTTPModerator submits images to a moderation service. The image is POSTed
+// to the service's URL with its perceptual hash in an X-Perceptual-Hash
+// header, and the service responds with a JSON object such as
+// {"verdict": "block"}.
+type HTTPModerator struct {
+	Config *ModeratorConfig
+	Logger *Logger
+	client *http.Client
+}
+
+func NewHTTPModeratorWithConfig(config *ModeratorConfig) Moderator {
+	return &HTTPModerator{
+		Config: config,
+		Logger: NewLogger("moderator.http.%s", config.Name),
+		client: &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+	}
+}
+
+func (m *HTTPModerator) Moderate(image *Image) (ModerationVerdict, error) {
+	request, err := http.NewRequest("POST", m.Config.URL, bytes.NewReader(image.Bytes))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", image.MimeType)
+	if hash, err := PerceptualHash(image); err == nil {
+		request.Header.Set("X-Perceptual-Hash", hash)
+	}
+
+	response, err := m.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Moderation service responded with status %d", response.StatusCode)
+	}
+
+	var result struct {
+		Verdict ModerationVerdict `json:"verdict"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	switch result.Verdict {
+	case MODERATION_VERDICT_ALLOW, MODERATION_VERDICT_BLOCK, MODERATION_VERDICT_BLUR:
+		return result.Verdict, nil
+	}
+	return "", fmt.Errorf("Moderation service responded with unknown verdict %q", result.Verdict)
+}
+
+func init() {
+	RegisterModerator(MODERATOR_TYPE_HTTP, NewHTTPModeratorWithConfig)
+}
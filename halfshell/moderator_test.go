@@ -0,0 +1,92 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// A moderator that returns the same verdict for every image.
+type verdictModerator ModerationVerdict
+
+func (m verdictModerator) Moderate(*Image) (ModerationVerdict, error) {
+	return ModerationVerdict(m), nil
+}
+
+// Checks that an image a moderator requires to be blurred is blurred, even
+// by a processor whose maximum blur radius percentage disables the blur the
+// request asked for.
+func TestModerationBlurChangesPixels(t *testing.T) {
+	card, err := testCardImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	processor := NewImageProcessorWithConfig(&ProcessorConfig{
+		Name:                "moderated",
+		MaxImageWidth:       4000,
+		MaxImageHeight:      4000,
+		MaintainAspectRatio: true,
+		ResizeFilter:        "lanczos",
+	})
+	server := &Server{WorkerPool: NewWorkerPool(1, 1), Logger: NewLogger("server")}
+	request := &HalfshellRequest{
+		Route: &Route{
+			Name:                "moderated",
+			Processor:           processor,
+			WorkerPool:          NewWorkerPool(1, 1),
+			Moderator:           verdictModerator(MODERATION_VERDICT_BLUR),
+			ModerationBlurSigma: DEFAULT_MODERATION_BLUR_SIGMA,
+		},
+		SourceOptions:    &ImageSourceOptions{Path: "/card.png"},
+		ProcessorOptions: &ImageProcessorOptions{Dimensions: ImageDimensions{240, 160}, BlurRadius: 1, Raw: true},
+		Renditions:       []*ImageProcessorOptions{{Dimensions: ImageDimensions{120, 80}}},
+	}
+	requested := *request.ProcessorOptions
+	requested.Raw = false
+
+	if !server.moderate(nil, request, true, card) {
+		t.Fatal("moderator blocked the image")
+	}
+	for _, options := range append([]*ImageProcessorOptions{request.ProcessorOptions}, request.Renditions...) {
+		if options.GaussianSigma != DEFAULT_MODERATION_BLUR_SIGMA || options.Raw {
+			t.Errorf("moderated options %+v don't blur the image", options)
+		}
+	}
+
+	render := func(options ImageProcessorOptions) image.Image {
+		processed, err := processor.ProcessImage(card, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(processed.Bytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+	unblurred, blurred := render(requested), render(*request.ProcessorOptions)
+	if difference := perceptualDifference(unblurred, blurred); difference < 0.05 {
+		t.Errorf("blurred image differs from the unblurred image by only %.4f", difference)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"github.com/rafikk/imagick/imagick"
+	"math/bits"
+	"strconv"
+)
+
+// The dimensions of the grayscale thumbnail that difference hashes compare.
+// Each of the 8 rows yields 8 bits, one for each pair of adjacent pixels.
+const (
+	DHASH_WIDTH  = 9
+	DHASH_HEIGHT = 8
+)
+
+// Returns the difference hash (dHash) of an image as 16 hexadecimal digits.
+// Visually similar images have hashes that differ in few bits, so their
+// Hamming distance can be used to find duplicates that have been re-encoded
+// or resized. Only the first frame of animated images is decoded and hashed.
+func PerceptualHash(image *Image) (string, error) {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+
+	// Let the JPEG decoder skip most of the image's pixels.
+	wand.SetOption("jpeg:size", fmt.Sprintf("%dx%d", DHASH_WIDTH*2, DHASH_HEIGHT*2))
+	if err := readFirstFrame(wand, image.Bytes); err != nil {
+		return "", err
+	}
+	if err := wand.TransformImageColorspace(imagick.COLORSPACE_GRAY); err != nil {
+		return "", err
+	}
+	if err := wand.ResizeImage(DHASH_WIDTH, DHASH_HEIGHT, imagick.FILTER_LANCZOS, 1); err != nil {
+		return "", err
+	}
+	if err := wand.SetImageDepth(8); err != nil {
+		return "", err
+	}
+	if err := wand.SetImageFormat("GRAY"); err != nil {
+		return "", err
+	}
+
+	pixels := wand.GetImageBlob()
+	if len(pixels) < DHASH_WIDTH*DHASH_HEIGHT {
+		return "", fmt.Errorf("Expected %d pixels to hash, got %d", DHASH_WIDTH*DHASH_HEIGHT, len(pixels))
+	}
+
+	var hash uint64
+	for y := 0; y < DHASH_HEIGHT; y++ {
+		for x := 0; x < DHASH_WIDTH-1; x++ {
+			hash <<= 1
+			if pixels[y*DHASH_WIDTH+x] < pixels[y*DHASH_WIDTH+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash), nil
+}
+
+// Returns the Hamming distance between two difference hashes: the number of
+// bits, out of 64, that differ.
+func PerceptualHashDistance(a, b string) (int, error) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	return bits.OnesCount64(x ^ y), nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Copies the C2PA manifest store (Content Credentials) of the original image
+// into the processed image, which has had its metadata stripped. Manifests are
+// kept in JPEG APP11 segments and PNG caBX chunks, so they are only copied
+// between images of the same format, and the processed image is returned as
+// is otherwise.
+//
+// The manifest isn't re-signed: its hard binding covers the original image, so
+// verifiers report the processed image as changed since it was signed, while
+// still showing where it came from.
+func copyProvenance(original, processed []byte) []byte {
+	format := SniffImageFormat(original)
+	if format != SniffImageFormat(processed) {
+		return processed
+	}
+	switch format {
+	case "JPEG":
+		if segments := jpegProvenanceSegments(original); len(segments) > 0 {
+			return insertJPEGSegments(processed, segments)
+		}
+	case "PNG":
+		if chunks := pngProvenanceChunks(original); len(chunks) > 0 {
+			return insertPNGChunks(processed, chunks)
+		}
+	}
+	return processed
+}
+
+// Calls fn with the marker, offset and length of each marker segment of a JPEG
+// image before its scan data, until fn returns false.
+func walkJPEGSegments(data []byte, fn func(marker byte, offset, length int) bool) {
+	offset := 2
+	for offset+4 <= len(data) && data[offset] == 0xff {
+		marker := data[offset+1]
+		if marker == 0xda || marker == 0xd9 {
+			return
+		}
+		length := 2 + int(binary.BigEndian.Uint16(data[offset+2:]))
+		if offset+length > len(data) || !fn(marker, offset, length) {
+			return
+		}
+		offset += length
+	}
+}
+
+// Returns the APP11 segments of a JPEG image holding JUMBF boxes, which is how
+// C2PA manifests are embedded.
+func jpegProvenanceSegments(data []byte) [][]byte {
+	var segments [][]byte
+	walkJPEGSegments(data, func(marker byte, offset, length int) bool {
+		if length >= 4 && isJPEGProvenanceSegment(marker, data[offset+4:offset+length]) {
+			segments = append(segments, data[offset:offset+length])
+		}
+		return true
+	})
+	return segments
+}
+
+// Inserts segments into a JPEG image after its leading APP0 and APP1 segments,
+// which readers expect first.
+func insertJPEGSegments(data []byte, segments [][]byte) []byte {
+	position := 2
+	walkJPEGSegments(data, func(marker byte, offset, length int) bool {
+		if marker != 0xe0 && marker != 0xe1 {
+			return false
+		}
+		position = offset + length
+		return true
+	})
+
+	var buffer bytes.Buffer
+	buffer.Write(data[:position])
+	for _, segment := range segments {
+		buffer.Write(segment)
+	}
+	buffer.Write(data[position:])
+	return buffer.Bytes()
+}
+
+// Calls fn with the type, offset and length, including the length, type and
+// CRC fields, of each chunk of a PNG image, until fn returns false.
+func walkPNGChunks(data []byte, fn func(chunkType string, offset, length int) bool) {
+	offset := 8
+	for offset+12 <= len(data) {
+		length := 12 + int(binary.BigEndian.Uint32(data[offset:]))
+		if length < 12 || offset+length > len(data) || !fn(string(data[offset+4:offset+8]), offset, length) {
+			return
+		}
+		offset += length
+	}
+}
+
+// Returns the caBX chunks of a PNG image, which hold its C2PA manifests.
+func pngProvenanceChunks(data []byte) [][]byte {
+	var chunks [][]byte
+	walkPNGChunks(data, func(chunkType string, offset, length int) bool {
+		if chunkType == "caBX" {
+			chunks = append(chunks, data[offset:offset+length])
+		}
+		return true
+	})
+	return chunks
+}
+
+// Inserts chunks into a PNG image before its first IDAT chunk.
+func insertPNGChunks(data []byte, chunks [][]byte) []byte {
+	position := -1
+	walkPNGChunks(data, func(chunkType string, offset, length int) bool {
+		if chunkType == "IDAT" {
+			position = offset
+			return false
+		}
+		return true
+	})
+	if position < 0 {
+		return data
+	}
+
+	var buffer bytes.Buffer
+	buffer.Write(data[:position])
+	for _, chunk := range chunks {
+		buffer.Write(chunk)
+	}
+	buffer.Write(data[position:])
+	return buffer.Bytes()
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"strconv"
+	"strings"
+)
+
+// Bodies smaller than this aren't worth compressing.
+const COMPRESSION_MIN_SIZE = 512
+
+// Returns the content encoding that the client accepts, according to its
+// Accept-Encoding header, to compress a response with: gzip, deflate, or an
+// empty string for no compression.
+func acceptedContentEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, element := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(element, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				quality, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		accepted[coding] = quality > 0
+	}
+
+	for _, coding := range []string{"gzip", "deflate"} {
+		if enabled, ok := accepted[coding]; enabled || (!ok && accepted["*"]) {
+			return coding
+		}
+	}
+	return ""
+}
+
+// Compresses a body with a content encoding.
+func compressBody(encoding string, body []byte) []byte {
+	var buffer bytes.Buffer
+	switch encoding {
+	case "gzip":
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(body)
+		writer.Close()
+	case "deflate":
+		writer, _ := flate.NewWriter(&buffer, flate.DefaultCompression)
+		writer.Write(body)
+		writer.Close()
+	default:
+		return body
+	}
+	return buffer.Bytes()
+}
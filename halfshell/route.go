@@ -21,72 +21,748 @@
 package halfshell
 
 import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// The maximum number of renditions that can be requested at once.
+const MAX_RENDITIONS = 10
+
+// The largest device pixel ratio client hint that is honored.
+const MAX_CLIENT_HINT_DPR = 4
+
+// The widest aspect ratio, and the inverse of the tallest, that can be
+// requested.
+const MAX_ASPECT_RATIO = 100
+
+// What routes do with requests that don't specify dimensions: scale the image
+// to the processor's default dimensions, serve it at its original dimensions,
+// or reject the request.
+const (
+	MISSING_DIMENSIONS_DEFAULT  = "default"
+	MISSING_DIMENSIONS_ORIGINAL = "original"
+	MISSING_DIMENSIONS_REJECT   = "reject"
+)
+
+// Headers that trusted proxies may use to set options, and the options they
+// set. Header options take precedence over all other options.
+var HeaderDirectives = map[string]string{
+	"X-Halfshell-Width":     "w",
+	"X-Halfshell-Height":    "h",
+	"X-Halfshell-Fit":       "fit",
+	"X-Halfshell-Format":    "format",
+	"X-Halfshell-Quality":   "q",
+	"X-Halfshell-Blur":      "blur",
+	"X-Halfshell-Grayscale": "grayscale",
+}
+
 // A Route handles the business logic of a Halfshell request. It contains a
 // Processor and a Source. When a request is serviced, the appropriate route
 // is chosen after which the image is retrieved from the source and
 // processed by the processor.
 type Route struct {
 	Name           string
+	Tenant         *TenantConfig
 	Pattern        *regexp.Regexp
 	ImagePathIndex int
 	Processor      ImageProcessor
+	ProcessorName  string
 	Source         ImageSource
+	SourceName     string
 	Statter        Statter
+	DefaultOptions map[string]string
+	ParameterNames map[string]string
+
+	AllowedDimensions       []ImageDimensions
+	SnapToAllowedDimensions bool
+	WorkerPool              *WorkerPool
+	BandwidthLimiter        *BandwidthLimiter
+	ClientHints             bool
+	SaveDataProfile         bool
+	Fonts                   map[string]string
+	SocialCard              *SocialCardConfig
+	SpriteSheet             bool
+	Moderator               Moderator
+	ModerationBlurSigma     float64
+	FetchTimeout            time.Duration
+	OutputFormats           []string
+	MinDimensions           ImageDimensions
+	MaxDimensions           ImageDimensions
+	MinAspectRatio          float64
+	MaxAspectRatio          float64
+	Raw                     bool
+	MissingDimensions       string
+	SignatureSecret         string
+	SignatureSecrets        map[string]string
+	SignatureClockSkew      time.Duration
+	UnsignedWatermark       *ImageOverlay
+	PreserveProvenance      bool
+	Digester                *ResponseDigester
+	BlurMode                string
+	GrayscaleExemptPaths    []*regexp.Regexp
+	StripMetadata           bool
+	ErrorImages             bool
+	ErrorImageFont          string
+	LUTs                    map[string]*ColorLookupTable
+	ExifRules               []*ExifRule
+	ScrubLocation           bool
+	Headers                 map[string]string
+	CachePolicy             *CachePolicy
+	CacheControl            string
 }
 
 // Returns a pointer to a new Route instance created using the provided
 // configuration settings.
 func NewRouteWithConfig(config *RouteConfig) *Route {
-	return &Route{
+	route := &Route{
 		Name:           config.Name,
+		Tenant:         config.TenantConfig,
 		Pattern:        config.Pattern,
 		ImagePathIndex: config.ImagePathIndex,
 		Processor:      NewImageProcessorWithConfig(config.ProcessorConfig),
+		ProcessorName:  config.ProcessorConfig.Name,
 		Source:         NewImageSourceWithConfig(config.SourceConfig),
+		SourceName:     config.SourceConfig.Name,
 		Statter:        NewStatterWithConfig(config),
+		DefaultOptions: config.DefaultOptions,
+		ParameterNames: config.ParameterNames,
+
+		AllowedDimensions:       config.AllowedDimensions,
+		SnapToAllowedDimensions: config.SnapToAllowedDimensions,
+		WorkerPool:              NewWorkerPool(config.ProcessingWorkers, config.ProcessingQueueSize),
+		BandwidthLimiter:        NewBandwidthLimiter(config.MaxBandwidth),
+		ClientHints:             config.ClientHints,
+		SaveDataProfile:         config.SaveDataProfile,
+		Fonts:                   config.ProcessorConfig.Fonts,
+		SocialCard:              config.SocialCard,
+		SpriteSheet:             config.SpriteSheet,
+		FetchTimeout:            config.SourceConfig.FetchTimeout,
+		OutputFormats:           config.OutputFormats,
+		MinDimensions:           config.MinDimensions,
+		MaxDimensions:           ImageDimensions{config.ProcessorConfig.MaxImageWidth, config.ProcessorConfig.MaxImageHeight},
+		MinAspectRatio:          config.MinAspectRatio,
+		MaxAspectRatio:          config.MaxAspectRatio,
+		Raw:                     config.Raw,
+		MissingDimensions:       config.MissingDimensions,
+		SignatureSecret:         config.SignatureSecret,
+		SignatureSecrets:        config.SignatureSecrets,
+		SignatureClockSkew:      config.SignatureClockSkew,
+		UnsignedWatermark:       config.UnsignedWatermark,
+		PreserveProvenance:      config.PreserveProvenance,
+		Digester:                NewResponseDigesterWithConfig(config),
+		BlurMode:                config.BlurMode,
+		GrayscaleExemptPaths:    config.ProcessorConfig.GrayscaleExemptPaths,
+		StripMetadata:           config.StripMetadata,
+		ErrorImages:             config.ErrorImages,
+		ErrorImageFont:          config.ErrorImageFont,
+		LUTs:                    config.LUTs,
+		ExifRules:               config.ExifRules,
+		ScrubLocation:           config.ScrubLocation,
+		Headers:                 config.Headers,
+		CachePolicy:             config.CachePolicy,
+		CacheControl:            config.CachePolicy.CacheControl(),
+	}
+	for name, lut := range config.LUTs {
+		if err := lut.Decode(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to decode color lookup table %s for route %s: %v\n", name, config.Name, err)
+			os.Exit(1)
+		}
+	}
+	if config.ModeratorConfig != nil {
+		route.Moderator = NewModeratorWithConfig(config.ModeratorConfig)
+		route.ModerationBlurSigma = config.ModeratorConfig.BlurSigma
 	}
+	return route
 }
 
 // Accepts an HTTP request and returns a bool indicating whether the route
 // should handle the request.
 func (p *Route) ShouldHandleRequest(r *http.Request) bool {
-	return p.Pattern.MatchString(r.URL.Path)
+	path, ok := p.requestPath(r)
+	return ok && p.Pattern.MatchString(path)
+}
+
+// Returns the first of the routes that should handle the request, or nil if
+// none should. A request belonging to a tenant is only handled by the tenant's
+// routes, so requests under a tenant's hostnames or path prefix that none of
+// its routes match aren't served by the top-level routes, or another tenant's.
+func RouteForRequest(routes []*Route, r *http.Request) *Route {
+	var tenant *TenantConfig
+	for _, route := range routes {
+		if route.Tenant == nil {
+			continue
+		}
+		if _, ok := route.Tenant.requestPath(r); ok {
+			tenant = route.Tenant
+			break
+		}
+	}
+
+	for _, route := range routes {
+		if route.Tenant == tenant && route.ShouldHandleRequest(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Returns the path that the route pattern is matched against. For tenant
+// routes, this is the request path without the tenant's path prefix, and
+// false is returned for requests that don't belong to the tenant.
+func (p *Route) requestPath(r *http.Request) (string, bool) {
+	return p.Tenant.requestPath(r)
 }
 
-// Parses the source and processor options from the request.
+// Returns the request path without the tenant's path prefix, and false if the
+// request doesn't belong to the tenant. The prefix matches whole segments of
+// the path, so a prefix of /acme doesn't match /acmecorp/image.jpg. A nil
+// tenant has every request, with its path unchanged.
+func (t *TenantConfig) requestPath(r *http.Request) (string, bool) {
+	if t == nil {
+		return r.URL.Path, true
+	}
+
+	if len(t.Hostnames) > 0 {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		host = strings.ToLower(host)
+
+		matched := false
+		for _, hostname := range t.Hostnames {
+			if host == hostname {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "", false
+		}
+	}
+
+	if t.PathPrefix != "" && r.URL.Path != t.PathPrefix && !strings.HasPrefix(r.URL.Path, t.PathPrefix+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(r.URL.Path, t.PathPrefix), true
+}
+
+// Parses the source and processor options from the request. The returned
+// error describes options that the route does not accept; the options are
+// returned regardless.
 func (p *Route) SourceAndProcessorOptionsForRequest(r *http.Request) (
-	*ImageSourceOptions, *ImageProcessorOptions) {
-	pathArgs := NamedSubexpMap(p.Pattern, r.URL.Path)
+	*ImageSourceOptions, *ImageProcessorOptions, error) {
+	return p.optionsForRequest(r, nil)
+}
+
+// Parses the renditions of the requested image given by the renditions
+// parameter, a JSON array of objects whose values override the request's
+// options for each rendition. Returns nil for requests without renditions.
+func (p *Route) RenditionOptionsForRequest(r *http.Request) ([]*ImageProcessorOptions, error) {
+	value := p.formValue(r, p.parameterName("renditions"))
+	if value == "" {
+		return nil, nil
+	}
+	if p.SpriteSheet || p.SocialCard != nil {
+		return nil, fmt.Errorf("Route %s does not support renditions", p.Name)
+	}
+
+	var renditions []map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &renditions); err != nil || len(renditions) == 0 || len(renditions) > MAX_RENDITIONS {
+		return nil, fmt.Errorf("Invalid value %q for parameter renditions", value)
+	}
 
-	// Lookup `key` argument in URL.Path first, then form values.
+	renditionOptions := make([]*ImageProcessorOptions, 0, len(renditions))
+	for _, rendition := range renditions {
+		overrides := make(map[string]string, len(rendition))
+		for key, value := range rendition {
+			overrides[key] = fmt.Sprint(value)
+		}
+		_, options, err := p.optionsForRequest(r, overrides)
+		if err != nil {
+			return nil, err
+		}
+		if len(options.Overlays) > 0 {
+			return nil, fmt.Errorf("Renditions can't have layers")
+		}
+		renditionOptions = append(renditionOptions, options)
+	}
+	return renditionOptions, nil
+}
+
+// Parses the source and processor options from the request, with the values
+// in overrides taking precedence over all but header directives.
+func (p *Route) optionsForRequest(r *http.Request, overrides map[string]string) (
+	*ImageSourceOptions, *ImageProcessorOptions, error) {
+	path, _ := p.requestPath(r)
+	pathArgs := NamedSubexpMap(p.Pattern, path)
+
+	directives := make(map[string]string)
+	for header, key := range HeaderDirectives {
+		if val := r.Header.Get(header); val != "" {
+			directives[key] = val
+		}
+	}
+
+	// Lookup `key` argument in header directives first, then URL.Path, then
+	// form values, then the route's defaults. Form values may be named
+	// differently for the route, and are read only from the query string on
+	// routes with signature secrets.
 	// (it could be argued that form values should take precedence.)
 	var pathOrFormValue = func(key string) string {
+		if val, ok := directives[key]; ok {
+			return val
+		}
+		if val, ok := overrides[key]; ok {
+			return val
+		}
 		if val, ok := pathArgs[key]; ok {
 			return val
 		}
-		return r.FormValue(key)
+		if val := p.formValue(r, p.parameterName(key)); val != "" {
+			return val
+		}
+		return p.DefaultOptions[key]
+	}
+
+	options := &optionsParser{value: pathOrFormValue}
+	sourceOptions := &ImageSourceOptions{Path: pathArgs["image_path"], Data: p.formValue(r, p.parameterName("data"))}
+	processorOptions := &ImageProcessorOptions{
+		Dimensions: ImageDimensions{options.uint("w"), options.uint("h")},
+		BlurRadius: options.float("blur"),
+		BlurMode:   p.BlurMode,
+		GrayScale:  options.optionalBool("grayscale"),
+		Fit:        ImageFit(options.oneOf("fit", string(IMAGE_FIT_CONTAIN), string(IMAGE_FIT_COVER), string(IMAGE_FIT_FILL), string(IMAGE_FIT_LIQUID))),
+		Format:     imageFormatsByName[options.oneOf("format", imageFormatNames()...)],
+		Quality:    options.uint("q"),
+		SaveData:   options.bool("lite") || strings.EqualFold(r.Header.Get("Save-Data"), "on"),
+		Enlarge:    options.optionalBool("enlarge"),
+		Filter:     options.oneOf("filter", resizeFilterNames()...),
+		Zoom:       options.float("zoom"),
+
+		GaussianRadius: options.float("blur_radius"),
+		GaussianSigma:  options.float("blur_sigma"),
+
+		GrayscaleColorspace: options.oneOf("grayscale_colorspace", "gray", "rec601luma", "rec709luma"),
+		Dither:              options.oneOf("dither", ditherThresholdMaps...),
+		Gamma:               options.float("gamma"),
+		BlackPoint:          options.float("black_point"),
+		WhitePoint:          options.float("white_point"),
+		Enhance:             options.bool("enhance"),
+		Denoise:             options.uint("denoise"),
+		Posterize:           options.uint("posterize"),
+		Flip:                options.oneOf("flip", "h", "v", "hv"),
+		Rotate:              options.float("rotate"),
+
+		Text:           pathOrFormValue("text"),
+		Font:           pathOrFormValue("font"),
+		TextSize:       options.uint("text_size"),
+		TextColor:      options.color("text_color"),
+		TextBackground: options.color("text_background"),
+		TextGravity:    options.oneOf("text_gravity", textGravityNames()...),
+		Overlays:       options.layers("layers"),
+
+		PerceptualHash:   options.oneOf("phash", "header", "json"),
+		PerceptualHashOf: options.oneOf("phash_of", "original", "processed"),
+		Statistics:       options.bool("stats"),
+		Info:             options.bool("info"),
+		CompareTo:        pathOrFormValue("compare_to"),
+		DiffTo:           pathOrFormValue("diff_to"),
+		DiffFuzz:         options.float("diff_fuzz"),
+
+		Raw:                options.bool("raw") || p.Raw,
+		Strip:              p.StripMetadata,
+		ExifRules:          p.ExifRules,
+		PreserveProvenance: p.PreserveProvenance,
+	}
+
+	if aspectRatio := options.aspectRatio("ar"); aspectRatio > 0 {
+		dimensions := &processorOptions.Dimensions
+		if dimensions.Width > 0 && dimensions.Height == 0 {
+			dimensions.Height = uint64(math.Max(math.Floor(float64(dimensions.Width)/aspectRatio+0.5), 1))
+		} else if dimensions.Height > 0 && dimensions.Width == 0 {
+			dimensions.Width = uint64(math.Max(math.Floor(float64(dimensions.Height)*aspectRatio+0.5), 1))
+		} else {
+			options.fail("ar", pathOrFormValue("ar"))
+		}
+		if processorOptions.Fit == "" {
+			processorOptions.Fit = IMAGE_FIT_COVER
+		}
+	}
+
+	if slice := options.floats("slice"); len(slice) > 0 {
+		processorOptions.Slice = parseInsets(slice)
+		if processorOptions.Slice == nil {
+			options.fail("slice", pathOrFormValue("slice"))
+		} else if insets, dimensions := processorOptions.Slice, processorOptions.Dimensions; insets.Left+insets.Right >= dimensions.Width ||
+			insets.Top+insets.Bottom >= dimensions.Height {
+			options.fail("slice", pathOrFormValue("slice"))
+		}
+	}
+
+	if crop := options.floats("crop"); len(crop) > 0 {
+		processorOptions.Crop = parseRect(crop)
+		if processorOptions.Crop == nil || processorOptions.Slice != nil {
+			options.fail("crop", pathOrFormValue("crop"))
+		}
+	}
+	processorOptions.CropOrder = options.oneOf("crop_order", CROP_ORDER_BEFORE, CROP_ORDER_AFTER)
+	if processorOptions.CropOrder != "" && processorOptions.Crop == nil {
+		options.fail("crop_order", pathOrFormValue("crop_order"))
+	}
+
+	if extract := options.floats("extract"); len(extract) > 0 {
+		processorOptions.Extract = parseRect(extract)
+		if processorOptions.Extract == nil {
+			options.fail("extract", pathOrFormValue("extract"))
+		}
+	}
+
+	if strip := options.optionalBool("strip"); strip != nil {
+		processorOptions.Strip = *strip
+	}
+
+	if processorOptions.GrayScale == nil {
+		for _, pattern := range p.GrayscaleExemptPaths {
+			if pattern.MatchString(sourceOptions.Path) {
+				grayscale := false
+				processorOptions.GrayScale = &grayscale
+				break
+			}
+		}
 	}
 
-	width, _ := strconv.ParseUint(pathOrFormValue("w"), 10, 32)
-	height, _ := strconv.ParseUint(pathOrFormValue("h"), 10, 32)
-	blurRadius, _ := strconv.ParseFloat(pathOrFormValue("blur"), 64)
-	grayScale, _ := strconv.ParseBool(pathOrFormValue("grayscale"))
+	if p.SocialCard != nil {
+		p.applySocialCard(processorOptions, pathOrFormValue("title"))
+	}
 
-	return &ImageSourceOptions{Path: pathArgs["image_path"]}, &ImageProcessorOptions{
-		Dimensions: ImageDimensions{width, height},
-		BlurRadius: blurRadius,
-		GrayScale:  grayScale,
+	if processorOptions.Zoom != 0 && (!(processorOptions.Zoom > 0 && processorOptions.Zoom <= MAX_ZOOM) ||
+		processorOptions.Dimensions.Width > 0 || processorOptions.Dimensions.Height > 0) {
+		options.fail("zoom", pathOrFormValue("zoom"))
+	}
+	if processorOptions.BlurRadius < 0 || (processorOptions.BlurMode == BLUR_MODE_SIGMA && processorOptions.BlurRadius > MAX_BLUR_SIGMA) {
+		options.fail("blur", pathOrFormValue("blur"))
+	}
+	if processorOptions.GaussianSigma < 0 || processorOptions.GaussianSigma > MAX_BLUR_SIGMA ||
+		(processorOptions.GaussianSigma > 0 && processorOptions.BlurRadius != 0) {
+		options.fail("blur_sigma", pathOrFormValue("blur_sigma"))
+	}
+	if processorOptions.GaussianRadius < 0 || processorOptions.GaussianRadius > MAX_BLUR_RADIUS ||
+		(processorOptions.GaussianRadius > 0 && processorOptions.GaussianSigma == 0) {
+		options.fail("blur_radius", pathOrFormValue("blur_radius"))
+	}
+	if processorOptions.Quality > 100 {
+		options.fail("q", pathOrFormValue("q"))
+	}
+	if sizes := options.floats("sizes"); len(sizes) > 0 || processorOptions.Format == "ICO" {
+		processorOptions.IconSizes = parseIconSizes(sizes)
+		if processorOptions.IconSizes == nil || processorOptions.Format != "ICO" {
+			options.fail("sizes", pathOrFormValue("sizes"))
+		}
+	}
+	if processorOptions.Format != "" && len(p.OutputFormats) > 0 {
+		allowed := false
+		for _, format := range p.OutputFormats {
+			allowed = allowed || format == processorOptions.Format
+		}
+		if !allowed {
+			options.fail("format", pathOrFormValue("format"))
+		}
+	}
+	if processorOptions.Gamma < 0 || processorOptions.Gamma > 10 {
+		options.fail("gamma", pathOrFormValue("gamma"))
+	}
+	if processorOptions.BlackPoint < 0 || processorOptions.BlackPoint > 100 {
+		options.fail("black_point", pathOrFormValue("black_point"))
+	}
+	if processorOptions.WhitePoint < 0 || processorOptions.WhitePoint > 100 ||
+		(processorOptions.WhitePoint > 0 && processorOptions.WhitePoint <= processorOptions.BlackPoint) {
+		options.fail("white_point", pathOrFormValue("white_point"))
+	}
+	if vignette := options.floats("vignette"); len(vignette) > 0 {
+		processorOptions.VignetteRadius = vignette[0]
+		if len(vignette) > 1 {
+			processorOptions.VignetteOpacity = vignette[1]
+		}
+		if len(vignette) > 2 || processorOptions.VignetteRadius < 0 || processorOptions.VignetteRadius > 1 ||
+			processorOptions.VignetteOpacity < 0 || processorOptions.VignetteOpacity > 1 {
+			options.fail("vignette", pathOrFormValue("vignette"))
+		}
+	}
+	if math.Abs(processorOptions.Rotate) > 360 {
+		options.fail("rotate", pathOrFormValue("rotate"))
+	}
+	if processorOptions.Posterize == 1 || processorOptions.Posterize > 256 {
+		options.fail("posterize", pathOrFormValue("posterize"))
+	}
+	if processorOptions.Denoise > MAX_DENOISE_PASSES {
+		options.fail("denoise", pathOrFormValue("denoise"))
+	}
+	if processorOptions.DiffFuzz < 0 || processorOptions.DiffFuzz > 100 {
+		options.fail("diff_fuzz", pathOrFormValue("diff_fuzz"))
+	}
+	if processorOptions.DiffTo != "" && processorOptions.CompareTo != "" {
+		options.fail("diff_to", processorOptions.DiffTo)
+	}
+	if name := pathOrFormValue("lut"); name != "" {
+		if processorOptions.LUT = p.LUTs[name]; processorOptions.LUT == nil {
+			options.fail("lut", name)
+		}
+	}
+	if processorOptions.Text != "" {
+		if !isSafeText(processorOptions.Text) {
+			options.fail("text", processorOptions.Text)
+		}
+		if _, ok := p.Fonts[processorOptions.Font]; !ok {
+			options.fail("font", processorOptions.Font)
+		}
+		if processorOptions.TextSize > MAX_TEXT_SIZE {
+			options.fail("text_size", pathOrFormValue("text_size"))
+		}
+	}
+	if options.err != nil {
+		return sourceOptions, processorOptions, options.err
+	}
+
+	// With client hints, the width hint stands in for dimensions the request
+	// doesn't specify. Requested dimensions are checked against, or snapped
+	// to, the allowed dimensions first and then scaled by the DPR hint, so
+	// that the allowed dimensions are in CSS pixels.
+	dimensionsRequested := false
+	if p.ClientHints {
+		_, widthInPath := pathArgs["w"]
+		_, heightInPath := pathArgs["h"]
+		dimensionsRequested = widthInPath || heightInPath || processorOptions.Zoom > 0 ||
+			p.formValue(r, p.parameterName("w")) != "" || p.formValue(r, p.parameterName("h")) != ""
+		if !dimensionsRequested {
+			p.applyWidthHint(r, processorOptions)
+		}
+	}
+
+	dimensions, err := p.allowedDimensions(processorOptions.Dimensions)
+	if err != nil {
+		processorOptions.Dimensions = dimensions
+		return sourceOptions, processorOptions, err
+	}
+	if p.ClientHints && dimensionsRequested {
+		dimensions = p.devicePixelDimensions(r, dimensions)
+	}
+	processorOptions.Dimensions = dimensions
+
+	// The minimum dimensions and aspect ratios apply to the dimensions the
+	// image is served at, so they're checked after the client hints.
+	if dimensions.Width > 0 && dimensions.Width < p.MinDimensions.Width {
+		options.fail("w", fmt.Sprint(dimensions.Width))
+	}
+	if dimensions.Height > 0 && dimensions.Height < p.MinDimensions.Height {
+		options.fail("h", fmt.Sprint(dimensions.Height))
+	}
+	if dimensions.Width > 0 && dimensions.Height > 0 {
+		aspectRatio := dimensions.AspectRatio()
+		if (p.MinAspectRatio > 0 && aspectRatio < p.MinAspectRatio) || (p.MaxAspectRatio > 0 && aspectRatio > p.MaxAspectRatio) {
+			options.fail("h", fmt.Sprint(dimensions.Height))
+		}
+	}
+	if options.err != nil {
+		return sourceOptions, processorOptions, options.err
+	}
+
+	if dimensions.Width == 0 && dimensions.Height == 0 && processorOptions.Zoom == 0 {
+		switch p.MissingDimensions {
+		case MISSING_DIMENSIONS_ORIGINAL:
+			processorOptions.OriginalDimensions = true
+		case MISSING_DIMENSIONS_REJECT:
+			err = fmt.Errorf("Route %s requires dimensions", p.Name)
+		}
+	}
+
+	if p.SpriteSheet && err == nil {
+		err = p.applySpriteSheet(processorOptions, options)
+	}
+
+	return sourceOptions, processorOptions, err
+}
+
+// Sets up a sprite sheet with the requested dimensions as its cell size. The
+// sheet itself isn't scaled; its cells are reduced instead to fit the sheet
+// within the processor's maximum dimensions and MAX_SPRITE_SHEET_PIXELS.
+func (p *Route) applySpriteSheet(processorOptions *ImageProcessorOptions, options *optionsParser) error {
+	sheet := &SpriteSheet{
+		Columns:    options.uint("columns"),
+		Cell:       processorOptions.Dimensions,
+		Spacing:    options.uint("spacing"),
+		Background: options.color("background"),
+	}
+	if tiles := options.value("tiles"); tiles != "" {
+		sheet.Paths = strings.Split(tiles, ",")
+	}
+	if sheet.Background == "" {
+		sheet.Background = "#ffffff"
+	}
+
+	if sheet.Cell.Width == 0 || sheet.Cell.Height == 0 {
+		options.fail("w", fmt.Sprint(sheet.Cell.Width))
+	}
+	if len(sheet.Paths)+1 > MAX_SPRITE_TILES {
+		options.fail("tiles", options.value("tiles"))
+	}
+	for _, path := range sheet.Paths {
+		if path == "" {
+			options.fail("tiles", options.value("tiles"))
+		}
+	}
+	if sheet.Spacing > MAX_SPRITE_SPACING {
+		options.fail("spacing", options.value("spacing"))
+	}
+
+	processorOptions.Dimensions = ImageDimensions{}
+	processorOptions.OriginalDimensions = true
+	processorOptions.SpriteSheet = sheet
+	return options.err
+}
+
+// Sets the requested width to the width hint sent with a request that doesn't
+// specify dimensions.
+func (p *Route) applyWidthHint(r *http.Request, options *ImageProcessorOptions) {
+	if width, err := strconv.ParseUint(r.Header.Get("Sec-CH-Width"), 10, 32); err == nil && width > 0 {
+		options.Dimensions = ImageDimensions{Width: width}
+	}
+}
+
+// Returns the dimensions scaled by the device pixel ratio hint sent with the
+// request. The ratio is reduced as needed to keep the dimensions within the
+// processor's maximum dimensions, though dimensions already beyond them aren't
+// reduced.
+func (p *Route) devicePixelDimensions(r *http.Request, dimensions ImageDimensions) ImageDimensions {
+	dpr, err := strconv.ParseFloat(r.Header.Get("Sec-CH-DPR"), 64)
+	if err != nil || !(dpr > 0) {
+		return dimensions
+	}
+	dpr = math.Min(dpr, MAX_CLIENT_HINT_DPR)
+	if p.MaxDimensions.Width > 0 && dimensions.Width > 0 {
+		dpr = math.Min(dpr, math.Max(float64(p.MaxDimensions.Width)/float64(dimensions.Width), 1))
+	}
+	if p.MaxDimensions.Height > 0 && dimensions.Height > 0 {
+		dpr = math.Min(dpr, math.Max(float64(p.MaxDimensions.Height)/float64(dimensions.Height), 1))
+	}
+	return ImageDimensions{
+		uint64(math.Floor(float64(dimensions.Width)*dpr + 0.5)),
+		uint64(math.Floor(float64(dimensions.Height)*dpr + 0.5)),
+	}
+}
+
+// Replaces the processor options affecting the layout of the image with those
+// of the route's social card.
+func (p *Route) applySocialCard(options *ImageProcessorOptions, title string) {
+	card := p.SocialCard
+	enlarge := true
+	options.Dimensions = ImageDimensions{card.Width, card.Height}
+	options.Fit = IMAGE_FIT_COVER
+	options.Enlarge = &enlarge
+	options.Zoom = 0
+	options.Crop = nil
+	options.Extract = nil
+	options.Rotate = 0
+	options.Flip = ""
+
+	options.Text = title
+	options.Font = card.Font
+	options.TextSize = card.TitleSize
+	options.TextColor = card.TitleColor
+	options.TextBackground = card.TitleBackground
+	options.TextGravity = card.TitleGravity
+
+	if card.Logo != "" {
+		options.Overlays = []*ImageOverlay{{
+			Path:    card.Logo,
+			Gravity: card.LogoGravity,
+			X:       TEXT_MARGIN,
+			Y:       TEXT_MARGIN,
+			Blend:   "over",
+			Opacity: 1,
+		}}
 	}
 }
 
+// Returns the value of a request parameter. Routes with signature secrets
+// read parameters only from the query string, which the signature covers, so
+// that values in the body of a POST to a signed URL can't override them.
+func (p *Route) formValue(r *http.Request, name string) string {
+	if p.SignatureSecret != "" || len(p.SignatureSecrets) > 0 {
+		return r.URL.Query().Get(name)
+	}
+	return r.FormValue(name)
+}
+
+// Returns the name of the request parameter holding the value of an option.
+func (p *Route) parameterName(option string) string {
+	if name, ok := p.ParameterNames[option]; ok {
+		return name
+	}
+	return option
+}
+
+// Checks the requested dimensions against the route's allowed dimensions.
+// Returns the requested dimensions or, if the route snaps to allowed
+// dimensions, the nearest allowed dimensions. Requests without dimensions are
+// always allowed.
+func (p *Route) allowedDimensions(dimensions ImageDimensions) (ImageDimensions, error) {
+	if len(p.AllowedDimensions) == 0 || (dimensions.Width == 0 && dimensions.Height == 0) {
+		return dimensions, nil
+	}
+
+	nearest := p.AllowedDimensions[0]
+	nearestDistance := dimensionsDistance(dimensions, nearest)
+	for _, allowed := range p.AllowedDimensions {
+		if allowed == dimensions {
+			return dimensions, nil
+		}
+		if distance := dimensionsDistance(dimensions, allowed); distance < nearestDistance {
+			nearest, nearestDistance = allowed, distance
+		}
+	}
+
+	if p.SnapToAllowedDimensions {
+		return nearest, nil
+	}
+	return dimensions, fmt.Errorf("Dimensions %v are not allowed", dimensions)
+}
+
+// Returns how far apart two dimensions are, ignoring a dimension that wasn't
+// requested.
+func dimensionsDistance(requested, other ImageDimensions) uint64 {
+	var distance uint64
+	if requested.Width > 0 {
+		distance += absDifference(requested.Width, other.Width)
+	}
+	if requested.Height > 0 {
+		distance += absDifference(requested.Height, other.Height)
+	}
+	return distance
+}
+
+func absDifference(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
 // Constructs a map of named subexpressions to their matched string values.
+// The map is empty if the expression doesn't match.
 func NamedSubexpMap(re *regexp.Regexp, s string) map[string]string {
-	matches := re.FindAllStringSubmatch(s, -1)[0]
+	matches := re.FindStringSubmatch(s)
+	if matches == nil {
+		return map[string]string{}
+	}
 	names := re.SubexpNames()
 	m := make(map[string]string, len(names))
 	for i, name := range names {
@@ -98,3 +774,246 @@ func NamedSubexpMap(re *regexp.Regexp, s string) map[string]string {
 	}
 	return m
 }
+
+// Returns the sizes of an icon's images, or the default sizes if none are
+// given, or nil if the values aren't sizes.
+func parseIconSizes(values []float64) []uint64 {
+	if len(values) == 0 {
+		return DEFAULT_ICON_SIZES
+	}
+	if len(values) > MAX_ICON_SIZES {
+		return nil
+	}
+	sizes := make([]uint64, 0, len(values))
+	for _, value := range values {
+		if value < 1 || value > MAX_ICON_SIZE || value != math.Floor(value) {
+			return nil
+		}
+		sizes = append(sizes, uint64(value))
+	}
+	return sizes
+}
+
+// Returns the rectangle given as its x and y offsets, width and height, or nil
+// if the values aren't a rectangle.
+func parseRect(values []float64) *ImageRect {
+	if len(values) != 4 || values[2] == 0 || values[3] == 0 {
+		return nil
+	}
+	for _, value := range values {
+		if value < 0 || value > math.MaxUint32 || value != math.Trunc(value) {
+			return nil
+		}
+	}
+	return &ImageRect{uint64(values[0]), uint64(values[1]), uint64(values[2]), uint64(values[3])}
+}
+
+// Returns the insets given as one value for all edges, or as values for the
+// top, right, bottom and left edges, or nil if the values aren't insets. Like
+// rectangles, insets are at most 32 bits, so that they can be added up.
+func parseInsets(values []float64) *ImageInsets {
+	if len(values) == 1 {
+		values = []float64{values[0], values[0], values[0], values[0]}
+	}
+	if len(values) != 4 {
+		return nil
+	}
+	for _, value := range values {
+		if value < 0 || value > math.MaxUint32 || value != math.Trunc(value) {
+			return nil
+		}
+	}
+	return &ImageInsets{uint64(values[0]), uint64(values[1]), uint64(values[2]), uint64(values[3])}
+}
+
+// optionsParser parses option values looked up by name, remembering the first
+// value that could not be parsed. Missing values parse as the zero value.
+type optionsParser struct {
+	value func(string) string
+	err   error
+}
+
+func (o *optionsParser) fail(key, value string) {
+	if o.err == nil {
+		o.err = fmt.Errorf("Invalid value %q for parameter %s", value, key)
+	}
+}
+
+func (o *optionsParser) uint(key string) uint64 {
+	value := o.value(key)
+	if value == "" {
+		return 0
+	}
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		o.fail(key, value)
+	}
+	return parsed
+}
+
+func (o *optionsParser) float(key string) float64 {
+	value := o.value(key)
+	if value == "" {
+		return 0
+	}
+	parsed, err := parseFiniteFloat(value)
+	if err != nil {
+		o.fail(key, value)
+	}
+	return parsed
+}
+
+func (o *optionsParser) bool(key string) bool {
+	value := o.value(key)
+	if value == "" {
+		return false
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		o.fail(key, value)
+	}
+	return parsed
+}
+
+// Parses a bool that is nil when not given.
+func (o *optionsParser) optionalBool(key string) *bool {
+	if o.value(key) == "" {
+		return nil
+	}
+	parsed := o.bool(key)
+	return &parsed
+}
+
+// Parses an aspect ratio given as width and height separated by a colon, e.g.
+// 16:9, or as a positive number.
+func (o *optionsParser) aspectRatio(key string) float64 {
+	value := o.value(key)
+	if value == "" {
+		return 0
+	}
+	fields := strings.Split(value, ":")
+	ratio, err := strconv.ParseFloat(fields[0], 64)
+	if err == nil && len(fields) == 2 {
+		var height float64
+		if height, err = strconv.ParseFloat(fields[1], 64); err == nil && height > 0 {
+			ratio /= height
+		} else {
+			ratio = 0
+		}
+	}
+	if err != nil || len(fields) > 2 || !(ratio >= 1.0/MAX_ASPECT_RATIO && ratio <= MAX_ASPECT_RATIO) {
+		o.fail(key, value)
+		return 0
+	}
+	return ratio
+}
+
+// Parses a comma separated list of floats.
+func (o *optionsParser) floats(key string) []float64 {
+	value := o.value(key)
+	if value == "" {
+		return nil
+	}
+	var parsed []float64
+	for _, field := range strings.Split(value, ",") {
+		f, err := parseFiniteFloat(strings.TrimSpace(field))
+		if err != nil {
+			o.fail(key, value)
+			return nil
+		}
+		parsed = append(parsed, f)
+	}
+	return parsed
+}
+
+// Parses a float, refusing NaN and infinities, which strconv accepts but no
+// option can take.
+func parseFiniteFloat(value string) (float64, error) {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err == nil && (math.IsNaN(parsed) || math.IsInf(parsed, 0)) {
+		return 0, fmt.Errorf("%s is not a finite number", value)
+	}
+	return parsed, err
+}
+
+// Parses a color given as 6 or 8 hexadecimal digits, RGB or RGBA. The color is
+// returned with a leading '#'.
+func (o *optionsParser) color(key string) string {
+	value := o.value(key)
+	if value == "" {
+		return ""
+	}
+	color, ok := parseHexColor(value)
+	if !ok {
+		o.fail(key, value)
+	}
+	return color
+}
+
+// Parses layers to composite over the image, given as a JSON array of objects
+// with a source path and optional gravity, x and y offsets, blend mode and
+// opacity.
+func (o *optionsParser) layers(key string) []*ImageOverlay {
+	value := o.value(key)
+	if value == "" {
+		return nil
+	}
+
+	var layers []struct {
+		Path    string   `json:"path"`
+		Gravity string   `json:"gravity"`
+		X       int      `json:"x"`
+		Y       int      `json:"y"`
+		Blend   string   `json:"blend"`
+		Opacity *float64 `json:"opacity"`
+	}
+	if err := json.Unmarshal([]byte(value), &layers); err != nil || len(layers) > MAX_LAYERS {
+		o.fail(key, value)
+		return nil
+	}
+
+	overlays := make([]*ImageOverlay, 0, len(layers))
+	for _, layer := range layers {
+		overlay := &ImageOverlay{
+			Path:    layer.Path,
+			Gravity: strings.ToLower(layer.Gravity),
+			X:       layer.X,
+			Y:       layer.Y,
+			Blend:   strings.ToLower(layer.Blend),
+			Opacity: 1,
+		}
+		if overlay.Gravity == "" {
+			overlay.Gravity = "northwest"
+		}
+		if overlay.Blend == "" {
+			overlay.Blend = "over"
+		}
+		if layer.Opacity != nil {
+			overlay.Opacity = *layer.Opacity
+		}
+
+		_, validGravity := textGravities[overlay.Gravity]
+		_, validBlend := blendModes[overlay.Blend]
+		if overlay.Path == "" || !validGravity || !validBlend || overlay.Opacity < 0 || overlay.Opacity > 1 {
+			o.fail(key, value)
+			return nil
+		}
+		overlays = append(overlays, overlay)
+	}
+	return overlays
+}
+
+// Parses a value that must be one of the given choices, ignoring case.
+func (o *optionsParser) oneOf(key string, choices ...string) string {
+	value := strings.ToLower(o.value(key))
+	if value == "" {
+		return ""
+	}
+	for _, choice := range choices {
+		if value == choice {
+			return value
+		}
+	}
+	o.fail(key, value)
+	return ""
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Returns routes covering the ways options are parsed: from the query string,
+// from the path, with client hints, and for sprite sheets.
+func testRoutes() []*Route {
+	processor := NewImageProcessorWithConfig(&ProcessorConfig{
+		Name:                "test",
+		DefaultImageWidth:   800,
+		DefaultImageHeight:  600,
+		MaxImageWidth:       4000,
+		MaxImageHeight:      4000,
+		MaintainAspectRatio: true,
+		ResizeFilter:        "lanczos",
+		GrayscaleColorspace: "gray",
+	})
+	return []*Route{
+		{
+			Name:      "query",
+			Pattern:   regexp.MustCompile(`^/query(?P<image_path>/.+)$`),
+			Processor: processor,
+			BlurMode:  BLUR_MODE_RELATIVE,
+			Fonts:     map[string]string{"sans": "/fonts/sans.ttf"},
+		},
+		{
+			Name:              "path",
+			Pattern:           regexp.MustCompile(`^/path(?P<image_path>/.+)/(?P<w>[^/]*)x(?P<h>[^/]*)$`),
+			Processor:         processor,
+			BlurMode:          BLUR_MODE_SIGMA,
+			MinDimensions:     ImageDimensions{10, 10},
+			MinAspectRatio:    0.25,
+			MaxAspectRatio:    4,
+			MissingDimensions: MISSING_DIMENSIONS_REJECT,
+		},
+		{
+			Name:                    "hints",
+			Pattern:                 regexp.MustCompile(`^/hints(?P<image_path>/.+)$`),
+			Processor:               processor,
+			ClientHints:             true,
+			AllowedDimensions:       []ImageDimensions{{100, 100}, {200, 200}},
+			SnapToAllowedDimensions: true,
+			MissingDimensions:       MISSING_DIMENSIONS_ORIGINAL,
+		},
+		{
+			Name:        "sprites",
+			Pattern:     regexp.MustCompile(`^/sprites(?P<image_path>/.+)$`),
+			Processor:   processor,
+			SpriteSheet: true,
+		},
+	}
+}
+
+func FuzzOptionsForRequest(f *testing.F) {
+	f.Add("/query/a.jpg", "w=100&h=100&fit=cover", "", "")
+	f.Add("/query/a.jpg", "ar=16:9&w=300&q=80&format=webp", "", "")
+	f.Add("/query/a.jpg", "crop=0,0,100,100&crop_order=after&rotate=-360&flip=hv", "", "")
+	f.Add("/query/a.jpg", "slice=10&w=50&h=50&vignette=0.5,0.3&gamma=2.2", "", "")
+	f.Add("/query/a.jpg", `layers=[{"path":"/logo.png","gravity":"SouthEast","opacity":0.5}]`, "", "")
+	f.Add("/query/a.jpg", `renditions=[{"w":100},{"w":200,"format":"avif"}]`, "", "")
+	f.Add("/query/a.jpg", "text=Hello&font=sans&text_size=24&text_color=ff0000", "", "")
+	f.Add("/query/a.jpg", "zoom=0.5&blur=0.25&grayscale=true&dither=o8x8", "", "")
+	f.Add("/query/a.jpg", "format=ico&sizes=16,32,48", "", "")
+	f.Add("/path/a.jpg/100x200", "blur=5", "", "")
+	f.Add("/path/a.jpg/x300", "", "", "")
+	f.Add("/hints/a.jpg", "w=150", "2.5", "")
+	f.Add("/hints/a.jpg", "", "1", "320")
+	f.Add("/sprites/a.jpg", "w=160&h=90&columns=5&tiles=/b.jpg,/c.jpg&spacing=4", "", "")
+	f.Add("/query/a.jpg", "blur=NaN&rotate=Inf&zoom=nan", "", "")
+	f.Add("/query/a.jpg", "vignette=NaN,-Inf&gamma=+Inf&sizes=16,NaN", "", "")
+	f.Add("/hints/a.jpg", "w=100", "NaN", "")
+
+	routes := testRoutes()
+	f.Fuzz(func(t *testing.T, path, query, dpr, width string) {
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: path, RawQuery: query}, Header: http.Header{}}
+		r.Header.Set("Sec-CH-DPR", dpr)
+		r.Header.Set("Sec-CH-Width", width)
+		for _, route := range routes {
+			if !route.ShouldHandleRequest(r) {
+				continue
+			}
+			route.RenditionOptionsForRequest(r)
+			_, options, err := route.SourceAndProcessorOptionsForRequest(r)
+			if err != nil {
+				continue
+			}
+
+			for _, value := range floatOptions(options) {
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					t.Errorf("%s: accepted non-finite option in %+v", route.Name, options)
+				}
+			}
+			if options.Quality > 100 {
+				t.Errorf("%s: accepted quality %d", route.Name, options.Quality)
+			}
+			if options.VignetteRadius < 0 || options.VignetteRadius > 1 || options.VignetteOpacity < 0 || options.VignetteOpacity > 1 {
+				t.Errorf("%s: accepted vignette %v,%v", route.Name, options.VignetteRadius, options.VignetteOpacity)
+			}
+			if math.Abs(options.Rotate) > 360 {
+				t.Errorf("%s: accepted rotation %v", route.Name, options.Rotate)
+			}
+			if sheet := options.SpriteSheet; sheet != nil && (sheet.Cell.Width == 0 || sheet.Cell.Height == 0 || len(sheet.Paths)+1 > MAX_SPRITE_TILES) {
+				t.Errorf("%s: accepted sprite sheet %+v", route.Name, sheet)
+			}
+
+			canonical := route.Processor.CanonicalOptions(options)
+			if again := route.Processor.CanonicalOptions(canonical); !reflect.DeepEqual(again, canonical) {
+				t.Errorf("%s: canonical options %+v are not canonical: %+v", route.Name, canonical, again)
+			}
+		}
+	})
+}
+
+// Returns the values of the float options, and of the floats in slices of
+// them.
+func floatOptions(options *ImageProcessorOptions) []float64 {
+	var values []float64
+	v := reflect.ValueOf(options).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch field := v.Field(i); {
+		case field.Kind() == reflect.Float64:
+			values = append(values, field.Float())
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Float64:
+			for j := 0; j < field.Len(); j++ {
+				values = append(values, field.Index(j).Float())
+			}
+		}
+	}
+	return values
+}
+
+func FuzzNamedSubexpMap(f *testing.F) {
+	f.Add(`^/(?P<image_path>.+)$`, "/a.jpg")
+	f.Add(`^/(?P<w>\d+)x(?P<h>\d+)(?P<image_path>/.+)$`, "/100x200/a.jpg")
+	f.Add(`^/(?P<w>\d+)x(?P<h>\d+)(?P<image_path>/.+)$`, "/axb/a.jpg")
+	f.Add(`(?P<a>x)|(?P<b>y)`, "y")
+	f.Add(`(?P<a>x)*`, "")
+
+	f.Fuzz(func(t *testing.T, pattern, s string) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return
+		}
+		m := NamedSubexpMap(re, s)
+		for name, value := range m {
+			if name == "" {
+				t.Errorf("unnamed group in %v", m)
+			}
+			if !strings.Contains(s, value) {
+				t.Errorf("group %s matched %q, which isn't in %q", name, value, s)
+			}
+		}
+		if !re.MatchString(s) && len(m) > 0 {
+			t.Errorf("groups %v for %q, which %s doesn't match", m, s, pattern)
+		}
+	})
+}
+
+func TestRouteForRequest(t *testing.T) {
+	acme := &TenantConfig{Name: "acme", PathPrefix: "/acme"}
+	hosted := &TenantConfig{Name: "hosted", Hostnames: []string{"images.example.com"}}
+	routes := []*Route{
+		{Name: "acme.images", Tenant: acme, Pattern: regexp.MustCompile(`^/images(?P<image_path>/.+)$`)},
+		{Name: "hosted.images", Tenant: hosted, Pattern: regexp.MustCompile(`^(?P<image_path>/.+\.jpg)$`)},
+		{Name: "images", Pattern: regexp.MustCompile(`^(?P<image_path>/.+)$`)},
+	}
+
+	for _, c := range []struct {
+		host, path, route string
+	}{
+		{"example.com", "/acme/images/a.jpg", "acme.images"},
+		{"example.com", "/acme/other/a.jpg", ""},
+		{"example.com", "/acme", ""},
+		{"example.com", "/acmecorp/images/a.jpg", "images"},
+		{"example.com", "/images/a.jpg", "images"},
+		{"images.example.com:8080", "/a.jpg", "hosted.images"},
+		{"IMAGES.example.com", "/a.png", ""},
+		{"images.example.com", "/acme/images/a.jpg", "acme.images"},
+	} {
+		r := &http.Request{Method: "GET", Host: c.host, URL: &url.URL{Path: c.path}}
+		name := ""
+		if route := RouteForRequest(routes, r); route != nil {
+			name = route.Name
+		}
+		if name != c.route {
+			t.Errorf("%s%s: handled by route %q, want %q", c.host, c.path, name, c.route)
+		}
+	}
+}
+
+func TestMinimumDimensionsAfterClientHints(t *testing.T) {
+	route := &Route{
+		Name:           "hints",
+		Pattern:        regexp.MustCompile(`^(?P<image_path>/.+)$`),
+		Processor:      testRoutes()[0].Processor,
+		ClientHints:    true,
+		MinDimensions:  ImageDimensions{100, 100},
+		MaxAspectRatio: 2,
+	}
+
+	for _, c := range []struct {
+		query, dpr, width string
+		ok                bool
+	}{
+		{"w=100&h=100", "", "", true},
+		{"w=60&h=60", "", "", false},
+		{"w=60&h=60", "2", "", true},
+		{"w=100&h=100", "0.5", "", false},
+		{"", "", "50", false},
+		{"", "", "150", true},
+	} {
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: "/a.jpg", RawQuery: c.query}, Header: http.Header{}}
+		r.Header.Set("Sec-CH-DPR", c.dpr)
+		r.Header.Set("Sec-CH-Width", c.width)
+		if _, _, err := route.SourceAndProcessorOptionsForRequest(r); (err == nil) != c.ok {
+			t.Errorf("%q with DPR %q and width %q: got error %v", c.query, c.dpr, c.width, err)
+		}
+	}
+}
+
+func TestDevicePixelRatioAfterAllowedDimensions(t *testing.T) {
+	route := &Route{
+		Name:                    "hints",
+		Pattern:                 regexp.MustCompile(`^(?P<image_path>/.+)$`),
+		Processor:               testRoutes()[0].Processor,
+		ClientHints:             true,
+		AllowedDimensions:       []ImageDimensions{{100, 100}, {200, 200}},
+		SnapToAllowedDimensions: true,
+		MaxDimensions:           ImageDimensions{300, 300},
+	}
+
+	for _, c := range []struct {
+		query, dpr string
+		dimensions ImageDimensions
+	}{
+		{"w=160&h=160", "", ImageDimensions{200, 200}},
+		{"w=90&h=90", "2", ImageDimensions{200, 200}},
+		{"w=160&h=160", "1.25", ImageDimensions{250, 250}},
+		{"w=160&h=160", "2", ImageDimensions{300, 300}},
+		{"w=160&h=160", "NaN", ImageDimensions{200, 200}},
+		{"w=160&h=160", "0.5", ImageDimensions{100, 100}},
+	} {
+		r := &http.Request{Method: "GET", URL: &url.URL{Path: "/a.jpg", RawQuery: c.query}, Header: http.Header{}}
+		r.Header.Set("Sec-CH-DPR", c.dpr)
+		_, options, err := route.SourceAndProcessorOptionsForRequest(r)
+		if err != nil {
+			t.Errorf("%q with DPR %q: %v", c.query, c.dpr, err)
+		} else if options.Dimensions != c.dimensions {
+			t.Errorf("%q with DPR %q: dimensions %v, want %v", c.query, c.dpr, options.Dimensions, c.dimensions)
+		}
+	}
+}
+
+func TestParseInsets(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []float64
+		expected *ImageInsets
+	}{
+		{"all edges", []float64{5}, &ImageInsets{5, 5, 5, 5}},
+		{"each edge", []float64{1, 2, 3, 4}, &ImageInsets{Top: 1, Right: 2, Bottom: 3, Left: 4}},
+		{"largest", []float64{math.MaxUint32}, &ImageInsets{math.MaxUint32, math.MaxUint32, math.MaxUint32, math.MaxUint32}},
+		{"two values", []float64{1, 2}, nil},
+		{"none", []float64{}, nil},
+		{"negative", []float64{1, -2, 3, 4}, nil},
+		{"fractional", []float64{1.5}, nil},
+		{"too large", []float64{math.MaxUint32 + 1}, nil},
+	}
+	for _, test := range tests {
+		if insets := parseInsets(test.values); !reflect.DeepEqual(insets, test.expected) {
+			t.Errorf("%s: parsed %+v, expected %+v", test.name, insets, test.expected)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// The default timeout in seconds for scanning an image.
+const DEFAULT_SCANNER_TIMEOUT = 10
+
+// The size of the chunks that content is streamed to clamd in.
+const CLAMD_CHUNK_SIZE = 64 * 1024
+
+// ClamdScanner scans content for malware with a clamd daemon, listening on a
+// TCP address such as "127.0.0.1:3310" or on a unix socket given by its path.
+type ClamdScanner struct {
+	Address string
+	Timeout time.Duration
+}
+
+// Streams content to clamd. Returns the name of the signature that the
+// content matched, or an empty string if the content is clean.
+func (s *ClamdScanner) Scan(data []byte) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(s.Address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, s.Address, s.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	// INSTREAM takes the content as chunks prefixed with their length, ending
+	// with an empty chunk.
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > CLAMD_CHUNK_SIZE {
+			chunk = chunk[:CLAMD_CHUNK_SIZE]
+		}
+		if err = binary.Write(conn, binary.BigEndian, uint32(len(chunk))); err != nil {
+			return "", err
+		}
+		if _, err = conn.Write(chunk); err != nil {
+			return "", err
+		}
+		data = data[len(chunk):]
+	}
+	if err = binary.Write(conn, binary.BigEndian, uint32(0)); err != nil {
+		return "", err
+	}
+
+	// The reply is "stream: OK", "stream: <signature> FOUND" or
+	// "<message> ERROR".
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return "", err
+	}
+	result := strings.TrimPrefix(string(bytes.TrimRight(reply, "\x00")), "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd error: %s", result)
+}
+
+// scanningImageSource refuses images from a source that its scanner flags or
+// fails to scan.
+type scanningImageSource struct {
+	ImageSource
+	Scanner *ClamdScanner
+	Logger  *Logger
+}
+
+func newScanningImageSource(source ImageSource, config *SourceConfig) ImageSource {
+	return &scanningImageSource{
+		ImageSource: source,
+		Scanner: &ClamdScanner{
+			Address: config.ScannerAddress,
+			Timeout: time.Duration(config.ScannerTimeout) * time.Second,
+		},
+		Logger: NewLogger("source.scanner.%s", config.Name),
+	}
+}
+
+func (s *scanningImageSource) GetImage(request *ImageSourceOptions) *Image {
+	image := s.ImageSource.GetImage(request)
+	if image == nil {
+		return nil
+	}
+
+	signature, err := s.Scanner.Scan(image.Bytes)
+	if err != nil {
+		s.Logger.Warn("Error scanning image %s, refusing it: %v", request.Path, err)
+		image.Release()
+		return nil
+	}
+	if signature != "" {
+		s.Logger.Warn("Image %s matched malware signature %s, refusing it", request.Path, signature)
+		image.Release()
+		return nil
+	}
+	return image
+}
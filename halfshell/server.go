@@ -21,17 +21,38 @@
 package halfshell
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
 	*http.Server
-	Routes []*Route
-	Logger *Logger
-	Config *ServerConfig
+	Routes         []*Route
+	Logger         *Logger
+	Config         *ServerConfig
+	WorkerPool     *WorkerPool
+	MemoryWatchdog *MemoryWatchdog
+	Statter        Statter
+	AdminServer    *AdminServer
+	FaultInjector  *FaultInjector
+	EventLogger    *EventLogger
+	UsageTracker   *UsageTracker
+	Cache          *ResponseCache
+	HTTP3Server    HTTP3Server
+	warming        int32
 }
 
 func NewServerWithConfigAndRoutes(config *ServerConfig, routes []*Route) *Server {
@@ -41,18 +62,136 @@ func NewServerWithConfigAndRoutes(config *ServerConfig, routes []*Route) *Server
 		WriteTimeout:   time.Duration(config.WriteTimeout) * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	server := &Server{httpServer, routes, NewLogger("server"), config}
+	if config.H2CEnabled {
+		// HTTP/2 is always offered to TLS clients; h2c additionally accepts
+		// HTTP/2 over cleartext connections from internal clients.
+		httpServer.Protocols = new(http.Protocols)
+		httpServer.Protocols.SetHTTP1(true)
+		httpServer.Protocols.SetHTTP2(true)
+		httpServer.Protocols.SetUnencryptedHTTP2(true)
+	}
+	server := &Server{
+		Server:         httpServer,
+		Routes:         routes,
+		Logger:         NewLogger("server"),
+		Config:         config,
+		WorkerPool:     NewWorkerPoolWithConfig(config),
+		MemoryWatchdog: NewMemoryWatchdogWithConfig(config),
+		FaultInjector:  NewFaultInjectorWithConfig(config),
+		EventLogger:    NewEventLoggerWithConfig(config),
+		UsageTracker:   NewUsageTrackerWithConfig(config),
+		Cache:          NewResponseCacheWithConfig(config),
+	}
+	if config.WarmupConfig != nil {
+		server.warming = 1
+	}
+	if !config.StatsdDisabled {
+		server.Statter = NewStatterWithName("server", config.StatsConfigs)
+	}
+	if config.AdminPort > 0 {
+		server.AdminServer = NewAdminServerWithConfig(config, server)
+	}
 	httpServer.Handler = server
+	if config.HTTP3Enabled {
+		server.HTTP3Server = newHTTP3Server(server)
+	}
 	return server
 }
 
+// HTTP3Server serves HTTP/3 alongside the public server, in builds with the
+// http3 tag.
+type HTTP3Server interface {
+	ListenAndServeTLS(certFile, keyFile string) error
+	SetQUICHeaders(http.Header) error
+}
+
+// Starts reporting server statistics and listens for HTTP requests.
+func (s *Server) ListenAndServe() error {
+	s.MemoryWatchdog.Start()
+	s.UsageTracker.Start()
+	if s.Config.WarmupConfig != nil {
+		go s.warmUp()
+	}
+	if s.Statter != nil {
+		go s.reportServerStats()
+	}
+	if s.AdminServer != nil {
+		go func() {
+			s.Logger.Fatal(s.AdminServer.ListenAndServe())
+		}()
+	}
+	if s.Config.UnixSocket != "" {
+		listener, err := s.listenUnix()
+		if err != nil {
+			return err
+		}
+		if s.Config.Port == 0 {
+			return s.Serve(listener)
+		}
+		go func() {
+			s.Logger.Fatal(s.Serve(listener))
+		}()
+	}
+	if s.HTTP3Server != nil {
+		go func() {
+			s.Logger.Fatal(s.HTTP3Server.ListenAndServeTLS(s.Config.TLSCertFile, s.Config.TLSKeyFile))
+		}()
+	}
+	if s.Config.TLSCertFile != "" {
+		return s.Server.ListenAndServeTLS(s.Config.TLSCertFile, s.Config.TLSKeyFile)
+	}
+	return s.Server.ListenAndServe()
+}
+
+// Listens on the configured unix socket, replacing a socket left behind by a
+// previous process.
+func (s *Server) listenUnix() (net.Listener, error) {
+	path := s.Config.UnixSocket
+	if fileInfo, err := os.Lstat(path); err == nil && fileInfo.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Config.UnixSocketMode != 0 {
+		if err = os.Chmod(path, s.Config.UnixSocketMode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+func (s *Server) reportServerStats() {
+	for range time.Tick(10 * time.Second) {
+		s.Statter.Gauge("worker_pool.queue_depth", s.WorkerPool.QueueDepth())
+		s.Statter.Gauge("worker_pool.in_flight", s.WorkerPool.InFlight())
+		if s.Cache != nil {
+			stats := s.Cache.Stats()
+			s.Statter.Gauge("cache.entries", int64(stats.Entries))
+			s.Statter.Gauge("cache.size", int64(stats.Size))
+		}
+	}
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	hw := s.NewHalfshellResponseWriter(w)
+	if s.HTTP3Server != nil && r.ProtoMajor < 3 {
+		s.HTTP3Server.SetQUICHeaders(w.Header())
+	}
+	hw := s.NewHalfshellResponseWriter(w, r)
 	hr := s.NewHalfshellRequest(r)
 	defer s.LogRequest(hw, hr)
 	switch {
+	case s.AdminServer != nil:
+		s.ImageRequestHandler(hw, hr)
 	case "/healthcheck" == hr.URL.Path || "/health" == hr.URL.Path:
 		hw.Write([]byte("OK"))
+	case "/ready" == hr.URL.Path:
+		s.ReadinessHandler(hw, hr)
 	default:
 		s.ImageRequestHandler(hw, hr)
 	}
@@ -65,30 +204,669 @@ func (s *Server) ImageRequestHandler(w *HalfshellResponseWriter, r *HalfshellReq
 		return
 	}
 
-	if !s.Config.StatsdDisabled {
+	if !s.Config.StatsdDisabled && !r.Warmup {
 		defer func() { go r.Route.Statter.RegisterRequest(w, r) }()
 	}
+	w.Headers = r.Route.Headers
+	w.CacheControl = r.Route.CacheControl
+	if !r.SignatureExpires.IsZero() {
+		w.CacheControl = r.Route.CachePolicy.CacheControlUntil(r.SignatureExpires)
+	}
+	w.CountPixels = s.UsageTracker != nil
+
+	if r.Route.ClientHints {
+		w.SetHeader("Accept-CH", "Sec-CH-DPR, Sec-CH-Width")
+		w.SetHeader("Vary", "Sec-CH-DPR, Sec-CH-Width, Save-Data")
+	} else if r.Route.SaveDataProfile {
+		w.SetHeader("Vary", "Save-Data")
+	}
+
+	if r.WantsExplanation() {
+		s.ExplainHandler(w, r)
+		return
+	}
+
+	if r.SignatureError != nil {
+		s.writeRouteError(w, r, r.SignatureError.Error(), http.StatusForbidden)
+		return
+	}
+
+	if r.OptionsError != nil {
+		s.writeRouteError(w, r, r.OptionsError.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !r.Warmup {
+		r.QuotaError = s.UsageTracker.CheckQuota(s.UsageTracker.Account(r))
+	}
+	if r.QuotaError != nil {
+		if r.QuotaError.Status == http.StatusTooManyRequests {
+			w.SetHeader("Retry-After", strconv.Itoa(int(time.Until(nextUsagePeriod(time.Now())).Seconds())+1))
+		}
+		s.writeRouteError(w, r, r.QuotaError.Error(), r.QuotaError.Status)
+		return
+	}
+
+	if r.ProcessorOptions.Info {
+		s.writeInfo(w, r)
+		return
+	}
+
+	cache := s.Cache
+	if !r.Route.CachePolicy.Memory {
+		cache = nil
+	}
+	cacheKey := r.CacheKey()
+	cached, hit := cache.Get(cacheKey)
+	if hit {
+		r.CacheStatus = CACHE_STATUS_HIT
+	}
+	if cache != nil && s.Statter != nil {
+		s.Statter.Count("cache." + strings.ToLower(r.CacheStatus))
+	}
+
+	if s.wantsDebugHeaders(r.Request) {
+		s.setDebugHeaders(w, r)
+	}
+
+	if hit {
+		w.BandwidthLimiter = r.Route.BandwidthLimiter
+		w.Digester = r.Route.Digester
+		w.WriteCachedResponse(cached)
+		return
+	}
+	if cache != nil {
+		w.captureResponse(cache.MaxSize)
+		defer s.cacheResponse(w, r, cacheKey)
+	}
+
+	if s.MemoryWatchdog.ShouldShed() {
+		s.Logger.Warn("Memory usage %d exceeds threshold, shedding request for image %s",
+			s.MemoryWatchdog.Usage(), r.SourceOptions.Path)
+		if s.Statter != nil {
+			s.Statter.Count("memory.shed")
+		}
+		w.SetHeader("Retry-After", "5")
+		s.writeRouteError(w, r, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
 
 	s.Logger.Info("Handling request for image %s with dimensions %v",
 		r.SourceOptions.Path, r.ProcessorOptions.Dimensions)
 
-	image := r.Route.Source.GetImage(r.SourceOptions)
-	if image == nil {
-		w.WriteError("Not Found", http.StatusNotFound)
+	fetchStart := time.Now()
+	image, err := s.getImage(r, r.SourceOptions)
+	r.FetchDuration = time.Since(fetchStart)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	defer image.Release()
+	r.SourceSize = len(image.Bytes)
+
+	w.Digester = r.Route.Digester
+	if w.Digester != nil {
+		w.Digester.SetSourceHeader(w, image.Bytes)
+	}
+
+	// Every image that the response is made from is checked against the
+	// route's EXIF rules and moderated before any of it is served. Diffs and
+	// comparisons are of the original images, which can't be blurred, so
+	// they're refused for images that are to be blurred.
+	comparedPath := r.ProcessorOptions.CompareTo
+	if comparedPath == "" {
+		comparedPath = r.ProcessorOptions.DiffTo
+	}
+	if comparedPath != "" {
+		other, err := s.getImage(r, &ImageSourceOptions{Path: comparedPath})
+		if err != nil {
+			s.Logger.Warn("Compared image %s for image %s: %s", comparedPath, r.SourceOptions.Path, err)
+			s.writeError(w, r, err)
+			return
+		}
+		defer other.Release()
+		if !s.checkExifRules(w, r, image, other) || !s.moderate(w, r, false, image, other) {
+			return
+		}
+		if r.ProcessorOptions.CompareTo != "" {
+			s.writeComparison(w, r, image, other)
+		} else {
+			s.writeDiff(w, r, image, other)
+		}
 		return
 	}
 
-	processedImage := r.Route.Processor.ProcessImage(image, r.ProcessorOptions)
+	images := []*Image{image}
+	for _, overlay := range r.ProcessorOptions.Overlays {
+		if overlay.Image, err = s.getImage(r, &ImageSourceOptions{Path: overlay.Path}); err != nil {
+			s.Logger.Warn("Overlay %s for image %s: %s", overlay.Path, r.SourceOptions.Path, err)
+			s.writeError(w, r, err)
+			return
+		}
+		defer overlay.Image.Release()
+		images = append(images, overlay.Image)
+	}
+
+	if sheet := r.ProcessorOptions.SpriteSheet; sheet != nil {
+		sheet.Images = make([]*Image, 0, len(sheet.Paths))
+		for _, path := range sheet.Paths {
+			tile, err := s.getImage(r, &ImageSourceOptions{Path: path})
+			if err != nil {
+				s.Logger.Warn("Sprite tile %s for image %s: %s", path, r.SourceOptions.Path, err)
+				s.writeError(w, r, err)
+				return
+			}
+			defer tile.Release()
+			sheet.Images = append(sheet.Images, tile)
+			images = append(images, tile)
+		}
+	}
+
+	if !s.checkExifRules(w, r, images...) || !s.moderate(w, r, true, images...) {
+		return
+	}
+
+	s.FaultInjector.DelayResponse()
+	if s.FaultInjector.FailProcessing() {
+		s.Logger.Warn("Injecting processing failure for image %s", r.SourceOptions.Path)
+		s.writeRouteError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.ProcessorOptions.Raw {
+		s.writeRaw(w, r, image)
+		return
+	}
+
+	if r.Renditions != nil {
+		s.writeRenditions(w, r, image)
+		return
+	}
+
+	var processedImage *Image
+	var hash string
+	var hashErr error
+	accepted := s.doWork(r, func() {
+		// Hashes of the original image don't need the image to be processed.
+		if r.ProcessorOptions.PerceptualHash == "json" && r.ProcessorOptions.PerceptualHashOf == "original" {
+			processedImage = image
+		} else if processedImage, err = r.Route.Processor.ProcessImage(image, r.ProcessorOptions); processedImage == nil {
+			return
+		}
+
+		if r.ProcessorOptions.PerceptualHash != "" {
+			hashedImage := processedImage
+			if r.ProcessorOptions.PerceptualHashOf == "original" {
+				hashedImage = image
+			}
+			hash, hashErr = PerceptualHash(hashedImage)
+		}
+	})
+	if !accepted {
+		s.writeSaturated(w, r)
+		return
+	}
 	if processedImage == nil {
-		s.Logger.Warn("Error processing image data %s to dimensions: %v",
-			r.ProcessorOptions.Dimensions)
-		w.WriteError("Internal Server Error", http.StatusNotFound)
+		s.Logger.Warn("Error processing image data %s to dimensions: %v: %s",
+			r.SourceOptions.Path, r.ProcessorOptions.Dimensions, err)
+		s.writeError(w, r, err)
+		return
+	}
+
+	if r.ProcessorOptions.Statistics {
+		s.writeStatistics(w, r, processedImage)
+		return
+	}
+
+	if r.ProcessorOptions.PerceptualHash != "" {
+		if hashErr != nil {
+			s.Logger.Warn("Error hashing image %s: %s", r.SourceOptions.Path, hashErr)
+		}
+		if r.ProcessorOptions.PerceptualHash == "json" {
+			s.writePerceptualHash(w, r, hash, hashErr)
+			return
+		}
+		if hashErr == nil {
+			w.SetHeader("X-Perceptual-Hash", hash)
+		}
+	}
+
+	scrubbed, ok := s.scrubLocation(w, r, processedImage)
+	if !ok {
 		return
 	}
 
 	s.Logger.Info("Returning resized image %s to dimensions %v",
 		r.SourceOptions.Path, r.ProcessorOptions.Dimensions)
-	w.WriteImage(processedImage)
+	w.BandwidthLimiter = r.Route.BandwidthLimiter
+	w.WriteImage(scrubbed[0])
+}
+
+// Scrubs the GPS location and camera serial numbers from the images of a
+// route that scrubs them, and asserts it in a header. Returns false if an
+// image can't be scrubbed and verified, in which case an error response is
+// written, as images are never served with their location.
+func (s *Server) scrubLocation(w *HalfshellResponseWriter, r *HalfshellRequest, images ...*Image) ([]*Image, bool) {
+	if !r.Route.ScrubLocation {
+		return images, true
+	}
+
+	scrubbed := make([]*Image, len(images))
+	var err error
+	scrub := func() {
+		for i, image := range images {
+			if scrubbed[i], err = ScrubLocationMetadata(image, r.Route.Processor); err != nil {
+				return
+			}
+		}
+	}
+	// Images that are scrubbed by re-encoding them are decoded, so they're
+	// scrubbed on the route's workers.
+	reencoded := false
+	for _, image := range images {
+		reencoded = reencoded || reencodedToScrubLocation(image)
+	}
+	if !reencoded {
+		scrub()
+	} else if !s.doWork(r, scrub) {
+		s.writeSaturated(w, r)
+		return nil, false
+	}
+	if err != nil {
+		s.Logger.Warn("Error scrubbing location of image %s: %s", r.SourceOptions.Path, err)
+		s.writeRouteError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	w.SetHeader(LOCATION_SCRUBBED_HEADER, "true")
+	return scrubbed, true
+}
+
+// Responds with the image as fetched from the source, without processing it.
+// The Content-Type is taken from the image's format where it's recognized, and
+// SVG images are still sanitized.
+func (s *Server) writeRaw(w *HalfshellResponseWriter, r *HalfshellRequest, image *Image) {
+	rawImage := &Image{Bytes: image.Bytes, MimeType: image.MimeType}
+	if format := SniffImageFormat(image.Bytes); format != "" {
+		rawImage.MimeType = MimeTypeForImageFormat(format)
+	}
+	if rawImage.MimeType == "image/svg+xml" {
+		sanitized, err := SanitizeSVG(image.Bytes)
+		if err != nil {
+			s.Logger.Warn("Error sanitizing SVG image %s: %s", r.SourceOptions.Path, err)
+			s.writeError(w, r, err)
+			return
+		}
+		rawImage.Bytes = sanitized
+	}
+
+	scrubbed, ok := s.scrubLocation(w, r, rawImage)
+	if !ok {
+		return
+	}
+
+	s.Logger.Info("Returning raw image %s", r.SourceOptions.Path)
+	w.BandwidthLimiter = r.Route.BandwidthLimiter
+	w.WriteImage(scrubbed[0])
+}
+
+// Processes the request's renditions of an image and responds with them as
+// the parts of a multipart/mixed response, in the order they were requested.
+func (s *Server) writeRenditions(w *HalfshellResponseWriter, r *HalfshellRequest, image *Image) {
+	var renditions []*Image
+	var err error
+	accepted := s.doWork(r, func() {
+		renditions, err = r.Route.Processor.ProcessImageRenditions(image, r.Renditions)
+	})
+	if !accepted {
+		s.writeSaturated(w, r)
+		return
+	}
+	if err != nil {
+		s.Logger.Warn("Error processing renditions of image %s: %s", r.SourceOptions.Path, err)
+		s.writeError(w, r, err)
+		return
+	}
+
+	renditions, ok := s.scrubLocation(w, r, renditions...)
+	if !ok {
+		return
+	}
+
+	s.Logger.Info("Returning %d renditions of image %s", len(renditions), r.SourceOptions.Path)
+	w.BandwidthLimiter = r.Route.BandwidthLimiter
+	w.WriteImages(renditions)
+}
+
+// Runs work on one of the route's workers and one of the server's workers.
+// Requests wait for a share of the route's workers before queueing for the
+// server's workers, so that a busy route can't fill the server's queue. The
+// server's workers serve the queues of tenants, and of top-level routes, in
+// turn. Returns false if the server's queue was full.
+func (s *Server) doWork(r *HalfshellRequest, work func()) bool {
+	return doWorkForRoute(s.WorkerPool, r.Route, work)
+}
+
+// Runs work for a route on one of its workers and one of the pool's workers,
+// in the queue of the route's tenant or of the route, like Server.doWork.
+func doWorkForRoute(pool *WorkerPool, route *Route, work func()) bool {
+	queue := route.Name
+	if route.Tenant != nil {
+		queue = route.Tenant.Name
+	}
+	accepted := false
+	route.WorkerPool.Do(func() {
+		accepted = pool.DoInQueue(queue, work)
+	})
+	return accepted
+}
+
+func (s *Server) writeSaturated(w *HalfshellResponseWriter, r *HalfshellRequest) {
+	s.Logger.Warn("Worker pool saturated, rejecting request for image %s",
+		r.SourceOptions.Path)
+	if s.Statter != nil {
+		s.Statter.Count("worker_pool.rejected")
+	}
+	s.writeRouteError(w, r, "Service Unavailable", http.StatusServiceUnavailable)
+}
+
+// Fetches an image from the route's source. Gives up waiting for the source
+// after the route's fetch timeout, releasing the image if it arrives later. The
+// source is given the request's context, with the timeout as its deadline, so
+// that HTTP and database fetches still under way are cancelled when the
+// request is, or when it times out.
+func (s *Server) getImage(r *HalfshellRequest, options *ImageSourceOptions) (*Image, error) {
+	contextOptions := *options
+	contextOptions.Context = r.Context()
+	options = &contextOptions
+	fetch := func() *Image {
+		s.FaultInjector.DelaySource()
+		return r.Route.Source.GetImage(options)
+	}
+	if r.Route.FetchTimeout == 0 {
+		if image := fetch(); image != nil {
+			return image, nil
+		}
+		return nil, ErrImageNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), r.Route.FetchTimeout)
+	defer cancel()
+	contextOptions.Context = ctx
+
+	fetched := make(chan *Image, 1)
+	go func() { fetched <- fetch() }()
+
+	timer := time.NewTimer(r.Route.FetchTimeout)
+	defer timer.Stop()
+	select {
+	case image := <-fetched:
+		if image == nil {
+			return nil, ErrImageNotFound
+		}
+		return image, nil
+	case <-timer.C:
+		go func() {
+			if image := <-fetched; image != nil {
+				image.Release()
+			}
+		}()
+		return nil, &StageTimeoutError{"fetch", r.Route.FetchTimeout}
+	}
+}
+
+// Writes the response for an error fetching or processing an image: 504 for
+// stage timeouts and 404 otherwise.
+func (s *Server) writeError(w *HalfshellResponseWriter, r *HalfshellRequest, err error) {
+	if timeoutErr, ok := err.(*StageTimeoutError); ok {
+		s.Logger.Warn("Request for image %s timed out: %s", r.SourceOptions.Path, err)
+		if s.Statter != nil {
+			s.Statter.Count(fmt.Sprintf("timeout.%s", timeoutErr.Stage))
+		}
+		s.writeRouteError(w, r, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if err == ErrImageNotFound {
+		s.writeRouteError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+	if err == ErrImageRejected {
+		s.writeRouteError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	s.writeRouteError(w, r, "Internal Server Error", http.StatusNotFound)
+}
+
+// Writes an error response to a request for an image. Routes with error images
+// respond with a placeholder image of the requested dimensions instead of the
+// message, with the same status. Requests turned away because the server is
+// overloaded or the client is over its quota always get the message, since
+// rendering a placeholder would spend the ImageMagick time they are refused.
+// Placeholders are rendered on the route's workers like other images, and the
+// message is written instead when the workers are saturated.
+func (s *Server) writeRouteError(w *HalfshellResponseWriter, r *HalfshellRequest, message string, status int) {
+	if r.Route.ErrorImages && status != http.StatusServiceUnavailable && status != http.StatusTooManyRequests {
+		var dimensions ImageDimensions
+		if r.ProcessorOptions != nil {
+			dimensions = r.ProcessorOptions.Dimensions
+		}
+		var image *Image
+		var err error
+		if s.doWork(r, func() { image, err = NewErrorImage(dimensions, status, r.Route.ErrorImageFont) }) {
+			if err == nil {
+				w.WriteErrorImage(image, status)
+				return
+			}
+			s.Logger.Warn("Error rendering error image for %s: %s", r.URL.Path, err)
+		}
+	}
+	w.WriteError(message, status)
+}
+
+// Refuses the request if any of the images that the response is made from is
+// rejected by the route's EXIF rules, whatever the response is. Writes the
+// error response and returns false if so.
+func (s *Server) checkExifRules(w *HalfshellResponseWriter, r *HalfshellRequest, images ...*Image) bool {
+	if len(r.Route.ExifRules) == 0 {
+		return true
+	}
+
+	var err error
+	if !s.doWork(r, func() {
+		for _, image := range images {
+			if err = checkRejectRules(r.Route.ExifRules, image); err != nil {
+				return
+			}
+		}
+	}) {
+		s.writeSaturated(w, r)
+		return false
+	}
+	if err != nil {
+		s.Logger.Info("Refusing image %s: %s", r.SourceOptions.Path, err)
+		s.writeError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// Applies the route's moderator to the images a request is served from, the
+// first of which is the source image. Returns false if an image is not to be served, in
+// which case the response has been written. When blur is true, a source image
+// that is to be blurred is blurred by the processor; other images that are to
+// be blurred are refused like blocked images.
+func (s *Server) moderate(w *HalfshellResponseWriter, r *HalfshellRequest, blur bool, images ...*Image) bool {
+	if r.Route.Moderator == nil {
+		return true
+	}
+
+	// Moderators may decode the images, so they're run on the route's workers.
+	verdicts := make([]ModerationVerdict, len(images))
+	var err error
+	if !s.doWork(r, func() {
+		for i, image := range images {
+			if verdicts[i], err = r.Route.Moderator.Moderate(image); err != nil {
+				return
+			}
+		}
+	}) {
+		s.writeSaturated(w, r)
+		return false
+	}
+	if err != nil {
+		s.Logger.Warn("Error moderating image %s: %s", r.SourceOptions.Path, err)
+		s.writeRouteError(w, r, "Service Unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+
+	for i, verdict := range verdicts {
+		if verdict == MODERATION_VERDICT_BLUR && blur && i == 0 {
+			s.Logger.Info("Moderator blurred image %s", r.SourceOptions.Path)
+			if s.Statter != nil {
+				s.Statter.Count("moderation.blurred")
+			}
+			blurForModeration(r.ProcessorOptions, r.Route.ModerationBlurSigma)
+			for _, rendition := range r.Renditions {
+				blurForModeration(rendition, r.Route.ModerationBlurSigma)
+			}
+		} else if verdict != MODERATION_VERDICT_ALLOW {
+			s.Logger.Info("Moderator blocked image %s", r.SourceOptions.Path)
+			if s.Statter != nil {
+				s.Statter.Count("moderation.blocked")
+			}
+			s.writeRouteError(w, r, "Forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// Responds with the perceptual hash of an image as JSON, or with an error if
+// the image couldn't be hashed.
+func (s *Server) writePerceptualHash(w *HalfshellResponseWriter, r *HalfshellRequest, hash string, err error) {
+	if err != nil {
+		w.WriteError("Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	imageOf := r.ProcessorOptions.PerceptualHashOf
+	if imageOf == "" {
+		imageOf = "processed"
+	}
+	w.WriteJSON(map[string]string{"dhash": hash, "image": imageOf})
+}
+
+// Responds with the perceptual hashes of an original image and of the image
+// it's compared to as JSON, with the Hamming distance between the hashes and
+// their similarity, from 0 for opposite hashes to 1 for identical hashes.
+func (s *Server) writeComparison(w *HalfshellResponseWriter, r *HalfshellRequest, image, other *Image) {
+	var hash, otherHash string
+	var err error
+	if !s.doWork(r, func() {
+		if hash, err = PerceptualHash(image); err == nil {
+			otherHash, err = PerceptualHash(other)
+		}
+	}) {
+		s.writeSaturated(w, r)
+		return
+	}
+	if err != nil {
+		s.Logger.Warn("Error hashing image %s: %s", r.SourceOptions.Path, err)
+		s.writeRouteError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	distance, _ := PerceptualHashDistance(hash, otherHash)
+	w.WriteJSON(map[string]interface{}{
+		"dhash":            hash,
+		"compare_to_dhash": otherHash,
+		"distance":         distance,
+		"similarity":       1 - float64(distance)/64,
+	})
+}
+
+// Responds with a visual diff of an original image and the image it's diffed
+// with, and the percentage of their pixels that differ in a header.
+func (s *Server) writeDiff(w *HalfshellResponseWriter, r *HalfshellRequest, image, other *Image) {
+	var diff *Image
+	var err error
+	var changedPixels float64
+	if !s.doWork(r, func() { diff, changedPixels, err = DiffImages(image, other, r.ProcessorOptions.DiffFuzz) }) {
+		s.writeSaturated(w, r)
+		return
+	}
+	if err != nil {
+		s.Logger.Warn("Error diffing image %s with %s: %s", r.SourceOptions.Path, r.ProcessorOptions.DiffTo, err)
+		s.writeRouteError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	scrubbed, ok := s.scrubLocation(w, r, diff)
+	if !ok {
+		return
+	}
+
+	w.SetHeader(DIFF_CHANGED_PIXELS_HEADER, strconv.FormatFloat(changedPixels, 'f', 4, 64))
+	w.WriteImage(scrubbed[0])
+}
+
+// Responds with the metadata of the requested source image as JSON, looked up
+// without downloading the image where the route's source can.
+func (s *Server) writeInfo(w *HalfshellResponseWriter, r *HalfshellRequest) {
+	metadata, err := GetImageMetadata(r.Route.Source, r.SourceOptions)
+	if err != nil {
+		s.Logger.Warn("Error looking up image %s: %s", r.SourceOptions.Path, err)
+		s.writeRouteError(w, r, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	if !metadata.Exists {
+		s.writeRouteError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	info := map[string]interface{}{"path": r.SourceOptions.Path}
+	if metadata.Size >= 0 {
+		info["size"] = metadata.Size
+	}
+	if !metadata.LastModified.IsZero() {
+		info["last_modified"] = metadata.LastModified.UTC().Format(time.RFC3339)
+	}
+	if metadata.MimeType != "" {
+		info["content_type"] = metadata.MimeType
+	}
+	w.WriteJSON(info)
+}
+
+// Responds with the statistics of a processed image as JSON. The statistics
+// are computed by the route's workers, as they read every pixel.
+func (s *Server) writeStatistics(w *HalfshellResponseWriter, r *HalfshellRequest, image *Image) {
+	var statistics *ImageStatistics
+	var err error
+	if !s.doWork(r, func() { statistics, err = NewImageStatistics(image) }) {
+		s.writeSaturated(w, r)
+		return
+	}
+	if err != nil {
+		s.Logger.Warn("Error measuring image %s: %s", r.SourceOptions.Path, err)
+		s.writeRouteError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteJSON(statistics)
+}
+
+// Returns true if the server can accept more image requests: it has warmed
+// up its cache and its worker pool isn't saturated.
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.warming) == 0 && !s.WorkerPool.Saturated()
+}
+
+// Reports whether the server can accept more image requests. Responds with
+// 503 while the worker pool is saturated.
+func (s *Server) ReadinessHandler(w *HalfshellResponseWriter, r *HalfshellRequest) {
+	if !s.Ready() {
+		w.WriteError("Saturated", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
 }
 
 func (s *Server) LogRequest(w *HalfshellResponseWriter, r *HalfshellRequest) {
@@ -99,6 +877,8 @@ func (s *Server) LogRequest(w *HalfshellResponseWriter, r *HalfshellRequest) {
 	}
 	fmt.Printf(logFormat, host, r.Timestamp.Format("02/Jan/2006:15:04:05 -0700"),
 		r.Method, r.URL.RequestURI(), r.Proto, w.Status, w.Size)
+	s.EventLogger.LogRequest(w, r)
+	s.UsageTracker.RecordRequest(w, r)
 }
 
 type HalfshellRequest struct {
@@ -107,39 +887,161 @@ type HalfshellRequest struct {
 	Route            *Route
 	SourceOptions    *ImageSourceOptions
 	ProcessorOptions *ImageProcessorOptions
+	Renditions       []*ImageProcessorOptions
+	OptionsError     error
+	Signed           bool
+	SignatureExpires time.Time
+	SignatureError   error
+
+	// Whether the response was served from the cache, and the size of the
+	// source image and how long it took to fetch, for the event log.
+	CacheStatus   string
+	SourceSize    int
+	FetchDuration time.Duration
+
+	// Set when the request's account has used up its usage quota.
+	QuotaError *QuotaExceededError
+	// Set for the server's own warm-up requests, which are neither counted
+	// nor checked against quotas.
+	Warmup bool
 }
 
 func (s *Server) NewHalfshellRequest(r *http.Request) *HalfshellRequest {
-	request := &HalfshellRequest{r, time.Now(), nil, nil, nil}
-	for _, route := range s.Routes {
-		if route.ShouldHandleRequest(r) {
-			request.Route = route
+	if !s.IsTrustedProxy(r) {
+		for header := range HeaderDirectives {
+			r.Header.Del(header)
 		}
 	}
 
+	request := &HalfshellRequest{Request: r, Timestamp: time.Now(), CacheStatus: CACHE_STATUS_MISS}
+	request.Route = RouteForRequest(s.Routes, r)
+
 	if request.Route != nil {
-		request.SourceOptions, request.ProcessorOptions =
+		request.Signed, request.SignatureError = request.Route.VerifySignature(r)
+		if request.Signed {
+			request.SignatureExpires = request.Route.SignatureExpiry(r)
+		}
+		request.SourceOptions, request.ProcessorOptions, request.OptionsError =
 			request.Route.SourceAndProcessorOptionsForRequest(r)
+		if request.OptionsError == nil {
+			request.Renditions, request.OptionsError = request.Route.RenditionOptionsForRequest(r)
+		}
+		if request.OptionsError == nil && request.SignatureError == nil {
+			request.SignatureError = request.Route.ApplyWatermarkPolicy(
+				request.ProcessorOptions, request.Renditions, request.Signed)
+		}
 	}
 
 	return request
 }
 
+// Returns a key identifying the response to the request: requests with the
+// same key are served the same image. The key is of the request's options in
+// their canonical form, so that requests that differ only in options with the
+// same effect, like those set to the processor's defaults, share a key.
+func (r *HalfshellRequest) CacheKey() string {
+	hash := sha256.New()
+	if r.Route.Tenant != nil {
+		fmt.Fprintf(hash, "%s\x00", r.Route.Tenant.Name)
+	}
+	fmt.Fprintf(hash, "%s\x00", r.Route.Name)
+	encoder := json.NewEncoder(hash)
+	encoder.Encode(r.SourceOptions)
+	encoder.Encode(r.Route.Processor.CanonicalOptions(r.ProcessorOptions))
+	var renditions []*ImageProcessorOptions
+	for _, rendition := range r.Renditions {
+		renditions = append(renditions, r.Route.Processor.CanonicalOptions(rendition))
+	}
+	encoder.Encode(renditions)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Returns true if the request was sent by one of the configured trusted
+// proxies, which may set options with header directives.
+func (s *Server) IsTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.Config.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The Content-Security-Policy of SVG images unless configured otherwise. It
+// blocks scripts and every external resource.
+const DEFAULT_SVG_CONTENT_SECURITY_POLICY = "default-src 'none'; style-src 'unsafe-inline'; sandbox"
+
 // HalfshellResponseWriter is a wrapper around http.ResponseWriter that provides
 // access to the response status and size after they have been set.
 type HalfshellResponseWriter struct {
-	w      http.ResponseWriter
-	Status int
-	Size   int
+	w                http.ResponseWriter
+	Status           int
+	Size             int
+	BandwidthLimiter *BandwidthLimiter
+	Digester         *ResponseDigester
+
+	// Headers set when the response's header is written, overriding the
+	// writer's own. Headers with an empty value are removed.
+	Headers map[string]string
+
+	// The Cache-Control header of image responses, or the default.
+	CacheControl string
+
+	// The pixels of the images written, counted for usage accounting.
+	CountPixels bool
+	Pixels      uint64
+
+	svgContentSecurityPolicy string
+	acceptEncoding           string
+	debugStart               time.Time
+	captured                 *CachedResponse
+	captureLimit             uint64
+	// The body of a captured response before it was compressed.
+	uncompressed []byte
+	// Set for responses that mustn't be cached whatever the route's cache
+	// policy, such as debug responses and error images.
+	uncacheable bool
 }
 
-// Create a new HalfshellResponseWriter by wrapping http.ResponseWriter.
-func (s *Server) NewHalfshellResponseWriter(w http.ResponseWriter) *HalfshellResponseWriter {
-	return &HalfshellResponseWriter{w: w}
+// Create a new HalfshellResponseWriter by wrapping http.ResponseWriter for the
+// response to a request. The server's security headers are set on every
+// response.
+func (s *Server) NewHalfshellResponseWriter(w http.ResponseWriter, r *http.Request) *HalfshellResponseWriter {
+	for header, value := range s.Config.SecurityHeaders {
+		w.Header().Set(header, value)
+	}
+	return &HalfshellResponseWriter{
+		w:                        w,
+		svgContentSecurityPolicy: s.Config.SVGContentSecurityPolicy,
+		acceptEncoding:           r.Header.Get("Accept-Encoding"),
+	}
 }
 
-// Forwards to http.ResponseWriter's WriteHeader method.
+// Sets the writer's headers and debug headers and forwards to
+// http.ResponseWriter's WriteHeader method.
 func (hw *HalfshellResponseWriter) WriteHeader(status int) {
+	for header, value := range hw.Headers {
+		if value == "" {
+			hw.w.Header().Del(header)
+		} else {
+			hw.w.Header().Set(header, value)
+		}
+	}
+	if hw.captured != nil {
+		hw.captured.Header = hw.w.Header().Clone()
+		if length, err := strconv.ParseUint(hw.captured.Header.Get("Content-Length"), 10, 64); err == nil && length > hw.captureLimit {
+			hw.captured = nil
+		}
+	}
+	hw.setDebugTime()
 	hw.Status = status
 	hw.w.WriteHeader(status)
 }
@@ -149,24 +1051,182 @@ func (hw *HalfshellResponseWriter) SetHeader(name, value string) {
 	hw.w.Header().Set(name, value)
 }
 
-// Writes data the output stream.
+// Responses at least this large are streamed: their headers are flushed
+// before the body, which is then written and flushed in chunks.
+const (
+	STREAMING_THRESHOLD  = 1 << 20
+	STREAMING_CHUNK_SIZE = 256 * 1024
+)
+
+// Writes data the output stream. If the writer has a bandwidth limiter, the
+// data is written in chunks at the limited rate. Large data is written in
+// chunks that are flushed to the client as they are written.
 func (hw *HalfshellResponseWriter) Write(data []byte) (int, error) {
-	hw.Size += len(data)
-	return hw.w.Write(data)
+	if hw.captured != nil {
+		if uint64(len(hw.captured.Body)+len(data)) > hw.captureLimit {
+			hw.captured = nil
+		} else {
+			hw.captured.Body = append(hw.captured.Body, data...)
+		}
+	}
+	streaming := len(data) >= STREAMING_THRESHOLD
+	if hw.BandwidthLimiter == nil && !streaming {
+		hw.Size += len(data)
+		return hw.w.Write(data)
+	}
+
+	chunkSize := STREAMING_CHUNK_SIZE
+	if hw.BandwidthLimiter != nil {
+		chunkSize = BANDWIDTH_CHUNK_SIZE
+	}
+
+	written := 0
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		if hw.BandwidthLimiter != nil {
+			hw.BandwidthLimiter.Wait(len(chunk))
+		}
+		n, err := hw.w.Write(chunk)
+		hw.Size += n
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if streaming {
+			hw.Flush()
+		}
+		data = data[len(chunk):]
+	}
+	return written, nil
+}
+
+// Sends any buffered data to the client.
+func (hw *HalfshellResponseWriter) Flush() {
+	if flusher, ok := hw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Writes the response headers with the given status and body length. The
+// headers of responses that will be streamed are flushed immediately, so
+// that clients get the length before the body.
+func (hw *HalfshellResponseWriter) writeHeaderWithLength(status int, length int) {
+	hw.SetHeader("Content-Length", fmt.Sprintf("%d", length))
+	hw.WriteHeader(status)
+	if length >= STREAMING_THRESHOLD {
+		hw.Flush()
+	}
+}
+
+// Compresses a text body with an encoding that the client accepts, and sets
+// the response's encoding headers. Image formats other than SVG are already
+// compressed and are never compressed again. A captured response keeps its
+// uncompressed body, which is cached and compressed for each client it's
+// served to.
+func (hw *HalfshellResponseWriter) compress(body []byte) []byte {
+	hw.w.Header().Add("Vary", "Accept-Encoding")
+	if hw.captured != nil {
+		hw.captured.compressible = true
+		hw.uncompressed = body
+	}
+	return hw.encode(body)
+}
+
+// Encodes a body with an encoding that the client accepts, unless it's too
+// small to be worth it, and sets the response's Content-Encoding header.
+func (hw *HalfshellResponseWriter) encode(body []byte) []byte {
+	encoding := acceptedContentEncoding(hw.acceptEncoding)
+	if encoding == "" || len(body) < COMPRESSION_MIN_SIZE {
+		return body
+	}
+	hw.SetHeader("Content-Encoding", encoding)
+	return compressBody(encoding, body)
 }
 
 // Writes an error response.
 func (hw *HalfshellResponseWriter) WriteError(message string, status int) {
+	body := hw.compress([]byte(message))
 	hw.SetHeader("Content-Type", "text/plain; charset=utf-8")
-	hw.WriteHeader(status)
-	hw.Write([]byte(message))
+	hw.writeHeaderWithLength(status, len(body))
+	hw.Write(body)
 }
 
-// Writes an image to the output stream and sets the appropriate headers.
-func (hw *HalfshellResponseWriter) WriteImage(image *Image) {
+// Returns the Cache-Control header of image responses.
+func (hw *HalfshellResponseWriter) cacheControl() string {
+	if hw.CacheControl == "" {
+		return DEFAULT_CACHE_CONTROL
+	}
+	return hw.CacheControl
+}
+
+// Writes a placeholder image for an error response. Error images aren't cached,
+// as the error may not persist.
+func (hw *HalfshellResponseWriter) WriteErrorImage(image *Image, status int) {
 	hw.SetHeader("Content-Type", image.MimeType)
-	hw.SetHeader("Content-Length", fmt.Sprintf("%d", len(image.Bytes)))
-	hw.SetHeader("Cache-Control", "no-transform,public,max-age=86400,s-maxage=2592000")
-	hw.WriteHeader(http.StatusOK)
+	hw.SetHeader("Cache-Control", "no-store")
+	hw.uncacheable = true
+	hw.writeHeaderWithLength(status, len(image.Bytes))
 	hw.Write(image.Bytes)
 }
+
+// Writes a value encoded as JSON to the output stream.
+func (hw *HalfshellResponseWriter) WriteJSON(value interface{}) {
+	data, _ := json.Marshal(value)
+	data = hw.compress(data)
+	hw.SetHeader("Content-Type", "application/json")
+	hw.writeHeaderWithLength(http.StatusOK, len(data))
+	hw.Write(data)
+}
+
+// Writes images to the output stream as the parts of a multipart/mixed
+// response.
+func (hw *HalfshellResponseWriter) WriteImages(images []*Image) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, image := range images {
+		if hw.CountPixels {
+			hw.Pixels += imagePixels(image)
+		}
+		part, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   {image.MimeType},
+			"Content-Length": {fmt.Sprintf("%d", len(image.Bytes))},
+		})
+		part.Write(image.Bytes)
+	}
+	parts.Close()
+
+	hw.SetHeader("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%s", parts.Boundary()))
+	hw.SetHeader("Cache-Control", hw.cacheControl())
+	if hw.Digester != nil {
+		hw.Digester.SetHeaders(hw, body.Bytes())
+	}
+	hw.writeHeaderWithLength(http.StatusOK, body.Len())
+	hw.Write(body.Bytes())
+}
+
+// Writes an image to the output stream and sets the appropriate headers. SVG
+// images, which can contain scripts, are served with the server's SVG content
+// security policy.
+func (hw *HalfshellResponseWriter) WriteImage(image *Image) {
+	body := image.Bytes
+	if hw.CountPixels {
+		hw.Pixels += imagePixels(image)
+	}
+	hw.SetHeader("Content-Type", image.MimeType)
+	hw.setDebugDimensions(image.Bytes)
+	if image.MimeType == "image/svg+xml" {
+		if hw.svgContentSecurityPolicy != "" {
+			hw.SetHeader("Content-Security-Policy", hw.svgContentSecurityPolicy)
+		}
+		body = hw.compress(body)
+	}
+	hw.SetHeader("Cache-Control", hw.cacheControl())
+	if hw.Digester != nil {
+		hw.Digester.SetHeaders(hw, body)
+	}
+	hw.writeHeaderWithLength(http.StatusOK, len(body))
+	hw.Write(body)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build http3
+// +build http3
+
+package halfshell
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP/3 is served in builds with the http3 tag, which need Go 1.20 and
+// quic-go.
+const HTTP3_SUPPORTED = true
+
+// Returns a server for HTTP/3 over QUIC on the UDP port, alongside HTTP/1.1
+// and HTTP/2 over TCP, whose responses advertise it with Alt-Svc. Idle
+// connections are closed after the read timeout, as the public server closes
+// them.
+func newHTTP3Server(s *Server) HTTP3Server {
+	return &http3.Server{
+		Addr:           fmt.Sprintf(":%d", s.Config.HTTP3Port),
+		Handler:        http.HandlerFunc(s.serveHTTP3),
+		IdleTimeout:    s.ReadTimeout,
+		MaxHeaderBytes: s.MaxHeaderBytes,
+	}
+}
+
+// Serves an HTTP/3 request with the public server's read and write timeouts,
+// which http3.Server has no settings for, as deadlines on the request's
+// stream.
+func (s *Server) serveHTTP3(w http.ResponseWriter, r *http.Request) {
+	controller := http.NewResponseController(w)
+	if s.ReadTimeout > 0 {
+		controller.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
+	if s.WriteTimeout > 0 {
+		controller.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+	s.ServeHTTP(w, r)
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Errors for requests to routes with a signature secret that aren't signed
+// when the route requires it, or whose signature doesn't match.
+var (
+	ErrSignatureRequired = errors.New("Request signature required")
+	ErrInvalidSignature  = errors.New("Invalid request signature")
+	ErrSignatureExpired  = errors.New("Request signature expired")
+)
+
+// How long after a signed request's expiry time it's still accepted by
+// default, for the clock of the server verifying requests running ahead of
+// the clock of the server that signed them.
+const DEFAULT_SIGNATURE_CLOCK_SKEW = 30 * time.Second
+
+// Checks the signature of a request to a route with signature secrets, and
+// returns true if the request is signed. Unsigned requests are allowed only
+// when the route watermarks them.
+//
+// The signature is the hex-encoded HMAC-SHA256, keyed with one of the route's
+// secrets, of the request path followed by '?' and the query parameters other
+// than the signature, encoded sorted by name. Requests name the secret they're
+// signed with by its key ID in the kid parameter, which the signature covers
+// like the other parameters, or are signed with the route's signature_secret.
+// Several keys can be active at once, so that the keys can be rotated without
+// breaking the URLs signed with the previous key.
+//
+// Signed requests with an expires parameter, a Unix timestamp that the
+// signature covers, are rejected once it has passed by more than the route's
+// clock skew.
+func (p *Route) VerifySignature(r *http.Request) (bool, error) {
+	if p.SignatureSecret == "" && len(p.SignatureSecrets) == 0 {
+		return false, nil
+	}
+
+	name := p.parameterName("sig")
+	query := r.URL.Query()
+	value := query.Get(name)
+	if value == "" {
+		if p.UnsignedWatermark == nil {
+			return false, ErrSignatureRequired
+		}
+		return false, nil
+	}
+	signature, err := hex.DecodeString(value)
+	if err != nil {
+		return false, ErrInvalidSignature
+	}
+
+	secret := p.SignatureSecret
+	if keyID := query.Get(p.parameterName("kid")); keyID != "" {
+		secret = p.SignatureSecrets[keyID]
+	}
+	if secret == "" {
+		return false, ErrInvalidSignature
+	}
+
+	query.Del(name)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(r.URL.Path + "?" + query.Encode()))
+	// hmac.Equal takes the same time wherever the signatures differ.
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return false, ErrInvalidSignature
+	}
+
+	if value := query.Get(p.parameterName("expires")); value != "" {
+		expires, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false, ErrInvalidSignature
+		}
+		if time.Now().After(time.Unix(expires, 0).Add(p.SignatureClockSkew)) {
+			return false, ErrSignatureExpired
+		}
+	}
+	return true, nil
+}
+
+// Returns when the URL of a request signed with an expires parameter stops
+// working, or the zero time if it doesn't expire.
+func (p *Route) SignatureExpiry(r *http.Request) time.Time {
+	expires, err := strconv.ParseInt(r.URL.Query().Get(p.parameterName("expires")), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(expires, 0)
+}
+
+// Adds the route's watermark over the images of unsigned requests. Requests
+// that would bypass the watermark, for raw images, renditions, or diffs and
+// comparisons of the original images, must be signed.
+func (p *Route) ApplyWatermarkPolicy(processorOptions *ImageProcessorOptions, renditions []*ImageProcessorOptions, signed bool) error {
+	if p.UnsignedWatermark == nil || signed {
+		return nil
+	}
+	if processorOptions.Raw || renditions != nil || processorOptions.DiffTo != "" || processorOptions.CompareTo != "" {
+		return ErrSignatureRequired
+	}
+
+	watermark := *p.UnsignedWatermark
+	processorOptions.Overlays = append(processorOptions.Overlays, &watermark)
+	return nil
+}
@@ -21,6 +21,7 @@
 package halfshell
 
 import (
+	"context"
 	"fmt"
 	"os"
 )
@@ -38,6 +39,19 @@ type ImageSource interface {
 
 type ImageSourceOptions struct {
 	Path string
+	Data string
+
+	// Cancelled when the fetch is abandoned. Sources that fetch over the
+	// network stop fetching when it is. Nil for fetches outside requests.
+	Context context.Context
+}
+
+// Returns the context to fetch the image with.
+func (o *ImageSourceOptions) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
 }
 
 func RegisterSource(sourceType ImageSourceType, factory ImageSourceFactoryFunction) {
@@ -50,5 +64,47 @@ func NewImageSourceWithConfig(config *SourceConfig) ImageSource {
 		fmt.Fprintf(os.Stderr, "Unknown image source type: %s\n", config.Type)
 		os.Exit(1)
 	}
-	return factory(config)
+	source := factory(config)
+	metadataSource, hasMetadata := source.(ImageMetadataSource)
+	if config.HedgeDelay > 0 {
+		source = newHedgingImageSource(source, config)
+	}
+	source = &formatCheckingImageSource{
+		ImageSource: source,
+		Config:      config,
+		Logger:      NewLogger("source.formats.%s", config.Name),
+	}
+	if config.ScannerAddress != "" {
+		source = newScanningImageSource(source, config)
+	}
+	if hasMetadata || config.MetadataCacheTTL > 0 {
+		source = newMetadataCachingImageSource(source, metadataSource, config)
+	}
+	return source
+}
+
+// formatCheckingImageSource refuses images from a source whose magic bytes
+// aren't those of one of the source's allowed formats, so that ImageMagick
+// never decodes content with other coders.
+type formatCheckingImageSource struct {
+	ImageSource
+	Config *SourceConfig
+	Logger *Logger
+}
+
+func (s *formatCheckingImageSource) GetImage(request *ImageSourceOptions) *Image {
+	image := s.ImageSource.GetImage(request)
+	if image == nil {
+		return nil
+	}
+
+	format := SniffImageFormat(image.Bytes)
+	for _, allowed := range s.Config.AllowedFormats {
+		if format == allowed {
+			return image
+		}
+	}
+	s.Logger.Warn("Refusing image %s of format %q", request.Path, format)
+	image.Release()
+	return nil
 }
@@ -0,0 +1,103 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+const (
+	IMAGE_SOURCE_TYPE_DATA ImageSourceType = "data"
+)
+
+// The maximum decoded size of inline images when the source doesn't
+// configure one.
+const DEFAULT_MAX_DATA_SOURCE_SIZE = 1 << 20
+
+// DataImageSource reads images inlined in the request as a `data:` URI or
+// bare base64, for callers that already hold the bytes. The image path is
+// ignored.
+type DataImageSource struct {
+	Config *SourceConfig
+	Logger *Logger
+}
+
+func NewDataImageSourceWithConfig(config *SourceConfig) ImageSource {
+	if config.MaxSourceSize == 0 {
+		config.MaxSourceSize = DEFAULT_MAX_DATA_SOURCE_SIZE
+	}
+	return &DataImageSource{
+		Config: config,
+		Logger: NewLogger("source.data.%s", config.Name),
+	}
+}
+
+func (s *DataImageSource) GetImage(request *ImageSourceOptions) *Image {
+	if request.Data == "" {
+		s.Logger.Warn("No inline image data in request")
+		return nil
+	}
+
+	mimeType, data, ok := parseDataURI(request.Data)
+	if !ok {
+		s.Logger.Warn("Malformed data URI")
+		return nil
+	}
+	// Query strings decode a `+` as a space.
+	data = strings.Replace(data, " ", "+", -1)
+
+	size := base64.StdEncoding.DecodedLen(len(data))
+	if uint64(size) > s.Config.MaxSourceSize+2 {
+		s.Logger.Warn("Failed to read image: %v", ErrImageTooLarge)
+		return nil
+	}
+
+	decoder := base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))
+	image, err := newImageFromReader(decoder, mimeType, int64(size), s.Config.MaxSourceSize)
+	if err != nil {
+		s.Logger.Warn("Failed to read image: %v", err)
+		return nil
+	}
+	return image
+}
+
+// Splits a base64 `data:` URI into its MIME type and payload. Data that
+// doesn't start with `data:` is taken to be bare base64 of unknown type.
+func parseDataURI(uri string) (mimeType string, data string, ok bool) {
+	if !strings.HasPrefix(uri, "data:") {
+		return "", uri, true
+	}
+
+	comma := strings.IndexByte(uri, ',')
+	if comma < 0 {
+		return "", "", false
+	}
+	params := strings.Split(uri[len("data:"):comma], ";")
+	if params[len(params)-1] != "base64" {
+		return "", "", false
+	}
+	return params[0], uri[comma+1:], true
+}
+
+func init() {
+	RegisterSource(IMAGE_SOURCE_TYPE_DATA, NewDataImageSourceWithConfig)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"regexp"
+	"time"
+)
+
+const (
+	IMAGE_SOURCE_TYPE_DATABASE ImageSourceType = "database"
+)
+
+const (
+	DEFAULT_DATABASE_MAX_OPEN_CONNS = 16
+	DEFAULT_DATABASE_MAX_IDLE_CONNS = 4
+)
+
+// Table and column names are interpolated into the query, so they're
+// restricted to plain (optionally schema-qualified) identifiers.
+var databaseIdentifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// DatabaseImageSource reads image bytes from a blob column of a PostgreSQL or
+// MySQL table, looking rows up by the image path.
+type DatabaseImageSource struct {
+	Config    *SourceConfig
+	Logger    *Logger
+	db        *sql.DB
+	statement *sql.Stmt
+}
+
+func NewDatabaseImageSourceWithConfig(config *SourceConfig) ImageSource {
+	source := &DatabaseImageSource{
+		Config: config,
+		Logger: NewLogger("source.database.%s", config.Name),
+	}
+
+	var placeholder string
+	switch config.DatabaseDriver {
+	case "postgres":
+		placeholder = "$1"
+	case "mysql":
+		placeholder = "?"
+	default:
+		source.Logger.Fatalf("Unknown database driver %s", config.DatabaseDriver)
+	}
+	for _, identifier := range []string{config.DatabaseTable, config.DatabaseKeyColumn, config.DatabaseDataColumn} {
+		if !databaseIdentifierRegexp.MatchString(identifier) {
+			source.Logger.Fatalf("Invalid database table or column name %q", identifier)
+		}
+	}
+
+	db, err := sql.Open(config.DatabaseDriver, config.DatabaseDSN)
+	if err != nil {
+		source.Logger.Fatal(err)
+	}
+	db.SetMaxOpenConns(int(config.DatabaseMaxOpenConns))
+	db.SetMaxIdleConns(int(config.DatabaseMaxIdleConns))
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s",
+		config.DatabaseDataColumn, config.DatabaseTable, config.DatabaseKeyColumn, placeholder)
+	if source.statement, err = db.Prepare(query); err != nil {
+		source.Logger.Fatalf("Failed to prepare %s: %v", query, err)
+	}
+	source.db = db
+
+	return source
+}
+
+func (s *DatabaseImageSource) GetImage(request *ImageSourceOptions) *Image {
+	var data []byte
+	err := s.statement.QueryRowContext(request.context(), request.Path).Scan(&data)
+	if err == sql.ErrNoRows {
+		s.Logger.Warn("No image with key %s", request.Path)
+		return nil
+	}
+	if err != nil {
+		s.Logger.Warn("Error querying image %s: %v", request.Path, err)
+		return nil
+	}
+	if s.Config.MaxSourceSize > 0 && uint64(len(data)) > s.Config.MaxSourceSize {
+		s.Logger.Warn("Failed to read image %s: %v", request.Path, ErrImageTooLarge)
+		return nil
+	}
+
+	image, err := newImageFromReader(bytes.NewReader(data), "", int64(len(data)), s.Config.MaxSourceSize)
+	if err != nil {
+		s.Logger.Warn("Failed to read image %s: %v", request.Path, err)
+		return nil
+	}
+	return image
+}
+
+func init() {
+	RegisterSource(IMAGE_SOURCE_TYPE_DATABASE, NewDatabaseImageSourceWithConfig)
+}
@@ -54,7 +54,7 @@ func NewFileSystemImageSourceWithConfig(config *SourceConfig) ImageSource {
 
 	fileInfo, err := baseDirectory.Stat()
 	if err != nil || !fileInfo.IsDir() {
-		source.Logger.Fatal("Directory %s not a directory", source.Config.Directory, err)
+		source.Logger.Fatalf("Directory %s not a directory: %v", source.Config.Directory, err)
 	}
 
 	return source
@@ -68,8 +68,9 @@ func (s *FileSystemImageSource) GetImage(request *ImageSourceOptions) *Image {
 		s.Logger.Warn("Failed to open file: %v", err)
 		return nil
 	}
+	defer file.Close()
 
-	image, err := NewImageFromFile(file)
+	image, err := NewImageFromFile(file, s.Config.MaxSourceSize)
 	if err != nil {
 		s.Logger.Warn("Failed to read image: %v", err)
 		return nil
@@ -77,6 +78,21 @@ func (s *FileSystemImageSource) GetImage(request *ImageSourceOptions) *Image {
 	return image
 }
 
+// Looks up an image's metadata from its file's.
+func (s *FileSystemImageSource) GetImageMetadata(request *ImageSourceOptions) (*ImageMetadata, error) {
+	fileInfo, err := os.Stat(s.fileNameForRequest(request))
+	if os.IsNotExist(err) {
+		return &ImageMetadata{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return &ImageMetadata{}, nil
+	}
+	return &ImageMetadata{Exists: true, Size: fileInfo.Size(), LastModified: fileInfo.ModTime()}, nil
+}
+
 func (s *FileSystemImageSource) fileNameForRequest(request *ImageSourceOptions) string {
 	// Remove the leading / from the file name
 	path := strings.TrimLeft(request.Path, string(filepath.Separator))
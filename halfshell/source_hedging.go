@@ -0,0 +1,85 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"time"
+)
+
+// hedgingImageSource sends a second, hedged request to its source when the
+// first hasn't returned an image after the hedge delay, and returns the image
+// of whichever request succeeds first. This trims the long tail of origin
+// latency at the cost of extra requests for the slowest fetches.
+type hedgingImageSource struct {
+	ImageSource
+	Delay  time.Duration
+	Logger *Logger
+}
+
+func newHedgingImageSource(source ImageSource, config *SourceConfig) ImageSource {
+	return &hedgingImageSource{
+		ImageSource: source,
+		Delay:       config.HedgeDelay,
+		Logger:      NewLogger("source.hedging.%s", config.Name),
+	}
+}
+
+func (s *hedgingImageSource) GetImage(request *ImageSourceOptions) *Image {
+	// Buffered so that the request that loses doesn't block.
+	fetched := make(chan *Image, 2)
+	fetch := func() { fetched <- s.ImageSource.GetImage(request) }
+	go fetch()
+
+	timer := time.NewTimer(s.Delay)
+	defer timer.Stop()
+
+	pending := 1
+	for {
+		select {
+		case image := <-fetched:
+			pending--
+			if image != nil {
+				if pending > 0 {
+					go releaseImages(fetched, pending)
+				}
+				return image
+			}
+			// A request that fails before the delay isn't hedged, since
+			// the failure isn't slowness.
+			if pending == 0 {
+				return nil
+			}
+		case <-timer.C:
+			s.Logger.Info("Hedging request for image %s after %v", request.Path, s.Delay)
+			pending++
+			go fetch()
+		}
+	}
+}
+
+// Releases the images of the outstanding requests as they arrive.
+func releaseImages(images <-chan *Image, count int) {
+	for i := 0; i < count; i++ {
+		if image := <-images; image != nil {
+			image.Release()
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The default number of source images whose metadata is cached.
+const DEFAULT_METADATA_CACHE_SIZE = 10000
+
+// ImageMetadata describes a source image without its content: whether it
+// exists, and if so its size in bytes, when it was last modified and its
+// content type, where the source knows them.
+type ImageMetadata struct {
+	Exists       bool
+	Size         int64
+	LastModified time.Time
+	MimeType     string
+}
+
+// ImageMetadataSource is implemented by sources that can look up the metadata
+// of an image without downloading it, like with an HTTP HEAD request. Images
+// that don't exist have metadata that says so, while errors are for failing
+// to find out.
+type ImageMetadataSource interface {
+	GetImageMetadata(*ImageSourceOptions) (*ImageMetadata, error)
+}
+
+// Returns the metadata of an image from a source, looking it up without
+// downloading the image if the source can, or else by downloading it.
+func GetImageMetadata(source ImageSource, request *ImageSourceOptions) (*ImageMetadata, error) {
+	if metadataSource, ok := source.(ImageMetadataSource); ok {
+		return metadataSource.GetImageMetadata(request)
+	}
+	image := source.GetImage(request)
+	if image == nil {
+		return &ImageMetadata{}, nil
+	}
+	defer image.Release()
+	return &ImageMetadata{Exists: true, Size: int64(len(image.Bytes)), MimeType: image.MimeType}, nil
+}
+
+// Looks up an image's metadata with a HEAD request to an HTTP source. Images
+// the source responds to with a 404 don't exist.
+func getHTTPImageMetadata(client *http.Client, httpRequest *http.Request) (*ImageMetadata, error) {
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	httpResponse.Body.Close()
+	switch httpResponse.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return &ImageMetadata{}, nil
+	default:
+		return nil, fmt.Errorf("Source responded with status %d (url=%v)", httpResponse.StatusCode, httpRequest.URL)
+	}
+
+	metadata := &ImageMetadata{
+		Exists:   true,
+		Size:     httpResponse.ContentLength,
+		MimeType: httpResponse.Header.Get("Content-Type"),
+	}
+	if lastModified, err := http.ParseTime(httpResponse.Header.Get("Last-Modified")); err == nil {
+		metadata.LastModified = lastModified
+	}
+	return metadata, nil
+}
+
+// metadataCachingImageSource looks up the metadata of a source's images and
+// caches it for the source's metadata cache TTL, so that looking it up again
+// doesn't reach the source. The metadata of the images the source returns is
+// cached too, replacing what was cached before, so that images found since
+// they were looked up aren't refused. Requests for images that are known not
+// to exist, or to be larger than the source's maximum size, fail without
+// downloading them. Sources that can't look up metadata have it looked up by
+// downloading the image.
+type metadataCachingImageSource struct {
+	ImageSource
+	Metadata ImageMetadataSource
+	Config   *SourceConfig
+	Logger   *Logger
+	cache    *metadataCache
+}
+
+func newMetadataCachingImageSource(source ImageSource, metadata ImageMetadataSource, config *SourceConfig) ImageSource {
+	size := config.MetadataCacheSize
+	if size == 0 {
+		size = DEFAULT_METADATA_CACHE_SIZE
+	}
+	return &metadataCachingImageSource{
+		ImageSource: source,
+		Metadata:    metadata,
+		Config:      config,
+		Logger:      NewLogger("source.metadata.%s", config.Name),
+		cache:       newMetadataCache(int(size), config.MetadataCacheTTL),
+	}
+}
+
+func (s *metadataCachingImageSource) GetImage(request *ImageSourceOptions) *Image {
+	cached, ok := s.cache.Get(request.Path)
+	if ok {
+		if !cached.Exists {
+			s.Logger.Info("Image %s is known not to exist", request.Path)
+			return nil
+		}
+		if s.Config.MaxSourceSize > 0 && cached.Size > int64(s.Config.MaxSourceSize) {
+			s.Logger.Warn("Image %s of %d bytes is too large", request.Path, cached.Size)
+			return nil
+		}
+	}
+
+	// Images the source doesn't return aren't known not to exist, since the
+	// fetch may have failed or been cancelled, but what was cached about them
+	// is no longer trusted.
+	image := s.ImageSource.GetImage(request)
+	if image == nil {
+		s.cache.Remove(request.Path)
+		return nil
+	}
+	metadata := &ImageMetadata{Exists: true, Size: int64(len(image.Bytes)), MimeType: image.MimeType}
+	if ok {
+		metadata.LastModified = cached.LastModified
+	}
+	s.cache.Add(request.Path, metadata)
+	return image
+}
+
+func (s *metadataCachingImageSource) GetImageMetadata(request *ImageSourceOptions) (*ImageMetadata, error) {
+	if metadata, ok := s.cache.Get(request.Path); ok {
+		return metadata, nil
+	}
+	if s.Metadata == nil {
+		image := s.GetImage(request)
+		if image == nil {
+			return &ImageMetadata{}, nil
+		}
+		defer image.Release()
+		return &ImageMetadata{Exists: true, Size: int64(len(image.Bytes)), MimeType: image.MimeType}, nil
+	}
+	metadata, err := s.Metadata.GetImageMetadata(request)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.Add(request.Path, metadata)
+	return metadata, nil
+}
+
+// metadataCache holds the most recently looked up metadata of images, by
+// their paths, for a time, evicting the least recently used. A nil
+// metadataCache holds nothing.
+type metadataCache struct {
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+	mutex   sync.Mutex
+}
+
+type metadataCacheEntry struct {
+	path     string
+	metadata *ImageMetadata
+	expires  time.Time
+}
+
+func newMetadataCache(size int, ttl time.Duration) *metadataCache {
+	if ttl == 0 {
+		return nil
+	}
+	return &metadataCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *metadataCache) Get(path string) (*ImageMetadata, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*metadataCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, path)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.metadata, true
+}
+
+func (c *metadataCache) Add(path string, metadata *ImageMetadata) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := &metadataCacheEntry{path, metadata, time.Now().Add(c.ttl)}
+	if element, ok := c.entries[path]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[path] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*metadataCacheEntry).path)
+	}
+}
+
+func (c *metadataCache) Remove(path string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[path]; ok {
+		c.order.Remove(element)
+		delete(c.entries, path)
+	}
+}
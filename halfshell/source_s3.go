@@ -23,7 +23,6 @@ package halfshell
 import (
 	"fmt"
 	"github.com/oysterbooks/s3"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
@@ -34,57 +33,99 @@ const (
 	IMAGE_SOURCE_TYPE_S3 ImageSourceType = "s3"
 )
 
+const DEFAULT_S3_REGION = "us-east-1"
+
 type S3ImageSource struct {
 	Config *SourceConfig
 	Logger *Logger
+	client *http.Client
 }
 
 func NewS3ImageSourceWithConfig(config *SourceConfig) ImageSource {
 	return &S3ImageSource{
 		Config: config,
 		Logger: NewLogger("source.s3.%s", config.Name),
+		client: newSourceHTTPClient(config),
 	}
 }
 
 func (s *S3ImageSource) GetImage(request *ImageSourceOptions) *Image {
-	httpRequest := s.signedHTTPRequestForRequest(request)
-	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	httpRequest := s.signedHTTPRequestForRequest("GET", request)
+	httpResponse, err := s.client.Do(httpRequest)
 	if err != nil {
 		s.Logger.Warn("Error downlading image: %v", err)
 		return nil
 	}
 	if httpResponse.StatusCode != 200 {
+		httpResponse.Body.Close()
 		s.Logger.Warn("Error downlading image (url=%v)", httpRequest.URL)
 		return nil
 	}
-	image, err := NewImageFromHTTPResponse(httpResponse)
+	image, err := NewImageFromHTTPResponse(httpResponse, s.Config.MaxSourceSize)
 	if err != nil {
-		responseBody, _ := ioutil.ReadAll(httpResponse.Body)
-		s.Logger.Warn("Unable to create image from response body: %v (url=%v)", string(responseBody), httpRequest.URL)
+		s.Logger.Warn("Unable to create image from response body: %v (url=%v)", err, httpRequest.URL)
+		return nil
 	}
 	s.Logger.Info("Successfully retrieved image from S3: %v", httpRequest.URL)
 	return image
 }
 
-func (s *S3ImageSource) signedHTTPRequestForRequest(request *ImageSourceOptions) *http.Request {
+// Looks up an image's metadata with a HEAD request for the object.
+func (s *S3ImageSource) GetImageMetadata(request *ImageSourceOptions) (*ImageMetadata, error) {
+	return getHTTPImageMetadata(s.client, s.signedHTTPRequestForRequest("HEAD", request))
+}
+
+func (s *S3ImageSource) signedHTTPRequestForRequest(method string, request *ImageSourceOptions) *http.Request {
+	escape := url.QueryEscape
+	if s.Config.S3SignatureVersion == 4 {
+		escape = func(component string) string { return escapeV4(component, true) }
+	}
 	imageURLPathComponents := strings.Split(request.Path, "/")
 	for index, component := range imageURLPathComponents {
-		component = url.QueryEscape(component)
+		component = escape(component)
 		imageURLPathComponents[index] = component
 	}
+	path := strings.Join(imageURLPathComponents, "/")
+
+	scheme, domain := "http", "s3.amazonaws.com"
+	if s.Config.S3SignatureVersion == 4 {
+		scheme, domain = "https", fmt.Sprintf("s3.%s.amazonaws.com", s.Config.S3Region)
+	}
+	if s.Config.S3Endpoint != nil {
+		scheme, domain = s.Config.S3Endpoint.Scheme, s.Config.S3Endpoint.Host
+	}
+
+	// Path-style addressing puts the bucket in the path rather than the host,
+	// as S3-compatible stores without wildcard DNS require.
+	host := fmt.Sprintf("%s.%s", s.Config.S3Bucket, domain)
+	if s.Config.S3PathStyle {
+		host = domain
+		path = "/" + escape(s.Config.S3Bucket) + path
+	}
 	requestURL := &url.URL{
-		Opaque: strings.Join(imageURLPathComponents, "/"),
-		Scheme: "http",
-		Host:   fmt.Sprintf("%s.s3.amazonaws.com", s.Config.S3Bucket),
+		Opaque: path,
+		Scheme: scheme,
+		Host:   host,
 	}
 
-	httpRequest, _ := http.NewRequest("GET", requestURL.RequestURI(), nil)
+	httpRequest, _ := http.NewRequestWithContext(request.context(), method, requestURL.RequestURI(), nil)
 	httpRequest.URL = requestURL
+	httpRequest.Host = host
+	if s.Config.S3SignatureVersion == 4 {
+		signRequestV4(httpRequest, s.Config.S3AccessKey, s.Config.S3SecretKey, s.Config.S3Region, "s3", time.Now())
+		return httpRequest
+	}
+
 	httpRequest.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
-	s3.Sign(httpRequest, s3.Keys{
+	keys := s3.Keys{
 		AccessKey: s.Config.S3AccessKey,
 		SecretKey: s.Config.S3SecretKey,
-	})
+	}
+	if s.Config.S3Endpoint != nil || s.Config.S3PathStyle {
+		(&s3.Service{Domain: domain}).Sign(httpRequest, keys)
+	} else {
+		s3.Sign(httpRequest, keys)
+	}
 
 	return httpRequest
 }
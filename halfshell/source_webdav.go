@@ -0,0 +1,133 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	IMAGE_SOURCE_TYPE_WEBDAV ImageSourceType = "webdav"
+)
+
+// WebDAVImageSource fetches images from a WebDAV collection with a GET of the
+// image path beneath the collection's URL, authenticating with HTTP basic
+// auth or a bearer token.
+type WebDAVImageSource struct {
+	Config *SourceConfig
+	Logger *Logger
+	client *http.Client
+	url    *url.URL
+}
+
+func NewWebDAVImageSourceWithConfig(config *SourceConfig) ImageSource {
+	source := &WebDAVImageSource{
+		Config: config,
+		Logger: NewLogger("source.webdav.%s", config.Name),
+		client: newSourceHTTPClient(config),
+	}
+
+	baseURL, err := url.Parse(config.WebDAVURL)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		source.Logger.Fatalf("Invalid WebDAV URL %s", config.WebDAVURL)
+	}
+	baseURL.Path = strings.TrimRight(baseURL.Path, "/")
+	source.url = baseURL
+
+	if config.WebDAVTokenFile != "" {
+		token, err := ioutil.ReadFile(config.WebDAVTokenFile)
+		if err != nil {
+			source.Logger.Fatal(err)
+		}
+		config.WebDAVToken = strings.TrimSpace(string(token))
+	}
+
+	return source
+}
+
+func (s *WebDAVImageSource) GetImage(request *ImageSourceOptions) *Image {
+	httpRequest := s.httpRequestForRequest("GET", request)
+	if httpRequest == nil {
+		s.Logger.Warn("Refusing image path outside the collection: %s", request.Path)
+		return nil
+	}
+	httpResponse, err := s.client.Do(httpRequest)
+	if err != nil {
+		s.Logger.Warn("Error downloading image: %v", err)
+		return nil
+	}
+	if httpResponse.StatusCode != 200 {
+		httpResponse.Body.Close()
+		s.Logger.Warn("Error downloading image (url=%v, status=%d)", httpRequest.URL, httpResponse.StatusCode)
+		return nil
+	}
+	image, err := NewImageFromHTTPResponse(httpResponse, s.Config.MaxSourceSize)
+	if err != nil {
+		s.Logger.Warn("Unable to create image from response body: %v (url=%v)", err, httpRequest.URL)
+		return nil
+	}
+	s.Logger.Info("Successfully retrieved image from WebDAV: %v", httpRequest.URL)
+	return image
+}
+
+// Looks up an image's metadata with a HEAD request for the image path.
+func (s *WebDAVImageSource) GetImageMetadata(request *ImageSourceOptions) (*ImageMetadata, error) {
+	httpRequest := s.httpRequestForRequest("HEAD", request)
+	if httpRequest == nil {
+		return &ImageMetadata{}, nil
+	}
+	return getHTTPImageMetadata(s.client, httpRequest)
+}
+
+// Returns the request for the image path beneath the collection's URL, or nil
+// if the path has ".." segments, which could refer to resources outside the
+// collection.
+func (s *WebDAVImageSource) httpRequestForRequest(method string, request *ImageSourceOptions) *http.Request {
+	for _, segment := range strings.FieldsFunc(request.Path, isWebDAVPathSeparator) {
+		if segment == ".." {
+			return nil
+		}
+	}
+
+	requestURL := *s.url
+	requestURL.Path += "/" + strings.TrimLeft(request.Path, "/")
+
+	httpRequest, _ := http.NewRequestWithContext(request.context(), method, requestURL.String(), nil)
+	if s.Config.WebDAVToken != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+s.Config.WebDAVToken)
+	} else if s.Config.WebDAVUsername != "" {
+		httpRequest.SetBasicAuth(s.Config.WebDAVUsername, s.Config.WebDAVPassword)
+	}
+	return httpRequest
+}
+
+// Returns true for the characters that WebDAV servers may treat as path
+// separators.
+func isWebDAVPathSeparator(c rune) bool {
+	return c == '/' || c == '\\'
+}
+
+func init() {
+	RegisterSource(IMAGE_SOURCE_TYPE_WEBDAV, NewWebDAVImageSourceWithConfig)
+}
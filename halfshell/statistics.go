@@ -0,0 +1,133 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"github.com/rafikk/imagick/imagick"
+	"math"
+)
+
+// ImageStatistics describe the pixels of an image, for quality control.
+type ImageStatistics struct {
+	Width    uint64                        `json:"width"`
+	Height   uint64                        `json:"height"`
+	Channels map[string]*ChannelStatistics `json:"channels"`
+
+	// The variance of the Laplacian of the image's luma. Blurry images have
+	// few edges and a low variance; it's comparable between images of the
+	// same size.
+	Sharpness float64 `json:"sharpness"`
+}
+
+// ChannelStatistics describe the 8-bit values of a channel of an image.
+type ChannelStatistics struct {
+	Mean              float64  `json:"mean"`
+	StandardDeviation float64  `json:"standard_deviation"`
+	Histogram         []uint64 `json:"histogram"`
+}
+
+// Returns the statistics of the red, green and blue channels of an image in
+// the sRGB colorspace, and of its Rec. 601 luma. Transparency is ignored, and
+// only the first frame of animated images is measured.
+func NewImageStatistics(image *Image) (*ImageStatistics, error) {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := readImageBlob(wand, image.Bytes); err != nil {
+		return nil, err
+	}
+	if err := wand.TransformImageColorspace(imagick.COLORSPACE_SRGB); err != nil {
+		return nil, err
+	}
+	if err := wand.SetImageDepth(8); err != nil {
+		return nil, err
+	}
+	if err := wand.SetImageFormat("RGB"); err != nil {
+		return nil, err
+	}
+
+	width, height := int(wand.GetImageWidth()), int(wand.GetImageHeight())
+	pixels := wand.GetImageBlob()
+	if len(pixels) < width*height*3 {
+		return nil, fmt.Errorf("Expected %d pixels to measure, got %d", width*height, len(pixels)/3)
+	}
+
+	names := []string{"red", "green", "blue", "luma"}
+	histograms := make([][]uint64, len(names))
+	for i := range histograms {
+		histograms[i] = make([]uint64, 256)
+	}
+	luma := make([]float64, width*height)
+	for i := range luma {
+		r, g, b := pixels[i*3], pixels[i*3+1], pixels[i*3+2]
+		luma[i] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		histograms[0][r]++
+		histograms[1][g]++
+		histograms[2][b]++
+		histograms[3][uint8(math.Min(255, luma[i]+0.5))]++
+	}
+
+	statistics := &ImageStatistics{
+		Width:     uint64(width),
+		Height:    uint64(height),
+		Channels:  make(map[string]*ChannelStatistics, len(names)),
+		Sharpness: laplacianVariance(luma, width, height),
+	}
+	for i, name := range names {
+		statistics.Channels[name] = newChannelStatistics(histograms[i])
+	}
+	return statistics, nil
+}
+
+func newChannelStatistics(histogram []uint64) *ChannelStatistics {
+	var count, sum, squares float64
+	for value, n := range histogram {
+		count += float64(n)
+		sum += float64(n) * float64(value)
+		squares += float64(n) * float64(value) * float64(value)
+	}
+	statistics := &ChannelStatistics{Histogram: histogram}
+	if count > 0 {
+		statistics.Mean = sum / count
+		statistics.StandardDeviation = math.Sqrt(math.Max(0, squares/count-statistics.Mean*statistics.Mean))
+	}
+	return statistics
+}
+
+// Returns the variance of the 4-neighbour Laplacian of a channel's values,
+// over the pixels that aren't on the image's edges.
+func laplacianVariance(values []float64, width, height int) float64 {
+	var count, sum, squares float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*width + x
+			laplacian := values[i-width] + values[i+width] + values[i-1] + values[i+1] - 4*values[i]
+			count++
+			sum += laplacian
+			squares += laplacian * laplacian
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	mean := sum / count
+	return squares/count - mean*mean
+}
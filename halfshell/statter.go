@@ -21,34 +21,116 @@
 package halfshell
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
 type Statter interface {
 	RegisterRequest(*HalfshellResponseWriter, *HalfshellRequest)
+	Count(stat string)
+	Gauge(stat string, value int64)
 }
 
-type statsdStatter struct {
-	conn     *net.UDPConn
-	addr     *net.UDPAddr
-	Name     string
-	Hostname string
-	Logger   *Logger
+// The metrics backends that stats can be sent to.
+const (
+	STATS_BACKEND_STATSD     = "statsd"
+	STATS_BACKEND_DOGSTATSD  = "dogstatsd"
+	STATS_BACKEND_INFLUX     = "influx"
+	STATS_BACKEND_CLOUDWATCH = "cloudwatch"
+)
+
+// The ports of the backends' agents on the host, which stats are sent to by
+// default.
+var statsBackendPorts = map[string]int{
+	STATS_BACKEND_STATSD:     8125,
+	STATS_BACKEND_DOGSTATSD:  8125,
+	STATS_BACKEND_INFLUX:     8089,
+	STATS_BACKEND_CLOUDWATCH: 25888,
+}
+
+const DEFAULT_CLOUDWATCH_NAMESPACE = "Halfshell"
+
+// The kinds of stats, with their statsd type codes.
+type statKind string
+
+const (
+	STAT_KIND_COUNT statKind = "c"
+	STAT_KIND_GAUGE statKind = "g"
+	STAT_KIND_TIME  statKind = "ms"
+)
+
+// A statsFormat encodes a stat of a statter as a packet for a backend.
+type statsFormat func(s *udpStatter, stat string, kind statKind, value int64) []byte
+
+var statsFormats = map[string]statsFormat{
+	STATS_BACKEND_STATSD:     formatStatsdStat,
+	STATS_BACKEND_DOGSTATSD:  formatDogStatsdStat,
+	STATS_BACKEND_INFLUX:     formatInfluxStat,
+	STATS_BACKEND_CLOUDWATCH: formatCloudWatchStat,
 }
 
+// udpStatter sends stats to a backend's agent over UDP.
+type udpStatter struct {
+	conn      *net.UDPConn
+	addr      *net.UDPAddr
+	format    statsFormat
+	Backend   string
+	Namespace string
+	Name      string
+	Hostname  string
+	Logger    *Logger
+}
+
+// multiStatter sends stats to several backends.
+type multiStatter []Statter
+
 func NewStatterWithConfig(config *RouteConfig) Statter {
-	logger := NewLogger("stats.%s", config.Name)
+	return NewStatterWithName(config.Name, config.StatsConfigs)
+}
+
+// Creates a new Statter whose stats are named for name and sent to the
+// configured backends. Without any backends configured, stats are sent to
+// statsd.
+func NewStatterWithName(name string, configs []*StatsConfig) Statter {
+	if len(configs) == 0 {
+		configs = []*StatsConfig{{Backend: STATS_BACKEND_STATSD}}
+	}
+
+	var statters multiStatter
+	for _, config := range configs {
+		if statter := newUDPStatter(name, config); statter != nil {
+			statters = append(statters, statter)
+		}
+	}
+	switch len(statters) {
+	case 0:
+		return nil
+	case 1:
+		return statters[0]
+	}
+	return statters
+}
+
+// Creates a statter for a backend. The backend's agent is assumed to run on
+// the host at HOST_IP, or localhost, unless the backend has an address.
+func newUDPStatter(name string, config *StatsConfig) *udpStatter {
+	logger := NewLogger("stats.%s", name)
 	hostname, _ := os.Hostname()
-	hostIp := os.Getenv("HOST_IP")
-	if hostIp == "" {
-		hostIp = "localhost"
+	address := config.Address
+	if address == "" {
+		hostIp := os.Getenv("HOST_IP")
+		if hostIp == "" {
+			hostIp = "localhost"
+		}
+		address = fmt.Sprintf("%s:%d", hostIp, statsBackendPorts[config.Backend])
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:8125", hostIp))
+	addr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
 		logger.Error("Unable to resolve UDP address: %v", err)
 		return nil
@@ -60,16 +142,23 @@ func NewStatterWithConfig(config *RouteConfig) Statter {
 		return nil
 	}
 
-	return &statsdStatter{
-		conn:     conn,
-		addr:     addr,
-		Name:     config.Name,
-		Hostname: hostname,
-		Logger:   logger,
+	namespace := config.Namespace
+	if namespace == "" && config.Backend == STATS_BACKEND_CLOUDWATCH {
+		namespace = DEFAULT_CLOUDWATCH_NAMESPACE
+	}
+	return &udpStatter{
+		conn:      conn,
+		addr:      addr,
+		format:    statsFormats[config.Backend],
+		Backend:   config.Backend,
+		Namespace: namespace,
+		Name:      name,
+		Hostname:  hostname,
+		Logger:    logger,
 	}
 }
 
-func (s *statsdStatter) RegisterRequest(w *HalfshellResponseWriter, r *HalfshellRequest) {
+func (s *udpStatter) RegisterRequest(w *HalfshellResponseWriter, r *HalfshellRequest) {
 	now := time.Now()
 
 	status := "success"
@@ -88,24 +177,97 @@ func (s *statsdStatter) RegisterRequest(w *HalfshellResponseWriter, r *Halfshell
 	}
 }
 
-func (s *statsdStatter) count(stat string) {
-	stat = fmt.Sprintf("%s.halfshell.%s.%s", s.Hostname, s.Name, stat)
+func (s *udpStatter) Count(stat string) {
+	s.count(stat)
+}
+
+func (s *udpStatter) Gauge(stat string, value int64) {
+	s.Logger.Info("Setting gauge: %s (%d)", stat, value)
+	s.send(stat, STAT_KIND_GAUGE, value)
+}
+
+func (s *udpStatter) count(stat string) {
 	s.Logger.Info("Incrementing counter: %s", stat)
-	s.send(stat, "1|c")
+	s.send(stat, STAT_KIND_COUNT, 1)
 }
 
-func (s *statsdStatter) time(stat string, time int64) {
-	stat = fmt.Sprintf("%s.halfshell.%s.%s", s.Hostname, s.Name, stat)
+func (s *udpStatter) time(stat string, time int64) {
 	s.Logger.Info("Registering time: %s (%d)", stat, time)
-	s.send(stat, fmt.Sprintf("%d|ms", time))
+	s.send(stat, STAT_KIND_TIME, time)
 }
 
-func (s *statsdStatter) send(stat string, value string) {
-	data := fmt.Sprintf("%s:%s", stat, value)
-	n, err := s.conn.Write([]byte(data))
+func (s *udpStatter) send(stat string, kind statKind, value int64) {
+	n, err := s.conn.Write(s.format(s, stat, kind, value))
 	if err != nil {
-		s.Logger.Error("Error sending data to statsd: %v", err)
+		s.Logger.Error("Error sending data to %s: %v", s.Backend, err)
 	} else if n == 0 {
 		s.Logger.Error("No bytes were written")
 	}
 }
+
+// Names stats with the host and the statter's name, e.g.
+// host.halfshell.route.http.status.200:1|c.
+func formatStatsdStat(s *udpStatter, stat string, kind statKind, value int64) []byte {
+	return []byte(fmt.Sprintf("%s.halfshell.%s.%s:%d|%s", s.Hostname, s.Name, stat, value, kind))
+}
+
+// Tags stats with the host and the statter's name, e.g.
+// halfshell.http.status.200:1|c|#host:host,route:route.
+func formatDogStatsdStat(s *udpStatter, stat string, kind statKind, value int64) []byte {
+	return []byte(fmt.Sprintf("halfshell.%s:%d|%s|#host:%s,route:%s", stat, value, kind, s.Hostname, s.Name))
+}
+
+// Writes stats as InfluxDB line protocol points of a measurement named for
+// the stat, tagged with the host and the statter's name, with a count, value
+// or ms field for counters, gauges and times, e.g.
+// halfshell.http.status.200,host=host,route=route count=1i 1500000000000000000.
+func formatInfluxStat(s *udpStatter, stat string, kind statKind, value int64) []byte {
+	field := map[statKind]string{STAT_KIND_COUNT: "count", STAT_KIND_GAUGE: "value", STAT_KIND_TIME: "ms"}[kind]
+	return []byte(fmt.Sprintf("halfshell.%s,host=%s,route=%s %s=%di %d\n", escapeInfluxKey(stat),
+		escapeInfluxKey(s.Hostname), escapeInfluxKey(s.Name), field, value, time.Now().UnixNano()))
+}
+
+var influxKeyEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+func escapeInfluxKey(key string) string {
+	return influxKeyEscaper.Replace(key)
+}
+
+// Writes stats as CloudWatch embedded metric format (EMF) events in the
+// statter's namespace, with the host and the statter's name as dimensions.
+func formatCloudWatchStat(s *udpStatter, stat string, kind statKind, value int64) []byte {
+	unit := map[statKind]string{STAT_KIND_COUNT: "Count", STAT_KIND_GAUGE: "None", STAT_KIND_TIME: "Milliseconds"}[kind]
+	event := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  s.Namespace,
+				"Dimensions": [][]string{{"Host", "Route"}},
+				"Metrics":    []map[string]string{{"Name": stat, "Unit": unit}},
+			}},
+		},
+		"Host":  s.Hostname,
+		"Route": s.Name,
+		stat:    value,
+	}
+	data, _ := json.Marshal(event)
+	return append(data, '\n')
+}
+
+func (s multiStatter) RegisterRequest(w *HalfshellResponseWriter, r *HalfshellRequest) {
+	for _, statter := range s {
+		statter.RegisterRequest(w, r)
+	}
+}
+
+func (s multiStatter) Count(stat string) {
+	for _, statter := range s {
+		statter.Count(stat)
+	}
+}
+
+func (s multiStatter) Gauge(stat string, value int64) {
+	for _, statter := range s {
+		statter.Gauge(stat, value)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// SVG elements that are removed with their content: scripts, embedded HTML
+// and other documents, and event handlers.
+var unsafeSVGElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// Data URIs that SVG images may reference. Other references must be to
+// fragments of the image itself.
+var safeSVGDataURIPrefixes = []string{
+	"data:image/png", "data:image/jpeg", "data:image/gif", "data:image/webp",
+}
+
+// Matches CSS references to anything but fragments of the image itself.
+var externalCSSReferenceRegexp = regexp.MustCompile(`(?i)@import|url\(\s*['"]?\s*[^#'"\s)]`)
+
+// Returns an SVG image with everything that could run scripts or load
+// external resources removed: script and foreignObject elements, event handler
+// attributes, links and references other than to the image's own fragments,
+// animations of links, external CSS references, and the DOCTYPE, which could
+// declare entities.
+func SanitizeSVG(svg []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(svg))
+	var output bytes.Buffer
+	skipDepth := 0
+	// The text of style elements is checked once the element ends, as it can
+	// be split between text and CDATA sections and nested elements, which are
+	// removed.
+	styleDepth := 0
+	var style bytes.Buffer
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			if skipDepth > 0 || isUnsafeSVGElement(token) {
+				skipDepth++
+				continue
+			}
+			if styleDepth > 0 {
+				styleDepth++
+				continue
+			}
+			if strings.ToLower(token.Name.Local) == "style" {
+				styleDepth = 1
+				style.Reset()
+			}
+			output.WriteString("<" + xmlName(token.Name))
+			for _, attr := range token.Attr {
+				if isSafeSVGAttr(attr) {
+					output.WriteString(" " + xmlName(attr.Name) + `="`)
+					xml.EscapeText(&output, []byte(attr.Value))
+					output.WriteString(`"`)
+				}
+			}
+			output.WriteString(">")
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			if styleDepth > 0 {
+				if styleDepth--; styleDepth > 0 {
+					continue
+				}
+				if !externalCSSReferenceRegexp.Match(style.Bytes()) {
+					xml.EscapeText(&output, style.Bytes())
+				}
+			}
+			output.WriteString("</" + xmlName(token.Name) + ">")
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			if styleDepth > 0 {
+				style.Write(token)
+				continue
+			}
+			xml.EscapeText(&output, token)
+		case xml.ProcInst:
+			if token.Target == "xml" {
+				output.WriteString("<?xml " + string(token.Inst) + "?>")
+			}
+		}
+	}
+	return output.Bytes(), nil
+}
+
+func isUnsafeSVGElement(element xml.StartElement) bool {
+	name := strings.ToLower(element.Name.Local)
+	if unsafeSVGElements[name] {
+		return true
+	}
+	if name == "set" || strings.HasPrefix(name, "animate") {
+		for _, attr := range element.Attr {
+			if attr.Name.Local == "attributeName" {
+				target := strings.ToLower(attr.Value)
+				return strings.HasSuffix(target, "href") || strings.HasPrefix(target, "on")
+			}
+		}
+	}
+	return false
+}
+
+func isSafeSVGAttr(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	value := strings.ToLower(strings.TrimSpace(attr.Value))
+	if strings.HasPrefix(name, "on") || strings.Contains(value, "javascript:") {
+		return false
+	}
+	if name == "href" && !strings.HasPrefix(value, "#") {
+		for _, prefix := range safeSVGDataURIPrefixes {
+			if strings.HasPrefix(value, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return !externalCSSReferenceRegexp.MatchString(value)
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+func FuzzSanitizeSVG(f *testing.F) {
+	f.Add([]byte(`<svg xmlns="http://www.w3.org/2000/svg"><rect width="10" height="10"/></svg>`))
+	f.Add([]byte(`<?xml version="1.0"?><!DOCTYPE svg [<!ENTITY x "y">]><svg><text>&x;</text></svg>`))
+	f.Add([]byte(`<svg><script>alert(1)</script><g onload="alert(1)"/></svg>`))
+	f.Add([]byte(`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><image xlink:href="text:/etc/passwd"/></svg>`))
+	f.Add([]byte(`<svg><image href="file:///etc/passwd"/><use href="#a"/></svg>`))
+	f.Add([]byte(`<svg><foreignObject><iframe src="https://example.com"/></foreignObject></svg>`))
+	f.Add([]byte(`<svg><style>@import url(https://example.com/a.css);</style></svg>`))
+	f.Add([]byte(`<svg><style>@im<![CDATA[port "https://example.com/a.css";]]></style></svg>`))
+	f.Add([]byte(`<svg><style>@im<b/>port "https://example.com/a.css";</style></svg>`))
+	f.Add([]byte(`<svg><a><set attributeName="href" to="javascript:alert(1)"/></a></svg>`))
+	f.Add([]byte(`<svg><rect style="fill: url(https://example.com/#a)"/></svg>`))
+
+	f.Fuzz(func(t *testing.T, svg []byte) {
+		sanitized, err := SanitizeSVG(svg)
+		if err != nil {
+			return
+		}
+
+		decoder := xml.NewDecoder(bytes.NewReader(sanitized))
+		inStyle := false
+		var style []byte
+		for {
+			token, err := decoder.RawToken()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("sanitized SVG %q can't be parsed: %s", sanitized, err)
+			}
+
+			switch token := token.(type) {
+			case xml.StartElement:
+				if isUnsafeSVGElement(token) {
+					t.Errorf("sanitized SVG %q has a %s element", sanitized, token.Name.Local)
+				}
+				for _, attr := range token.Attr {
+					if !isSafeSVGAttr(attr) {
+						t.Errorf("sanitized SVG %q has an unsafe %s attribute", sanitized, xmlName(attr.Name))
+					}
+				}
+				if inStyle {
+					t.Errorf("sanitized SVG %q has a %s element in a style element", sanitized, token.Name.Local)
+				}
+				inStyle, style = strings.ToLower(token.Name.Local) == "style", nil
+			case xml.EndElement:
+				if inStyle && externalCSSReferenceRegexp.Match(style) {
+					t.Errorf("sanitized SVG %q has an external CSS reference", sanitized)
+				}
+				inStyle = false
+			case xml.CharData:
+				style = append(style, token...)
+			case xml.Directive:
+				t.Errorf("sanitized SVG %q has a directive", sanitized)
+			}
+		}
+	})
+}
@@ -29,8 +29,11 @@ Running on process {{.Pid}}
 
 Server settings:
   Port: {{.Config.ServerConfig.Port}}
+  Admin Port: {{.Config.ServerConfig.AdminPort}}
+  Unix Socket: {{.Config.ServerConfig.UnixSocket}}
   Read Timeout: {{.Config.ServerConfig.ReadTimeout}}
   Write Timeout: {{.Config.ServerConfig.WriteTimeout}}
+  Processing Workers: {{.Config.ServerConfig.ProcessingWorkers}}
 
 Routes:
 {{ range $index, $route := .Routes }}  {{ $route.Name }}:
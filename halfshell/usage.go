@@ -0,0 +1,309 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"fmt"
+	"github.com/rafikk/imagick/imagick"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often usage is flushed to the usage store by default, in seconds.
+const DEFAULT_USAGE_FLUSH_INTERVAL = 60
+
+// The default timeout in seconds for flushing usage to a usage store.
+const DEFAULT_USAGE_STORE_TIMEOUT = 10
+
+// Usage is accounted by calendar month in UTC.
+const USAGE_PERIOD_LAYOUT = "2006-01"
+
+type UsageStoreType string
+type UsageStoreFactoryFunction func(*UsageConfig) UsageStore
+
+var (
+	usageStoreTypeToFactoryFunctionMap = make(map[UsageStoreType]UsageStoreFactoryFunction)
+)
+
+// Usage is what an account has used of the server in a period: the requests
+// made, the pixels of the images served and the bytes of the responses.
+type Usage struct {
+	Requests uint64 `json:"requests"`
+	Pixels   uint64 `json:"pixels"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+func (u *Usage) add(other Usage) {
+	u.Requests += other.Requests
+	u.Pixels += other.Pixels
+	u.Bytes += other.Bytes
+}
+
+// UsageQuota is the usage an account is allowed in a period. Requests of an
+// account that has used up any of its quota are refused with the quota's
+// status, either 402 or 429. Zero limits are unlimited.
+type UsageQuota struct {
+	Requests uint64
+	Pixels   uint64
+	Bytes    uint64
+	Status   int
+}
+
+func (q *UsageQuota) exceededBy(usage Usage) bool {
+	return (q.Requests > 0 && usage.Requests >= q.Requests) ||
+		(q.Pixels > 0 && usage.Pixels >= q.Pixels) ||
+		(q.Bytes > 0 && usage.Bytes >= q.Bytes)
+}
+
+// QuotaExceededError is the error of a request by an account that has used
+// up its quota.
+type QuotaExceededError struct {
+	Account string
+	Status  int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("Usage quota of %s exceeded", e.Account)
+}
+
+// UsageStore is the interface for stores of the usage of each account. Stores
+// may be shared by several servers, so they add to the totals rather than
+// replacing them.
+type UsageStore interface {
+	// Adds usage by account to the totals of a period, and returns the
+	// period's totals of every account.
+	AddUsage(period string, usage map[string]Usage) (map[string]Usage, error)
+}
+
+func RegisterUsageStore(storeType UsageStoreType, factory UsageStoreFactoryFunction) {
+	usageStoreTypeToFactoryFunctionMap[storeType] = factory
+}
+
+// Creates a new UsageStore using configuration settings.
+func NewUsageStoreWithConfig(config *UsageConfig) UsageStore {
+	factory := usageStoreTypeToFactoryFunctionMap[config.StoreType]
+	if factory == nil {
+		fmt.Fprintf(os.Stderr, "Unknown usage store type: %s\n", config.StoreType)
+		os.Exit(1)
+	}
+	return factory(config)
+}
+
+// UsageTracker accounts the usage of each account, for billing, and enforces
+// their quotas. Usage is kept in memory and flushed to the store
+// periodically, so quotas are enforced against the totals as of the last
+// flush plus the server's own usage since, and may be overrun by the usage of
+// other servers sharing the store in the meantime. A nil UsageTracker
+// accounts nothing.
+type UsageTracker struct {
+	Config  *UsageConfig
+	Logger  *Logger
+	Store   UsageStore
+	mutex   sync.Mutex
+	period  string
+	totals  map[string]Usage
+	pending map[string]map[string]Usage
+}
+
+// Creates a new UsageTracker if the server's configuration has a usage store,
+// or returns nil.
+func NewUsageTrackerWithConfig(config *ServerConfig) *UsageTracker {
+	if config.UsageConfig == nil {
+		return nil
+	}
+	return &UsageTracker{
+		Config:  config.UsageConfig,
+		Logger:  NewLogger("usage"),
+		Store:   NewUsageStoreWithConfig(config.UsageConfig),
+		totals:  make(map[string]Usage),
+		pending: make(map[string]map[string]Usage),
+	}
+}
+
+// Loads the totals of the current period and starts flushing usage to the
+// store periodically.
+func (t *UsageTracker) Start() {
+	if t == nil {
+		return
+	}
+	t.Flush()
+	go func() {
+		for range time.Tick(t.Config.FlushInterval) {
+			t.Flush()
+		}
+	}()
+}
+
+// Adds to the usage of an account in the current period.
+func (t *UsageTracker) Record(account string, usage Usage) {
+	if t == nil || account == "" {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	period := usagePeriod(time.Now())
+	if t.pending[period] == nil {
+		t.pending[period] = make(map[string]Usage)
+	}
+	pending := t.pending[period][account]
+	pending.add(usage)
+	t.pending[period][account] = pending
+}
+
+// Returns the usage of an account in the current period, as of the last flush
+// plus the usage recorded since.
+func (t *UsageTracker) Usage(account string) Usage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	period := usagePeriod(time.Now())
+	var usage Usage
+	if t.period == period {
+		usage = t.totals[account]
+	}
+	usage.add(t.pending[period][account])
+	return usage
+}
+
+// Returns the usage of every account in the current period.
+func (t *UsageTracker) Accounts() map[string]Usage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	period := usagePeriod(time.Now())
+	accounts := make(map[string]Usage, len(t.totals))
+	if t.period == period {
+		for account, usage := range t.totals {
+			accounts[account] = usage
+		}
+	}
+	for account, pending := range t.pending[period] {
+		usage := accounts[account]
+		usage.add(pending)
+		accounts[account] = usage
+	}
+	return accounts
+}
+
+// Returns a QuotaExceededError if the account has used up its quota.
+func (t *UsageTracker) CheckQuota(account string) *QuotaExceededError {
+	if t == nil || account == "" {
+		return nil
+	}
+	quota := t.Config.Quotas[account]
+	if quota == nil || !quota.exceededBy(t.Usage(account)) {
+		return nil
+	}
+	return &QuotaExceededError{Account: account, Status: quota.Status}
+}
+
+// Adds the usage recorded since the last flush to the store, and updates the
+// totals of the current period. Usage that fails to flush is kept for the
+// next flush.
+func (t *UsageTracker) Flush() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	pending := t.pending
+	t.pending = make(map[string]map[string]Usage)
+	t.mutex.Unlock()
+
+	current := usagePeriod(time.Now())
+	if pending[current] == nil {
+		pending[current] = make(map[string]Usage)
+	}
+	for period, usage := range pending {
+		totals, err := t.Store.AddUsage(period, usage)
+		if err != nil {
+			t.Logger.Error("Error flushing usage of %s: %v", period, err)
+			t.mutex.Lock()
+			if t.pending[period] == nil {
+				t.pending[period] = make(map[string]Usage)
+			}
+			for account, accountUsage := range usage {
+				unflushed := t.pending[period][account]
+				unflushed.add(accountUsage)
+				t.pending[period][account] = unflushed
+			}
+			t.mutex.Unlock()
+			continue
+		}
+		if period == current {
+			t.mutex.Lock()
+			t.period, t.totals = period, totals
+			t.mutex.Unlock()
+		}
+	}
+}
+
+func usagePeriod(t time.Time) string {
+	return t.UTC().Format(USAGE_PERIOD_LAYOUT)
+}
+
+// Returns when the period after the one of the given time starts.
+func nextUsagePeriod(t time.Time) time.Time {
+	year, month, _ := t.UTC().Date()
+	return time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Returns the account a request's usage is accounted to: the account that the
+// key ID it's signed with is assigned to, or else its route's tenant, or else
+// its route. Key IDs aren't accounts themselves, so that rotating a key doesn't
+// start an account's usage afresh.
+func (t *UsageTracker) Account(r *HalfshellRequest) string {
+	if t == nil || r.Route == nil {
+		return ""
+	}
+	if keyID := r.URL.Query().Get(r.Route.parameterName("kid")); r.Signed && keyID != "" {
+		if account, ok := t.Config.KeyAccounts[keyID]; ok {
+			return account
+		}
+	}
+	if r.Route.Tenant != nil {
+		return r.Route.Tenant.Name
+	}
+	return r.Route.Name
+}
+
+// Records the usage of a completed request to a route, unless it was refused
+// for exceeding its account's quota.
+func (t *UsageTracker) RecordRequest(w *HalfshellResponseWriter, r *HalfshellRequest) {
+	if t == nil || r.Route == nil || r.QuotaError != nil {
+		return
+	}
+	t.Record(t.Account(r), Usage{Requests: 1, Pixels: w.Pixels, Bytes: uint64(w.Size)})
+}
+
+// Returns the number of pixels of an image over all of its frames, reading
+// only the image's headers.
+func imagePixels(image *Image) uint64 {
+	wand := imagick.NewMagickWand()
+	defer wand.Destroy()
+	if err := pingImageBlob(wand, image.Bytes); err != nil {
+		return 0
+	}
+	var pixels uint64
+	for i := 0; i < int(wand.GetNumberImages()); i++ {
+		wand.SetIteratorIndex(i)
+		pixels += uint64(wand.GetImageWidth()) * uint64(wand.GetImageHeight())
+	}
+	return pixels
+}
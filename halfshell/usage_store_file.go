@@ -0,0 +1,98 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	USAGE_STORE_TYPE_FILE UsageStoreType = "file"
+)
+
+// FileUsageStore keeps the totals of every period in a JSON file, mapping
+// each period to the usage of each account, for a single server.
+type FileUsageStore struct {
+	Config *UsageConfig
+	mutex  sync.Mutex
+}
+
+func NewFileUsageStoreWithConfig(config *UsageConfig) UsageStore {
+	return &FileUsageStore{Config: config}
+}
+
+func (s *FileUsageStore) AddUsage(period string, usage map[string]Usage) (map[string]Usage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	periods := make(map[string]map[string]Usage)
+	data, err := ioutil.ReadFile(s.Config.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &periods); err != nil {
+			return nil, err
+		}
+	}
+	if len(usage) == 0 {
+		return periods[period], nil
+	}
+
+	if periods[period] == nil {
+		periods[period] = make(map[string]Usage)
+	}
+	for account, accountUsage := range usage {
+		total := periods[period][account]
+		total.add(accountUsage)
+		periods[period][account] = total
+	}
+
+	// The file is replaced, rather than rewritten in place, so that it's
+	// never left half written.
+	if data, err = json.MarshalIndent(periods, "", "  "); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(s.Config.Path), ".usage")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(file.Name(), s.Config.Path); err != nil {
+		return nil, err
+	}
+	return periods[period], nil
+}
+
+func init() {
+	RegisterUsageStore(USAGE_STORE_TYPE_FILE, NewFileUsageStoreWithConfig)
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	USAGE_STORE_TYPE_HTTP UsageStoreType = "http"
+)
+
+// HTTPUsageStore submits usage to a billing service, which keeps the totals
+// of the servers sharing it. The usage is POSTed to the service's URL as a
+// JSON object such as {"period": "2024-05", "usage": {"acme": {"requests": 3,
+// "pixels": 120000, "bytes": 52000}}}, and the service responds with the
+// period's totals of every account, in the same form as the usage.
+type HTTPUsageStore struct {
+	Config *UsageConfig
+	client *http.Client
+}
+
+func NewHTTPUsageStoreWithConfig(config *UsageConfig) UsageStore {
+	return &HTTPUsageStore{
+		Config: config,
+		client: &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+	}
+}
+
+func (s *HTTPUsageStore) AddUsage(period string, usage map[string]Usage) (map[string]Usage, error) {
+	body, err := json.Marshal(map[string]interface{}{"period": period, "usage": usage})
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.client.Post(s.Config.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Usage store responded with status %d", response.StatusCode)
+	}
+
+	var totals map[string]Usage
+	if err := json.NewDecoder(response.Body).Decode(&totals); err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+func init() {
+	RegisterUsageStore(USAGE_STORE_TYPE_HTTP, NewHTTPUsageStoreWithConfig)
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for warming up the response cache on startup.
+const (
+	DEFAULT_WARMUP_CONCURRENCY = 4
+	DEFAULT_WARMUP_TIMEOUT     = 5 * time.Minute
+)
+
+// Warms up the response cache by making the warm-up requests, before the
+// server reports that it's ready. The server is ready once the requests have
+// been made, or the warm-up times out or fails, so that a bad list of
+// requests never keeps it out of service. Requests under way when the warm-up
+// times out are cancelled.
+func (s *Server) warmUp() {
+	defer atomic.StoreInt32(&s.warming, 0)
+
+	config := s.Config.WarmupConfig
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_WARMUP_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	urls, err := s.warmupURLs(ctx)
+	if err != nil {
+		s.Logger.Error("Unable to read warm-up requests: %v", err)
+		return
+	}
+
+	concurrency := int(config.Concurrency)
+	if concurrency == 0 {
+		concurrency = DEFAULT_WARMUP_CONCURRENCY
+	}
+	requests := make(chan string)
+	var warmed, failed int64
+	var group sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for url := range requests {
+				if s.warmUpRequest(ctx, url) {
+					atomic.AddInt64(&warmed, 1)
+				} else {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, url := range urls {
+		select {
+		case requests <- url:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(requests)
+
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.Logger.Info("Warmed up the cache with %d of %d requests in %v, %d failed",
+			warmed, len(urls), time.Since(start), failed)
+	case <-ctx.Done():
+		s.Logger.Warn("Warm-up timed out after %v, with %d of %d requests made",
+			timeout, atomic.LoadInt64(&warmed)+atomic.LoadInt64(&failed), len(urls))
+		// The requests under way are cancelled with the context, and are
+		// waited for so that they're done before the server is ready.
+		<-done
+	}
+}
+
+// Returns the URLs of the warm-up requests, one per line of the warm-up file
+// or the response from the warm-up URL. Blank lines and lines starting with
+// '#' are skipped.
+func (s *Server) warmupURLs(ctx context.Context) ([]string, error) {
+	var reader io.Reader
+	if path := s.Config.WarmupConfig.File; path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	} else {
+		request, err := http.NewRequest("GET", s.Config.WarmupConfig.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		response, err := http.DefaultClient.Do(request.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Warm-up URL responded with status %d", response.StatusCode)
+		}
+		reader = response.Body
+	}
+
+	urls := []string{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	return urls, scanner.Err()
+}
+
+// Makes a warm-up request, which is handled like a request for an image
+// without being logged or accounted, to cache its response. Its fetches are
+// cancelled with the context. Returns true if the request succeeded.
+func (s *Server) warmUpRequest(ctx context.Context, url string) bool {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		s.Logger.Warn("Invalid warm-up request %s: %v", url, err)
+		return false
+	}
+	writer := &warmupResponseWriter{header: make(http.Header)}
+	hw := s.NewHalfshellResponseWriter(writer, request)
+	hr := s.NewHalfshellRequest(request)
+	hr.Warmup = true
+	s.ImageRequestHandler(hw, hr)
+	if hw.Status != http.StatusOK {
+		s.Logger.Warn("Warm-up request %s responded with status %d", url, hw.Status)
+		return false
+	}
+	return true
+}
+
+// warmupResponseWriter discards the responses to warm-up requests.
+type warmupResponseWriter struct {
+	header http.Header
+}
+
+func (w *warmupResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *warmupResponseWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w *warmupResponseWriter) WriteHeader(status int) {}
@@ -0,0 +1,169 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// WorkerPool bounds the number of images that are processed concurrently.
+// Requests beyond the number of workers wait in a queue of limited size, and
+// requests beyond that are rejected. Waiting requests are queued by name, and
+// freed workers take requests from the named queues in turn, so that a burst of
+// requests in one queue waits behind the requests of the others rather than
+// ahead of them.
+type WorkerPool struct {
+	workers   int64
+	busy      int64
+	queueSize int64
+	queued    int64
+	inFlight  int64
+	rejected  int64
+	queues    map[string][]chan struct{}
+	order     []string
+	next      int
+	mutex     sync.Mutex
+}
+
+// Creates a new WorkerPool using the server's configuration settings.
+func NewWorkerPoolWithConfig(config *ServerConfig) *WorkerPool {
+	return NewWorkerPool(config.ProcessingWorkers, config.ProcessingQueueSize)
+}
+
+// Creates a new WorkerPool with the given number of workers and queue size. A
+// worker count of 0 creates a pool that runs every operation immediately.
+func NewWorkerPool(workers, queueSize uint64) *WorkerPool {
+	return &WorkerPool{
+		workers:   int64(workers),
+		queueSize: int64(queueSize),
+		queues:    make(map[string][]chan struct{}),
+	}
+}
+
+// Runs f on a worker, waiting in the unnamed queue if all workers are busy.
+// Returns false without running f if the queue is full.
+func (p *WorkerPool) Do(f func()) bool {
+	return p.DoInQueue("", f)
+}
+
+// Runs f on a worker, waiting in the named queue if all workers are busy.
+// Returns false without running f if the pool's queue is full. The queue size
+// is shared by all the named queues.
+func (p *WorkerPool) DoInQueue(queue string, f func()) bool {
+	if p.workers > 0 {
+		if !p.acquire(queue) {
+			return false
+		}
+		defer p.release()
+	}
+
+	atomic.AddInt64(&p.inFlight, 1)
+	defer atomic.AddInt64(&p.inFlight, -1)
+	f()
+	return true
+}
+
+// Takes a worker, waiting in the named queue for one if all are busy. Returns
+// false if the queue is full.
+func (p *WorkerPool) acquire(queue string) bool {
+	p.mutex.Lock()
+	if p.busy < p.workers {
+		p.busy++
+		p.mutex.Unlock()
+		return true
+	}
+	if p.queued >= p.queueSize {
+		p.rejected++
+		p.mutex.Unlock()
+		return false
+	}
+
+	ready := make(chan struct{})
+	if len(p.queues[queue]) == 0 {
+		p.order = append(p.order, queue)
+	}
+	p.queues[queue] = append(p.queues[queue], ready)
+	p.queued++
+	p.mutex.Unlock()
+
+	// The releasing worker is handed over without becoming free.
+	<-ready
+	return true
+}
+
+// Hands the worker over to the first request of the next queue in turn, or
+// frees it if no requests are waiting.
+func (p *WorkerPool) release() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.order) == 0 {
+		p.busy--
+		return
+	}
+
+	queue := p.order[p.next]
+	waiting := p.queues[queue]
+	ready := waiting[0]
+	if len(waiting) == 1 {
+		// The queue leaves the rotation, so the next queue takes its place.
+		delete(p.queues, queue)
+		p.order = append(p.order[:p.next], p.order[p.next+1:]...)
+	} else {
+		p.queues[queue] = waiting[1:]
+		p.next++
+	}
+	if p.next >= len(p.order) {
+		p.next = 0
+	}
+	p.queued--
+	close(ready)
+}
+
+// The number of operations waiting for a worker.
+func (p *WorkerPool) QueueDepth() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.queued
+}
+
+// The number of operations currently running.
+func (p *WorkerPool) InFlight() int64 {
+	return atomic.LoadInt64(&p.inFlight)
+}
+
+// The total number of operations rejected because the queue was full.
+func (p *WorkerPool) Rejected() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.rejected
+}
+
+// Returns true if all workers are busy and the queue is full, meaning the next
+// operation would be rejected.
+func (p *WorkerPool) Saturated() bool {
+	if p.workers == 0 {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.busy >= p.workers && p.queued >= p.queueSize
+}
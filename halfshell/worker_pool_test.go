@@ -0,0 +1,90 @@
+// Copyright (c) 2014 Oyster
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package halfshell
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolServesQueuesInTurn(t *testing.T) {
+	pool := NewWorkerPool(1, 4)
+	blocked, unblock := make(chan struct{}), make(chan struct{})
+	go pool.Do(func() {
+		close(blocked)
+		<-unblock
+	})
+	<-blocked
+
+	var order []string
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i, name := range []string{"a1", "a2", "a3", "b1"} {
+		wg.Add(1)
+		name := name
+		go func() {
+			defer wg.Done()
+			pool.DoInQueue(name[:1], func() {
+				mutex.Lock()
+				order = append(order, name)
+				mutex.Unlock()
+			})
+		}()
+		waitForQueueDepth(t, pool, int64(i+1))
+	}
+
+	if !pool.Saturated() {
+		t.Error("pool with a full queue isn't saturated")
+	}
+	if pool.DoInQueue("c", func() {}) {
+		t.Error("pool with a full queue accepted an operation")
+	}
+
+	close(unblock)
+	wg.Wait()
+	if want := []string{"a1", "b1", "a2", "a3"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("operations ran in order %v, want %v", order, want)
+	}
+	if pool.QueueDepth() != 0 || pool.Rejected() != 1 || pool.Saturated() {
+		t.Errorf("pool has queue depth %d and %d rejections after finishing", pool.QueueDepth(), pool.Rejected())
+	}
+}
+
+func TestWorkerPoolWithoutWorkers(t *testing.T) {
+	pool := NewWorkerPool(0, 0)
+	ran := false
+	if !pool.DoInQueue("a", func() { ran = true }) || !ran {
+		t.Error("pool without workers didn't run the operation")
+	}
+	if pool.Saturated() {
+		t.Error("pool without workers is saturated")
+	}
+}
+
+func waitForQueueDepth(t *testing.T, pool *WorkerPool, depth int64) {
+	for deadline := time.Now().Add(5 * time.Second); pool.QueueDepth() < depth; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth is %d, want %d", pool.QueueDepth(), depth)
+		}
+	}
+}
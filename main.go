@@ -28,10 +28,14 @@ import (
 
 func main() {
 	if len(os.Args) < 2 || os.Args[1] == "" {
-		fmt.Fprintf(os.Stderr, "usage: %s [config]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "usage: %s [config]\n       %s bench [flags] [url ...]\n", os.Args[0], os.Args[0])
 		os.Exit(1)
 	}
 
+	if os.Args[1] == "bench" {
+		os.Exit(halfshell.RunBenchmark(os.Args[2:]))
+	}
+
 	config := halfshell.NewConfigFromFile(os.Args[1])
 	halfshell := halfshell.NewWithConfig(config)
 	halfshell.Run()